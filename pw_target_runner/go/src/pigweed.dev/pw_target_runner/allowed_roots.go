@@ -0,0 +1,100 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// SetAllowedRoots restricts the executables clients may request to those within
+// one of the given directories. Requested paths are resolved, following any
+// symlinks and "..", before they are checked, and requests for any other path
+// are rejected with codes.PermissionDenied. Uploaded binaries and requests made
+// through the library rather than over gRPC are not checked. Each root must
+// exist. Passing no roots removes the restriction. This cannot be done while the
+// server is running.
+func (s *Server) SetAllowedRoots(roots []string) error {
+	if s.state.isActive() {
+		return errServerRunning
+	}
+
+	var resolved []string
+	for _, root := range roots {
+		path, err := resolvePath(root)
+		if err != nil {
+			return fmt.Errorf("Invalid allowed root %s: %v", root, err)
+		}
+		resolved = append(resolved, path)
+	}
+
+	s.allowedRoots = resolved
+	return nil
+}
+
+// checkAllowedPath returns a gRPC error if an executable requested by a client
+// is not within one of the server's allowed roots. Otherwise, it returns the
+// path at which the executable should be run: if the server has allowed roots,
+// this is the resolved path which was checked, so that a symlink cannot be
+// swapped to point elsewhere between the check and the run.
+func (s *Server) checkAllowedPath(path string) (string, error) {
+	if len(s.allowedRoots) == 0 {
+		return path, nil
+	}
+
+	resolved, err := resolvePath(path)
+	if err == nil && underAnyRoot(resolved, s.allowedRoots) {
+		return resolved, nil
+	}
+
+	if err != nil {
+		log.Printf("Rejecting request for %s: %v\n", path, err)
+	} else {
+		log.Printf("Rejecting request for %s: %s is outside the allowed roots\n", path, resolved)
+	}
+	return "", status.Errorf(
+		codes.PermissionDenied, "%s is not within a directory allowed by the server", path)
+}
+
+// resolvePath returns the absolute path of a file with all symlinks and ".."
+// elements resolved. The file must exist.
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
+
+// underAnyRoot returns whether a resolved path is one of the given root
+// directories or within one of them.
+func underAnyRoot(path string, roots []string) bool {
+	for _, root := range roots {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			continue
+		}
+		if rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+			return true
+		}
+	}
+	return false
+}
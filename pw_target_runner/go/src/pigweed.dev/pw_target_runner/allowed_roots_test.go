@@ -0,0 +1,96 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCheckAllowedPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pw_target_runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "allowed")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{root, outside} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(d, "test"), nil, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(outside, "test"), filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer()
+	if _, err := s.checkAllowedPath(filepath.Join(outside, "test")); err != nil {
+		t.Errorf("Path was rejected with no allowed roots: %v", err)
+	}
+
+	if err := s.SetAllowedRoots([]string{root}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path    string
+		allowed bool
+	}{
+		{filepath.Join(root, "test"), true},
+		{filepath.Join(outside, "test"), false},
+		{filepath.Join(root, "..", "outside", "test"), false},
+		{filepath.Join(root, "link"), false},
+		{filepath.Join(root, "missing"), false},
+		{root + "-sibling", false},
+	}
+
+	for _, test := range tests {
+		_, err := s.checkAllowedPath(test.path)
+		if test.allowed && err != nil {
+			t.Errorf("%s was rejected: %v", test.path, err)
+		}
+		if !test.allowed && status.Code(err) != codes.PermissionDenied {
+			t.Errorf("Got %v for %s; want PermissionDenied", err, test.path)
+		}
+	}
+
+	// An allowed symlink is run through its target, which is what was
+	// checked, rather than through the link, which could be changed.
+	inner := filepath.Join(root, "inner-link")
+	if err := os.Symlink(filepath.Join(root, "test"), inner); err != nil {
+		t.Fatal(err)
+	}
+	want, err := resolvePath(filepath.Join(root, "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path, err := s.checkAllowedPath(inner); err != nil || path != want {
+		t.Errorf("Got path %q, error %v for %s; want %q", path, err, inner, want)
+	}
+
+	if err := s.SetAllowedRoots([]string{filepath.Join(dir, "missing")}); err == nil {
+		t.Errorf("Nonexistent allowed root was accepted")
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+var errClientAuthRequiresTLS = errors.New(
+	"Allowing specific clients requires TLS with verified client certificates")
+
+// SetTLSConfig configures the server to only accept TLS connections, using the
+// provided configuration. Clients are authenticated if the configuration
+// requires and verifies their certificates. This cannot be done while the
+// server is running.
+func (s *Server) SetTLSConfig(config *tls.Config) error {
+	if s.state.isActive() {
+		return errServerRunning
+	}
+	s.tlsConfig = config
+	return nil
+}
+
+// SetAllowedClients restricts the server to clients which present a verified
+// certificate whose subject common name is one of names. RPCs from any other
+// client are rejected. This requires a TLS configuration which verifies client
+// certificates, and cannot be done while the server is running.
+func (s *Server) SetAllowedClients(names []string) error {
+	if s.state.isActive() {
+		return errServerRunning
+	}
+
+	s.allowedClients = make(map[string]bool)
+	for _, name := range names {
+		s.allowedClients[name] = true
+	}
+	return nil
+}
+
+// verifiesClients returns whether the server's TLS configuration verifies the
+// certificates of clients which present them.
+func (s *Server) verifiesClients() bool {
+	if s.tlsConfig == nil {
+		return false
+	}
+	return s.tlsConfig.ClientAuth == tls.VerifyClientCertIfGiven ||
+		s.tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert
+}
+
+// authorize checks whether the client making an RPC is allowed to use the
+// server, logging its identity.
+func (s *Server) authorize(ctx context.Context, method string) error {
+	identity := clientIdentity(ctx)
+
+	if identity != "" {
+		log.Printf("%s called by %s\n", method, identity)
+	}
+
+	if s.allowedClients != nil && !s.allowedClients[identity] {
+		log.Printf("Rejecting call to %s from unknown client %q\n", method, identity)
+		return status.Error(codes.Unauthenticated, "Client is not allowed")
+	}
+
+	return nil
+}
+
+// clientIdentity returns the common name from the verified certificate of the
+// client making an RPC, or an empty string if it did not present one.
+func clientIdentity(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 {
+		return ""
+	}
+
+	chain := info.State.VerifiedChains[0]
+	if len(chain) == 0 {
+		return ""
+	}
+	return chain[0].Subject.CommonName
+}
+
+// unaryAuthInterceptor authorizes each unary RPC before it is handled.
+func (s *Server) unaryAuthInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	if err := s.authorize(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// streamAuthInterceptor authorizes each streaming RPC before it is handled.
+func (s *Server) streamAuthInterceptor(
+	srv interface{},
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	if err := s.authorize(stream.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
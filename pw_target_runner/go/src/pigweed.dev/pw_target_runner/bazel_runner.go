@@ -0,0 +1,256 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	pb "pigweed.dev/proto/pw_target_runner/target_runner_pb"
+)
+
+var errNotBazelTarget = errors.New("Request path is not a Bazel test target")
+
+// Matches the line of a "bazel test" summary reporting the status of a target,
+// e.g. "//pkg:test    PASSED in 0.4s".
+var bazelSummaryPattern = regexp.MustCompile(
+	`^(\S+)\s+(?:\(cached\) )?(PASSED|FLAKY|FAILED TO BUILD|FAILED|TIMEOUT|` +
+		`INCOMPLETE|NO STATUS|SKIPPED)\b`)
+
+// Exit codes with which Bazel reports that the build failed, and that the build
+// succeeded but tests failed. Either is a failure of the test target.
+const (
+	bazelExitBuildFailed = 1
+	bazelExitTestsFailed = 3
+)
+
+// BazelTestRunner is a struct that implements the DeviceRunner interface,
+// running each request's path as a Bazel test target through "bazel test" in a
+// workspace. The status of the target is taken from Bazel's test summary, and
+// the test's log from the workspace's test logs directory is returned as the
+// run output.
+type BazelTestRunner struct {
+	bazel         string
+	workspace     string
+	flags         []string
+	maxOutputSize int
+	logger        *log.Logger
+
+	// Directory holding test logs, as reported by "bazel info".
+	testlogs string
+}
+
+// NewBazelTestRunner creates a BazelTestRunner which runs tests in the Bazel
+// workspace rooted at workspace.
+func NewBazelTestRunner(id int, workspace string) *BazelTestRunner {
+	return &BazelTestRunner{
+		bazel:         "bazel",
+		workspace:     workspace,
+		maxOutputSize: defaultMaxOutputSize,
+		logger:        newLogger(fmt.Sprintf("BazelTestRunner %d", id)),
+	}
+}
+
+// SetBazel sets the Bazel program to run. Defaults to "bazel".
+func (r *BazelTestRunner) SetBazel(bazel string) {
+	r.bazel = bazel
+}
+
+// SetFlags sets additional flags passed to "bazel test" and "bazel info", e.g.
+// "--config=ci".
+func (r *BazelTestRunner) SetFlags(flags []string) {
+	r.flags = flags
+}
+
+// SetMaxOutputSize sets the maximum number of bytes of output kept from each
+// run. A size of zero disables the limit.
+func (r *BazelTestRunner) SetMaxOutputSize(size int) {
+	r.maxOutputSize = size
+}
+
+// WorkerStart starts the worker, locating the workspace's test logs directory.
+// The worker fails to start if Bazel cannot be run in the workspace. Part of
+// DeviceRunner interface.
+func (r *BazelTestRunner) WorkerStart() error {
+	r.logger.Printf("Starting worker")
+
+	args := append([]string{"info"}, r.flags...)
+	cmd := exec.Command(r.bazel, append(args, "bazel-testlogs")...)
+	cmd.Dir = r.workspace
+
+	out, err := cmd.Output()
+	if err != nil {
+		r.logger.Printf("Failed to query Bazel in %s: %v\n", r.workspace, err)
+		return err
+	}
+
+	r.testlogs = strings.TrimSpace(string(out))
+	r.logger.Printf("Reading test logs from %s\n", r.testlogs)
+	return nil
+}
+
+// WorkerExit exits the worker. Part of DeviceRunner interface.
+func (r *BazelTestRunner) WorkerExit() {
+	r.logger.Printf("Exiting worker")
+}
+
+// HandleRunRequest runs a requested test target through "bazel test". The
+// request's arguments are passed to the test through --test_arg, and its case
+// filter through --test_filter. If the test produced a log, it is returned as
+// the output; otherwise, such as when the target failed to build, Bazel's own
+// output is. Part of DeviceRunner interface.
+func (r *BazelTestRunner) HandleRunRequest(req *RunRequest) *RunResponse {
+	res := &RunResponse{}
+
+	target := req.Path
+	if !strings.HasPrefix(target, "//") && !strings.HasPrefix(target, "@") {
+		res.Err = errNotBazelTarget
+		return res
+	}
+	if req.ExpectedStatus != pb.RunStatus_PENDING {
+		res.Err = errExpectedStatusUnsupported
+		return res
+	}
+
+	r.logger.Printf("[%s] Running Bazel test %s\n", req.ID, target)
+
+	// Color and progress output would interfere with parsing the summary.
+	args := append([]string{"test", "--color=no", "--curses=no"}, r.flags...)
+	for _, arg := range req.Args {
+		args = append(args, "--test_arg="+arg)
+	}
+	if req.CaseFilter != "" {
+		args = append(args, "--test_filter="+req.CaseFilter)
+	}
+	if req.FailFast {
+		args = append(args, "--test_runner_fail_fast")
+	}
+	args = append(args, "--", target)
+
+	ctx := req.Context()
+	cmd := exec.CommandContext(ctx, r.bazel, args...)
+	cmd.Dir = r.workspace
+
+	bazelOutput := &boundedBuffer{max: r.maxOutputSize, budget: req.outputBudget}
+	output, flush := withOutputStream(req, bazelOutput)
+	err := runCommand(cmd, output, false)
+	flush()
+
+	if ctx.Err() != nil {
+		r.logger.Printf("[%s] Request cancelled; Bazel killed\n", req.ID)
+		res.Err = ctx.Err()
+		return res
+	}
+
+	status, ok := parseBazelSummary(bazelOutput.Bytes(), canonicalLabel(target))
+	if ok {
+		res.Status = status
+	} else if err == nil {
+		res.Status = pb.RunStatus_SUCCESS
+	} else if e, ok := err.(*exec.ExitError); ok &&
+		(e.ExitCode() == bazelExitBuildFailed || e.ExitCode() == bazelExitTestsFailed) {
+		res.Status = pb.RunStatus_FAILURE
+	} else {
+		r.logger.Printf("[%s] Bazel failed: %v\n%s", req.ID, err, bazelOutput.Bytes())
+		res.Err = fmt.Errorf("bazel test failed: %v", err)
+		return res
+	}
+
+	r.logger.Printf("[%s] Bazel test %s finished: %v\n", req.ID, target, res.Status)
+
+	res.Output = bazelOutput.Bytes()
+	if logPath, ok := r.testLogPath(target); ok {
+		if testLog, err := r.readTestLog(logPath); err == nil {
+			res.Output = testLog
+		}
+	}
+
+	return res
+}
+
+// parseBazelSummary finds the status of a target in the summary printed by
+// "bazel test", returning false if the target is not listed. Flaky tests which
+// eventually passed are considered successful.
+func parseBazelSummary(output []byte, target string) (pb.RunStatus, bool) {
+	for _, line := range strings.Split(string(output), "\n") {
+		match := bazelSummaryPattern.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil || match[1] != target {
+			continue
+		}
+
+		switch match[2] {
+		case "PASSED", "FLAKY":
+			return pb.RunStatus_SUCCESS, true
+		case "SKIPPED":
+			return pb.RunStatus_SKIPPED, true
+		case "TIMEOUT":
+			return pb.RunStatus_TIMEOUT, true
+		default:
+			return pb.RunStatus_FAILURE, true
+		}
+	}
+	return pb.RunStatus_PENDING, false
+}
+
+// canonicalLabel expands a label which omits its target name, e.g. "//pkg/test",
+// to the form Bazel reports it in, "//pkg/test:test".
+func canonicalLabel(label string) string {
+	if strings.Contains(label, ":") || strings.HasSuffix(label, "...") {
+		return label
+	}
+	return label + ":" + filepath.Base(label)
+}
+
+// testLogPath returns the path of the log of a test target in the workspace's
+// test logs directory. Only targets in the main repository, written as
+// "//package:name" or "//package", are supported.
+func (r *BazelTestRunner) testLogPath(target string) (string, bool) {
+	if !strings.HasPrefix(target, "//") || r.testlogs == "" {
+		return "", false
+	}
+
+	label := strings.TrimPrefix(canonicalLabel(target), "//")
+	i := strings.Index(label, ":")
+	if i < 0 {
+		return "", false
+	}
+	pkg, name := label[:i], label[i+1:]
+
+	return filepath.Join(r.testlogs, pkg, name, "test.log"), true
+}
+
+// readTestLog reads up to the runner's maximum output size from a test log.
+func (r *BazelTestRunner) readTestLog(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if r.maxOutputSize > 0 {
+		reader = io.LimitReader(file, int64(r.maxOutputSize))
+	}
+
+	return ioutil.ReadAll(reader)
+}
@@ -0,0 +1,161 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Period over which a cgroup's CPU limit is enforced, in microseconds.
+const cgroupCPUPeriod = 100000
+
+// How long to wait for the processes in a cgroup to exit after they are killed
+// before giving up on removing it.
+const cgroupRemoveTimeout = 5 * time.Second
+
+// runCgroup is a cgroup v2 group created to hold the processes of a single run.
+type runCgroup struct {
+	path string
+	dir  *os.File
+}
+
+// createCgroup creates a cgroup under parent with the given limits. The parent
+// must be a cgroup v2 directory writable by the server, with the controllers
+// needed for the limits enabled in its cgroup.subtree_control.
+func createCgroup(parent string, limits CgroupLimits) (*runCgroup, error) {
+	path, err := ioutil.TempDir(parent, "run-")
+	if err != nil {
+		return nil, err
+	}
+
+	cgroup := &runCgroup{path: path}
+	if err := writeCgroupLimits(path, limits); err != nil {
+		cgroup.remove()
+		return nil, err
+	}
+
+	if cgroup.dir, err = os.Open(path); err != nil {
+		cgroup.remove()
+		return nil, err
+	}
+	return cgroup, nil
+}
+
+// writeCgroupLimits configures the limits of the cgroup at path.
+func writeCgroupLimits(path string, limits CgroupLimits) error {
+	if limits.MemoryMaxBytes > 0 {
+		err := writeCgroupFile(path, "memory.max", strconv.FormatInt(limits.MemoryMaxBytes, 10))
+		if err != nil {
+			return err
+		}
+
+		// Swapping would let the run exceed its limit without being
+		// killed. Hosts without swap accounting lack the file.
+		err = writeCgroupFile(path, "memory.swap.max", "0")
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		// An out of memory kill takes down every process in the run, not
+		// only the largest, so that a test is not left running without
+		// a helper it depends on.
+		if err := writeCgroupFile(path, "memory.oom.group", "1"); err != nil {
+			return err
+		}
+	}
+
+	if limits.CPUPercent > 0 {
+		quota := int64(limits.CPUPercent) * cgroupCPUPeriod / 100
+		err := writeCgroupFile(path, "cpu.max", fmt.Sprintf("%d %d", quota, cgroupCPUPeriod))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeCgroupFile writes a value to one of a cgroup's interface files.
+func writeCgroupFile(path, name, value string) error {
+	return ioutil.WriteFile(filepath.Join(path, name), []byte(value), 0644)
+}
+
+// apply configures a command to start in the cgroup, so that any processes it
+// spawns are also in it.
+func (c *runCgroup) apply(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(c.dir.Fd())
+}
+
+// oomKilled returns whether any process in the cgroup was killed for exceeding
+// its memory limit.
+func (c *runCgroup) oomKilled() (bool, error) {
+	events, err := ioutil.ReadFile(filepath.Join(c.path, "memory.events"))
+	if err != nil {
+		return false, err
+	}
+	return parseOOMKills(events) > 0, nil
+}
+
+// parseOOMKills returns the number of out of memory kills recorded in the
+// contents of a cgroup's memory.events file.
+func parseOOMKills(events []byte) int {
+	scanner := bufio.NewScanner(bytes.NewReader(events))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			kills, _ := strconv.Atoi(fields[1])
+			return kills
+		}
+	}
+	return 0
+}
+
+// remove kills any processes left in the cgroup, then removes it.
+func (c *runCgroup) remove() error {
+	if c.dir != nil {
+		c.dir.Close()
+	}
+
+	// cgroup.kill requires Linux 5.14. The cgroup cannot be removed while
+	// processes remain in it, so on older kernels they must exit on their
+	// own.
+	writeCgroupFile(c.path, "cgroup.kill", "1")
+
+	deadline := time.Now().Add(cgroupRemoveTimeout)
+	for {
+		err := syscall.Rmdir(c.path)
+		if err != syscall.EBUSY || time.Now().After(deadline) {
+			if err != nil {
+				return &os.PathError{Op: "remove", Path: c.path, Err: err}
+			}
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
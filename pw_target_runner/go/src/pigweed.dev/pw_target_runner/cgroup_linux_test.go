@@ -0,0 +1,67 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteCgroupLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pw_target_runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	limits := CgroupLimits{MemoryMaxBytes: 64 << 20, CPUPercent: 150}
+	if err := writeCgroupLimits(dir, limits); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"memory.max":       "67108864",
+		"memory.swap.max":  "0",
+		"memory.oom.group": "1",
+		"cpu.max":          "150000 100000",
+	}
+	for name, value := range want {
+		got, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("Failed to read %s: %v", name, err)
+		} else if string(got) != value {
+			t.Errorf("Got %s of %q; want %q", name, got, value)
+		}
+	}
+}
+
+func TestParseOOMKills(t *testing.T) {
+	tests := []struct {
+		events string
+		want   int
+	}{
+		{"", 0},
+		{"low 0\nhigh 0\nmax 3\noom 1\noom_kill 0\n", 0},
+		{"low 0\nhigh 0\nmax 12\noom 2\noom_kill 2\noom_group_kill 1\n", 2},
+	}
+
+	for _, test := range tests {
+		if got := parseOOMKills([]byte(test.events)); got != test.want {
+			t.Errorf("parseOOMKills(%q) = %d; want %d", test.events, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+//go:build !linux
+// +build !linux
+
+package pw_target_runner
+
+import (
+	"errors"
+	"os/exec"
+)
+
+var errCgroupsUnsupported = errors.New("Running in cgroups is only supported on Linux")
+
+type runCgroup struct{}
+
+func createCgroup(parent string, limits CgroupLimits) (*runCgroup, error) {
+	return nil, errCgroupsUnsupported
+}
+
+func (c *runCgroup) apply(cmd *exec.Cmd) {}
+
+func (c *runCgroup) oomKilled() (bool, error) {
+	return false, errCgroupsUnsupported
+}
+
+func (c *runCgroup) remove() error {
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"google.golang.org/grpc/peer"
+)
+
+var errClientQueueFull = errors.New("Client has too many queued requests")
+
+// clientQueueLimit tracks the number of requests each client has queued or
+// running, refusing new requests from clients at the limit.
+type clientQueueLimit struct {
+	max    int
+	mutex  sync.Mutex
+	counts map[string]int
+}
+
+// acquire counts a new request from a client, returning false if the client
+// already has the maximum number of requests.
+func (l *clientQueueLimit) acquire(client string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.counts[client] >= l.max {
+		return false
+	}
+	l.counts[client]++
+	return true
+}
+
+// release counts the completion of a request from a client.
+func (l *clientQueueLimit) release(client string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.counts[client]--; l.counts[client] <= 0 {
+		delete(l.counts, client)
+	}
+}
+
+// SetMaxQueuedPerClient limits the number of requests each client may have
+// queued or running at once, so that one client cannot fill the queue and keep
+// others from running anything. Further requests from a client at its limit
+// are rejected with codes.ResourceExhausted. Clients are identified by the
+// common name of their certificate if they present a verified one, or by their
+// host otherwise; requests made through the library rather than over gRPC are
+// not limited. A limit of zero, the default, disables it. This cannot be done
+// while the server is running.
+func (s *Server) SetMaxQueuedPerClient(max int) error {
+	if s.state.isActive() {
+		return errServerRunning
+	}
+
+	if max > 0 {
+		s.clientLimit = &clientQueueLimit{max: max, counts: make(map[string]int)}
+	} else {
+		s.clientLimit = nil
+	}
+	return nil
+}
+
+// requestClient identifies the client which made the RPC of a request for the
+// per-client limit, returning an empty string for requests not made over gRPC.
+func requestClient(ctx context.Context) string {
+	if identity := clientIdentity(ctx); identity != "" {
+		return "cn:" + identity
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+
+	// Each of a client's connections comes from a different port, so only
+	// the host identifies it.
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return "addr:" + p.Addr.String()
+	}
+	return "addr:" + host
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Shell script which raises the core file size limit as far as it is allowed,
+// then runs its arguments.
+const enableCoreDumpsScript = `ulimit -c "$(ulimit -H -c)" && exec "$@"`
+
+// File in which the kernel's core file name pattern is configured.
+const corePatternFile = "/proc/sys/kernel/core_pattern"
+
+// enableCoreDumps wraps a command so that it and its children may dump core.
+// The core file size limit cannot be set through exec.Cmd, so it is raised by a
+// shell which then replaces itself with the command.
+func enableCoreDumps(cmd *exec.Cmd) {
+	args := []string{"sh", "-c", enableCoreDumpsScript, "sh", cmd.Path}
+	cmd.Args = append(args, cmd.Args[1:]...)
+	cmd.Path = "/bin/sh"
+}
+
+// checkCorePattern returns an error if the kernel is configured to write core
+// files anywhere other than the crashed process's working directory, from
+// which they are collected.
+func checkCorePattern() error {
+	content, err := ioutil.ReadFile(corePatternFile)
+	if err != nil {
+		return err
+	}
+
+	pattern := strings.TrimSpace(string(content))
+	if strings.HasPrefix(pattern, "|") || filepath.IsAbs(pattern) {
+		return fmt.Errorf(
+			"%s is %q; core files are only collected if it is a relative path",
+			corePatternFile,
+			pattern)
+	}
+	return nil
+}
+
+// collectCoreDumps moves any core files in a run's directory to destDir, adding
+// prefix to their names, and returns their new paths. Core files are those
+// named "core", or starting with "core.", as the kernel names them by default.
+func collectCoreDumps(runDir, destDir, prefix string) ([]string, error) {
+	files, err := ioutil.ReadDir(runDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var collected []string
+	for _, file := range files {
+		name := file.Name()
+		if !file.Mode().IsRegular() || name != "core" && !strings.HasPrefix(name, "core.") {
+			continue
+		}
+
+		dest := filepath.Join(destDir, prefix+name)
+		if err := moveFile(filepath.Join(runDir, name), dest); err != nil {
+			return collected, err
+		}
+		collected = append(collected, dest)
+	}
+	return collected, nil
+}
+
+// moveFile moves a file, copying it if it cannot be renamed, such as when the
+// destination is on a different filesystem.
+func moveFile(src, dest string) error {
+	if os.Rename(src, dest) == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dest)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dest)
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,106 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pb "pigweed.dev/proto/pw_target_runner/target_runner_pb"
+)
+
+func TestExecDeviceRunnerCollectsCoreDumps(t *testing.T) {
+	if err := checkCorePattern(); err != nil {
+		t.Skip(err)
+	}
+
+	dir, err := ioutil.TempDir("", "pw_target_runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The script crashes the shell running it.
+	script := filepath.Join(dir, "crash.sh")
+	if err := ioutil.WriteFile(script, []byte("kill -SEGV $$\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	coreDir := filepath.Join(dir, "cores")
+	r := NewExecDeviceRunner(0, []string{"/bin/sh"})
+	r.SetCoreDumpDir(coreDir)
+	if err := r.WorkerStart(); err != nil {
+		t.Fatal(err)
+	}
+
+	res := r.HandleRunRequest(&RunRequest{ID: "crash", Path: script})
+	if res.Err != nil {
+		t.Fatalf("Run failed: %v", res.Err)
+	}
+	if res.Status != pb.RunStatus_FAILURE {
+		t.Errorf("Got status %v; want FAILURE", res.Status)
+	}
+
+	// The host's hard limit may not allow core dumps at all.
+	if len(res.CoreDumps) == 0 {
+		t.Skip("No core dump was produced")
+	}
+	for _, core := range res.CoreDumps {
+		name := filepath.Base(core)
+		if filepath.Dir(core) != coreDir || !strings.HasPrefix(name, "crash-core") {
+			t.Errorf("Core dump %s was not saved as crash-core* in %s", core, coreDir)
+		}
+		if _, err := os.Stat(core); err != nil {
+			t.Errorf("Core dump was not saved: %v", err)
+		}
+	}
+}
+
+func TestCollectCoreDumps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pw_target_runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	runDir := filepath.Join(dir, "run")
+	destDir := filepath.Join(dir, "cores")
+	for _, d := range []string{runDir, destDir, filepath.Join(runDir, "core.d")} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"core", "core.1234", "corefile", "output.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(runDir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cores, err := collectCoreDumps(runDir, destDir, "id-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		filepath.Join(destDir, "id-core"),
+		filepath.Join(destDir, "id-core.1234"),
+	}
+	if strings.Join(cores, ",") != strings.Join(want, ",") {
+		t.Errorf("Collected %v; want %v", cores, want)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var errDeadlineUnreachable = errors.New("Request cannot complete before its deadline")
+
+// estimateCompletion estimates how long a request queued now would take to
+// complete: the time to run the requests ahead of it, spread across the pool's
+// available workers, plus its own run time. Run times are the average of the
+// executable's earlier runs, if the pool tracks them, or otherwise the average
+// across the pool's workers. If nothing has run yet, the estimate is zero.
+func (p *WorkerPool) estimateCompletion(req *RunRequest) time.Duration {
+	p.stateMutex.Lock()
+	var capacity, active int
+	var workerAverage time.Duration
+	var averaged int
+	for _, w := range p.workers {
+		if !w.available() {
+			continue
+		}
+		capacity += w.capacity
+		active += w.active
+		if w.averageRunTime > 0 {
+			workerAverage += w.averageRunTime
+			averaged++
+		}
+	}
+	p.stateMutex.Unlock()
+
+	if averaged == 0 || capacity == 0 {
+		return 0
+	}
+	workerAverage /= time.Duration(averaged)
+
+	runTime := workerAverage
+	if p.runTimes != nil {
+		if baseline := p.runTimes.average(runTimeKey(req)); baseline > 0 {
+			runTime = baseline
+		}
+	}
+
+	// Once every worker is busy, the request waits for those ahead of it to
+	// run in turns of the pool's capacity. Requests which are running are
+	// assumed to have a full run ahead of them.
+	ahead := int(atomic.LoadInt64(&p.queueDepth)) + active
+	var wait time.Duration
+	if ahead >= capacity {
+		turns := (ahead-capacity)/capacity + 1
+		wait = time.Duration(turns) * workerAverage
+	}
+
+	return wait + runTime
+}
+
+// checkDeadline returns errDeadlineUnreachable if a request with a deadline is
+// estimated to complete after it.
+func (p *WorkerPool) checkDeadline(req *RunRequest) error {
+	if req.Deadline.IsZero() {
+		return nil
+	}
+
+	estimate := p.estimateCompletion(req)
+	if time.Now().Add(estimate).After(req.Deadline) {
+		p.logger.Printf(
+			"[%s] Rejecting %s: estimated to complete in %v, after its deadline in %v\n",
+			req.ID,
+			req.Path,
+			estimate,
+			time.Until(req.Deadline))
+		return errDeadlineUnreachable
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// inflightRun is a request being run by the server which identical requests
+// can attach to, receiving its result rather than running again.
+type inflightRun struct {
+	// ID of the request being run.
+	id string
+
+	// Closed once res and err are set.
+	done chan struct{}
+	res  *RunResponse
+	err  error
+}
+
+// dedupKey returns the key under which a request is de-duplicated, derived
+// from the content of its executable and the options which affect its result.
+// Requests with arguments or streamed output, or which opted out, are not
+// de-duplicated, nor are requests whose path cannot be read as a file.
+func dedupKey(req *RunRequest) (string, bool) {
+	if req.NoDeduplicate || len(req.Args) > 0 || req.OnOutput != nil {
+		return "", false
+	}
+
+	file, err := os.Open(req.Path)
+	if err != nil {
+		return "", false
+	}
+	defer file.Close()
+
+	var deadline int64
+	if !req.Deadline.IsZero() {
+		deadline = req.Deadline.UnixNano()
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", false
+	}
+	fmt.Fprintf(
+		h,
+		"\x00case=%s\x00failfast=%t\x00discard=%t\x00timeout=%d\x00flaky=%t"+
+			"\x00retries=%d\x00expected=%d\x00soak=%d,%d\x00deadline=%d",
+		req.CaseFilter,
+		req.FailFast,
+		req.DiscardOutput,
+		req.Timeout,
+		req.Flaky,
+		req.RetriesOnFailure,
+		req.ExpectedStatus,
+		req.SoakIterations,
+		req.SoakDuration,
+		deadline)
+
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// runDeduplicated runs a request unless an identical request is already in
+// flight, in which case it waits for that request's result instead. If the
+// request it attached to is abandoned by its own requester, the request is run
+// after all.
+func (s *Server) runDeduplicated(
+	ctx context.Context,
+	req *RunRequest,
+	key string,
+) (*RunResponse, error) {
+	for {
+		s.inflightMutex.Lock()
+		run, ok := s.inflight[key]
+		if !ok {
+			break
+		}
+		s.inflightMutex.Unlock()
+
+		log.Printf(
+			"Request for %s attached to identical request [%s]\n", req.Path, run.id)
+
+		select {
+		case <-run.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if run.err == context.Canceled || run.err == context.DeadlineExceeded {
+			continue
+		}
+		if run.err != nil {
+			return nil, run.err
+		}
+
+		// Each requester gets its own copy of the response.
+		res := *run.res
+		return &res, nil
+	}
+
+	if req.ID == "" {
+		req.ID = newRequestID()
+	}
+	run := &inflightRun{id: req.ID, done: make(chan struct{})}
+	s.inflight[key] = run
+	s.inflightMutex.Unlock()
+
+	run.res, run.err = s.queue(ctx, req)
+
+	s.inflightMutex.Lock()
+	delete(s.inflight, key)
+	s.inflightMutex.Unlock()
+	close(run.done)
+
+	if run.err == nil {
+		s.state.recordResult(run.res.Status)
+	}
+	return run.res, run.err
+}
@@ -0,0 +1,190 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import "time"
+
+// WorkerLoad describes the current load of a worker which is able to take a
+// request, for a DispatchStrategy to choose between.
+type WorkerLoad struct {
+	// Index of the worker within its pool.
+	ID int
+
+	// Number of requests assigned to the worker which have not completed,
+	// and the maximum number it can handle at once.
+	AssignedRequests int
+	Capacity         int
+
+	// Moving average of the time the worker has taken to run requests, or
+	// zero if it has not run any.
+	AverageRunTime time.Duration
+}
+
+// DispatchStrategy chooses which worker in a pool runs the next request.
+type DispatchStrategy interface {
+	// ChooseWorker returns the index within candidates of the worker which
+	// should run the next request. Each candidate is running, healthy, not
+	// quarantined, and below its capacity, and there is always at least one.
+	ChooseWorker(candidates []WorkerLoad) int
+}
+
+// LeastLoaded is a DispatchStrategy which assigns each request to the worker
+// with the smallest fraction of its capacity in use. Ties are broken in favor
+// of the worker which has been running requests fastest, so that faster
+// hardware in a heterogeneous pool takes more of the work. Workers which have
+// not yet run anything are preferred, so that their speed is learned.
+type LeastLoaded struct{}
+
+// ChooseWorker returns the least loaded candidate. Part of DispatchStrategy
+// interface.
+func (LeastLoaded) ChooseWorker(candidates []WorkerLoad) int {
+	best := 0
+	for i := 1; i < len(candidates); i++ {
+		if lessLoaded(&candidates[i], &candidates[best]) {
+			best = i
+		}
+	}
+	return best
+}
+
+// lessLoaded returns whether worker a is less loaded than worker b.
+func lessLoaded(a, b *WorkerLoad) bool {
+	// Compare a.AssignedRequests / a.Capacity to b's without division.
+	loadA := a.AssignedRequests * b.Capacity
+	loadB := b.AssignedRequests * a.Capacity
+	if loadA != loadB {
+		return loadA < loadB
+	}
+	return a.AverageRunTime < b.AverageRunTime
+}
+
+// dispatch is run by the worker pool in a separate goroutine when it has a
+// dispatch strategy. It takes each request off the pool's queue and assigns it
+// to the worker chosen by the strategy, waiting for a worker to become able to
+// take it if none are. The routine exits when quit is closed, returning any
+// request it holds to the queue.
+func (p *WorkerPool) dispatch(quit <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	for {
+		var req *RunRequest
+		select {
+		case req = <-p.reqChannel:
+		case <-quit:
+			return
+		}
+
+		for !p.assign(req) {
+			select {
+			case <-p.dispatchWake:
+			case <-quit:
+				p.requeue(req)
+				return
+			}
+		}
+	}
+}
+
+// assign passes a request to the worker chosen by the pool's dispatch strategy,
+// returning false if no worker is able to take it.
+func (p *WorkerPool) assign(req *RunRequest) bool {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+
+	if p.paused {
+		return false
+	}
+
+	var candidates []*workerState
+	var loads []WorkerLoad
+	for _, w := range p.workers {
+		if !w.running || !w.available() || w.assigned >= w.capacity {
+			continue
+		}
+		candidates = append(candidates, w)
+		loads = append(loads, WorkerLoad{
+			ID:               w.id,
+			AssignedRequests: w.assigned,
+			Capacity:         w.capacity,
+			AverageRunTime:   w.averageRunTime,
+		})
+	}
+
+	if len(candidates) == 0 {
+		return false
+	}
+
+	// The worker's channel holds up to its capacity, and it is never
+	// assigned more than that, so this does not block.
+	w := candidates[p.strategy.ChooseWorker(loads)]
+	w.assigned++
+	w.assignedChannel <- req
+	return true
+}
+
+// unassign returns the requests assigned to a worker which it has not started
+// to the pool's queue, so that they can be assigned to other workers.
+func (p *WorkerPool) unassign(w *workerState) {
+	p.stateMutex.Lock()
+	var reqs []*RunRequest
+	for drained := false; !drained; {
+		select {
+		case req := <-w.assignedChannel:
+			reqs = append(reqs, req)
+		default:
+			drained = true
+		}
+	}
+	w.assigned -= len(reqs)
+	p.stateMutex.Unlock()
+
+	for _, req := range reqs {
+		p.requeue(req)
+	}
+}
+
+// requestFinished records that a worker has finished with a request, allowing
+// it to be assigned another.
+func (p *WorkerPool) requestFinished(w *workerState) {
+	if p.strategy == nil {
+		return
+	}
+
+	p.stateMutex.Lock()
+	w.assigned--
+	p.stateMutex.Unlock()
+
+	p.wakeDispatcher()
+}
+
+// wakeDispatcher signals the dispatch routine to retry assigning a request
+// which no worker was able to take, after a worker's state changed.
+func (p *WorkerPool) wakeDispatcher() {
+	select {
+	case p.dispatchWake <- struct{}{}:
+	default:
+	}
+}
+
+// requeue returns a request to the pool's queue, or its session queue for
+// session requests. This is done asynchronously to avoid blocking on a full
+// queue.
+func (p *WorkerPool) requeue(req *RunRequest) {
+	queue := p.reqChannel
+	if req.Session != nil {
+		queue = p.sessionChannel
+	}
+	go func() { queue <- req }()
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"log"
+)
+
+// EventListener is notified as each request moves through a worker pool, for
+// example to report progress to another system as it happens. Unlike a
+// ResultSink, which only receives final results, a listener sees each stage of
+// a request's lifecycle. Its methods are called from the goroutines processing
+// requests, so they must be safe to call concurrently and should return
+// quickly; a slow listener delays the request which triggered it.
+//
+// A flaky request which is retried after a delay is queued and started again
+// for each attempt, but completes only once. A request rejected by the pool
+// completes with an error without having been queued.
+type EventListener interface {
+	// OnQueued is called when a request is added to the pool's queue.
+	OnQueued(req *RunRequest)
+
+	// OnStarted is called when a worker, identified by its index within the
+	// pool, starts running a request.
+	OnStarted(req *RunRequest, worker int)
+
+	// OnCompleted is called with a request's response once it has been
+	// processed, before the response is sent to its requester.
+	OnCompleted(req *RunRequest, res *RunResponse)
+}
+
+// NopEventListener is an EventListener which ignores every event. It can be
+// embedded in listeners which only handle some events.
+type NopEventListener struct{}
+
+// OnQueued does nothing. Part of EventListener interface.
+func (NopEventListener) OnQueued(*RunRequest) {}
+
+// OnStarted does nothing. Part of EventListener interface.
+func (NopEventListener) OnStarted(*RunRequest, int) {}
+
+// OnCompleted does nothing. Part of EventListener interface.
+func (NopEventListener) OnCompleted(*RunRequest, *RunResponse) {}
+
+// LoggingEventListener is an EventListener which logs each event.
+type LoggingEventListener struct {
+	logger *log.Logger
+}
+
+// NewLoggingEventListener creates a LoggingEventListener which logs in the
+// library's configured format.
+func NewLoggingEventListener() *LoggingEventListener {
+	return &LoggingEventListener{logger: newLogger("Events")}
+}
+
+// OnQueued logs a request being queued. Part of EventListener interface.
+func (l *LoggingEventListener) OnQueued(req *RunRequest) {
+	l.logger.Printf("[%s] Queued %s\n", req.ID, req.Path)
+}
+
+// OnStarted logs a request being started. Part of EventListener interface.
+func (l *LoggingEventListener) OnStarted(req *RunRequest, worker int) {
+	l.logger.Printf("[%s] Started %s on worker %d\n", req.ID, req.Path, worker)
+}
+
+// OnCompleted logs a request's outcome. Part of EventListener interface.
+func (l *LoggingEventListener) OnCompleted(req *RunRequest, res *RunResponse) {
+	if res.Err != nil {
+		l.logger.Printf("[%s] Completed %s with error: %v\n", req.ID, req.Path, res.Err)
+		return
+	}
+	l.logger.Printf(
+		"[%s] Completed %s with status %v after %v queued, %v running\n",
+		req.ID,
+		req.Path,
+		res.Status,
+		res.QueueTime,
+		res.RunTime)
+}
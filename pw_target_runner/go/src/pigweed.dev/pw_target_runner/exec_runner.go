@@ -15,32 +15,382 @@
 package pw_target_runner
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
+	"github.com/creack/pty"
 	pb "pigweed.dev/proto/pw_target_runner/target_runner_pb"
 )
 
+// Default maximum number of bytes of output kept from a single run.
+const defaultMaxOutputSize = 16 << 20
+
+// How long to continue reading a command's output after it exits. The output
+// is normally complete by the time the command exits, but a process spawned by
+// the command may inherit its output pipe and hold it open indefinitely.
+const outputDrainTimeout = time.Second
+
+// Default time given to a command to exit after it is sent SIGTERM before it is
+// killed.
+const defaultKillGracePeriod = 5 * time.Second
+
 // ExecDeviceRunner is a struct that implements the DeviceRunner interface,
 // running its executables through a command with the path of the executable as
 // an argument.
 type ExecDeviceRunner struct {
-	command []string
-	logger  *log.Logger
+	command            []string
+	logger             *log.Logger
+	replaceInvalidUTF8 bool
+	maxOutputSize      int
+	listCasesArgs      []string
+	caseFilterArg      string
+	failFastArgs       []string
+	settleDelay        time.Duration
+	usePty             bool
+	warmupPath         string
+	outputTailSize     int
+	capacity           int
+	preRunHook         []string
+	postRunHook        []string
+	env                []string
+	killGracePeriod    time.Duration
+	detectLeaks        bool
+	defaultTimeout     time.Duration
+	maxTimeout         time.Duration
+	cgroupLimits       CgroupLimits
+	memoryGuard        MemoryGuard
+	sandbox            *SandboxConfig
+	coreDumpDir        string
+	successPattern     *regexp.Regexp
+	failurePattern     *regexp.Regexp
+	interactive        bool
+}
+
+// CgroupLimits configures the cgroup v2 group in which an ExecDeviceRunner runs
+// each executable.
+type CgroupLimits struct {
+	// The cgroup under which a group is created for each run, e.g.
+	// "/sys/fs/cgroup/pw_target_runner". The server must be able to write
+	// to it, and it must enable the memory and cpu controllers for its
+	// children.
+	Parent string
+
+	// If nonzero, the most memory the processes of a run may use. They are
+	// all killed if they exceed it.
+	MemoryMaxBytes int64
+
+	// If nonzero, the CPU time the processes of a run may use, as a
+	// percentage of a single CPU, e.g. 200 for two CPUs.
+	CPUPercent int
 }
 
 // NewExecDeviceRunner creates a new ExecDeviceRunner with a custom logger.
 func NewExecDeviceRunner(id int, command []string) *ExecDeviceRunner {
-	logPrefix := fmt.Sprintf("[ExecDeviceRunner %d] ", id)
-	logger := log.New(os.Stdout, logPrefix, log.LstdFlags)
-	return &ExecDeviceRunner{command, logger}
+	return &ExecDeviceRunner{
+		command:         command,
+		logger:          newLogger(fmt.Sprintf("ExecDeviceRunner %d", id)),
+		maxOutputSize:   defaultMaxOutputSize,
+		capacity:        1,
+		killGracePeriod: defaultKillGracePeriod,
+	}
+}
+
+// SetReplaceInvalidUTF8 configures whether invalid UTF-8 sequences in the
+// command's output are replaced with the Unicode replacement character. When
+// disabled, which is the default, the raw output bytes are returned.
+func (r *ExecDeviceRunner) SetReplaceInvalidUTF8(replace bool) {
+	r.replaceInvalidUTF8 = replace
+}
+
+// SetMaxOutputSize sets the maximum number of bytes of output kept from each
+// run. Output beyond this is read and discarded. A size of zero disables the
+// limit.
+func (r *ExecDeviceRunner) SetMaxOutputSize(size int) {
+	r.maxOutputSize = size
+}
+
+// SetListCasesArgs sets the arguments passed to an executable to have it list
+// its test cases, e.g. "--gtest_list_tests". The executable must print its
+// cases in GoogleTest's format. Listing cases is unsupported unless this is set.
+func (r *ExecDeviceRunner) SetListCasesArgs(args []string) {
+	r.listCasesArgs = args
+}
+
+// SetCaseFilterArg sets the prefix of the argument used to run a single test
+// case of an executable, e.g. "--gtest_filter=". The name of the requested case
+// is appended to it. Requests with a case filter fail unless this is set.
+func (r *ExecDeviceRunner) SetCaseFilterArg(prefix string) {
+	r.caseFilterArg = prefix
+}
+
+// SetFailFastArgs sets the arguments which make an executable stop at its first
+// failing test case, e.g. "--gtest_fail_fast". They are appended to the
+// arguments of requests which set FailFast, which fail unless this is set.
+func (r *ExecDeviceRunner) SetFailFastArgs(args []string) {
+	r.failFastArgs = args
+}
+
+// SetSettleDelay sets how long the runner's worker waits after each executable
+// completes before it takes another request, such as to let a device's power
+// rails settle between flashes. The delay does not hold up the result of the
+// executable which completed, and does not follow requests which run no
+// executable. This must be set before the runner is registered with a worker
+// pool. Defaults to zero.
+func (r *ExecDeviceRunner) SetSettleDelay(delay time.Duration) {
+	r.settleDelay = delay
+}
+
+// SetUsePty configures whether commands are attached to a pseudo-terminal
+// rather than a pipe. Programs which only emit colored output when writing to a
+// terminal, such as GoogleTest binaries, do so when this is enabled. Only
+// supported on Unix-like systems; runs fail on other platforms.
+func (r *ExecDeviceRunner) SetUsePty(usePty bool) {
+	r.usePty = usePty
+}
+
+// SetWarmupPath sets an executable which is run each time the worker starts,
+// before it handles any requests, so that the timing of those requests is not
+// skewed by a cold start. The warmup run's result is discarded. It is killed if
+// it runs for longer than the runner's default timeout.
+func (r *ExecDeviceRunner) SetWarmupPath(path string) {
+	r.warmupPath = path
+}
+
+// SetOutputTailSize configures the runner to keep only the last size bytes of
+// the output of successful runs, which bounds the memory used by chatty
+// executables. The full output of failed runs is still returned, up to the
+// maximum output size; it is held in a temporary file rather than in memory
+// while the command runs. A size of zero, the default, keeps the full output
+// of every run.
+func (r *ExecDeviceRunner) SetOutputTailSize(size int) {
+	r.outputTailSize = size
+}
+
+// SetCapacity sets the number of requests the runner handles at once, each
+// through a separate invocation of its command. This must be set before the
+// runner is registered with a worker pool.
+func (r *ExecDeviceRunner) SetCapacity(capacity int) {
+	r.capacity = capacity
+}
+
+// SetPreRunHook sets a command which is run before each executable, such as to
+// reset the device on which it runs. The command is run with the environment
+// variables described in runHook, and is subject to the same timeout as the
+// executable. If it fails, the executable is not run and the request fails with
+// an internal error.
+func (r *ExecDeviceRunner) SetPreRunHook(command []string) {
+	r.preRunHook = command
+}
+
+// SetPostRunHook sets a command which is run after each executable, regardless
+// of its outcome, such as to clean up after it. The command is run with the
+// environment variables described in runHook, including the executable's
+// result, and is subject to the same timeout as the executable. A failure of
+// the command is logged but does not affect the result.
+func (r *ExecDeviceRunner) SetPostRunHook(command []string) {
+	r.postRunHook = command
+}
+
+// SetEnv sets environment variables, as "KEY=VALUE" entries, which are added to
+// the server's environment for the runner's command and hooks. If a key appears
+// more than once, its last value is used.
+func (r *ExecDeviceRunner) SetEnv(env []string) {
+	r.env = env
+}
+
+// SetKillGracePeriod sets how long a command is given to exit when its request
+// is cancelled or times out. The command is first sent SIGTERM, allowing it to
+// flush its output and release the device, then killed if it is still running
+// once the grace period has passed. A grace period of zero kills the command
+// immediately. Defaults to 5 seconds.
+func (r *ExecDeviceRunner) SetKillGracePeriod(gracePeriod time.Duration) {
+	r.killGracePeriod = gracePeriod
+}
+
+// SetDetectLeakedProcesses configures the runner to check for processes spawned
+// by each executable which are still running once it exits, such as background
+// processes it failed to stop. Any which are found are killed, logged, and
+// counted in the response's LeakedProcesses. Each command is run in its own
+// process group so that its processes can be found; processes which leave the
+// group are not detected. Only supported on Linux.
+func (r *ExecDeviceRunner) SetDetectLeakedProcesses(detect bool) {
+	r.detectLeaks = detect
+}
+
+// SetCgroupLimits configures the runner to run each executable in a new cgroup
+// under limits.Parent, limiting the memory and CPU time that it and any
+// processes it spawns can use, so that a runaway executable cannot starve
+// others on the host. An executable killed for exceeding its memory limit
+// fails with the OUT_OF_MEMORY status. Processes left in the cgroup once the
+// executable exits are killed. An empty parent, the default, disables this.
+// Only supported on Linux.
+func (r *ExecDeviceRunner) SetCgroupLimits(limits CgroupLimits) {
+	r.cgroupLimits = limits
+}
+
+// SetMemoryGuard configures the runner to poll the memory used by each
+// executable and the processes it spawns, killing them and failing the run with
+// the OUT_OF_MEMORY status if they exceed guard.MaxBytes. This is a portable
+// fallback for hosts on which cgroup limits are unavailable, such as those in
+// containers or other than Linux, but it only catches usage which is still
+// over the limit when polled. Processes are read from /proc on Linux and
+// listed with ps elsewhere. A zero limit, the default, disables this.
+func (r *ExecDeviceRunner) SetMemoryGuard(guard MemoryGuard) {
+	r.memoryGuard = guard
+}
+
+// SandboxConfig configures the sandbox directories in which an ExecDeviceRunner
+// runs its executables.
+type SandboxConfig struct {
+	// If set, a read-only directory over which each sandbox is mounted
+	// through overlayfs, so that executables can use its files without
+	// changing them. Otherwise, each sandbox starts empty.
+	Base string
+}
+
+// SetSandbox configures the runner to run each executable with a fresh sandbox
+// directory as its working directory, so that files it writes there cannot
+// affect later runs. The sandbox is deleted once the executable exits. Mounting
+// a base directory requires the server to have CAP_SYS_ADMIN. A nil config, the
+// default, runs executables in the server's working directory. Only supported
+// on Linux.
+func (r *ExecDeviceRunner) SetSandbox(config *SandboxConfig) {
+	r.sandbox = config
+}
+
+// SetCoreDumpDir configures the runner to collect core dumps from executables
+// which crash, saving them in dir with their request's ID prefixed to their
+// names. Their paths are reported in the response's CoreDumps. The core file
+// size limit of each command is raised as far as its hard limit allows. Cores
+// are collected from the command's working directory, so the kernel's
+// core_pattern must be a relative path, such as the default "core"; each
+// executable is run in a sandbox directory, which is empty if no sandbox is
+// configured. An empty dir, the default, disables this. Only supported on
+// Linux.
+func (r *ExecDeviceRunner) SetCoreDumpDir(dir string) {
+	r.coreDumpDir = dir
+}
+
+// SetDefaultTimeout sets how long executables may run when their requests do
+// not set a timeout. An executable which runs for longer is terminated, as if
+// its request were cancelled, and fails. A timeout of zero, the default, lets
+// executables run until their requests are done.
+func (r *ExecDeviceRunner) SetDefaultTimeout(timeout time.Duration) {
+	r.defaultTimeout = timeout
+}
+
+// SetMaxTimeout caps the time any executable may run, including those whose
+// requests set a longer timeout or none at all. A maximum of zero, the default,
+// leaves timeouts uncapped.
+func (r *ExecDeviceRunner) SetMaxTimeout(timeout time.Duration) {
+	r.maxTimeout = timeout
+}
+
+// SetOutputPatterns has the runner determine whether executables passed from
+// their output, for harnesses which report results in a line such as
+// "RESULT: PASS" rather than through their exit codes. Each line of output is
+// matched against the patterns; either may be nil. A line matching failure
+// fails the run. Otherwise, if success is set, the run passes if and only if a
+// line matched it, whatever its exit code; if only failure is set, the exit
+// code decides runs it did not match. Timeouts and runs killed for exceeding
+// their memory limit are not affected. Output is matched even for requests
+// which discard it.
+func (r *ExecDeviceRunner) SetOutputPatterns(success, failure *regexp.Regexp) {
+	r.successPattern = success
+	r.failurePattern = failure
+}
+
+// timeout returns how long a request's executable may run, or zero if it may
+// run indefinitely.
+func (r *ExecDeviceRunner) timeout(req *RunRequest) time.Duration {
+	timeout := req.Timeout
+	if timeout <= 0 {
+		timeout = r.defaultTimeout
+	}
+	if r.maxTimeout > 0 && (timeout <= 0 || timeout > r.maxTimeout) {
+		timeout = r.maxTimeout
+	}
+	return timeout
+}
+
+// Capacity returns the number of requests the runner handles at once. Part of
+// ConcurrentRunner interface.
+func (r *ExecDeviceRunner) Capacity() int {
+	return r.capacity
+}
+
+// SettleDelay returns how long the runner's worker waits between requests. Part
+// of SettlingRunner interface.
+func (r *ExecDeviceRunner) SettleDelay() time.Duration {
+	return r.settleDelay
 }
 
 // WorkerStart starts the worker. Part of DeviceRunner interface.
 func (r *ExecDeviceRunner) WorkerStart() error {
 	r.logger.Printf("Starting worker")
+
+	if r.coreDumpDir != "" {
+		if err := os.MkdirAll(r.coreDumpDir, 0755); err != nil {
+			return err
+		}
+
+		// Runs are still allowed to dump core in case the pattern is
+		// changed, so this is only a warning.
+		if err := checkCorePattern(); err != nil {
+			r.logger.Printf("Core dumps may not be collected: %v\n", err)
+		}
+	}
+
+	if r.warmupPath != "" {
+		r.warmup()
+	}
+
+	return nil
+}
+
+// warmup runs the warmup executable, logging how long it took. A failed warmup
+// run is logged but does not prevent the worker from starting. The run is
+// subject to the runner's default timeout, so that a hung warmup cannot hold up
+// the worker indefinitely.
+func (r *ExecDeviceRunner) warmup() {
+	r.logger.Printf("Running warmup executable %s\n", r.warmupPath)
+
+	ctx := context.Background()
+	if r.defaultTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.defaultTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	cmd := r.buildCommand(context.Background(), r.warmupPath, nil)
+	err := runCommandGraceful(ctx, cmd, ioutil.Discard, r.usePty, r.killGracePeriod, nil)
+	duration := time.Since(start)
+
+	if ctx.Err() == context.DeadlineExceeded {
+		r.logger.Printf("Warmup run timed out after %v; command terminated\n", duration)
+	} else if err != nil {
+		r.logger.Printf("Warmup run failed after %v: %v\n", duration, err)
+	} else {
+		r.logger.Printf("Warmup run completed in %v\n", duration)
+	}
+}
+
+// HealthCheck reports the health of the worker. Part of HealthChecker
+// interface. An ExecDeviceRunner launches a new process for every request, so
+// it is always considered healthy.
+func (r *ExecDeviceRunner) HealthCheck() error {
 	return nil
 }
 
@@ -50,34 +400,672 @@ func (r *ExecDeviceRunner) WorkerExit() {
 }
 
 // HandleRunRequest runs a requested binary by executing the runner's command
-// with the binary path as an argument. The combined stdout and stderr of the
-// command is returned as the run output.
+// with the binary path as an argument, followed by any arguments in the
+// request and the case filter argument, if the request has a case filter. The
+// combined stdout and stderr of the command is returned as the run output.
+// The runner's hooks, if any, are run before and after the command, and their
+// combined output is returned separately.
 func (r *ExecDeviceRunner) HandleRunRequest(req *RunRequest) *RunResponse {
+	return r.withHooks(req, r.runBinary)
+}
+
+// withHooks runs a request through run, preceded and followed by the runner's
+// hooks, if any, as described in HandleRunRequest.
+func (r *ExecDeviceRunner) withHooks(
+	req *RunRequest,
+	run func(*RunRequest) *RunResponse,
+) *RunResponse {
+	hookOutput := &boundedBuffer{max: r.maxOutputSize}
+
+	if len(r.preRunHook) > 0 {
+		err := r.runHook(req.Context(), req, r.preRunHook, "", hookOutput)
+		if err != nil {
+			r.logger.Printf(
+				"[%s] Pre-run hook failed: %v\n%s", req.ID, err, hookOutput.Bytes())
+			return &RunResponse{
+				Err:        &preRunHookError{err: err, output: hookOutput.Bytes()},
+				HookOutput: hookOutput.Bytes(),
+			}
+		}
+	}
+
+	res := run(req)
+
+	if len(r.postRunHook) > 0 {
+		result := res.Status.String()
+		if res.Err != nil {
+			result = "ERROR"
+		}
+
+		// The post-run hook runs even if the request was cancelled, so
+		// it cannot use the request's context.
+		err := r.runHook(context.Background(), req, r.postRunHook, result, hookOutput)
+		if err != nil {
+			r.logger.Printf("[%s] Post-run hook failed: %v\n", req.ID, err)
+		}
+	}
+
+	res.HookOutput = hookOutput.Bytes()
+	return res
+}
+
+// preRunHookError is the error of a request whose pre-run hook failed. It
+// carries the hook's output, as the request has no other result through which
+// the output could reach its client.
+type preRunHookError struct {
+	err    error
+	output []byte
+}
+
+func (e *preRunHookError) Error() string {
+	return fmt.Sprintf("Pre-run hook failed: %v", e.err)
+}
+
+// runHook runs a hook command for a request, writing its output to output. In
+// addition to the runner's environment, the command receives the path to the
+// requested executable in PW_TARGET_RUNNER_BINARY and the ID of the request in
+// PW_TARGET_RUNNER_REQUEST_ID. For post-run hooks, the result of the run is
+// passed in PW_TARGET_RUNNER_RESULT as SUCCESS, FAILURE, TIMEOUT, or ERROR.
+//
+// A hook is given as long as the request's executable to run, so that a hung
+// hook cannot hold up the worker indefinitely. Like the executable, it is
+// terminated with the runner's grace period once ctx is done or it times out.
+func (r *ExecDeviceRunner) runHook(
+	ctx context.Context,
+	req *RunRequest,
+	hook []string,
+	result string,
+	output io.Writer,
+) error {
+	timeout := r.timeout(req)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	cmd := exec.Command(hook[0], hook[1:]...)
+	cmd.Env = append(
+		r.environ(),
+		"PW_TARGET_RUNNER_BINARY="+req.Path,
+		"PW_TARGET_RUNNER_REQUEST_ID="+req.ID)
+	if result != "" {
+		cmd.Env = append(cmd.Env, "PW_TARGET_RUNNER_RESULT="+result)
+	}
+
+	err := runCommandGraceful(ctx, cmd, output, false, r.killGracePeriod, nil)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %v", timeout)
+	}
+	return err
+}
+
+// runBinary runs a requested binary through the runner's command, as described
+// in HandleRunRequest.
+func (r *ExecDeviceRunner) runBinary(req *RunRequest) *RunResponse {
 	res := &RunResponse{Status: pb.RunStatus_SUCCESS}
 
-	r.logger.Printf("Running executable %s\n", req.Path)
+	if req.CaseFilter != "" && r.caseFilterArg == "" {
+		res.Err = errCaseFilterUnsupported
+		return res
+	}
+	if req.FailFast && len(r.failFastArgs) == 0 {
+		res.Err = errFailFastUnsupported
+		return res
+	}
 
-	// Copy runner command args, appending the binary path to the end.
-	args := append([]string(nil), r.command[1:]...)
-	args = append(args, req.Path)
+	if req.CaseFilter != "" {
+		r.logger.Printf(
+			"[%s] Running case %s of executable %s\n",
+			req.ID,
+			req.CaseFilter,
+			req.Path)
+	} else {
+		r.logger.Printf("[%s] Running executable %s\n", req.ID, req.Path)
+	}
 
-	cmd := exec.Command(r.command[0], args...)
-	output, err := cmd.CombinedOutput()
+	args := req.Args
+	if req.CaseFilter != "" {
+		args = append(append([]string(nil), args...), r.caseFilterArg+req.CaseFilter)
+	}
+	if req.FailFast {
+		args = append(append([]string(nil), args...), r.failFastArgs...)
+	}
 
-	if err != nil {
+	var capture outputCapture = &boundedBuffer{
+		max:    r.maxOutputSize,
+		budget: req.outputBudget,
+	}
+	if req.DiscardOutput {
+		capture = discardOutput{}
+	} else if r.outputTailSize > 0 {
+		tail, err := newTailBuffer(r.outputTailSize, r.maxOutputSize)
+		if err != nil {
+			r.logger.Printf("[%s] Failed to create output buffer: %v\n", req.ID, err)
+			res.Err = err
+			return res
+		}
+		defer tail.Close()
+		capture = tail
+	}
+
+	var matcher *outputMatcher
+	if r.successPattern != nil || r.failurePattern != nil {
+		matcher = &outputMatcher{
+			outputCapture: capture,
+			success:       r.successPattern,
+			failure:       r.failurePattern,
+		}
+		capture = matcher
+	}
+
+	// The command is terminated if the request is cancelled or times out
+	// while it runs. This is done by waitCommand rather than by exec, so
+	// that the command is given its grace period to exit.
+	ctx := req.Context()
+	runCtx := ctx
+	timeout := r.timeout(req)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// Executables which exceed the memory guard's limit are killed along
+	// with their process group.
+	var guard *memoryGuard
+	if r.memoryGuard.MaxBytes > 0 {
+		guard = newMemoryGuard(r.memoryGuard)
+	}
+
+	cmd := r.buildCommand(context.Background(), req.Path, args)
+	if r.detectLeaks || guard != nil {
+		setProcessGroup(cmd, r.usePty)
+	}
+
+	// Core dumps are collected from the command's working directory, so
+	// they require a sandbox.
+	var sandbox *runSandbox
+	if r.sandbox != nil || r.coreDumpDir != "" {
+		base := ""
+		if r.sandbox != nil {
+			base = r.sandbox.Base
+		}
+
+		var err error
+		if sandbox, err = createSandbox(base); err != nil {
+			r.logger.Printf("[%s] Failed to create sandbox: %v\n", req.ID, err)
+			res.Err = err
+			return res
+		}
+		defer r.removeSandbox(req, sandbox)
+		cmd.Dir = sandbox.dir
+	}
+
+	if r.coreDumpDir != "" {
+		enableCoreDumps(cmd)
+	}
+
+	var cgroup *runCgroup
+	if r.cgroupLimits.Parent != "" {
+		var err error
+		if cgroup, err = createCgroup(r.cgroupLimits.Parent, r.cgroupLimits); err != nil {
+			r.logger.Printf("[%s] Failed to create cgroup: %v\n", req.ID, err)
+			res.Err = err
+			return res
+		}
+		cgroup.apply(cmd)
+	}
+
+	started := func() {
+		if guard != nil {
+			guard.watch(cmd)
+		}
+	}
+
+	var err error
+	if req.DiscardOutput && matcher == nil {
+		// Leaving the command's stdout and stderr unset connects them
+		// to the null device.
+		if err = cmd.Start(); err == nil {
+			started()
+			err = waitCommand(runCtx, cmd, r.killGracePeriod)
+		}
+	} else {
+		output, flush := withOutputStream(req, capture)
+		err = runCommandGraceful(
+			runCtx, cmd, output, r.usePty, r.killGracePeriod, started)
+		flush()
+	}
+
+	guardKilled := false
+	if guard != nil {
+		used, guardErr := guard.stop()
+		if guardErr != nil {
+			r.logger.Printf("[%s] Failed to poll memory usage: %v\n", req.ID, guardErr)
+		}
+		if used > 0 {
+			r.logger.Printf("[%s] Executable was using %d bytes of memory\n", req.ID, used)
+			guardKilled = true
+		}
+	}
+
+	// Leaked processes are killed even if the request was cancelled, so
+	// that they do not interfere with the next request.
+	if r.detectLeaks && cmd.Process != nil {
+		r.reapLeakedProcesses(req, cmd.Process.Pid, res)
+	}
+
+	oomKilled := false
+	if cgroup != nil {
+		oomKilled = r.removeCgroup(req, cgroup)
+	}
+	memoryLimit := r.cgroupLimits.MemoryMaxBytes
+	if guardKilled && !oomKilled {
+		oomKilled = true
+		memoryLimit = r.memoryGuard.MaxBytes
+	}
+
+	if r.coreDumpDir != "" {
+		r.collectCoreDumps(req, sandbox, res)
+	}
+
+	// The usage covers the runner's command and any of its processes which
+	// it waited for.
+	if state := cmd.ProcessState; state != nil {
+		res.MaxRSSBytes = maxRSSBytes(state)
+		res.UserCPUTime = state.UserTime()
+		res.SystemCPUTime = state.SystemTime()
+	}
+
+	if ctx.Err() != nil {
+		r.logger.Printf("[%s] Request cancelled; command terminated\n", req.ID)
+		res.Err = ctx.Err()
+		return res
+	}
+
+	// The output an executable produced before it timed out is kept in
+	// full, as its last lines usually show where it hung.
+	timedOut := runCtx.Err() == context.DeadlineExceeded
+	if oomKilled {
+		r.logger.Printf(
+			"[%s] Executable exceeded memory limit of %d bytes; killed\n",
+			req.ID,
+			memoryLimit)
+		res.Status = pb.RunStatus_OUT_OF_MEMORY
+	} else if timedOut {
+		r.logger.Printf(
+			"[%s] Executable timed out after %v; command terminated\n", req.ID, timeout)
+		res.Status = pb.RunStatus_TIMEOUT
+	} else if err != nil {
 		if e, ok := err.(*exec.ExitError); ok {
 			// A nonzero exit status is interpreted as a failure.
-			r.logger.Printf("Command exited with status %d\n", e.ExitCode())
+			r.logger.Printf("[%s] Command exited with status %d\n", req.ID, e.ExitCode())
 			res.Status = pb.RunStatus_FAILURE
 		} else {
 			// Any other error with the command execution is
 			// reported as an internal error to the requester.
-			r.logger.Printf("Command failed: %v\n", err)
+			r.logger.Printf("[%s] Command failed: %v\n", req.ID, err)
 			res.Err = err
 			return res
 		}
 	}
 
+	if matcher != nil && !oomKilled && !timedOut {
+		status := matcher.status(res.Status)
+		if status != res.Status {
+			r.logger.Printf(
+				"[%s] Output determined status %v rather than exit code's %v\n",
+				req.ID,
+				status,
+				res.Status)
+		}
+		res.Status = status
+	}
+
+	if req.ExpectedStatus != pb.RunStatus_PENDING {
+		r.matchExpectedStatus(req, res)
+	}
+
+	captured, err := capture.output(res.Status == pb.RunStatus_SUCCESS)
+	if err != nil {
+		r.logger.Printf("[%s] Failed to read command output: %v\n", req.ID, err)
+		res.Err = err
+		return res
+	}
+
+	output := captured.data
+	if r.usePty {
+		// Terminals translate each newline written by the command to
+		// a carriage return and newline.
+		output = bytes.ReplaceAll(output, []byte("\r\n"), []byte("\n"))
+	}
+
+	if captured.dropped > 0 {
+		r.logger.Printf(
+			"[%s] Keeping last %d bytes of output; dropped %d bytes\n",
+			req.ID,
+			len(captured.data),
+			captured.dropped)
+		res.OutputDroppedBytes = captured.dropped
+	}
+
+	if captured.truncated {
+		r.logger.Printf(
+			"[%s] Command output exceeded %d bytes; truncating\n",
+			req.ID,
+			r.maxOutputSize)
+		output = append(output, "\n[output truncated]\n"...)
+	}
+
+	if captured.overBudget {
+		r.logger.Printf("[%s] Server output budget exhausted; truncating\n", req.ID)
+		output = append(output, "\n[output truncated: server output budget exhausted]\n"...)
+	}
+
+	if oomKilled {
+		output = append(output, fmt.Sprintf(
+			"\n[killed: exceeded memory limit of %d bytes]\n",
+			memoryLimit)...)
+	} else if timedOut {
+		output = append(output, fmt.Sprintf("\n[timed out after %v]\n", timeout)...)
+	}
+
+	if r.replaceInvalidUTF8 && !utf8.Valid(output) {
+		r.logger.Printf("[%s] Replacing invalid UTF-8 in command output\n", req.ID)
+		output = bytes.ToValidUTF8(output, []byte(string(utf8.RuneError)))
+		res.OutputReplaced = true
+	}
+
 	res.Output = output
 	return res
 }
+
+// matchExpectedStatus compares the status of a run with the status its request
+// expects, recording the actual status and replacing it with SUCCESS if they
+// match or FAILURE otherwise.
+func (r *ExecDeviceRunner) matchExpectedStatus(req *RunRequest, res *RunResponse) {
+	res.ActualStatus = res.Status
+	if res.Status == req.ExpectedStatus {
+		r.logger.Printf("[%s] Executable had expected status %v\n", req.ID, res.Status)
+		res.Status = pb.RunStatus_SUCCESS
+	} else {
+		r.logger.Printf(
+			"[%s] Executable had status %v; expected %v\n",
+			req.ID,
+			res.Status,
+			req.ExpectedStatus)
+		res.Status = pb.RunStatus_FAILURE
+	}
+}
+
+// reapLeakedProcesses kills any processes left running in the process group of
+// a request's command, recording how many there were in its response.
+func (r *ExecDeviceRunner) reapLeakedProcesses(req *RunRequest, pgid int, res *RunResponse) {
+	leaked, err := reapProcessGroup(pgid)
+	if err != nil {
+		r.logger.Printf("[%s] Failed to check for leaked processes: %v\n", req.ID, err)
+	}
+
+	if leaked > 0 {
+		r.logger.Printf(
+			"[%s] Command left %d process(es) running; killed them\n", req.ID, leaked)
+		res.LeakedProcesses = leaked
+	}
+}
+
+// removeCgroup removes the cgroup in which a request's command ran, killing any
+// processes left in it, and returns whether any of its processes were killed
+// for exceeding its memory limit.
+func (r *ExecDeviceRunner) removeCgroup(req *RunRequest, cgroup *runCgroup) bool {
+	oomKilled, err := cgroup.oomKilled()
+	if err != nil {
+		r.logger.Printf("[%s] Failed to read cgroup memory events: %v\n", req.ID, err)
+	}
+
+	if err := cgroup.remove(); err != nil {
+		r.logger.Printf("[%s] Failed to remove cgroup: %v\n", req.ID, err)
+	}
+	return oomKilled
+}
+
+// collectCoreDumps moves any core files left in the sandbox of a request's
+// command to the runner's core dump directory, recording their paths in its
+// response.
+func (r *ExecDeviceRunner) collectCoreDumps(
+	req *RunRequest,
+	sandbox *runSandbox,
+	res *RunResponse,
+) {
+	cores, err := collectCoreDumps(sandbox.dir, r.coreDumpDir, req.ID+"-")
+	if err != nil {
+		r.logger.Printf("[%s] Failed to collect core dumps: %v\n", req.ID, err)
+	}
+
+	for _, core := range cores {
+		r.logger.Printf("[%s] Saved core dump %s\n", req.ID, core)
+	}
+	res.CoreDumps = cores
+}
+
+// removeSandbox removes the sandbox in which a request's command ran.
+func (r *ExecDeviceRunner) removeSandbox(req *RunRequest, sandbox *runSandbox) {
+	if err := sandbox.remove(); err != nil {
+		r.logger.Printf("[%s] Failed to remove sandbox: %v\n", req.ID, err)
+	}
+}
+
+// ListCases lists the test cases in a requested executable by running the
+// runner's command with the executable's path, followed by any arguments in the
+// request and the configured list arguments. Part of CaseLister interface. The
+// listing is subject to the request's timeout, and is terminated as a run would
+// be if it takes longer or the request is cancelled.
+func (r *ExecDeviceRunner) ListCases(req *RunRequest) ([]string, error) {
+	if len(r.listCasesArgs) == 0 {
+		return nil, errCaseListingUnsupported
+	}
+
+	r.logger.Printf("[%s] Listing cases in executable %s\n", req.ID, req.Path)
+
+	ctx := req.Context()
+	timeout := r.timeout(req)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	args := append(append([]string(nil), req.Args...), r.listCasesArgs...)
+	cmd := r.buildCommand(context.Background(), req.Path, args)
+	output := &boundedBuffer{max: r.maxOutputSize}
+	err := runCommandGraceful(ctx, cmd, output, false, r.killGracePeriod, nil)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("listing cases timed out after %v", timeout)
+	}
+	if err != nil {
+		r.logger.Printf("[%s] Listing cases failed: %v\n", req.ID, err)
+		return nil, err
+	}
+
+	return parseCaseList(output.Bytes()), nil
+}
+
+// buildCommand creates a command which runs an executable through the runner's
+// command, passing it the executable's path followed by the given arguments.
+func (r *ExecDeviceRunner) buildCommand(
+	ctx context.Context,
+	path string,
+	args []string,
+) *exec.Cmd {
+	cmdArgs := append([]string(nil), r.command[1:]...)
+	cmdArgs = append(cmdArgs, path)
+	cmdArgs = append(cmdArgs, args...)
+	cmd := exec.CommandContext(ctx, r.command[0], cmdArgs...)
+	cmd.Env = r.environ()
+	return cmd
+}
+
+// environ returns the environment in which the runner's commands run: the
+// server's environment followed by the runner's variables, which take
+// precedence over it.
+func (r *ExecDeviceRunner) environ() []string {
+	return append(os.Environ(), r.env...)
+}
+
+// parseCaseList parses the output of a GoogleTest binary run with
+// --gtest_list_tests into full case names, e.g. "Suite.Case". The output lists
+// each suite name followed by a period, then each of its cases indented on the
+// lines below it. Comments following a "#" are ignored, as are any unindented
+// lines which are not suite names.
+func parseCaseList(output []byte) []string {
+	var cases []string
+	suite := ""
+
+	for _, line := range strings.Split(string(output), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+
+		name := strings.TrimSpace(line)
+		if name == "" {
+			continue
+		}
+
+		if line[0] != ' ' {
+			if strings.HasSuffix(name, ".") {
+				suite = name
+			} else {
+				suite = ""
+			}
+		} else if suite != "" {
+			cases = append(cases, suite+name)
+		}
+	}
+
+	return cases
+}
+
+// runCommand runs a command to completion, writing its combined stdout and
+// stderr to output. If usePty is set, the command is attached to a
+// pseudo-terminal rather than a pipe. The output writer should not return
+// errors, as the command could then block writing to a full pipe.
+//
+// Unlike exec.Cmd.CombinedOutput, this does not wait for the output pipe to be
+// closed once the command has exited. If the command is killed, processes it
+// spawned may hold the pipe open, which would otherwise leave both the caller
+// and the goroutine copying the output blocked indefinitely.
+func runCommand(cmd *exec.Cmd, output io.Writer, usePty bool) error {
+	return runCommandGraceful(context.Background(), cmd, output, usePty, 0, nil)
+}
+
+// runCommandGraceful runs a command as runCommand does. If ctx is done before
+// the command exits, it is terminated as described in waitCommand. If started
+// is not nil, it is called once the command has started.
+func runCommandGraceful(
+	ctx context.Context,
+	cmd *exec.Cmd,
+	output io.Writer,
+	usePty bool,
+	gracePeriod time.Duration,
+	started func(),
+) error {
+	var outputFile *os.File
+	var err error
+	if usePty {
+		outputFile, err = pty.Start(cmd)
+	} else {
+		outputFile, err = startWithPipe(cmd)
+	}
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+
+	if started != nil {
+		started()
+	}
+
+	copyDone := make(chan struct{})
+	go func() {
+		// Once the command exits, reads from a pseudo-terminal fail
+		// rather than reaching EOF, so errors are not reported.
+		io.Copy(output, outputFile)
+		close(copyDone)
+	}()
+
+	err = waitCommand(ctx, cmd, gracePeriod)
+
+	// Allow any output remaining in the pipe to be read, then stop reading
+	// even if the pipe is still held open. If the pipe does not support
+	// deadlines, closing it unblocks the reader immediately.
+	if outputFile.SetReadDeadline(time.Now().Add(outputDrainTimeout)) != nil {
+		outputFile.Close()
+	}
+	<-copyDone
+
+	return err
+}
+
+// waitCommand waits for a started command to exit. If ctx is done first, the
+// command is sent SIGTERM, then killed if it has not exited after gracePeriod.
+// With a grace period of zero, or if the signal cannot be sent, such as on
+// Windows, the command is killed immediately.
+func waitCommand(ctx context.Context, cmd *exec.Cmd, gracePeriod time.Duration) error {
+	untrack := runningCommands.add(cmd)
+	defer untrack()
+
+	if ctx.Done() == nil {
+		return cmd.Wait()
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-exited:
+			return
+		}
+
+		if gracePeriod > 0 && cmd.Process.Signal(syscall.SIGTERM) == nil {
+			timer := time.NewTimer(gracePeriod)
+			defer timer.Stop()
+
+			select {
+			case <-timer.C:
+			case <-exited:
+				return
+			}
+		}
+		cmd.Process.Kill()
+	}()
+
+	err := cmd.Wait()
+	close(exited)
+	return err
+}
+
+// startWithPipe starts a command with its stdout and stderr redirected to a
+// single pipe, returning the read end of the pipe.
+func startWithPipe(cmd *exec.Cmd) (*os.File, error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	// Stdout and stderr share a single pipe so that their output is
+	// interleaved in the order in which it was written.
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	err = cmd.Start()
+
+	// The command has its own copy of the write end of the pipe. Closing
+	// this one ensures reads reach EOF once the command exits.
+	pw.Close()
+
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+
+	return pr, nil
+}
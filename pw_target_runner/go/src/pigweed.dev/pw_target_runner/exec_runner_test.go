@@ -0,0 +1,477 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/status"
+	pb "pigweed.dev/proto/pw_target_runner/target_runner_pb"
+)
+
+func TestExecDeviceRunnerTimeout(t *testing.T) {
+	tests := []struct {
+		name           string
+		defaultTimeout time.Duration
+		maxTimeout     time.Duration
+		requested      time.Duration
+		want           time.Duration
+	}{
+		{"none", 0, 0, 0, 0},
+		{"default", time.Minute, 0, 0, time.Minute},
+		{"requested", time.Minute, 0, time.Second, time.Second},
+		{"requested longer than default", time.Minute, 0, time.Hour, time.Hour},
+		{"capped request", 0, time.Minute, time.Hour, time.Minute},
+		{"capped default", time.Hour, time.Minute, 0, time.Minute},
+		{"max without default", 0, time.Minute, 0, time.Minute},
+		{"request under max", time.Minute, time.Hour, time.Second, time.Second},
+	}
+
+	for _, test := range tests {
+		r := NewExecDeviceRunner(0, []string{"/bin/sh"})
+		r.SetDefaultTimeout(test.defaultTimeout)
+		r.SetMaxTimeout(test.maxTimeout)
+
+		got := r.timeout(&RunRequest{Timeout: test.requested})
+		if got != test.want {
+			t.Errorf("%s: got timeout %v; want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestExecDeviceRunnerKeepsOutputOfTimedOutRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pw_target_runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The script hangs after printing its last line. It replaces itself
+	// with sleep so that terminating it does not leave a child process
+	// holding its output open.
+	script := filepath.Join(dir, "hang.sh")
+	content := "echo 'last line before hang'\nexec sleep 10\n"
+	if err := ioutil.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		configure func(r *ExecDeviceRunner)
+	}{
+		{"pipe", func(r *ExecDeviceRunner) {}},
+		{"pty", func(r *ExecDeviceRunner) { r.SetUsePty(true) }},
+		{"tail", func(r *ExecDeviceRunner) { r.SetOutputTailSize(4) }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := NewExecDeviceRunner(0, []string{"/bin/sh"})
+			r.SetDefaultTimeout(200 * time.Millisecond)
+			r.SetKillGracePeriod(100 * time.Millisecond)
+			test.configure(r)
+
+			res := r.HandleRunRequest(&RunRequest{ID: "test", Path: script})
+			if res.Err != nil {
+				t.Fatalf("Run failed: %v", res.Err)
+			}
+			if res.Status != pb.RunStatus_TIMEOUT {
+				t.Errorf("Got status %v; want TIMEOUT", res.Status)
+			}
+			if !bytes.Contains(res.Output, []byte("last line before hang\n")) {
+				t.Errorf("Output %q is missing the line before the hang", res.Output)
+			}
+			if !bytes.HasSuffix(res.Output, []byte("[timed out after 200ms]\n")) {
+				t.Errorf("Output %q is not marked as timed out", res.Output)
+			}
+		})
+	}
+}
+
+func TestExecDeviceRunnerDoesNotLeakGoroutines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pw_target_runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The executable exits while a process it spawned holds its output pipe
+	// open, which must not leave the goroutine reading the pipe blocked.
+	path := filepath.Join(dir, "background.sh")
+	if err := ioutil.WriteFile(path, []byte("sleep 3 &\necho done\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewExecDeviceRunner(0, []string{"/bin/sh"})
+	baseline := runtime.NumGoroutine()
+	for i := 0; i < 2; i++ {
+		res := r.HandleRunRequest(&RunRequest{ID: "test", Path: path})
+		if res.Err != nil {
+			t.Fatalf("Run failed: %v", res.Err)
+		}
+	}
+
+	// Goroutines which have been unblocked may take a moment to exit.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > baseline {
+		t.Errorf("%d goroutines running after runs; want at most %d", n, baseline)
+	}
+}
+
+func TestExecDeviceRunnerReportsResourceUsage(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Peak memory is only checked on Linux")
+	}
+
+	dir, err := ioutil.TempDir("", "pw_target_runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The script keeps the CPU busy for a short while.
+	script := filepath.Join(dir, "busy.sh")
+	content := "i=0\nwhile [ $i -lt 20000 ]; do i=$((i+1)); done\n"
+	if err := ioutil.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewExecDeviceRunner(0, []string{"/bin/sh"})
+	res := r.HandleRunRequest(&RunRequest{ID: "test", Path: script})
+	if res.Err != nil {
+		t.Fatalf("Run failed: %v", res.Err)
+	}
+	if res.MaxRSSBytes <= 0 {
+		t.Errorf("Got peak memory of %d bytes; want some", res.MaxRSSBytes)
+	}
+	if res.UserCPUTime+res.SystemCPUTime <= 0 {
+		t.Error("Run reported no CPU time")
+	}
+}
+
+func TestExecDeviceRunnerPreRunHookFailure(t *testing.T) {
+	r := NewExecDeviceRunner(0, []string{"/bin/sh"})
+	r.SetPreRunHook([]string{"/bin/sh", "-c", "echo hook broke; exit 1"})
+	res := r.HandleRunRequest(&RunRequest{ID: "test", Path: "/nonexistent"})
+	if res.Err == nil {
+		t.Fatal("Expected the failed pre-run hook to fail the run")
+	}
+	if !bytes.Contains(res.HookOutput, []byte("hook broke")) {
+		t.Errorf("Got hook output %q; want that of the hook", res.HookOutput)
+	}
+
+	// The hook's output is returned to the client with the error.
+	msg := status.Convert(rpcError(res.Err)).Message()
+	if !strings.Contains(msg, "hook broke") {
+		t.Errorf("Got RPC error %q; want it to include the hook output", msg)
+	}
+}
+
+func TestExecDeviceRunnerHookTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pw_target_runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "pass.sh")
+	if err := ioutil.WriteFile(path, []byte("exit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// The hook replaces its shell with sleep so that terminating it does
+	// not leave a child process holding its output open.
+	hang := []string{"/bin/sh", "-c", "exec sleep 10"}
+	tests := []struct {
+		name      string
+		configure func(r *ExecDeviceRunner)
+		wantErr   bool
+	}{
+		{"pre-run", func(r *ExecDeviceRunner) { r.SetPreRunHook(hang) }, true},
+		{"post-run", func(r *ExecDeviceRunner) { r.SetPostRunHook(hang) }, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := NewExecDeviceRunner(0, []string{"/bin/sh"})
+			r.SetDefaultTimeout(200 * time.Millisecond)
+			r.SetKillGracePeriod(100 * time.Millisecond)
+			test.configure(r)
+
+			// The hung hook is killed, releasing the worker.
+			start := time.Now()
+			res := r.HandleRunRequest(&RunRequest{ID: "test", Path: path})
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("Run took %v; want the hook killed at its timeout", elapsed)
+			}
+			if gotErr := res.Err != nil; gotErr != test.wantErr {
+				t.Errorf("Got error %v; want error: %t", res.Err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestExecDeviceRunnerListCasesTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pw_target_runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "hang.sh")
+	if err := ioutil.WriteFile(path, []byte("exec sleep 10\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewExecDeviceRunner(0, []string{"/bin/sh"})
+	r.SetListCasesArgs([]string{"--gtest_list_tests"})
+	r.SetDefaultTimeout(200 * time.Millisecond)
+	r.SetKillGracePeriod(100 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := r.ListCases(&RunRequest{ID: "test", Path: path}); err == nil {
+		t.Error("Expected the hung listing to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Listing took %v; want it killed at its timeout", elapsed)
+	}
+}
+
+func TestExecDeviceRunnerExpectedStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pw_target_runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pass := filepath.Join(dir, "pass.sh")
+	fail := filepath.Join(dir, "fail.sh")
+	if err := ioutil.WriteFile(pass, []byte("exit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fail, []byte("exit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		expected pb.RunStatus
+		want     pb.RunStatus
+		actual   pb.RunStatus
+	}{
+		{"none", fail, pb.RunStatus_PENDING, pb.RunStatus_FAILURE, pb.RunStatus_PENDING},
+		{"failure as expected", fail, pb.RunStatus_FAILURE, pb.RunStatus_SUCCESS, pb.RunStatus_FAILURE},
+		{"unexpected success", pass, pb.RunStatus_FAILURE, pb.RunStatus_FAILURE, pb.RunStatus_SUCCESS},
+		{"success as expected", pass, pb.RunStatus_SUCCESS, pb.RunStatus_SUCCESS, pb.RunStatus_SUCCESS},
+	}
+
+	for _, test := range tests {
+		r := NewExecDeviceRunner(0, []string{"/bin/sh"})
+		res := r.HandleRunRequest(&RunRequest{
+			ID:             "test",
+			Path:           test.path,
+			ExpectedStatus: test.expected,
+		})
+		if res.Err != nil {
+			t.Fatalf("%s: run failed: %v", test.name, res.Err)
+		}
+		if res.Status != test.want || res.ActualStatus != test.actual {
+			t.Errorf(
+				"%s: got status %v (actual %v); want %v (actual %v)",
+				test.name,
+				res.Status,
+				res.ActualStatus,
+				test.want,
+				test.actual)
+		}
+	}
+}
+
+func TestExecDeviceRunnerOutputPatterns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pw_target_runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	pass := script("pass.sh", "echo 'RESULT: PASS'\nexit 0\n")
+	failLine := script("fail_line.sh", "echo 'RESULT: FAIL'\nexit 0\n")
+	silent := script("silent.sh", "echo 'done'\nexit 0\n")
+	passExit1 := script("pass_exit1.sh", "printf 'RESULT: PASS'\nexit 1\n")
+	both := script("both.sh", "echo 'RESULT: PASS'\necho 'RESULT: FAIL'\n")
+
+	success := regexp.MustCompile(`^RESULT: PASS$`)
+	failure := regexp.MustCompile(`^RESULT: FAIL$`)
+
+	tests := []struct {
+		name    string
+		path    string
+		success *regexp.Regexp
+		failure *regexp.Regexp
+		discard bool
+		want    pb.RunStatus
+	}{
+		{"success line", pass, success, failure, false, pb.RunStatus_SUCCESS},
+		{"failure line", failLine, success, failure, false, pb.RunStatus_FAILURE},
+		{"no success line", silent, success, nil, false, pb.RunStatus_FAILURE},
+		{"success line overrides exit code", passExit1, success, nil, false, pb.RunStatus_SUCCESS},
+		{"failure line takes precedence", both, success, failure, false, pb.RunStatus_FAILURE},
+		{"exit code without failure line", silent, nil, failure, false, pb.RunStatus_SUCCESS},
+		{"discarded output", failLine, nil, failure, true, pb.RunStatus_FAILURE},
+	}
+
+	for _, test := range tests {
+		r := NewExecDeviceRunner(0, []string{"/bin/sh"})
+		r.SetOutputPatterns(test.success, test.failure)
+		res := r.HandleRunRequest(&RunRequest{
+			ID:            "test",
+			Path:          test.path,
+			DiscardOutput: test.discard,
+		})
+		if res.Err != nil {
+			t.Fatalf("%s: run failed: %v", test.name, res.Err)
+		}
+		if res.Status != test.want {
+			t.Errorf("%s: got status %v; want %v", test.name, res.Status, test.want)
+		}
+	}
+}
+
+func TestExecDeviceRunnerFailFast(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pw_target_runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "args.sh")
+	if err := ioutil.WriteFile(path, []byte("echo \"$*\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	req := func() *RunRequest {
+		return &RunRequest{ID: "test", Path: path, Args: []string{"-v"}, FailFast: true}
+	}
+
+	r := NewExecDeviceRunner(0, []string{"/bin/sh"})
+	if res := r.HandleRunRequest(req()); res.Err != errFailFastUnsupported {
+		t.Errorf("Got error %v without fail-fast args; want errFailFastUnsupported", res.Err)
+	}
+
+	r.SetFailFastArgs([]string{"--gtest_fail_fast"})
+	res := r.HandleRunRequest(req())
+	if res.Err != nil {
+		t.Fatalf("Run failed: %v", res.Err)
+	}
+	if got, want := string(res.Output), "-v --gtest_fail_fast\n"; got != want {
+		t.Errorf("Executable got arguments %q; want %q", got, want)
+	}
+}
+
+func TestExecDeviceRunnerMemoryGuard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pw_target_runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Any process exceeds a limit of one byte, so the executable is killed
+	// as soon as its memory is first polled.
+	path := filepath.Join(dir, "sleep.sh")
+	if err := ioutil.WriteFile(path, []byte("sleep 10\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewExecDeviceRunner(0, []string{"/bin/sh"})
+	r.SetMemoryGuard(MemoryGuard{MaxBytes: 1, PollInterval: 10 * time.Millisecond})
+
+	start := time.Now()
+	res := r.HandleRunRequest(&RunRequest{ID: "test", Path: path})
+	if res.Err != nil {
+		t.Fatalf("Run failed: %v", res.Err)
+	}
+	if res.Status != pb.RunStatus_OUT_OF_MEMORY {
+		t.Errorf("Got status %v; want OUT_OF_MEMORY", res.Status)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Executable ran for %v; want it killed at the first poll", elapsed)
+	}
+}
+
+func TestExecDeviceRunnerSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pw_target_runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	echo := filepath.Join(dir, "echo.sh")
+	content := "read line\necho \"got $line\"\necho done >&2\nexit 3\n"
+	if err := ioutil.WriteFile(echo, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	req := &RunRequest{
+		ID:   "test",
+		Path: echo,
+		Session: &Session{
+			Stdin:  strings.NewReader("hello\n"),
+			Stdout: &stdout,
+			Stderr: &stderr,
+		},
+	}
+
+	r := NewExecDeviceRunner(0, []string{"/bin/sh"})
+	if res := r.RunSession(req); res.Err != errSessionsUnsupported {
+		t.Errorf(
+			"Got error %v from non-interactive runner; want %v",
+			res.Err,
+			errSessionsUnsupported)
+	}
+
+	r.SetInteractive(true)
+	res := r.RunSession(req)
+	if res.Err != nil {
+		t.Fatalf("Session failed: %v", res.Err)
+	}
+	if res.Status != pb.RunStatus_FAILURE {
+		t.Errorf("Got status %v; want FAILURE", res.Status)
+	}
+	if got := stdout.String(); got != "got hello\n" {
+		t.Errorf("Got stdout %q; want %q", got, "got hello\n")
+	}
+	if got := stderr.String(); got != "done\n" {
+		t.Errorf("Got stderr %q; want %q", got, "done\n")
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"log"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+
+	pb "pigweed.dev/proto/pw_target_runner/target_runner_pb"
+)
+
+// Tests of the package's API are in the pw_target_runner_test package, as they
+// use the testutil package, which imports this one. These give them access to
+// what they need of its internals.
+
+// ErrCaseFilterUnsupported is the error of a request with a case filter for a
+// runner which does not support them.
+var ErrCaseFilterUnsupported = errCaseFilterUnsupported
+
+// NewWorkerPool creates an empty worker pool whose logs are discarded.
+func NewWorkerPool() *WorkerPool {
+	p := newWorkerPool("TestWorkerPool")
+	p.logger = log.New(ioutil.Discard, "", 0)
+	return p
+}
+
+// StartWithoutServing starts a server's workers without starting its gRPC
+// server, so that requests can be run through it directly.
+func (s *Server) StartWithoutServing() error {
+	s.state.start()
+	return s.workerPool.Start()
+}
+
+// WithClientIdentity returns a context in which RPCs appear to be made by a
+// client which presented a verified certificate with the given common name.
+func WithClientIdentity(ctx context.Context, name string) context.Context {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: name}}
+	return peer.NewContext(ctx, &peer.Peer{
+		AuthInfo: credentials.TLSInfo{
+			State: tls.ConnectionState{
+				VerifiedChains: [][]*x509.Certificate{{cert}},
+			},
+		},
+	})
+}
+
+// CancelRPC cancels a request through a server's Cancel RPC handler, as the
+// client of ctx.
+func (s *Server) CancelRPC(ctx context.Context, id string) error {
+	service := &pwTargetRunnerService{s}
+	_, err := service.Cancel(ctx, &pb.CancelRequest{RequestId: id})
+	return err
+}
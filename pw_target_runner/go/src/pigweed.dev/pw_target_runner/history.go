@@ -0,0 +1,107 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"sync"
+	"time"
+)
+
+// HistoryEntry is a result recorded by a ResultHistory.
+type HistoryEntry struct {
+	// Time at which the request completed.
+	Time time.Time
+
+	Path       string
+	Args       []string
+	CaseFilter string
+	Labels     map[string]string
+	Response   *RunResponse
+}
+
+// ResultHistory is a ResultSink which keeps the most recent results in memory,
+// so that they can be inspected again without rerunning their executables.
+type ResultHistory struct {
+	mutex   sync.Mutex
+	entries []HistoryEntry
+
+	// Index in entries at which the next result is stored, and the number of
+	// results stored. Once full, each result overwrites the oldest.
+	next  int
+	count int
+}
+
+// NewResultHistory creates a ResultHistory which keeps up to size results.
+func NewResultHistory(size int) *ResultHistory {
+	return &ResultHistory{entries: make([]HistoryEntry, size)}
+}
+
+// OnResult records a result, discarding the oldest if the history is full. Part
+// of ResultSink interface.
+func (h *ResultHistory) OnResult(req *RunRequest, res *RunResponse) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if len(h.entries) == 0 {
+		return nil
+	}
+
+	h.entries[h.next] = HistoryEntry{
+		Time:       time.Now(),
+		Path:       req.Path,
+		Args:       req.Args,
+		CaseFilter: req.CaseFilter,
+		Labels:     req.Labels,
+		Response:   res,
+	}
+	h.next = (h.next + 1) % len(h.entries)
+	if h.count < len(h.entries) {
+		h.count++
+	}
+	return nil
+}
+
+// Recent returns up to n of the most recent results, newest first. If n is zero,
+// all recorded results are returned.
+func (h *ResultHistory) Recent(n int) []HistoryEntry {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if n <= 0 || n > h.count {
+		n = h.count
+	}
+
+	recent := make([]HistoryEntry, n)
+	for i := range recent {
+		index := (h.next - 1 - i + len(h.entries)) % len(h.entries)
+		recent[i] = h.entries[index]
+	}
+	return recent
+}
+
+// Find returns the most recent result recorded for the request with an ID, and
+// whether there is one.
+func (h *ResultHistory) Find(id string) (HistoryEntry, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for i := 0; i < h.count; i++ {
+		index := (h.next - 1 - i + len(h.entries)) % len(h.entries)
+		if h.entries[index].Response.RequestID == id {
+			return h.entries[index], true
+		}
+	}
+	return HistoryEntry{}, false
+}
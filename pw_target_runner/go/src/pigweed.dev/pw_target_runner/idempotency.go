@@ -0,0 +1,130 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+var errInvalidIdempotencyTTL = errors.New("Idempotency key TTL must be positive")
+
+// idempotentRun is the run of a request with an idempotency key. Until it
+// expires, later requests with the same key receive its result rather than
+// running again.
+type idempotentRun struct {
+	// ID of the request being run.
+	id string
+
+	// Closed once res and err are set.
+	done chan struct{}
+	res  *RunResponse
+	err  error
+
+	// When the run's result is forgotten. Zero while the run is in flight.
+	expires time.Time
+}
+
+// EnableIdempotencyKeys has the server honor the idempotency keys of requests,
+// so that a requester can safely retry requests, such as a batch interrupted by
+// a network failure, without running them twice. The result of a request with a
+// key is kept for ttl after it completes, and returned to any later request
+// with the same key without running it; a request which arrives while one with
+// its key is in flight waits for that request's result. Keys are opaque and
+// chosen by requesters, which should make them unique, such as by generating
+// them randomly. Requests which fail with an error, rather than a result, are
+// not kept. This cannot be done while the server is running.
+func (s *Server) EnableIdempotencyKeys(ttl time.Duration) error {
+	if s.state.isActive() {
+		return errServerRunning
+	}
+	if ttl <= 0 {
+		return errInvalidIdempotencyTTL
+	}
+	s.idempotencyTTL = ttl
+	return nil
+}
+
+// runIdempotent runs a request with an idempotency key, unless a request with
+// the same key has completed within the server's TTL or is in flight, in which
+// case its result is returned. If the request with the key is abandoned or
+// fails with an error, the request is run after all.
+func (s *Server) runIdempotent(ctx context.Context, req *RunRequest) (*RunResponse, error) {
+	key := req.IdempotencyKey
+
+	for {
+		s.idempotencyMutex.Lock()
+		s.expireIdempotentRuns()
+		run, ok := s.idempotentRuns[key]
+		if !ok {
+			break
+		}
+		s.idempotencyMutex.Unlock()
+
+		log.Printf(
+			"Request for %s has the idempotency key of request [%s]; using its result\n",
+			req.Path,
+			run.id)
+
+		select {
+		case <-run.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if run.err != nil {
+			continue
+		}
+
+		// Each requester gets its own copy of the response.
+		res := *run.res
+		res.Replayed = true
+		return &res, nil
+	}
+
+	if req.ID == "" {
+		req.ID = newRequestID()
+	}
+	run := &idempotentRun{id: req.ID, done: make(chan struct{})}
+	s.idempotentRuns[key] = run
+	s.idempotencyMutex.Unlock()
+
+	res, err := s.run(ctx, req)
+
+	s.idempotencyMutex.Lock()
+	run.res, run.err = res, err
+	if err != nil {
+		delete(s.idempotentRuns, key)
+	} else {
+		run.expires = time.Now().Add(s.idempotencyTTL)
+	}
+	s.idempotencyMutex.Unlock()
+	close(run.done)
+
+	return res, err
+}
+
+// expireIdempotentRuns forgets the results of completed runs whose TTL has
+// passed. idempotencyMutex must be held.
+func (s *Server) expireIdempotentRuns() {
+	now := time.Now()
+	for key, run := range s.idempotentRuns {
+		if !run.expires.IsZero() && now.After(run.expires) {
+			delete(s.idempotentRuns, key)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package pw_target_runner
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+var errListenBacklogUnsupported = errors.New(
+	"Setting the listen backlog is not supported on this platform")
+
+// setReuseAddr does nothing on this platform, where SO_REUSEADDR would allow
+// other processes to take over the server's port.
+func setReuseAddr(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+// listenWithBacklog is unsupported on this platform.
+func listenWithBacklog(port int, backlog int) (net.Listener, error) {
+	return nil, errListenBacklogUnsupported
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package pw_target_runner
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// setReuseAddr sets SO_REUSEADDR on a listening socket before it is bound, so
+// that a restarted server can bind its port while connections from its previous
+// instance are in TIME_WAIT. Used as a net.ListenConfig's Control function.
+func setReuseAddr(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(
+			int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// listenWithBacklog starts a TCP listener on all interfaces with a specific
+// accept backlog. The net package always uses the system's maximum backlog, so
+// the socket is created directly. The listener accepts both IPv4 and IPv6
+// connections where IPv6 is available.
+func listenWithBacklog(port int, backlog int) (net.Listener, error) {
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_STREAM, 0)
+	var addr syscall.Sockaddr = &syscall.SockaddrInet6{Port: port}
+	if err == syscall.EAFNOSUPPORT {
+		fd, err = syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+		addr = &syscall.SockaddrInet4{Port: port}
+	}
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	syscall.CloseOnExec(fd)
+
+	// The file takes ownership of the socket, which is duplicated into the
+	// listener.
+	file := os.NewFile(uintptr(fd), "listener")
+	defer file.Close()
+
+	if _, ok := addr.(*syscall.SockaddrInet6); ok {
+		err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 0)
+		if err != nil {
+			return nil, os.NewSyscallError("setsockopt", err)
+		}
+	}
+	err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	if err != nil {
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	if err := syscall.Bind(fd, addr); err != nil {
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := syscall.Listen(fd, backlog); err != nil {
+		return nil, os.NewSyscallError("listen", err)
+	}
+
+	return net.FileListener(file)
+}
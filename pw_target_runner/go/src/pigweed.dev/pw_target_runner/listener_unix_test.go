@@ -0,0 +1,56 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package pw_target_runner
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestBindWithBacklog(t *testing.T) {
+	s := NewServer()
+	if err := s.SetListenBacklog(4); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Bind(0); err != nil {
+		t.Fatalf("Failed to bind: %v", err)
+	}
+	defer s.listener.Close()
+
+	addr, err := s.Addr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := addr.(*net.TCPAddr).Port
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	conn.Close()
+
+	// The port can be bound again once the listener is closed, despite the
+	// connection left in TIME_WAIT.
+	s.listener.Close()
+	if err := s.Bind(port); err != nil {
+		t.Errorf("Failed to rebind port %d: %v", port, err)
+	} else {
+		s.listener.Close()
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogFormat selects the format of the lines logged by the package.
+type LogFormat int
+
+const (
+	// LogFormatText logs human-readable lines prefixed with the component
+	// which logged them and the time.
+	LogFormatText LogFormat = iota
+
+	// LogFormatJSON logs each line as a JSON object, for ingestion by log
+	// processing systems.
+	LogFormatJSON
+)
+
+// Flags of text loggers. Timestamps have microsecond precision so that logs can
+// be correlated with those of other systems.
+const textLogFlags = log.LstdFlags | log.Lmicroseconds
+
+var logFormat = LogFormatText
+
+// Matches the request ID with which log lines about a request are prefixed.
+var requestIDPattern = regexp.MustCompile(`(?s)^\[([^\]\s]+)\] (.*)$`)
+
+// SetLogFormat sets the format of the lines logged by the package, including
+// those logged through the standard logger. Only loggers of servers and runners
+// created after the call use the new format.
+func SetLogFormat(format LogFormat) {
+	logFormat = format
+
+	if format == LogFormatJSON {
+		log.SetOutput(&jsonLogWriter{out: &followedWriter{out: os.Stderr}})
+		log.SetFlags(0)
+	} else {
+		log.SetOutput(&followedWriter{out: os.Stderr})
+		log.SetFlags(textLogFlags)
+	}
+}
+
+// newLogger creates a logger for a component of the package in the current log
+// format.
+func newLogger(component string) *log.Logger {
+	out := &followedWriter{out: os.Stdout}
+	if logFormat == LogFormatJSON {
+		return log.New(&jsonLogWriter{out: out, component: component}, "", 0)
+	}
+	return log.New(out, fmt.Sprintf("[%s] ", component), textLogFlags)
+}
+
+// jsonLogLine is the JSON representation of a logged line.
+type jsonLogLine struct {
+	Time      string `json:"time"`
+	Component string `json:"component,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Message   string `json:"message"`
+}
+
+// jsonLogWriter is an io.Writer which receives lines from a log.Logger and
+// writes each one as a JSON object. Request IDs prefixing lines are moved to
+// their own field.
+type jsonLogWriter struct {
+	out       io.Writer
+	component string
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	line := jsonLogLine{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		Component: w.component,
+		Message:   strings.TrimSuffix(string(p), "\n"),
+	}
+
+	if match := requestIDPattern.FindStringSubmatch(line.Message); match != nil {
+		line.RequestID = match[1]
+		line.Message = match[2]
+	}
+
+	data, err := json.Marshal(&line)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := w.out.Write(append(data, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Number of recently logged lines kept so that those about a request can be
+// sent to clients which start following its logs after they were logged.
+const logBacklogSize = 1024
+
+// Lines which a follower has not yet taken are held up to this limit, beyond
+// which further lines are dropped rather than holding up logging.
+const followerBufferSize = 256
+
+// logFollower receives the lines logged about a request.
+type logFollower struct {
+	requestID string
+	lines     chan string
+}
+
+// logFollowers keeps recently logged lines and passes new ones to the
+// followers of the requests they are about.
+type logFollowers struct {
+	mutex     sync.Mutex
+	backlog   []string
+	next      int
+	followers map[*logFollower]bool
+}
+
+var followedLogs = &logFollowers{followers: make(map[*logFollower]bool)}
+
+// lineAboutRequest returns whether a logged line is about a request, in either
+// log format.
+func lineAboutRequest(line, requestID string) bool {
+	return strings.Contains(line, "["+requestID+"] ") ||
+		strings.Contains(line, `"request_id":"`+requestID+`"`)
+}
+
+// publish records a logged line and passes it to the followers of its request.
+func (f *logFollowers) publish(line string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if len(f.backlog) < logBacklogSize {
+		f.backlog = append(f.backlog, line)
+	} else {
+		f.backlog[f.next] = line
+		f.next = (f.next + 1) % logBacklogSize
+	}
+
+	for follower := range f.followers {
+		if !lineAboutRequest(line, follower.requestID) {
+			continue
+		}
+		select {
+		case follower.lines <- line:
+		default:
+		}
+	}
+}
+
+// follow starts following the lines logged about a request. It returns the
+// recent lines already logged about it, a channel receiving those logged from
+// then on, and a function which stops following the request.
+func (f *logFollowers) follow(requestID string) ([]string, <-chan string, func()) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var recent []string
+	for i := range f.backlog {
+		line := f.backlog[(f.next+i)%len(f.backlog)]
+		if lineAboutRequest(line, requestID) {
+			recent = append(recent, line)
+		}
+	}
+
+	follower := &logFollower{
+		requestID: requestID,
+		lines:     make(chan string, followerBufferSize),
+	}
+	f.followers[follower] = true
+
+	stop := func() {
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		delete(f.followers, follower)
+	}
+	return recent, follower.lines, stop
+}
+
+// followedWriter is an io.Writer which passes the lines written to it by a
+// log.Logger to the package's log followers before writing them out.
+type followedWriter struct {
+	out io.Writer
+}
+
+func (w *followedWriter) Write(p []byte) (int, error) {
+	followedLogs.publish(strings.TrimSuffix(string(p), "\n"))
+	return w.out.Write(p)
+}
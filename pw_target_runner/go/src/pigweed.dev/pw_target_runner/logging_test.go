@@ -0,0 +1,73 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLogFollowers(t *testing.T) {
+	f := &logFollowers{followers: make(map[*logFollower]bool)}
+	f.publish("[Pool] 2019/11/05 12:00:00.000000 [abc123] Queueing executable /test")
+	f.publish("[Pool] 2019/11/05 12:00:00.000001 [def456] Queueing executable /other")
+	f.publish(`{"component":"Runner","request_id":"abc123","message":"Running"}`)
+
+	recent, lines, stop := f.follow("abc123")
+	if len(recent) != 2 {
+		t.Errorf("Got %d recent lines about request; want 2: %q", len(recent), recent)
+	}
+
+	f.publish("[Pool] 2019/11/05 12:00:01.000000 [def456] Done")
+	f.publish("[Pool] 2019/11/05 12:00:01.000001 [abc123] Done")
+	select {
+	case line := <-lines:
+		if line != "[Pool] 2019/11/05 12:00:01.000001 [abc123] Done" {
+			t.Errorf("Followed line %q, which is not about the request", line)
+		}
+	default:
+		t.Error("No line was passed to the follower")
+	}
+	if len(lines) != 0 {
+		t.Errorf("Follower has %d unexpected lines", len(lines))
+	}
+
+	stop()
+	f.publish("[Pool] 2019/11/05 12:00:02.000000 [abc123] After stopping")
+	if len(lines) != 0 {
+		t.Error("Line was passed to a stopped follower")
+	}
+}
+
+func TestLogFollowersBacklogWraps(t *testing.T) {
+	f := &logFollowers{followers: make(map[*logFollower]bool)}
+	for i := 0; i < logBacklogSize+10; i++ {
+		f.publish(fmt.Sprintf("[abc123] Line %d", i))
+	}
+
+	recent, _, stop := f.follow("abc123")
+	defer stop()
+
+	if len(recent) != logBacklogSize {
+		t.Fatalf("Got %d recent lines; want %d", len(recent), logBacklogSize)
+	}
+	if recent[0] != "[abc123] Line 10" {
+		t.Errorf("Oldest recent line is %q; want %q", recent[0], "[abc123] Line 10")
+	}
+	last := fmt.Sprintf("[abc123] Line %d", logBacklogSize+9)
+	if recent[len(recent)-1] != last {
+		t.Errorf("Newest recent line is %q; want %q", recent[len(recent)-1], last)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"os/exec"
+	"time"
+)
+
+// Default interval at which a memory guard polls the memory used by a run.
+const defaultMemoryGuardInterval = time.Second
+
+// MemoryGuard configures an ExecDeviceRunner to limit the memory used by each
+// executable by polling it, as a portable alternative to cgroup limits.
+type MemoryGuard struct {
+	// The most memory the command of a run and the processes it spawns may
+	// have resident at once. They are killed if they exceed it. Zero
+	// disables the guard.
+	MaxBytes int64
+
+	// How often the memory used by a run is polled. If zero, it is polled
+	// every second. Runs which briefly exceed the limit between polls are
+	// not caught.
+	PollInterval time.Duration
+}
+
+// processMemory is the parent and resident set size of a running process.
+type processMemory struct {
+	parent   int
+	rssBytes int64
+}
+
+// memoryGuard polls the memory used by a running command and the processes it
+// spawns, killing the command if it exceeds the guard's limit.
+type memoryGuard struct {
+	config  MemoryGuard
+	done    chan struct{}
+	stopped chan struct{}
+
+	// Set by the polling goroutine before it stops.
+	exceededBytes int64
+	err           error
+}
+
+func newMemoryGuard(config MemoryGuard) *memoryGuard {
+	if config.PollInterval <= 0 {
+		config.PollInterval = defaultMemoryGuardInterval
+	}
+	return &memoryGuard{config: config, done: make(chan struct{})}
+}
+
+// watch starts polling the memory used by a started command.
+func (g *memoryGuard) watch(cmd *exec.Cmd) {
+	g.stopped = make(chan struct{})
+	go func() {
+		defer close(g.stopped)
+
+		ticker := time.NewTicker(g.config.PollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-g.done:
+				return
+			case <-ticker.C:
+			}
+
+			processes, err := listProcessMemory()
+			if err != nil {
+				g.err = err
+				return
+			}
+
+			used := processTreeMemory(cmd.Process.Pid, processes)
+			if used > g.config.MaxBytes {
+				g.exceededBytes = used
+				killProcessTree(cmd)
+				return
+			}
+		}
+	}()
+}
+
+// stop stops polling once the command has exited. It returns the memory the
+// command was found using if it was killed for exceeding the limit, or zero,
+// and any error which stopped the guard from polling.
+func (g *memoryGuard) stop() (int64, error) {
+	close(g.done)
+	if g.stopped == nil {
+		return 0, nil
+	}
+	<-g.stopped
+	return g.exceededBytes, g.err
+}
+
+// processTreeMemory returns the total resident set size of a process and all of
+// its descendants.
+func processTreeMemory(root int, processes map[int]processMemory) int64 {
+	children := make(map[int][]int)
+	for pid, p := range processes {
+		children[p.parent] = append(children[p.parent], pid)
+	}
+
+	var total int64
+	pending := []int{root}
+	for len(pending) > 0 {
+		pid := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if p, ok := processes[pid]; ok {
+			total += p.rssBytes
+			pending = append(pending, children[pid]...)
+		}
+	}
+	return total
+}
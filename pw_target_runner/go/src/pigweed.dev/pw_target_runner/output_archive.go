@@ -0,0 +1,260 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errArchiveNotFound  = errors.New("No archived output for request")
+	errInvalidArchiveID = errors.New("Request ID cannot name an archive file")
+)
+
+// Size of the reads in which archived output is passed to those following it.
+const archiveReadSize = 32 * 1024
+
+// OutputArchive keeps the output of runs streamed through the RunBinaryStream
+// RPC in a directory, in a file per request named after the request's ID.
+// Output is written as it is produced rather than once the run completes, so it
+// is archived in full even if the client following it disconnects, and it can be
+// followed again by request ID while the run is still in progress. Like
+// OutputLog, the directory is pruned to the configured limits as runs complete;
+// the archives of runs in progress are never pruned.
+type OutputArchive struct {
+	dir      string
+	maxFiles int
+	maxBytes int64
+
+	// Runs whose output is being archived, by request ID.
+	mutex  sync.Mutex
+	active map[string]*archivedRun
+
+	// Serializes pruning, so that runs completing together do not try to
+	// remove the same files.
+	pruneMutex sync.Mutex
+}
+
+// archivedRun is a run whose output is being archived. It is an io.Writer to
+// which the run's output is written.
+type archivedRun struct {
+	archive *OutputArchive
+	id      string
+	file    *os.File
+
+	// Number of bytes written, and the first error writing them, if any.
+	written int64
+	err     error
+
+	// Closed and replaced whenever output is written or the run completes,
+	// waking those following its output. Guarded by the archive's mutex.
+	changed chan struct{}
+}
+
+// NewOutputArchive creates an OutputArchive writing to the specified directory,
+// creating it if necessary. maxFiles and maxBytes limit the number and total
+// size of archive files kept; a value of zero disables the respective limit.
+func NewOutputArchive(dir string, maxFiles int, maxBytes int64) (*OutputArchive, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &OutputArchive{
+		dir:      dir,
+		maxFiles: maxFiles,
+		maxBytes: maxBytes,
+		active:   make(map[string]*archivedRun),
+	}, nil
+}
+
+// archivePath returns the path of the archive file of the request with an ID.
+// IDs come from clients when output is followed, so any which could name a file
+// outside the archive's directory are rejected.
+func (a *OutputArchive) archivePath(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) {
+		return "", errInvalidArchiveID
+	}
+	return filepath.Join(a.dir, id+outputLogExtension), nil
+}
+
+// begin starts archiving the output of the request with an ID.
+func (a *OutputArchive) begin(id string) (*archivedRun, error) {
+	path, err := a.archivePath(id)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	run := &archivedRun{
+		archive: a,
+		id:      id,
+		file:    file,
+		changed: make(chan struct{}),
+	}
+
+	a.mutex.Lock()
+	a.active[id] = run
+	a.mutex.Unlock()
+
+	return run, nil
+}
+
+// Write appends output to the run's archive, waking those following it.
+func (r *archivedRun) Write(p []byte) (int, error) {
+	n, err := r.file.Write(p)
+
+	r.archive.mutex.Lock()
+	defer r.archive.mutex.Unlock()
+
+	r.written += int64(n)
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+	r.notify()
+	return n, err
+}
+
+// notify wakes those following the run's output. Must be called with the
+// archive's mutex held.
+func (r *archivedRun) notify() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// finish completes the run's archive once the run has completed with res, which
+// is nil if the run failed. If none of the run's output was streamed, such as
+// for a result replayed from an earlier request, the output in its response is
+// archived instead. It returns the first error which occurred writing the
+// archive.
+func (r *archivedRun) finish(res *RunResponse) error {
+	r.archive.mutex.Lock()
+	written := r.written
+	r.archive.mutex.Unlock()
+
+	if written == 0 && res != nil && len(res.Output) > 0 {
+		r.Write(res.Output)
+	}
+
+	closeErr := r.file.Close()
+
+	r.archive.mutex.Lock()
+	delete(r.archive.active, r.id)
+	r.notify()
+	err := r.err
+	r.archive.mutex.Unlock()
+
+	if err == nil {
+		err = closeErr
+	}
+	if pruneErr := r.archive.prune(); err == nil {
+		err = pruneErr
+	}
+	return err
+}
+
+// prune removes the oldest archives of completed runs until the archive is
+// within its limits.
+func (a *OutputArchive) prune() error {
+	a.pruneMutex.Lock()
+	defer a.pruneMutex.Unlock()
+
+	return pruneLogFiles(a.dir, a.maxFiles, a.maxBytes, func(name string) bool {
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
+		_, active := a.active[strings.TrimSuffix(name, outputLogExtension)]
+		return active
+	})
+}
+
+// Follow passes the archived output of the request with an ID to send, in the
+// order in which it was written. If the request is still running, its output
+// is passed on as it is produced until the request completes or ctx is done.
+// errArchiveNotFound is returned if the request's output is not archived, such
+// as if it has been pruned. send must not retain the slices passed to it.
+func (a *OutputArchive) Follow(
+	ctx context.Context,
+	id string,
+	send func([]byte) error,
+) error {
+	path, err := a.archivePath(id)
+	if err != nil {
+		return errArchiveNotFound
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return errArchiveNotFound
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	buf := make([]byte, archiveReadSize)
+	for {
+		// Whether the run is active is checked before reading, so that
+		// output written after a read reaches the end of the file wakes
+		// the wait for more.
+		a.mutex.Lock()
+		var changed chan struct{}
+		if run, ok := a.active[id]; ok {
+			changed = run.changed
+		}
+		a.mutex.Unlock()
+
+		n, err := file.Read(buf)
+		if n > 0 {
+			if err := send(buf[:n]); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		// Once the run has completed, all of its output has been read.
+		if changed == nil {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// detachedContext is a context which carries the values of its parent, such as
+// the peer of an RPC, but is never done, so that a run can outlive the RPC which
+// requested it.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
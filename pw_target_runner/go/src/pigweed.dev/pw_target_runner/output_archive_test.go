@@ -0,0 +1,97 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestOutputArchiveFollow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pw_target_runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive, err := NewOutputArchive(dir, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	follow := func(id string) (string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		var got bytes.Buffer
+		err := archive.Follow(ctx, id, func(data []byte) error {
+			got.Write(data)
+			return nil
+		})
+		return got.String(), err
+	}
+
+	run, err := archive.begin("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run.Write([]byte("first\n"))
+
+	// A follower which starts while the run is in progress receives the
+	// output written before and after it started, until the run completes.
+	followed := make(chan string, 1)
+	go func() {
+		output, err := follow("a")
+		if err != nil {
+			t.Errorf("Failed to follow running request: %v", err)
+		}
+		followed <- output
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	run.Write([]byte("second\n"))
+	if err := run.finish(&RunResponse{}); err != nil {
+		t.Fatalf("Failed to finish archive: %v", err)
+	}
+
+	if output := <-followed; output != "first\nsecond\n" {
+		t.Errorf("Followed %q; want %q", output, "first\nsecond\n")
+	}
+	if output, err := follow("a"); err != nil || output != "first\nsecond\n" {
+		t.Errorf("Got %q, %v after completion; want the full output", output, err)
+	}
+
+	// A run whose output was not streamed has that of its response archived.
+	// Once it completes, the older archive is pruned.
+	run, err = archive.begin("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run.finish(&RunResponse{Output: []byte("replayed\n")})
+	if output, err := follow("b"); err != nil || output != "replayed\n" {
+		t.Errorf("Got %q, %v; want the response's output", output, err)
+	}
+	if _, err := follow("a"); err != errArchiveNotFound {
+		t.Errorf("Got error %v following pruned archive; want errArchiveNotFound", err)
+	}
+
+	if _, err := follow("../b"); err != errArchiveNotFound {
+		t.Errorf("Got error %v following invalid ID; want errArchiveNotFound", err)
+	}
+}
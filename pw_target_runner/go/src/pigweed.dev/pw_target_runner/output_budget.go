@@ -0,0 +1,168 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"context"
+	"sync"
+)
+
+// OutputBudgetMode selects what happens to output captured while a worker
+// pool's output budget is exhausted.
+type OutputBudgetMode int
+
+const (
+	// OutputBudgetTruncate drops output which does not fit in the budget,
+	// truncating the run's output.
+	OutputBudgetTruncate OutputBudgetMode = iota
+
+	// OutputBudgetBlock stops reading a run's output until other runs
+	// complete and release their share of the budget. As this could leave
+	// every run waiting on the others, output is truncated instead if no
+	// run holding part of the budget is able to make progress.
+	OutputBudgetBlock
+)
+
+// outputBudget limits the total number of bytes of output held in memory by the
+// runs of a worker pool. Each run takes its share through an outputReservation.
+type outputBudget struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+	limit int64
+	used  int64
+	mode  OutputBudgetMode
+
+	// Number of reservations holding part of the budget, and how many of
+	// those are waiting for more.
+	holders        int
+	waitingHolders int
+}
+
+func newOutputBudget(limit int64, mode OutputBudgetMode) *outputBudget {
+	b := &outputBudget{limit: limit, mode: mode}
+	b.cond = sync.NewCond(&b.mutex)
+	return b
+}
+
+// reserve creates a reservation against the budget for a request. Waits for
+// budget are abandoned once the request's context is done.
+func (b *outputBudget) reserve(ctx context.Context) *outputReservation {
+	return &outputReservation{budget: b, ctx: ctx}
+}
+
+// outputReservation is a single run's share of an outputBudget. A nil
+// reservation places no limit on output.
+type outputReservation struct {
+	budget *outputBudget
+	ctx    context.Context
+	held   int64
+}
+
+// acquire takes up to n bytes of the budget for the reservation, returning the
+// number of bytes granted. Fewer than n bytes are only granted once the budget
+// is exhausted.
+func (r *outputReservation) acquire(n int64) int64 {
+	if r == nil {
+		return n
+	}
+
+	b := r.budget
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for b.limit-b.used < n && b.mode == OutputBudgetBlock && r.canWait() {
+		r.wait()
+	}
+
+	granted := b.limit - b.used
+	if granted > n {
+		granted = n
+	}
+	if granted <= 0 {
+		return 0
+	}
+
+	if r.held == 0 {
+		b.holders++
+	}
+	r.held += granted
+	b.used += granted
+	return granted
+}
+
+// canWait returns whether the reservation may wait for budget to be released:
+// its request must still be active, and some other holder of the budget must be
+// running rather than waiting itself. Must be called with the budget's mutex
+// held.
+func (r *outputReservation) canWait() bool {
+	if r.ctx.Err() != nil {
+		return false
+	}
+
+	others := r.budget.holders - r.budget.waitingHolders
+	if r.held > 0 {
+		others--
+	}
+	return others > 0
+}
+
+// wait blocks until the budget changes or the reservation's request is done.
+// Must be called with the budget's mutex held.
+func (r *outputReservation) wait() {
+	b := r.budget
+
+	// A holder starting to wait may leave those already waiting with no
+	// one to wait on, so they are woken to check.
+	if r.held > 0 {
+		b.waitingHolders++
+		b.cond.Broadcast()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-r.ctx.Done():
+			b.mutex.Lock()
+			b.cond.Broadcast()
+			b.mutex.Unlock()
+		case <-done:
+		}
+	}()
+
+	b.cond.Wait()
+	close(done)
+
+	if r.held > 0 {
+		b.waitingHolders--
+	}
+}
+
+// release returns the reservation's share of the budget.
+func (r *outputReservation) release() {
+	if r == nil {
+		return
+	}
+
+	b := r.budget
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if r.held > 0 {
+		b.used -= r.held
+		b.holders--
+		r.held = 0
+		b.cond.Broadcast()
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// outputCapture is an io.Writer which collects the output of a command.
+type outputCapture interface {
+	io.Writer
+
+	// output returns the collected output once the command has exited.
+	// Depending on the capture, less of the output may be kept for
+	// commands which succeeded.
+	output(succeeded bool) (*capturedOutput, error)
+}
+
+// capturedOutput is the output collected from a command.
+type capturedOutput struct {
+	data []byte
+
+	// Number of bytes dropped from the start of the output.
+	dropped int64
+
+	// Whether bytes were dropped from the end of the output.
+	truncated bool
+
+	// Whether bytes were dropped from the end of the output because the
+	// worker pool's output budget was exhausted.
+	overBudget bool
+}
+
+// discardOutput is an outputCapture for commands whose output is not captured.
+type discardOutput struct{}
+
+func (discardOutput) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// output returns empty output. Part of outputCapture interface.
+func (discardOutput) output(succeeded bool) (*capturedOutput, error) {
+	return &capturedOutput{}, nil
+}
+
+// boundedBuffer is an io.Writer which stores up to max bytes written to it and
+// silently discards the rest. A max of zero places no limit on its size. If the
+// buffer has a budget, bytes are also discarded once the budget is exhausted.
+type boundedBuffer struct {
+	// Not embedded, as io.Copy would otherwise bypass Write through the
+	// promoted bytes.Buffer.ReadFrom.
+	buf        bytes.Buffer
+	max        int
+	truncated  bool
+	budget     *outputReservation
+	overBudget bool
+}
+
+func (b *boundedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+
+	// Output following dropped bytes is also dropped, so that the kept
+	// output has no gaps.
+	if b.overBudget {
+		return n, nil
+	}
+
+	if b.max > 0 && b.buf.Len()+len(p) > b.max {
+		p = p[:b.max-b.buf.Len()]
+		b.truncated = true
+	}
+
+	if granted := b.budget.acquire(int64(len(p))); granted < int64(len(p)) {
+		p = p[:granted]
+		b.overBudget = true
+	}
+
+	b.buf.Write(p)
+	return n, nil
+}
+
+// Bytes returns the data stored in the buffer.
+func (b *boundedBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+// output returns the data stored in the buffer. Part of outputCapture
+// interface.
+func (b *boundedBuffer) output(succeeded bool) (*capturedOutput, error) {
+	return &capturedOutput{
+		data:       b.Bytes(),
+		truncated:  b.truncated,
+		overBudget: b.overBudget,
+	}, nil
+}
+
+// tailBuffer is an outputCapture which keeps only the end of a command's output
+// in memory, in a fixed-size ring buffer. The full output, up to a maximum size,
+// is written to a temporary file, which is read back only if the command
+// failed. Close must be called to remove the file.
+type tailBuffer struct {
+	ring []byte
+
+	// Position in the ring at which the next byte is written.
+	pos int
+
+	// Number of bytes in the ring which hold output.
+	filled int
+
+	// Total number of bytes written to the buffer.
+	total int64
+
+	spill *boundedFile
+}
+
+// newTailBuffer creates a tailBuffer keeping the last size bytes of output in
+// memory and up to maxSize bytes on disk. A maxSize of zero places no limit on
+// the size of the file.
+func newTailBuffer(size int, maxSize int) (*tailBuffer, error) {
+	file, err := ioutil.TempFile("", "pw_target_runner_output_*")
+	if err != nil {
+		return nil, err
+	}
+
+	return &tailBuffer{
+		ring:  make([]byte, size),
+		spill: &boundedFile{file: file, max: int64(maxSize)},
+	}, nil
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	b.total += int64(n)
+
+	b.spill.Write(p)
+
+	// Only the last len(ring) bytes of a write larger than the ring can
+	// remain in it.
+	if len(p) > len(b.ring) {
+		p = p[len(p)-len(b.ring):]
+	}
+
+	for len(p) > 0 {
+		copied := copy(b.ring[b.pos:], p)
+		b.pos = (b.pos + copied) % len(b.ring)
+		p = p[copied:]
+
+		b.filled += copied
+		if b.filled > len(b.ring) {
+			b.filled = len(b.ring)
+		}
+	}
+
+	return n, nil
+}
+
+// output returns the tail of the output held in memory if the command
+// succeeded, or the full output from the temporary file otherwise. Part of
+// outputCapture interface.
+func (b *tailBuffer) output(succeeded bool) (*capturedOutput, error) {
+	if !succeeded {
+		data, err := b.spill.readAll()
+		if err != nil {
+			return nil, err
+		}
+		return &capturedOutput{data: data, truncated: b.spill.truncated}, nil
+	}
+
+	var tail []byte
+	if b.filled < len(b.ring) {
+		tail = append(tail, b.ring[:b.filled]...)
+	} else {
+		tail = append(tail, b.ring[b.pos:]...)
+		tail = append(tail, b.ring[:b.pos]...)
+	}
+
+	return &capturedOutput{data: tail, dropped: b.total - int64(len(tail))}, nil
+}
+
+// Close removes the buffer's temporary file.
+func (b *tailBuffer) Close() error {
+	b.spill.file.Close()
+	return os.Remove(b.spill.file.Name())
+}
+
+// boundedFile writes up to max bytes to a file, silently discarding the rest.
+// A max of zero places no limit on its size.
+//
+// Writes never fail, so that the command producing the output is never blocked
+// by a full pipe. The first error writing to the file is instead returned when
+// the file is read back.
+type boundedFile struct {
+	file      *os.File
+	max       int64
+	written   int64
+	truncated bool
+	err       error
+}
+
+func (f *boundedFile) Write(p []byte) (int, error) {
+	n := len(p)
+
+	if f.max > 0 && f.written+int64(len(p)) > f.max {
+		p = p[:f.max-f.written]
+		f.truncated = true
+	}
+
+	if f.err == nil {
+		var written int
+		written, f.err = f.file.Write(p)
+		f.written += int64(written)
+	}
+
+	return n, nil
+}
+
+// readAll reads back everything written to the file.
+func (f *boundedFile) readAll() ([]byte, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(f.file)
+}
@@ -0,0 +1,135 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const outputLogExtension = ".log"
+
+// OutputLog is a ResultSink which persists the output of each run to its own
+// file within a directory. The directory is pruned after every write, removing
+// the oldest log files until it is within the configured limits.
+type OutputLog struct {
+	dir      string
+	maxFiles int
+	maxBytes int64
+	mutex    sync.Mutex
+}
+
+// NewOutputLog creates an OutputLog writing to the specified directory,
+// creating it if necessary. maxFiles and maxBytes limit the number and total
+// size of log files kept; a value of zero disables the respective limit.
+func NewOutputLog(dir string, maxFiles int, maxBytes int64) (*OutputLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &OutputLog{dir: dir, maxFiles: maxFiles, maxBytes: maxBytes}, nil
+}
+
+// OnResult saves the output of a successfully processed request. Part of
+// ResultSink interface.
+func (l *OutputLog) OnResult(req *RunRequest, res *RunResponse) error {
+	if res.Err != nil {
+		return nil
+	}
+	return l.Write(req.Path, res.Output)
+}
+
+// Write saves the output of a run of the executable at path to a new file,
+// named after the path and the current time.
+func (l *OutputLog) Write(path string, output []byte) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// Flatten the executable's path into a single file name component so
+	// that identically named executables in different directories do not
+	// collide.
+	name := strings.Trim(filepath.ToSlash(filepath.Clean(path)), "/")
+	name = strings.NewReplacer("/", "_", ":", "_").Replace(name)
+	timestamp := time.Now().Format("20060102T150405.000000")
+	file := fmt.Sprintf("%s.%s%s", name, timestamp, outputLogExtension)
+
+	err := ioutil.WriteFile(filepath.Join(l.dir, file), output, 0644)
+	if err != nil {
+		return err
+	}
+
+	return l.prune()
+}
+
+// prune removes the oldest log files in the directory until the number and
+// total size of the remaining files are within the configured limits.
+func (l *OutputLog) prune() error {
+	return pruneLogFiles(l.dir, l.maxFiles, l.maxBytes, nil)
+}
+
+// pruneLogFiles removes the oldest log files in a directory until the number
+// and total size of the remaining files are within maxFiles and maxBytes, where
+// nonzero. Files for which skip returns true, if it is set, are neither counted
+// nor removed.
+func pruneLogFiles(dir string, maxFiles int, maxBytes int64, skip func(name string) bool) error {
+	if maxFiles <= 0 && maxBytes <= 0 {
+		return nil
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var logs []os.FileInfo
+	var totalBytes int64
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || filepath.Ext(entry.Name()) != outputLogExtension {
+			continue
+		}
+		if skip != nil && skip(entry.Name()) {
+			continue
+		}
+		logs = append(logs, entry)
+		totalBytes += entry.Size()
+	}
+
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i].ModTime().Before(logs[j].ModTime())
+	})
+
+	// The most recent log is always kept, even if it alone exceeds the
+	// size limit.
+	for len(logs) > 1 {
+		tooMany := maxFiles > 0 && len(logs) > maxFiles
+		tooLarge := maxBytes > 0 && totalBytes > maxBytes
+		if !tooMany && !tooLarge {
+			break
+		}
+
+		if err := os.Remove(filepath.Join(dir, logs[0].Name())); err != nil {
+			return err
+		}
+		totalBytes -= logs[0].Size()
+		logs = logs[1:]
+	}
+
+	return nil
+}
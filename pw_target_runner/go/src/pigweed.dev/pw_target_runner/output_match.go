@@ -0,0 +1,97 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"bytes"
+	"regexp"
+
+	pb "pigweed.dev/proto/pw_target_runner/target_runner_pb"
+)
+
+// Longest line of output matched against an ExecDeviceRunner's output patterns.
+// Longer lines are matched in pieces of this size.
+const maxMatchedLineLength = 64 << 10
+
+// outputMatcher is an outputCapture which matches each line of a command's
+// output against success and failure patterns as it is written, passing the
+// output on to another capture.
+type outputMatcher struct {
+	outputCapture
+
+	success *regexp.Regexp
+	failure *regexp.Regexp
+
+	// The line being written, which has not yet been matched.
+	line []byte
+
+	matchedSuccess bool
+	matchedFailure bool
+}
+
+func (m *outputMatcher) Write(p []byte) (int, error) {
+	for rest := p; len(rest) > 0; {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			m.line = append(m.line, rest...)
+			if len(m.line) >= maxMatchedLineLength {
+				m.matchLine()
+			}
+			break
+		}
+
+		m.line = append(m.line, rest[:i]...)
+		m.matchLine()
+		rest = rest[i+1:]
+	}
+
+	return m.outputCapture.Write(p)
+}
+
+// matchLine matches the line being written against the patterns and starts the
+// next one.
+func (m *outputMatcher) matchLine() {
+	// Lines written through a pseudo-terminal end with a carriage return.
+	line := bytes.TrimSuffix(m.line, []byte("\r"))
+	if m.success != nil && m.success.Match(line) {
+		m.matchedSuccess = true
+	}
+	if m.failure != nil && m.failure.Match(line) {
+		m.matchedFailure = true
+	}
+	m.line = m.line[:0]
+}
+
+// status returns the status of a run from the lines of its output which matched,
+// given the status from its command's exit code. A line matching the failure
+// pattern fails the run. Otherwise, if there is a success pattern, the run
+// passes only if a line matched it, whatever its exit code. With only a failure
+// pattern which did not match, the exit code's status stands.
+func (m *outputMatcher) status(exitStatus pb.RunStatus) pb.RunStatus {
+	if len(m.line) > 0 {
+		m.matchLine()
+	}
+
+	switch {
+	case m.matchedFailure:
+		return pb.RunStatus_FAILURE
+	case m.success == nil:
+		return exitStatus
+	case m.matchedSuccess:
+		return pb.RunStatus_SUCCESS
+	default:
+		return pb.RunStatus_FAILURE
+	}
+}
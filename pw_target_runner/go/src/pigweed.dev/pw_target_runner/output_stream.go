@@ -0,0 +1,187 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+// OutputFlushMode selects when streamed output is passed on to its consumer.
+type OutputFlushMode int
+
+const (
+	// FlushHybrid passes output on once a chunk's worth has accumulated, or
+	// once the oldest held output has waited for the flush interval,
+	// whichever comes first.
+	FlushHybrid OutputFlushMode = iota
+
+	// FlushLines passes output on a line at a time. A partial line is held
+	// until it is completed, unless it grows to the chunk size.
+	FlushLines
+
+	// FlushChunks passes output on in chunks of exactly the chunk size,
+	// except for the remainder at the end of the output.
+	FlushChunks
+
+	// FlushInterval passes on all held output once per flush interval.
+	FlushInterval
+)
+
+const (
+	defaultFlushChunkSize = 4096
+	defaultFlushInterval  = 100 * time.Millisecond
+)
+
+// OutputFlushPolicy controls how streamed output is grouped. Smaller chunks and
+// shorter intervals reduce the latency of streamed output at the cost of more
+// overhead per byte. The zero value is a FlushHybrid policy with default
+// limits.
+type OutputFlushPolicy struct {
+	Mode OutputFlushMode
+
+	// Size at which held output is passed on. If zero, 4 KiB is used.
+	ChunkSize int
+
+	// Longest time output is held in the FlushHybrid and FlushInterval
+	// modes. If zero, 100 ms is used.
+	Interval time.Duration
+}
+
+// outputStreamer is an io.Writer which groups the output written to it
+// according to a flush policy, passing each group to a function. It is safe
+// for concurrent use, as output may be flushed from a timer.
+type outputStreamer struct {
+	mutex     sync.Mutex
+	buf       []byte
+	send      func([]byte)
+	mode      OutputFlushMode
+	chunkSize int
+	interval  time.Duration
+	timer     *time.Timer
+}
+
+func newOutputStreamer(send func([]byte), policy OutputFlushPolicy) *outputStreamer {
+	s := &outputStreamer{
+		send:      send,
+		mode:      policy.Mode,
+		chunkSize: policy.ChunkSize,
+		interval:  policy.Interval,
+	}
+	if s.chunkSize <= 0 {
+		s.chunkSize = defaultFlushChunkSize
+	}
+	if s.interval <= 0 {
+		s.interval = defaultFlushInterval
+	}
+	return s
+}
+
+func (s *outputStreamer) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.buf = append(s.buf, p...)
+
+	switch s.mode {
+	case FlushLines:
+		if i := bytes.LastIndexByte(s.buf, '\n'); i >= 0 {
+			s.flush(i + 1)
+		}
+		for len(s.buf) >= s.chunkSize {
+			s.flush(s.chunkSize)
+		}
+	case FlushChunks:
+		for len(s.buf) >= s.chunkSize {
+			s.flush(s.chunkSize)
+		}
+	case FlushInterval:
+		s.startTimer()
+	default:
+		if len(s.buf) >= s.chunkSize {
+			s.flush(len(s.buf))
+		} else {
+			s.startTimer()
+		}
+	}
+
+	return len(p), nil
+}
+
+// startTimer arranges for held output to be flushed after the flush interval,
+// if it is not already scheduled to be. Must be called with the mutex held.
+func (s *outputStreamer) startTimer() {
+	if s.timer != nil || len(s.buf) == 0 {
+		return
+	}
+
+	// A timer which fires as it is stopped still runs, so each checks
+	// that it has not been replaced before flushing.
+	var timer *time.Timer
+	timer = time.AfterFunc(s.interval, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		if s.timer == timer {
+			s.timer = nil
+			s.flush(len(s.buf))
+		}
+	})
+	s.timer = timer
+}
+
+// flush passes the first n bytes of held output on. Must be called with the
+// mutex held, which keeps output in order.
+func (s *outputStreamer) flush(n int) {
+	if n == 0 {
+		return
+	}
+
+	data := s.buf[:n:n]
+	s.buf = append([]byte(nil), s.buf[n:]...)
+	s.send(data)
+
+	// Any output flushed early by size had a timer running for it.
+	if len(s.buf) == 0 && s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+}
+
+// Close passes on any held output. Nothing is passed on after it returns.
+func (s *outputStreamer) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.flush(len(s.buf))
+}
+
+// withOutputStream returns a writer which writes output to w and, if the request
+// streams its output, to its OnOutput function. The returned function passes
+// on any held output, and must be called once the output is complete.
+func withOutputStream(req *RunRequest, w io.Writer) (io.Writer, func()) {
+	if req.OnOutput == nil {
+		return w, func() {}
+	}
+
+	s := newOutputStreamer(req.OnOutput, req.OutputFlush)
+	return io.MultiWriter(w, s), s.Close
+}
@@ -0,0 +1,116 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// setProcessGroup configures a command to run in a process group of its own,
+// which the processes it spawns inherit, so that any left running once it
+// exits can be found by reapProcessGroup.
+func setProcessGroup(cmd *exec.Cmd, usePty bool) {
+	// Commands attached to a pseudo-terminal start a new session, which
+	// already places them in their own process group. A session leader
+	// cannot also change its process group.
+	if usePty {
+		return
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// killProcessTree kills a command with SIGKILL. If the command leads a process
+// group of its own, the processes it spawned are killed with it.
+func killProcessTree(cmd *exec.Cmd) {
+	attr := cmd.SysProcAttr
+	if attr != nil && (attr.Setpgid || attr.Setsid) {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.Process.Kill()
+}
+
+// reapProcessGroup kills any processes remaining in a process group after its
+// leader has exited, returning how many there were. Processes are found by
+// scanning /proc. Processes which moved to another process group or session
+// are not found.
+func reapProcessGroup(pgid int) (int, error) {
+	proc, err := os.Open("/proc")
+	if err != nil {
+		return 0, err
+	}
+	names, err := proc.Readdirnames(-1)
+	proc.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	leaked := 0
+	for _, name := range names {
+		pid, err := strconv.Atoi(name)
+		if err != nil {
+			continue
+		}
+
+		// Processes may exit while the directory is being scanned.
+		stat, err := ioutil.ReadFile("/proc/" + name + "/stat")
+		if err != nil {
+			continue
+		}
+
+		state, group, ok := parseProcStat(string(stat))
+		if ok && group == pgid && pid != pgid && state != "Z" {
+			leaked++
+		}
+	}
+
+	if leaked > 0 {
+		if err := syscall.Kill(-pgid, syscall.SIGKILL); err != nil &&
+			err != syscall.ESRCH {
+			return leaked, err
+		}
+	}
+	return leaked, nil
+}
+
+// parseProcStat extracts the state and process group of a process from the
+// contents of its /proc/<pid>/stat file. The process's name is enclosed in
+// parentheses and may contain spaces, so fields are counted from its end.
+func parseProcStat(stat string) (string, int, bool) {
+	end := strings.LastIndex(stat, ")")
+	if end < 0 {
+		return "", 0, false
+	}
+
+	// The fields following the name are the state, parent ID, and group ID.
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 3 {
+		return "", 0, false
+	}
+
+	group, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return "", 0, false
+	}
+	return fields[0], group, true
+}
@@ -0,0 +1,40 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+//go:build !linux
+// +build !linux
+
+package pw_target_runner
+
+import (
+	"errors"
+	"os/exec"
+)
+
+var errLeakDetectionUnsupported = errors.New(
+	"Detecting leaked processes is only supported on Linux")
+
+// setProcessGroup does nothing on platforms without leaked process detection.
+func setProcessGroup(cmd *exec.Cmd, usePty bool) {}
+
+// killProcessTree kills a command. The processes it spawned are not found on
+// this platform.
+func killProcessTree(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
+
+// reapProcessGroup is unsupported on this platform.
+func reapProcessGroup(pgid int) (int, error) {
+	return 0, errLeakDetectionUnsupported
+}
@@ -0,0 +1,83 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listProcessMemory returns the memory used by every running process, found by
+// scanning /proc.
+func listProcessMemory() (map[int]processMemory, error) {
+	proc, err := os.Open("/proc")
+	if err != nil {
+		return nil, err
+	}
+	names, err := proc.Readdirnames(-1)
+	proc.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	pageSize := int64(os.Getpagesize())
+	processes := make(map[int]processMemory)
+	for _, name := range names {
+		pid, err := strconv.Atoi(name)
+		if err != nil {
+			continue
+		}
+
+		// Processes may exit while the directory is being scanned.
+		stat, err := ioutil.ReadFile("/proc/" + name + "/stat")
+		if err != nil {
+			continue
+		}
+
+		if parent, pages, ok := parseProcStatMemory(string(stat)); ok {
+			processes[pid] = processMemory{parent: parent, rssBytes: pages * pageSize}
+		}
+	}
+	return processes, nil
+}
+
+// parseProcStatMemory extracts the parent and resident set size, in pages, of a
+// process from the contents of its /proc/<pid>/stat file. As in parseProcStat,
+// fields are counted from the end of the process's name.
+func parseProcStatMemory(stat string) (int, int64, bool) {
+	end := strings.LastIndex(stat, ")")
+	if end < 0 {
+		return 0, 0, false
+	}
+
+	// The parent ID is the second field following the name, and the
+	// resident set size the twenty-second.
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 22 {
+		return 0, 0, false
+	}
+
+	parent, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, 0, false
+	}
+	pages, err := strconv.ParseInt(fields[21], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return parent, pages, true
+}
@@ -0,0 +1,58 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+//go:build !linux
+// +build !linux
+
+package pw_target_runner
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// listProcessMemory returns the memory used by every running process, as listed
+// by ps. Hosts without a POSIX ps, such as Windows, are unsupported.
+func listProcessMemory() (map[int]processMemory, error) {
+	out, err := exec.Command("ps", "-A", "-o", "pid=", "-o", "ppid=", "-o", "rss=").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	processes := make(map[int]processMemory)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		parent, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+
+		// ps reports resident set sizes in kilobytes.
+		rss, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		processes[pid] = processMemory{parent: parent, rssBytes: rss * 1024}
+	}
+	return processes, nil
+}
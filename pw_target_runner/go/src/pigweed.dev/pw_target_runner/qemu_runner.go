@@ -0,0 +1,202 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+
+	pb "pigweed.dev/proto/pw_target_runner/target_runner_pb"
+)
+
+// QemuDeviceRunner is a struct that implements the DeviceRunner interface,
+// running firmware images in QEMU. Each image is loaded as the kernel of an
+// emulated machine with semihosting enabled. An image reports its result by
+// exiting through semihosting, which makes QEMU exit with the image's exit
+// code. The machine's serial port is connected to QEMU's output, which is
+// returned as the run output.
+type QemuDeviceRunner struct {
+	qemu          string
+	machine       string
+	cpu           string
+	args          []string
+	timeout       time.Duration
+	maxOutputSize int
+	logger        *log.Logger
+}
+
+// NewQemuDeviceRunner creates a QemuDeviceRunner which runs images on the
+// specified machine through a QEMU program, e.g. "qemu-system-arm".
+func NewQemuDeviceRunner(id int, qemu string, machine string) *QemuDeviceRunner {
+	return &QemuDeviceRunner{
+		qemu:          qemu,
+		machine:       machine,
+		maxOutputSize: defaultMaxOutputSize,
+		logger:        newLogger(fmt.Sprintf("QemuDeviceRunner %d", id)),
+	}
+}
+
+// SetCPU sets the CPU to emulate. If unset, the machine's default CPU is used.
+func (r *QemuDeviceRunner) SetCPU(cpu string) {
+	r.cpu = cpu
+}
+
+// SetArgs sets additional arguments passed to QEMU before the image.
+func (r *QemuDeviceRunner) SetArgs(args []string) {
+	r.args = args
+}
+
+// SetTimeout sets how long an image may run before QEMU is killed and the run
+// times out. This catches images which hang without exiting through semihosting. A
+// timeout of zero, the default, lets images run until the request is done.
+func (r *QemuDeviceRunner) SetTimeout(timeout time.Duration) {
+	r.timeout = timeout
+}
+
+// SetMaxOutputSize sets the maximum number of bytes of output kept from each
+// run. A size of zero disables the limit.
+func (r *QemuDeviceRunner) SetMaxOutputSize(size int) {
+	r.maxOutputSize = size
+}
+
+// WorkerStart starts the worker. Part of DeviceRunner interface.
+func (r *QemuDeviceRunner) WorkerStart() error {
+	r.logger.Printf("Starting worker")
+	return nil
+}
+
+// WorkerExit exits the worker. Part of DeviceRunner interface.
+func (r *QemuDeviceRunner) WorkerExit() {
+	r.logger.Printf("Exiting worker")
+}
+
+// HandleRunRequest runs a requested image in QEMU. The request's arguments are
+// passed to the image through semihosting, following the image's path. Part of
+// DeviceRunner interface.
+func (r *QemuDeviceRunner) HandleRunRequest(req *RunRequest) *RunResponse {
+	res := &RunResponse{}
+
+	if req.CaseFilter != "" {
+		res.Err = errCaseFilterUnsupported
+		return res
+	}
+	if req.FailFast {
+		res.Err = errFailFastUnsupported
+		return res
+	}
+	if req.ExpectedStatus != pb.RunStatus_PENDING {
+		res.Err = errExpectedStatusUnsupported
+		return res
+	}
+
+	r.logger.Printf("[%s] Running image %s on %s\n", req.ID, req.Path, r.machine)
+
+	ctx := req.Context()
+	runCtx := ctx
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(runCtx, r.qemu, r.qemuArgs(req)...)
+	output := &boundedBuffer{max: r.maxOutputSize, budget: req.outputBudget}
+	var err error
+	if req.DiscardOutput {
+		err = cmd.Run()
+	} else {
+		stream, flush := withOutputStream(req, output)
+		err = runCommand(cmd, stream, false)
+		flush()
+	}
+
+	if ctx.Err() != nil {
+		r.logger.Printf("[%s] Request cancelled; QEMU killed\n", req.ID)
+		res.Err = ctx.Err()
+		return res
+	}
+
+	res.Output = output.Bytes()
+	if output.truncated {
+		res.Output = append(res.Output, "\n[output truncated]\n"...)
+	}
+	if output.overBudget {
+		r.logger.Printf("[%s] Server output budget exhausted; truncating\n", req.ID)
+		res.Output = append(
+			res.Output, "\n[output truncated: server output budget exhausted]\n"...)
+	}
+
+	if runCtx.Err() == context.DeadlineExceeded {
+		r.logger.Printf(
+			"[%s] Image timed out after %v; QEMU killed\n", req.ID, r.timeout)
+		marker := fmt.Sprintf("\n[timed out after %v]\n", r.timeout)
+		res.Output = append(res.Output, marker...)
+		res.Status = pb.RunStatus_TIMEOUT
+		return res
+	}
+
+	if e, ok := err.(*exec.ExitError); ok {
+		r.logger.Printf("[%s] Image exited with status %d\n", req.ID, e.ExitCode())
+	}
+
+	res.Status, res.Err = semihostingStatus(err)
+	if res.Err != nil {
+		r.logger.Printf("[%s] QEMU failed: %v\n", req.ID, res.Err)
+	}
+
+	return res
+}
+
+// qemuArgs builds the arguments to QEMU which run a request's image.
+func (r *QemuDeviceRunner) qemuArgs(req *RunRequest) []string {
+	args := []string{"-machine", r.machine}
+	if r.cpu != "" {
+		args = append(args, "-cpu", r.cpu)
+	}
+
+	// The image's argv is passed through semihosting. Commas separate
+	// suboptions, so any within the arguments are escaped by doubling them.
+	semihosting := []string{"enable=on", "target=native"}
+	for _, arg := range append([]string{req.Path}, req.Args...) {
+		semihosting = append(semihosting, "arg="+strings.ReplaceAll(arg, ",", ",,"))
+	}
+
+	args = append(
+		args,
+		"-display", "none",
+		"-monitor", "none",
+		"-serial", "stdio",
+		"-semihosting-config", strings.Join(semihosting, ","))
+	args = append(args, r.args...)
+	return append(args, "-kernel", req.Path)
+}
+
+// semihostingStatus converts the result of running QEMU to the status of the
+// image it ran. QEMU exits with the code the image passed to the semihosting
+// exit call, so a zero exit status indicates success and any other a failure.
+// An error is returned if QEMU could not be run at all.
+func semihostingStatus(err error) (pb.RunStatus, error) {
+	if err == nil {
+		return pb.RunStatus_SUCCESS, nil
+	}
+	if _, ok := err.(*exec.ExitError); ok {
+		return pb.RunStatus_FAILURE, nil
+	}
+	return pb.RunStatus_PENDING, err
+}
@@ -0,0 +1,123 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"errors"
+	"time"
+)
+
+var errInvalidQuarantine = errors.New("Quarantine threshold must be positive")
+
+// EnableQuarantine has the pool quarantine a worker whose runner returns an
+// error, rather than a result, for threshold consecutive requests, such as one
+// whose board has dropped off the bus. A quarantined worker is given no further
+// requests; if every worker is quarantined, new requests are rejected as they
+// are when no worker is healthy. Requests which are abandoned do not count.
+//
+// If probeInterval is nonzero, each quarantined worker is probed that often to
+// see whether it has recovered: it is released once its health check passes,
+// or after the first interval if it does not implement HealthChecker. Released
+// workers are on probation, so that a single further error quarantines them
+// again, until they complete a request without one. Without probes, workers
+// stay quarantined until the pool is restarted. This cannot be done while the
+// pool is processing requests.
+func (p *WorkerPool) EnableQuarantine(threshold int, probeInterval time.Duration) error {
+	if p.Active() {
+		return errWorkerPoolActive
+	}
+	if threshold <= 0 {
+		return errInvalidQuarantine
+	}
+	p.quarantineThreshold = threshold
+	p.quarantineProbeInterval = probeInterval
+	return nil
+}
+
+// recordOutcome counts a worker's consecutive errors with the response to a
+// request it ran, quarantining it if it reaches the pool's threshold. Requests
+// which the worker does not support are not held against it. It returns
+// whether the worker was quarantined.
+func (p *WorkerPool) recordOutcome(w *workerState, req *RunRequest, res *RunResponse) bool {
+	if p.quarantineThreshold == 0 {
+		return false
+	}
+
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+
+	if res.Err == nil {
+		w.consecutiveErrors = 0
+		return false
+	}
+	if req.Context().Err() != nil || isUnsupported(res.Err) {
+		return false
+	}
+
+	w.consecutiveErrors++
+	if w.quarantined || w.consecutiveErrors < p.quarantineThreshold {
+		return false
+	}
+
+	p.logger.Printf(
+		"Quarantining worker %d after %d consecutive errors; last: %v\n",
+		w.id,
+		w.consecutiveErrors,
+		res.Err)
+	w.quarantined = true
+	return true
+}
+
+// isUnsupported returns whether an error is that of a request for a feature
+// which a worker's runner does not support, rather than a failure of the worker.
+func isUnsupported(err error) bool {
+	switch err {
+	case errCaseListingUnsupported,
+		errCaseFilterUnsupported,
+		errFailFastUnsupported,
+		errExpectedStatusUnsupported,
+		errSessionsUnsupported:
+		return true
+	}
+	return false
+}
+
+// probeQuarantined checks whether a quarantined worker has recovered, releasing
+// it on probation if so. checker is nil for workers which do not implement
+// HealthChecker.
+func (p *WorkerPool) probeQuarantined(w *workerState, checker HealthChecker) {
+	if checker != nil {
+		if err := checker.HealthCheck(); err != nil {
+			p.logger.Printf("Quarantined worker %d failed probe: %v\n", w.id, err)
+			return
+		}
+	}
+
+	p.stateMutex.Lock()
+	w.quarantined = false
+	w.consecutiveErrors = p.quarantineThreshold - 1
+	p.stateMutex.Unlock()
+
+	p.logger.Printf("Releasing worker %d from quarantine on probation\n", w.id)
+
+	p.wakeDispatcher()
+}
+
+// isQuarantined returns whether a worker is quarantined.
+func (p *WorkerPool) isQuarantined(w *workerState) bool {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	return w.quarantined
+}
@@ -0,0 +1,67 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"context"
+	"log"
+	"runtime/debug"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// unaryRecoveryInterceptor recovers from panics in unary RPC handlers, logging
+// the panic and failing the RPC with codes.Internal rather than letting the
+// panic take down the server. Panics in goroutines the handler starts, such as
+// those of the worker pool, are not recovered.
+func unaryRecoveryInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (res interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = handlerPanicError(info.FullMethod, r)
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// streamRecoveryInterceptor recovers from panics in streaming RPC handlers, as
+// unaryRecoveryInterceptor does for unary ones.
+func streamRecoveryInterceptor(
+	srv interface{},
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = handlerPanicError(info.FullMethod, r)
+		}
+	}()
+	return handler(srv, stream)
+}
+
+// handlerPanicError logs a panic recovered from the handler of an RPC, with the
+// stack at which it occurred, and returns the error with which the RPC fails.
+// Must be called from the deferred function which recovered the panic.
+func handlerPanicError(method string, r interface{}) error {
+	log.Printf("Handler for %s panicked: %v\n%s", method, r, debug.Stack())
+	return status.Error(codes.Internal, "Internal server error")
+}
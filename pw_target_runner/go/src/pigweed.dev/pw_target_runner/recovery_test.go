@@ -0,0 +1,93 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// panickingHealthServer is a health service whose handlers panic, standing in
+// for a buggy RPC handler.
+type panickingHealthServer struct {
+	healthpb.UnimplementedHealthServer
+}
+
+func (panickingHealthServer) Check(
+	context.Context,
+	*healthpb.HealthCheckRequest,
+) (*healthpb.HealthCheckResponse, error) {
+	panic("check failed unexpectedly")
+}
+
+func (panickingHealthServer) Watch(
+	*healthpb.HealthCheckRequest,
+	healthpb.Health_WatchServer,
+) error {
+	panic("watch failed unexpectedly")
+}
+
+func TestHandlerPanicsAreRecovered(t *testing.T) {
+	// The recovered panics' stacks are logged.
+	out := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(out)
+
+	grpcServer := grpc.NewServer(NewServer().serverOptions()...)
+	healthpb.RegisterHealthServer(grpcServer, panickingHealthServer{})
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The server keeps serving after each panic.
+	for i := 0; i < 2; i++ {
+		_, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+		if code := status.Code(err); code != codes.Internal {
+			t.Errorf("Check returned %v; want %v", code, codes.Internal)
+		}
+
+		stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+		if err != nil {
+			t.Fatalf("Failed to start Watch: %v", err)
+		}
+		_, err = stream.Recv()
+		if code := status.Code(err); code != codes.Internal {
+			t.Errorf("Watch returned %v; want %v", code, codes.Internal)
+		}
+	}
+}
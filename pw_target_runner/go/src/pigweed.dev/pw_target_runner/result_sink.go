@@ -0,0 +1,129 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	pb "pigweed.dev/proto/pw_target_runner/target_runner_pb"
+)
+
+// ResultSink receives the result of every request processed by a worker pool,
+// for example to persist it. Sinks are invoked by the pool as soon as a request
+// completes, regardless of whether its requester is still waiting for it.
+type ResultSink interface {
+	// OnResult is called with each processed request and its response.
+	// It is called from worker goroutines, so it must be safe to call
+	// concurrently.
+	OnResult(*RunRequest, *RunResponse) error
+}
+
+// JSONLinesSink is a ResultSink which appends each result to a file as a
+// single line of JSON.
+type JSONLinesSink struct {
+	file  *os.File
+	mutex sync.Mutex
+}
+
+// jsonResult is the structure of each line written by a JSONLinesSink.
+type jsonResult struct {
+	Time           time.Time         `json:"time"`
+	RequestID      string            `json:"request_id"`
+	Path           string            `json:"path"`
+	Args           []string          `json:"args,omitempty"`
+	Case           string            `json:"case,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	Status         string            `json:"status,omitempty"`
+	Actual         string            `json:"actual_status,omitempty"`
+	QueueTimeNs    int64             `json:"queue_time_ns"`
+	RunTimeNs      int64             `json:"run_time_ns"`
+	Output         string            `json:"output,omitempty"`
+	Leaked         int               `json:"leaked_processes,omitempty"`
+	MaxRSSBytes    int64             `json:"max_rss_bytes,omitempty"`
+	UserCPUNs      int64             `json:"user_cpu_ns,omitempty"`
+	SysCPUNs       int64             `json:"sys_cpu_ns,omitempty"`
+	Attempts       []string          `json:"attempts,omitempty"`
+	CoreDumps      []string          `json:"core_dumps,omitempty"`
+	SoakIterations int               `json:"soak_iterations,omitempty"`
+	SoakFailedAt   int               `json:"soak_failed_iteration,omitempty"`
+	BaselineNs     int64             `json:"baseline_run_time_ns,omitempty"`
+	Error          string            `json:"error,omitempty"`
+}
+
+// NewJSONLinesSink creates a JSONLinesSink which appends to the file at path,
+// creating it if it does not exist.
+func NewJSONLinesSink(path string) (*JSONLinesSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONLinesSink{file: file}, nil
+}
+
+// OnResult writes a result to the sink's file. Part of ResultSink interface.
+func (s *JSONLinesSink) OnResult(req *RunRequest, res *RunResponse) error {
+	result := jsonResult{
+		Time:        time.Now(),
+		RequestID:   res.RequestID,
+		Path:        req.Path,
+		Args:        req.Args,
+		Case:        req.CaseFilter,
+		Labels:      req.Labels,
+		QueueTimeNs: int64(res.QueueTime),
+		RunTimeNs:   int64(res.RunTime),
+	}
+
+	if res.Err != nil {
+		result.Error = res.Err.Error()
+	} else {
+		result.Status = res.Status.String()
+		if req.ExpectedStatus != pb.RunStatus_PENDING {
+			result.Actual = res.ActualStatus.String()
+		}
+		result.Output = string(res.Output)
+		result.Leaked = res.LeakedProcesses
+		result.MaxRSSBytes = res.MaxRSSBytes
+		result.UserCPUNs = int64(res.UserCPUTime)
+		result.SysCPUNs = int64(res.SystemCPUTime)
+		result.CoreDumps = res.CoreDumps
+		result.SoakIterations = res.SoakIterations
+		result.SoakFailedAt = res.SoakFailedIteration
+		result.BaselineNs = int64(res.BaselineRunTime)
+		for _, attempt := range res.Attempts {
+			result.Attempts = append(result.Attempts, attempt.String())
+		}
+	}
+
+	line, err := json.Marshal(&result)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the sink's file.
+func (s *JSONLinesSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.file.Close()
+}
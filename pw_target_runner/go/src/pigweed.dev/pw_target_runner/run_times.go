@@ -0,0 +1,114 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+var errInvalidRunTimeTracking = errors.New(
+	"Run time tracking requires a positive size and a smoothing factor in (0, 1]")
+
+// runTimeTracker keeps an exponential moving average of the run times of
+// executables. Averages are kept for a bounded number of executables; once it
+// is full, the least recently run executable's average is dropped.
+type runTimeTracker struct {
+	mutex     sync.Mutex
+	size      int
+	smoothing float64
+
+	// Averages by key, and the list holding them, ordered from the most to
+	// the least recently run.
+	averages map[string]*list.Element
+	order    *list.List
+}
+
+// runTimeAverage is the moving average of an executable's run times.
+type runTimeAverage struct {
+	key     string
+	average time.Duration
+}
+
+func newRunTimeTracker(size int, smoothing float64) *runTimeTracker {
+	return &runTimeTracker{
+		size:      size,
+		smoothing: smoothing,
+		averages:  make(map[string]*list.Element),
+		order:     list.New(),
+	}
+}
+
+// runTimeKey identifies an executable for run time tracking. Each test case of
+// an executable, and each set of arguments it is run with, is tracked
+// separately, as they may take very different times. Arguments cannot contain
+// NUL bytes, so they are separated by them.
+func runTimeKey(req *RunRequest) string {
+	key := req.Path + "\x00" + req.CaseFilter
+	for _, arg := range req.Args {
+		key += "\x00" + arg
+	}
+	return key
+}
+
+// observe returns the average run time of an executable before a new run, or
+// zero if it has none. If record is set, the run's time is then added to the
+// average; runs which did not succeed are not recorded, as they may have ended
+// early.
+func (t *runTimeTracker) observe(key string, runTime time.Duration, record bool) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	elem, ok := t.averages[key]
+	if !ok {
+		if record {
+			t.insert(key, runTime)
+		}
+		return 0
+	}
+
+	t.order.MoveToFront(elem)
+	avg := elem.Value.(*runTimeAverage)
+	baseline := avg.average
+	if record {
+		avg.average += time.Duration(t.smoothing * float64(runTime-avg.average))
+	}
+	return baseline
+}
+
+// average returns the average run time of an executable, or zero if it has
+// none, without recording a run.
+func (t *runTimeTracker) average(key string) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if elem, ok := t.averages[key]; ok {
+		return elem.Value.(*runTimeAverage).average
+	}
+	return 0
+}
+
+// insert starts tracking an executable, evicting the least recently run one if
+// the tracker is full.
+func (t *runTimeTracker) insert(key string, runTime time.Duration) {
+	if t.order.Len() >= t.size {
+		oldest := t.order.Back()
+		t.order.Remove(oldest)
+		delete(t.averages, oldest.Value.(*runTimeAverage).key)
+	}
+	t.averages[key] = t.order.PushFront(&runTimeAverage{key: key, average: runTime})
+}
@@ -0,0 +1,69 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRunTimeTracker(t *testing.T) {
+	tracker := newRunTimeTracker(2, 0.5)
+
+	steps := []struct {
+		key      string
+		runTime  time.Duration
+		record   bool
+		baseline time.Duration
+	}{
+		{"a", 100 * time.Millisecond, true, 0},
+		{"a", 200 * time.Millisecond, true, 100 * time.Millisecond},
+		{"a", 900 * time.Millisecond, false, 150 * time.Millisecond},
+		{"a", 50 * time.Millisecond, true, 150 * time.Millisecond},
+		{"b", 10 * time.Millisecond, true, 0},
+		{"a", 100 * time.Millisecond, true, 100 * time.Millisecond},
+
+		// "b" is now the least recently run, so it is evicted.
+		{"c", 10 * time.Millisecond, true, 0},
+		{"b", 10 * time.Millisecond, true, 0},
+		{"a", 100 * time.Millisecond, false, 0},
+	}
+
+	for i, step := range steps {
+		got := tracker.observe(step.key, step.runTime, step.record)
+		if got != step.baseline {
+			t.Errorf("Step %d (%s): got baseline %v; want %v", i, step.key, got, step.baseline)
+		}
+	}
+}
+
+func TestRunTimeKey(t *testing.T) {
+	reqs := []*RunRequest{
+		{Path: "/test/a"},
+		{Path: "/test/a", CaseFilter: "Suite.Case"},
+		{Path: "/test/a", Args: []string{"--size=small"}},
+		{Path: "/test/a", Args: []string{"--size=large"}},
+		{Path: "/test/a", Args: []string{"--size=small", "--fast"}},
+	}
+
+	keys := make(map[string]int)
+	for i, req := range reqs {
+		key := runTimeKey(req)
+		if j, ok := keys[key]; ok {
+			t.Errorf("Requests %d and %d share the run time key %q", j, i, key)
+		}
+		keys[key] = i
+	}
+}
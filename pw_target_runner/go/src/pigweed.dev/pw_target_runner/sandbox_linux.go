@@ -0,0 +1,86 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// runSandbox is a directory created for a single run, which its command uses as
+// its working directory.
+type runSandbox struct {
+	// Temporary directory holding all of the sandbox's files.
+	root string
+
+	// The command's working directory: the overlay mount if the sandbox has
+	// a base, or otherwise the root.
+	dir     string
+	mounted bool
+}
+
+// createSandbox creates a sandbox directory. If base is not empty, the
+// directory is an overlay mount of base, whose files can be read and modified
+// in the sandbox without changing base itself. Otherwise, it is empty.
+func createSandbox(base string) (*runSandbox, error) {
+	// Overlay mount options are separated by commas, and layers by colons.
+	if strings.ContainsAny(base, ",:") {
+		return nil, fmt.Errorf("Sandbox base %q cannot contain ',' or ':'", base)
+	}
+
+	root, err := ioutil.TempDir("", "pw_target_runner_sandbox_")
+	if err != nil {
+		return nil, err
+	}
+
+	if base == "" {
+		return &runSandbox{root: root, dir: root}, nil
+	}
+
+	s := &runSandbox{root: root, dir: filepath.Join(root, "merged")}
+	upper := filepath.Join(root, "upper")
+	work := filepath.Join(root, "work")
+	for _, dir := range []string{upper, work, s.dir} {
+		if err := os.Mkdir(dir, 0700); err != nil {
+			os.RemoveAll(root)
+			return nil, err
+		}
+	}
+
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", base, upper, work)
+	if err := syscall.Mount("overlay", s.dir, "overlay", 0, options); err != nil {
+		os.RemoveAll(root)
+		return nil, &os.PathError{Op: "mount overlay", Path: s.dir, Err: err}
+	}
+	s.mounted = true
+
+	return s, nil
+}
+
+// remove unmounts the sandbox, if it is mounted, and deletes its files.
+func (s *runSandbox) remove() error {
+	if s.mounted {
+		// The mount is detached lazily in case a process left running
+		// by the command still has it open.
+		if err := syscall.Unmount(s.dir, syscall.MNT_DETACH); err != nil {
+			return &os.PathError{Op: "unmount", Path: s.dir, Err: err}
+		}
+	}
+	return os.RemoveAll(s.root)
+}
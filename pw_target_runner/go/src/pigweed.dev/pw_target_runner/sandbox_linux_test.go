@@ -0,0 +1,102 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	pb "pigweed.dev/proto/pw_target_runner/target_runner_pb"
+)
+
+// runInSandbox runs a script through a runner with the given sandbox config,
+// returning its output. The script's first line of output must be its working
+// directory, which is checked to have been removed.
+func runInSandbox(t *testing.T, config *SandboxConfig, content string) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "pw_target_runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "sandboxed.sh")
+	if err := ioutil.WriteFile(script, []byte("pwd\n"+content), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewExecDeviceRunner(0, []string{"/bin/sh"})
+	r.SetSandbox(config)
+
+	res := r.HandleRunRequest(&RunRequest{ID: "test", Path: script})
+	if e, ok := res.Err.(*os.PathError); ok && e.Err == syscall.EPERM {
+		t.Skip("Mounting overlays requires CAP_SYS_ADMIN")
+	}
+	if res.Err != nil {
+		t.Fatalf("Run failed: %v", res.Err)
+	}
+	if res.Status != pb.RunStatus_SUCCESS {
+		t.Fatalf("Got status %v; want SUCCESS. Output:\n%s", res.Status, res.Output)
+	}
+
+	lines := strings.SplitN(string(res.Output), "\n", 2)
+	if lines[0] == dir || !strings.HasPrefix(lines[0], os.TempDir()) {
+		t.Errorf("Script ran in %s; want a new temporary directory", lines[0])
+	}
+	if _, err := os.Stat(lines[0]); !os.IsNotExist(err) {
+		t.Errorf("Sandbox %s was not removed", lines[0])
+	}
+	return lines[1]
+}
+
+func TestExecDeviceRunnerSandbox(t *testing.T) {
+	output := runInSandbox(t, &SandboxConfig{}, "ls -A\necho written > file.txt\n")
+	if output != "" {
+		t.Errorf("Sandbox was not empty; it contained:\n%s", output)
+	}
+}
+
+func TestExecDeviceRunnerOverlaySandbox(t *testing.T) {
+	base, err := ioutil.TempDir("", "pw_target_runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	baseFile := filepath.Join(base, "base.txt")
+	if err := ioutil.WriteFile(baseFile, []byte("from base\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	content := "cat base.txt\necho changed > base.txt\necho written > new.txt\n"
+	output := runInSandbox(t, &SandboxConfig{Base: base}, content)
+	if output != "from base\n" {
+		t.Errorf("Got output %q; want the base file's contents", output)
+	}
+
+	// Changes made in the sandbox must not reach the base.
+	if got, _ := ioutil.ReadFile(baseFile); !bytes.Equal(got, []byte("from base\n")) {
+		t.Errorf("Base file was changed to %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(base, "new.txt")); !os.IsNotExist(err) {
+		t.Errorf("File written in the sandbox was created in the base")
+	}
+}
@@ -18,15 +18,21 @@ package pw_target_runner
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"log"
 	"net"
+	"sync"
 	"time"
 
 	"google.golang.org/grpc"
+	channelz "google.golang.org/grpc/channelz/service"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/stats"
 	"google.golang.org/grpc/status"
 
 	pb "pigweed.dev/proto/pw_target_runner/target_runner_pb"
@@ -35,35 +41,174 @@ import (
 var (
 	errServerNotBound   = errors.New("Server not bound to a port")
 	errServerNotRunning = errors.New("Server is not running")
+	errServerRunning    = errors.New("Server is already running")
 )
 
 // Server is a gRPC server that runs a TargetRunner service.
 type Server struct {
-	grpcServer  *grpc.Server
-	listener    net.Listener
-	tasksPassed uint32
-	tasksFailed uint32
+	grpcServer *grpc.Server
+	listener   net.Listener
+	state      serverState
+	workerPool *WorkerPool
+
+	// Maximum size of an uploaded binary. Uploads are disabled if zero.
+	maxUploadSize int64
+
+	// Accept backlog of the server's listener, or zero for the system's
+	// default.
+	listenBacklog int
+
+	// TLS configuration for the server's connections, if TLS is enabled.
+	tlsConfig *tls.Config
+
+	// Common names of the client certificates allowed to make RPCs. If nil,
+	// all clients are allowed.
+	allowedClients map[string]bool
+
+	// Resolved directories within which clients may request executables. If
+	// empty, any path may be requested.
+	allowedRoots []string
+
+	// Recent results, if the server keeps a history.
+	history *ResultHistory
+
+	// Archive of the output of streamed runs, if the server keeps one.
+	outputArchive *OutputArchive
+
+	// Limit on the requests each client may have queued, if any.
+	clientLimit *clientQueueLimit
+
+	// Queued and running requests, by ID.
+	requestsMutex sync.Mutex
+	requests      map[string]*trackedRequest
+
+	// Whether identical requests in flight at the same time are run once,
+	// and those requests, keyed by dedupKey.
+	dedup         bool
+	inflightMutex sync.Mutex
+	inflight      map[string]*inflightRun
+
+	// How long the results of requests with idempotency keys are kept, if
+	// the server honors the keys, and those requests, by key.
+	idempotencyTTL   time.Duration
+	idempotencyMutex sync.Mutex
+	idempotentRuns   map[string]*idempotentRun
+
+	// Size above which the output of a result sent through RunBinaryStream
+	// is split into chunks of this size, sent ahead of the result.
+	outputChunkSize int
+
+	// Whether the gRPC channelz service is registered.
+	channelz bool
+
+	// Handler of the gRPC server's stats, such as one which traces RPCs, if
+	// any.
+	statsHandler stats.Handler
+}
+
+// Default size above which the output of a streamed result is sent in chunks.
+// This keeps messages well under gRPC's default 4 MiB limit on those received.
+const defaultOutputChunkSize = 1 << 20
+
+// trackedRequest is a request tracked by the server while it is queued or
+// running.
+type trackedRequest struct {
+	// Path of the requested executable.
+	path string
+
+	// Common name from the certificate of the client which made the
+	// request, if it presented one.
+	client string
+
+	// Context of the request, which is done once the request completes.
+	ctx context.Context
+
+	// Cancels the request.
+	cancel context.CancelFunc
+}
+
+// serverState tracks whether a server is running and the results of the
+// executables it has run. It is accessed concurrently by RPC handlers.
+type serverState struct {
+	mutex       sync.RWMutex
 	startTime   time.Time
 	active      bool
-	workerPool  *WorkerPool
+	tasksPassed uint32
+	tasksFailed uint32
 }
 
-// NewServer creates a gRPC server with a registered TargetRunner service.
-func NewServer() *Server {
-	s := &Server{
-		grpcServer: grpc.NewServer(),
-		workerPool: newWorkerPool("ServerWorkerPool"),
+// start marks the server as running from the current time.
+func (st *serverState) start() {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.startTime = time.Now()
+	st.active = true
+}
+
+// stop marks the server as no longer running.
+func (st *serverState) stop() {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.active = false
+}
+
+// isActive returns whether the server is running.
+func (st *serverState) isActive() bool {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	return st.active
+}
+
+// recordResult counts the result of a completed run.
+func (st *serverState) recordResult(status pb.RunStatus) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if status == pb.RunStatus_SUCCESS {
+		st.tasksPassed++
+	} else {
+		st.tasksFailed++
 	}
+}
 
-	reflection.Register(s.grpcServer)
-	pb.RegisterTargetRunnerServer(s.grpcServer, &pwTargetRunnerService{s})
+// snapshot returns the server's uptime and the number of runs which passed and
+// failed, read consistently with each other.
+func (st *serverState) snapshot() (time.Duration, uint32, uint32) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	var uptime time.Duration
+	if st.active {
+		uptime = time.Since(st.startTime)
+	}
+	return uptime, st.tasksPassed, st.tasksFailed
+}
 
-	return s
+// NewServer creates a server for a TargetRunner service. The underlying gRPC
+// server is created when the server is started, so that its transport can be
+// configured beforehand.
+func NewServer() *Server {
+	return &Server{
+		workerPool:      newWorkerPool("ServerWorkerPool"),
+		requests:        make(map[string]*trackedRequest),
+		inflight:        make(map[string]*inflightRun),
+		idempotentRuns:  make(map[string]*idempotentRun),
+		outputChunkSize: defaultOutputChunkSize,
+	}
 }
 
-// Bind starts a TCP listener on a specified port.
+// Bind starts a TCP listener on a specified port. If the port is 0, the
+// operating system chooses an available port, which can be retrieved through
+// Addr. On Unix-like hosts, the port can be bound even while connections from a
+// previous server on it are in TIME_WAIT.
 func (s *Server) Bind(port int) error {
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	var lis net.Listener
+	var err error
+	if s.listenBacklog > 0 {
+		lis, err = listenWithBacklog(port, s.listenBacklog)
+	} else {
+		config := net.ListenConfig{Control: setReuseAddr}
+		lis, err = config.Listen(context.Background(), "tcp", fmt.Sprintf(":%d", port))
+	}
 	if err != nil {
 		return err
 	}
@@ -71,39 +216,379 @@ func (s *Server) Bind(port int) error {
 	return nil
 }
 
+// SetListenBacklog sets the maximum number of connections waiting to be
+// accepted by the server's listener, beyond which new connections are refused
+// or dropped. If zero, the default, the system's maximum is used. The system may
+// cap the backlog at a lower value, such as net.core.somaxconn on Linux. Only
+// supported on Unix-like hosts. This must be done before Bind is called.
+func (s *Server) SetListenBacklog(backlog int) error {
+	if s.state.isActive() {
+		return errServerRunning
+	}
+	s.listenBacklog = backlog
+	return nil
+}
+
+// Addr returns the address on which the server is listening. Bind must have
+// been called before this; an error is returned if it is not.
+func (s *Server) Addr() (net.Addr, error) {
+	if s.listener == nil {
+		return nil, errServerNotBound
+	}
+	return s.listener.Addr(), nil
+}
+
 // RegisterWorker adds a worker to the server's worker pool.
 func (s *Server) RegisterWorker(worker DeviceRunner) {
 	s.workerPool.RegisterWorker(worker)
 }
 
+// SetIdleShutdown configures the server's workers to exit after being idle for
+// idleTimeout, keeping at least minWarmWorkers running. Exited workers are
+// started again on demand as requests arrive.
+func (s *Server) SetIdleShutdown(idleTimeout time.Duration, minWarmWorkers int) error {
+	return s.workerPool.SetIdleShutdown(idleTimeout, minWarmWorkers)
+}
+
+// SetRetryBackoff configures the server's worker pool to wait before retrying
+// flaky requests which fail. See WorkerPool.SetRetryBackoff.
+func (s *Server) SetRetryBackoff(backoff RetryBackoff) error {
+	return s.workerPool.SetRetryBackoff(backoff)
+}
+
+// EnableUploads allows clients to upload binaries to the server to run, up to
+// maxSize bytes. As this lets clients run arbitrary code on the server's host,
+// it should only be enabled on trusted networks.
+func (s *Server) EnableUploads(maxSize int64) {
+	s.maxUploadSize = maxSize
+}
+
+// AddResultSink adds a sink to which the result of every executable run by the
+// server is sent, independent of whether the result reaches the requester.
+func (s *Server) AddResultSink(sink ResultSink) error {
+	return s.workerPool.AddResultSink(sink)
+}
+
+// EnableRunTimeTracking has the server keep a moving average of the run time of
+// each executable it runs, as WorkerPool.EnableRunTimeTracking does. This cannot
+// be done while the server is running.
+func (s *Server) EnableRunTimeTracking(size int, smoothing float64) error {
+	return s.workerPool.EnableRunTimeTracking(size, smoothing)
+}
+
+// AddEventListener adds a listener which is notified as each executable run by
+// the server is queued, started, and completed. This cannot be done while the
+// server is running.
+func (s *Server) AddEventListener(listener EventListener) error {
+	return s.workerPool.AddEventListener(listener)
+}
+
+// EnableHistory has the server keep the results of the last size executables it
+// runs, which clients can retrieve through the History RPC. This cannot be done
+// while the server is running.
+func (s *Server) EnableHistory(size int) error {
+	if s.state.isActive() {
+		return errServerRunning
+	}
+
+	history := NewResultHistory(size)
+	if err := s.workerPool.AddResultSink(history); err != nil {
+		return err
+	}
+	s.history = history
+	return nil
+}
+
+// SetOutputArchive has the server write the output of every run requested
+// through the RunBinaryStream RPC to an archive as it is produced, from which
+// clients can follow it again by request ID through the FollowOutput RPC. Runs
+// whose requests set continue_on_disconnect keep running if their client
+// disconnects. This cannot be done while the server is running.
+func (s *Server) SetOutputArchive(archive *OutputArchive) error {
+	if s.state.isActive() {
+		return errServerRunning
+	}
+	s.outputArchive = archive
+	return nil
+}
+
+// EnableDeduplication has the server run identical requests which are in flight
+// at the same time only once. A request for an executable with the same content
+// as one already queued or running, and the same case filter, waits for and
+// returns that request's result instead of being queued. Requests with
+// arguments or streamed output, or which set NoDeduplicate, are always run.
+// This should only be enabled if the server's executables are idempotent. It
+// cannot be done while the server is running.
+func (s *Server) EnableDeduplication() error {
+	if s.state.isActive() {
+		return errServerRunning
+	}
+	s.dedup = true
+	return nil
+}
+
+// EnableChannelz registers gRPC's channelz service on the server, through which
+// tools such as grpcdebug can inspect the state of its connections and streams.
+// The service is subject to the same client authentication as the server's
+// other RPCs. This cannot be done while the server is running.
+func (s *Server) EnableChannelz() error {
+	if s.state.isActive() {
+		return errServerRunning
+	}
+	s.channelz = true
+	return nil
+}
+
+// SetStatsHandler installs a gRPC stats handler on the server, which is told of
+// each RPC and connection as it progresses. For example, OpenTelemetry's
+// otelgrpc handler traces each RPC, continuing any trace propagated in the
+// RPC's metadata; the context of requests made through the RPC carries its
+// span. This cannot be done while the server is running.
+func (s *Server) SetStatsHandler(handler stats.Handler) error {
+	if s.state.isActive() {
+		return errServerRunning
+	}
+	s.statsHandler = handler
+	return nil
+}
+
+// EnableQuarantine has the server quarantine workers which return errors for
+// several consecutive requests, as described in WorkerPool.EnableQuarantine.
+func (s *Server) EnableQuarantine(threshold int, probeInterval time.Duration) error {
+	return s.workerPool.EnableQuarantine(threshold, probeInterval)
+}
+
+// SetWorkerStatsFile has the server persist the lifetime statistics of its
+// workers to a file, as described in WorkerPool.SetWorkerStatsFile.
+func (s *Server) SetWorkerStatsFile(path string) error {
+	return s.workerPool.SetWorkerStatsFile(path)
+}
+
+// SetWorkerStartTimeout sets how long the server's workers may take to start,
+// as described in WorkerPool.SetWorkerStartTimeout.
+func (s *Server) SetWorkerStartTimeout(timeout time.Duration) error {
+	return s.workerPool.SetWorkerStartTimeout(timeout)
+}
+
+// SetHealthCheckInterval sets how often the server's workers have their health
+// checked while idle. Only workers implementing HealthChecker are checked.
+func (s *Server) SetHealthCheckInterval(interval time.Duration) error {
+	return s.workerPool.SetHealthCheckInterval(interval)
+}
+
+// SetDispatchStrategy sets the strategy with which the server assigns requests
+// to its workers. See WorkerPool.SetDispatchStrategy.
+func (s *Server) SetDispatchStrategy(strategy DispatchStrategy) error {
+	return s.workerPool.SetDispatchStrategy(strategy)
+}
+
+// SetResponseTimeout sets how long workers wait for responses to be received
+// before dropping them. See WorkerPool.SetResponseTimeout.
+func (s *Server) SetResponseTimeout(timeout time.Duration) error {
+	return s.workerPool.SetResponseTimeout(timeout)
+}
+
+// SetOutputBudget limits the total output held in memory by the server's running
+// requests. See WorkerPool.SetOutputBudget.
+func (s *Server) SetOutputBudget(limit int64, mode OutputBudgetMode) error {
+	return s.workerPool.SetOutputBudget(limit, mode)
+}
+
+// SetOutputChunkSize sets the size above which the output of a result sent
+// through the RunBinaryStream RPC is split into chunks of this size, sent ahead
+// of the result, so that verbose executables do not exceed message size limits.
+// A size of zero restores the default of 1 MiB. This cannot be done while the
+// server is running.
+func (s *Server) SetOutputChunkSize(size int) error {
+	if s.state.isActive() {
+		return errServerRunning
+	}
+
+	if size <= 0 {
+		size = defaultOutputChunkSize
+	}
+	s.outputChunkSize = size
+	return nil
+}
+
+// Pause holds the server's queued requests until Resume is called, without
+// stopping its workers. See WorkerPool.Pause.
+func (s *Server) Pause() {
+	s.workerPool.Pause()
+}
+
+// Resume allows the server's workers to take requests again after Pause.
+func (s *Server) Resume() {
+	s.workerPool.Resume()
+}
+
 // RunBinary runs an executable through a worker in the server, returning
 // the worker's response. The function blocks until the executable has been
 // processed.
 func (s *Server) RunBinary(path string) (*RunResponse, error) {
-	if !s.active {
+	return s.RunBinaryContext(context.Background(), path)
+}
+
+// RunBinaryContext runs an executable through a worker in the server, returning
+// the worker's response. The function blocks until the executable has been
+// processed or the provided context is done. If the context is done before a
+// worker has finished running the executable, the request is abandoned and the
+// context's error is returned.
+func (s *Server) RunBinaryContext(ctx context.Context, path string) (*RunResponse, error) {
+	return s.Run(ctx, &RunRequest{Path: path})
+}
+
+// Run queues a request to run through a worker in the server, returning the
+// worker's response. The request's response channel and context are set by
+// this function. Like RunBinaryContext, the function blocks until the request
+// has been processed or the context is done. If deduplication or idempotency
+// keys are enabled, the response may be that of another request.
+func (s *Server) Run(ctx context.Context, req *RunRequest) (*RunResponse, error) {
+	if s.idempotencyTTL > 0 && req.IdempotencyKey != "" {
+		return s.runIdempotent(ctx, req)
+	}
+	return s.run(ctx, req)
+}
+
+// run runs a request for Run, de-duplicating it if enabled.
+func (s *Server) run(ctx context.Context, req *RunRequest) (*RunResponse, error) {
+	if s.dedup {
+		if key, ok := dedupKey(req); ok {
+			return s.runDeduplicated(ctx, req, key)
+		}
+	}
+
+	res, err := s.queue(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	s.state.recordResult(res.Status)
+	return res, nil
+}
+
+// ListCases lists the test cases in an executable without running them. The
+// request is processed by a worker like any other, so the workers' runners must
+// implement CaseLister.
+func (s *Server) ListCases(ctx context.Context, req *RunRequest) (*RunResponse, error) {
+	req.ListCases = true
+	return s.queue(ctx, req)
+}
+
+// Cancel cancels a queued or running request by its ID, returning whether the
+// request was found. The cancelled request fails with context.Canceled. Any
+// request can be cancelled this way; the Cancel RPC also checks which client
+// made it.
+func (s *Server) Cancel(id string) bool {
+	s.requestsMutex.Lock()
+	tracked, ok := s.requests[id]
+	s.requestsMutex.Unlock()
+
+	if ok {
+		log.Printf("[%s] Cancelling request\n", id)
+		tracked.cancel()
+	}
+	return ok
+}
+
+// requestOwner returns the identity of the client which made a queued or
+// running request, as in clientIdentity, or false if there is no such request.
+func (s *Server) requestOwner(id string) (string, bool) {
+	s.requestsMutex.Lock()
+	defer s.requestsMutex.Unlock()
+
+	tracked, ok := s.requests[id]
+	if !ok {
+		return "", false
+	}
+	return tracked.client, true
+}
+
+// requestDone returns a channel which is closed once a queued or running
+// request completes, or false if there is no such request.
+func (s *Server) requestDone(id string) (<-chan struct{}, bool) {
+	s.requestsMutex.Lock()
+	defer s.requestsMutex.Unlock()
+
+	tracked, ok := s.requests[id]
+	if !ok {
+		return nil, false
+	}
+	return tracked.ctx.Done(), true
+}
+
+// queue sends a request to the worker pool and waits for its response, or until
+// the context is done. The request can be cancelled through Cancel until then.
+func (s *Server) queue(ctx context.Context, req *RunRequest) (*RunResponse, error) {
+	if !s.state.isActive() {
 		return nil, errServerNotRunning
 	}
 
+	// The request's ID is assigned here rather than by the worker pool so
+	// that the request can be tracked before it is queued.
+	if req.ID == "" {
+		req.ID = newRequestID()
+	}
+
+	if s.clientLimit != nil {
+		client := requestClient(ctx)
+		if client != "" {
+			if !s.clientLimit.acquire(client) {
+				log.Printf(
+					"[%s] Rejecting request for %s: client %s has %d requests queued\n",
+					req.ID,
+					req.Path,
+					client,
+					s.clientLimit.max)
+				return nil, errClientQueueFull
+			}
+			defer s.clientLimit.release(client)
+		}
+	}
+
+	// A request with a deadline is abandoned once it passes.
+	var cancel context.CancelFunc
+	if !req.Deadline.IsZero() {
+		ctx, cancel = context.WithDeadline(ctx, req.Deadline)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	s.requestsMutex.Lock()
+	s.requests[req.ID] = &trackedRequest{
+		path:   req.Path,
+		client: clientIdentity(ctx),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	s.requestsMutex.Unlock()
+
+	defer func() {
+		s.requestsMutex.Lock()
+		delete(s.requests, req.ID)
+		s.requestsMutex.Unlock()
+	}()
+
+	// The channel is buffered so that a worker completing an abandoned
+	// request does not block on sending its response.
 	resChan := make(chan *RunResponse, 1)
-	defer close(resChan)
+	req.ResponseChannel = resChan
+	req.ctx = ctx
 
-	s.workerPool.QueueExecutable(&RunRequest{
-		Path:            path,
-		ResponseChannel: resChan,
-	})
+	s.workerPool.QueueExecutable(req)
 
-	res := <-resChan
+	var res *RunResponse
+	select {
+	case res = <-resChan:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 
 	if res.Err != nil {
 		return nil, res.Err
 	}
 
-	if res.Status == pb.RunStatus_SUCCESS {
-		s.tasksPassed++
-	} else {
-		s.tasksFailed++
-	}
-
 	return res, nil
 }
 
@@ -115,15 +600,48 @@ func (s *Server) Serve() error {
 		return errServerNotBound
 	}
 
+	if s.allowedClients != nil && !s.verifiesClients() {
+		return errClientAuthRequiresTLS
+	}
+
+	s.grpcServer = grpc.NewServer(s.serverOptions()...)
+	reflection.Register(s.grpcServer)
+	if s.channelz {
+		channelz.RegisterChannelzServiceToServer(s.grpcServer)
+	}
+	pb.RegisterTargetRunnerServer(s.grpcServer, &pwTargetRunnerService{s})
+
 	log.Printf("Starting gRPC server on %v\n", s.listener.Addr())
 
-	s.startTime = time.Now()
-	s.active = true
+	s.state.start()
 	s.workerPool.Start()
 
 	return s.grpcServer.Serve(s.listener)
 }
 
+// serverOptions returns the options with which the server's gRPC server is
+// created. Panics in RPC handlers are always recovered from, including those in
+// the interceptors which follow.
+func (s *Server) serverOptions() []grpc.ServerOption {
+	unary := []grpc.UnaryServerInterceptor{unaryRecoveryInterceptor}
+	stream := []grpc.StreamServerInterceptor{streamRecoveryInterceptor}
+
+	var opts []grpc.ServerOption
+	if s.tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(s.tlsConfig)))
+		unary = append(unary, s.unaryAuthInterceptor)
+		stream = append(stream, s.streamAuthInterceptor)
+	}
+	if s.statsHandler != nil {
+		opts = append(opts, grpc.StatsHandler(s.statsHandler))
+	}
+
+	return append(
+		opts,
+		grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(stream...))
+}
+
 // pwTargetRunnerService implements the pw.target_runner.TargetRunner gRPC
 // service.
 type pwTargetRunnerService struct {
@@ -135,18 +653,480 @@ func (s *pwTargetRunnerService) RunBinary(
 	ctx context.Context,
 	desc *pb.RunBinaryRequest,
 ) (*pb.RunBinaryResponse, error) {
-	runRes, err := s.server.RunBinary(desc.FilePath)
+	path, err := s.server.checkAllowedPath(desc.FilePath)
 	if err != nil {
-		return nil, status.Error(codes.Internal, "Internal server error")
+		return nil, err
 	}
 
-	res := &pb.RunBinaryResponse{
-		Result:      runRes.Status,
-		QueueTimeNs: uint64(runRes.QueueTime),
-		RunTimeNs:   uint64(runRes.RunTime),
-		Output:      runRes.Output,
+	req := runRequestFromProto(desc)
+	req.Path = path
+	runRes, err := s.server.Run(ctx, req)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+
+	return runResponseToProto(desc, runRes), nil
+}
+
+// RunBinaryStream runs a single executable on-device, streaming updates on its
+// progress followed by its result.
+func (s *pwTargetRunnerService) RunBinaryStream(
+	desc *pb.RunBinaryRequest,
+	stream pb.TargetRunner_RunBinaryStreamServer,
+) error {
+	path, err := s.server.checkAllowedPath(desc.FilePath)
+	if err != nil {
+		return err
+	}
+
+	req := runRequestFromProto(desc)
+	req.Path = path
+	return s.streamRun(desc, req, stream)
+}
+
+// updateStream is a server stream of RunBinaryUpdate messages, such as that of
+// RunBinaryStream.
+type updateStream interface {
+	Context() context.Context
+	Send(*pb.RunBinaryUpdate) error
+}
+
+// streamRun runs the request req, described by desc, sending updates on its
+// progress followed by its result to a stream.
+func (s *pwTargetRunnerService) streamRun(
+	desc *pb.RunBinaryRequest,
+	req *RunRequest,
+	stream updateStream,
+) error {
+	ctx := stream.Context()
+
+	// If the server archives output, the run's output is also written to
+	// the archive as it is produced. A request which asks to is then kept
+	// running if its client disconnects, as its output is not lost.
+	runCtx := ctx
+	var archived *archivedRun
+	var disconnected <-chan struct{}
+	if s.server.outputArchive != nil {
+		if req.ID == "" {
+			req.ID = newRequestID()
+		}
+
+		var err error
+		archived, err = s.server.outputArchive.begin(req.ID)
+		if err != nil {
+			log.Printf("[%s] Failed to archive output: %v\n", req.ID, err)
+		} else if desc.ContinueOnDisconnect {
+			runCtx = detachedContext{ctx}
+			disconnected = ctx.Done()
+		}
+	}
+
+	// Updates are raised from other goroutines, but must all be sent from
+	// this one, so they are funneled through a channel. At most two updates
+	// are sent before the result, but they are dropped if the stream has
+	// ended so that a run kept going after its client disconnects cannot
+	// block on them.
+	updates := make(chan *pb.RunBinaryUpdate, 2)
+	done := make(chan error, 1)
+
+	// Output is sent through its own channel, as there is no bound on the
+	// number of output updates. Runners wait for each to be taken, which
+	// throttles them to the rate of the stream.
+	output := make(chan []byte, 16)
+
+	var runRes *RunResponse
+	go func() {
+		var err error
+		req.OnQueued = func(position int) {
+			update := &pb.RunBinaryUpdate{
+				Update: &pb.RunBinaryUpdate_Queued{
+					Queued: &pb.QueuedUpdate{
+						Position:  uint32(position),
+						RequestId: req.ID,
+					},
+				},
+			}
+			select {
+			case updates <- update:
+			case <-ctx.Done():
+			}
+		}
+		req.OnStart = func() {
+			update := &pb.RunBinaryUpdate{
+				Update: &pb.RunBinaryUpdate_Started{
+					Started: &pb.StartedUpdate{},
+				},
+			}
+			select {
+			case updates <- update:
+			case <-ctx.Done():
+			}
+		}
+		if desc.StreamOutput || archived != nil {
+			req.OnOutput = func(data []byte) {
+				if archived != nil {
+					archived.Write(data)
+				}
+				if !desc.StreamOutput {
+					return
+				}
+				select {
+				case output <- data:
+				case <-ctx.Done():
+				}
+			}
+			req.OutputFlush = outputFlushFromProto(desc.OutputFlush)
+		}
+		runRes, err = s.server.Run(runCtx, req)
+		if archived != nil {
+			if err := archived.finish(runRes); err != nil {
+				log.Printf("[%s] Failed to archive output: %v\n", req.ID, err)
+			}
+		}
+		done <- err
+	}()
+
+	for {
+		select {
+		case update := <-updates:
+			if err := stream.Send(update); err != nil {
+				return err
+			}
+		case data := <-output:
+			if err := stream.Send(outputUpdate(data)); err != nil {
+				return err
+			}
+		case <-disconnected:
+			log.Printf(
+				"[%s] Client disconnected; continuing to run %s\n", req.ID, req.Path)
+			return rpcError(ctx.Err())
+		case err := <-done:
+			if err != nil {
+				return rpcError(err)
+			}
+
+			// Flush any updates that arrived alongside the result
+			// so that they are not sent out of order. All output
+			// has been produced by the time the result is ready.
+			for len(updates) > 0 {
+				if err := stream.Send(<-updates); err != nil {
+					return err
+				}
+			}
+			for len(output) > 0 {
+				if err := stream.Send(outputUpdate(<-output)); err != nil {
+					return err
+				}
+			}
+
+			result := runResponseToProto(desc, runRes)
+			if err := s.sendOutputChunks(stream, result); err != nil {
+				return err
+			}
+
+			return stream.Send(&pb.RunBinaryUpdate{
+				Update: &pb.RunBinaryUpdate_Result{Result: result},
+			})
+		}
+	}
+}
+
+// outputUpdate creates an update carrying a portion of an executable's output.
+func outputUpdate(data []byte) *pb.RunBinaryUpdate {
+	return &pb.RunBinaryUpdate{
+		Update: &pb.RunBinaryUpdate_Output{
+			Output: &pb.OutputUpdate{Data: data},
+		},
+	}
+}
+
+// sendOutputChunks sends the output of a result in chunks ahead of it if it is
+// larger than the server's output chunk size, removing it from the result.
+func (s *pwTargetRunnerService) sendOutputChunks(
+	stream updateStream,
+	res *pb.RunBinaryResponse,
+) error {
+	size := s.server.outputChunkSize
+	if len(res.Output) <= size {
+		return nil
+	}
+
+	for seq, offset := 0, 0; offset < len(res.Output); seq, offset = seq+1, offset+size {
+		end := offset + size
+		if end > len(res.Output) {
+			end = len(res.Output)
+		}
+
+		err := stream.Send(&pb.RunBinaryUpdate{
+			Update: &pb.RunBinaryUpdate_ResultOutput{
+				ResultOutput: &pb.OutputChunk{
+					Sequence: uint32(seq),
+					Data:     res.Output[offset:end],
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	res.Output = nil
+	res.OutputChunked = true
+	return nil
+}
+
+// RunBinaries runs a batch of executables, streaming back each result as soon as
+// it is available.
+func (s *pwTargetRunnerService) RunBinaries(
+	batch *pb.RunBinariesRequest,
+	stream pb.TargetRunner_RunBinariesServer,
+) error {
+	// The whole batch is rejected before any of it runs if any executable
+	// is outside the allowed roots.
+	reqs := make([]*RunRequest, len(batch.Binaries))
+	for i, desc := range batch.Binaries {
+		path, err := s.server.checkAllowedPath(desc.FilePath)
+		if err != nil {
+			return err
+		}
+		reqs[i] = runRequestFromProto(desc)
+		reqs[i].Path = path
+	}
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	type batchResult struct {
+		index int
+		res   *RunResponse
+		err   error
+	}
+
+	// Each request is run from its own goroutine, so that results can be
+	// streamed in the order in which they complete. The channel is large
+	// enough to hold every result, so that none of these goroutines are left
+	// blocked if the stream fails.
+	results := make(chan batchResult, len(batch.Binaries))
+	for i, req := range reqs {
+		go func(index int, req *RunRequest) {
+			res, err := s.server.Run(ctx, req)
+			results <- batchResult{index, res, err}
+		}(i, req)
+	}
+
+	for range batch.Binaries {
+		result := <-results
+		desc := batch.Binaries[result.index]
+
+		// An executable which could not be run is reported in its own
+		// result, so that the other results of the batch are still
+		// delivered, unless the RPC itself has ended.
+		var res *pb.RunBinaryResponse
+		if result.err != nil {
+			if ctx.Err() != nil {
+				return rpcError(result.err)
+			}
+			res = &pb.RunBinaryResponse{
+				FilePath:   desc.FilePath,
+				CaseFilter: desc.CaseFilter,
+				Labels:     desc.Labels,
+				Error:      status.Convert(rpcError(result.err)).Message(),
+			}
+		} else {
+			res = runResponseToProto(desc, result.res)
+		}
+		res.BatchIndex = uint32(result.index)
+
+		if err := stream.Send(res); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ListCases lists the test cases in an executable without running it.
+func (s *pwTargetRunnerService) ListCases(
+	ctx context.Context,
+	desc *pb.RunBinaryRequest,
+) (*pb.CaseList, error) {
+	path, err := s.server.checkAllowedPath(desc.FilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	req := runRequestFromProto(desc)
+	req.Path = path
+	runRes, err := s.server.ListCases(ctx, req)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+
+	return &pb.CaseList{Cases: runRes.Cases, RequestId: runRes.RequestID}, nil
+}
+
+// runRequestFromProto creates a RunRequest from a RunBinaryRequest.
+func runRequestFromProto(desc *pb.RunBinaryRequest) *RunRequest {
+	return &RunRequest{
+		Path:             desc.FilePath,
+		Args:             desc.Args,
+		CaseFilter:       desc.CaseFilter,
+		FailFast:         desc.FailFast,
+		DiscardOutput:    desc.DiscardOutput,
+		NoDeduplicate:    desc.NoDeduplicate,
+		IdempotencyKey:   desc.IdempotencyKey,
+		Timeout:          time.Duration(desc.TimeoutNs),
+		Deadline:         deadlineFromProto(desc.DeadlineUnixNs),
+		Flaky:            desc.Flaky,
+		RetriesOnFailure: int(desc.RetriesOnFailure),
+		ExpectedStatus:   desc.ExpectedStatus,
+		SoakIterations:   int(desc.SoakIterations),
+		SoakDuration:     time.Duration(desc.SoakDurationNs),
+		Labels:           desc.Labels,
+	}
+}
+
+// deadlineFromProto converts a request's deadline in nanoseconds since the Unix
+// epoch, leaving it unset if zero.
+func deadlineFromProto(ns uint64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(ns))
+}
+
+// outputFlushFromProto converts a requested output flush policy. Unset limits
+// are left as zero so that defaults apply.
+func outputFlushFromProto(flush *pb.OutputFlush) OutputFlushPolicy {
+	if flush == nil {
+		return OutputFlushPolicy{}
+	}
+
+	policy := OutputFlushPolicy{
+		ChunkSize: int(flush.ChunkSize),
+		Interval:  time.Duration(flush.IntervalNs),
+	}
+	switch flush.Mode {
+	case pb.OutputFlush_LINES:
+		policy.Mode = FlushLines
+	case pb.OutputFlush_CHUNKS:
+		policy.Mode = FlushChunks
+	case pb.OutputFlush_INTERVAL:
+		policy.Mode = FlushInterval
+	default:
+		policy.Mode = FlushHybrid
+	}
+	return policy
+}
+
+// runResponseToProto converts a worker's response to the request described by
+// desc to a RunBinaryResponse. The request's labels are echoed back unchanged.
+func runResponseToProto(
+	desc *pb.RunBinaryRequest,
+	runRes *RunResponse,
+) *pb.RunBinaryResponse {
+	return &pb.RunBinaryResponse{
+		FilePath:            desc.FilePath,
+		CaseFilter:          desc.CaseFilter,
+		RequestId:           runRes.RequestID,
+		Result:              runRes.Status,
+		QueueTimeNs:         uint64(runRes.QueueTime),
+		RunTimeNs:           uint64(runRes.RunTime),
+		Output:              runRes.Output,
+		OutputSize:          uint64(len(runRes.Output)),
+		OutputReplaced:      runRes.OutputReplaced,
+		OutputTailed:        runRes.OutputDroppedBytes > 0,
+		OutputDroppedBytes:  uint64(runRes.OutputDroppedBytes),
+		HookOutput:          runRes.HookOutput,
+		LeakedProcesses:     uint32(runRes.LeakedProcesses),
+		MaxRssBytes:         uint64(runRes.MaxRSSBytes),
+		UserCpuNs:           uint64(runRes.UserCPUTime),
+		SysCpuNs:            uint64(runRes.SystemCPUTime),
+		AttemptResults:      runRes.Attempts,
+		ActualStatus:        runRes.ActualStatus,
+		CoreDumps:           runRes.CoreDumps,
+		SoakIterations:      uint32(runRes.SoakIterations),
+		SoakFailedIteration: uint32(runRes.SoakFailedIteration),
+		BaselineRunTimeNs:   uint64(runRes.BaselineRunTime),
+		Replayed:            runRes.Replayed,
+		Labels:              desc.Labels,
+		OutputCrc32:         crc32.ChecksumIEEE(runRes.Output),
+	}
+}
+
+// rpcError converts an error from running an executable to a gRPC status
+// error. The output of a failed pre-run hook is included in the status message
+// so that the client can see why its request failed.
+func rpcError(err error) error {
+	if hookErr, ok := err.(*preRunHookError); ok {
+		return status.Errorf(
+			codes.FailedPrecondition, "%v\n%s", hookErr, hookErr.output)
+	}
+
+	switch err {
+	case context.Canceled:
+		return status.Error(codes.Canceled, "Request cancelled")
+	case context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, "Request deadline exceeded")
+	case errCaseListingUnsupported:
+		return status.Error(codes.Unimplemented, "Workers do not support listing cases")
+	case errCaseFilterUnsupported:
+		return status.Error(codes.Unimplemented, "Workers do not support case filters")
+	case errFailFastUnsupported:
+		return status.Error(codes.Unimplemented, "Workers do not support fail-fast runs")
+	case errExpectedStatusUnsupported:
+		return status.Error(
+			codes.Unimplemented, "Workers do not support expected statuses")
+	case errSessionsUnsupported:
+		return status.Error(
+			codes.Unimplemented, "Workers do not support interactive sessions")
+	case errNoRegisteredWorkers:
+		return status.Error(
+			codes.FailedPrecondition, "Server has no workers; check its configuration")
+	case errNoAvailableWorkers:
+		return status.Error(
+			codes.FailedPrecondition, "All of the server's workers are down or unhealthy")
+	case errClientQueueFull:
+		return status.Error(
+			codes.ResourceExhausted, "Too many requests from this client are queued")
+	case errDeadlineUnreachable:
+		return status.Error(
+			codes.DeadlineExceeded, "Request is not expected to complete by its deadline")
+	default:
+		return status.Error(codes.Internal, "Internal server error")
 	}
-	return res, nil
+}
+
+// Cancel cancels a queued or running request. A request made by a client which
+// presented a certificate can only be cancelled by a client with the same
+// identity.
+func (s *pwTargetRunnerService) Cancel(
+	ctx context.Context,
+	req *pb.CancelRequest,
+) (*pb.Empty, error) {
+	owner, ok := s.server.requestOwner(req.RequestId)
+	if ok && owner != "" && owner != clientIdentity(ctx) {
+		log.Printf(
+			"[%s] Refusing to cancel request of client %s for another client\n",
+			req.RequestId,
+			owner)
+		return nil, status.Errorf(
+			codes.PermissionDenied, "Request %s was made by another client", req.RequestId)
+	}
+	if !s.server.Cancel(req.RequestId) {
+		return nil, status.Errorf(
+			codes.NotFound, "No queued or running request with ID %s", req.RequestId)
+	}
+	return &pb.Empty{}, nil
+}
+
+// Ping returns immediately. It does not touch the worker pool, so it succeeds as
+// long as the gRPC server is serving.
+func (s *pwTargetRunnerService) Ping(
+	ctx context.Context,
+	_ *pb.Empty,
+) (*pb.Empty, error) {
+	return &pb.Empty{}, nil
 }
 
 // Status returns information about the server.
@@ -154,10 +1134,196 @@ func (s *pwTargetRunnerService) Status(
 	ctx context.Context,
 	_ *pb.Empty,
 ) (*pb.ServerStatus, error) {
+	pool := s.server.workerPool.Snapshot()
+	uptime, passed, failed := s.server.state.snapshot()
+
 	resp := &pb.ServerStatus{
-		UptimeNs:    uint64(time.Since(s.server.startTime)),
-		TasksPassed: s.server.tasksPassed,
-		TasksFailed: s.server.tasksFailed,
+		UptimeNs:         uint64(uptime),
+		TasksPassed:      passed,
+		TasksFailed:      failed,
+		WorkersUnhealthy: uint32(pool.WorkersUnhealthy),
+		Pool: &pb.PoolStats{
+			QueueDepth:         uint32(pool.QueueDepth),
+			WorkersTotal:       uint32(pool.WorkersTotal),
+			WorkersBusy:        uint32(pool.WorkersBusy),
+			WorkersUnhealthy:   uint32(pool.WorkersUnhealthy),
+			WorkersQuarantined: uint32(pool.WorkersQuarantined),
+			RequestsQueued:     pool.RequestsQueued,
+			RequestsCompleted:  pool.RequestsCompleted,
+			RequestsRejected:   pool.RequestsRejected,
+			Paused:             pool.Paused,
+		},
+	}
+
+	return resp, nil
+}
+
+// Pause holds the server's queued requests until Resume is called.
+func (s *pwTargetRunnerService) Pause(
+	ctx context.Context,
+	_ *pb.Empty,
+) (*pb.Empty, error) {
+	s.server.Pause()
+	return &pb.Empty{}, nil
+}
+
+// Resume allows the server's workers to take requests again.
+func (s *pwTargetRunnerService) Resume(
+	ctx context.Context,
+	_ *pb.Empty,
+) (*pb.Empty, error) {
+	s.server.Resume()
+	return &pb.Empty{}, nil
+}
+
+// LogStream streams the server's log lines about a request, starting with recent
+// ones, until the request completes.
+func (s *pwTargetRunnerService) LogStream(
+	req *pb.LogStreamRequest,
+	stream pb.TargetRunner_LogStreamServer,
+) error {
+	recent, lines, stop := followedLogs.follow(req.RequestId)
+	defer stop()
+
+	done, active := s.server.requestDone(req.RequestId)
+	if !active && len(recent) == 0 {
+		return status.Errorf(
+			codes.NotFound, "No logs of a request with ID %s", req.RequestId)
+	}
+
+	for _, line := range recent {
+		if err := stream.Send(&pb.LogLine{Line: line}); err != nil {
+			return err
+		}
+	}
+
+	// A request which has already completed logs no further lines.
+	if !active {
+		return nil
+	}
+
+	for {
+		select {
+		case line := <-lines:
+			if err := stream.Send(&pb.LogLine{Line: line}); err != nil {
+				return err
+			}
+		case <-done:
+			// Lines logged as the request completed may still be
+			// waiting to be sent.
+			for len(lines) > 0 {
+				if err := stream.Send(&pb.LogLine{Line: <-lines}); err != nil {
+					return err
+				}
+			}
+			return nil
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+// ListWorkers returns the state of each worker in the server's pool.
+func (s *pwTargetRunnerService) ListWorkers(
+	ctx context.Context,
+	_ *pb.Empty,
+) (*pb.WorkerList, error) {
+	workers := s.server.workerPool.Workers()
+
+	resp := &pb.WorkerList{
+		Workers: make([]*pb.WorkerStatus, len(workers)),
+	}
+	for i, w := range workers {
+		resp.Workers[i] = &pb.WorkerStatus{
+			Id:             uint32(w.ID),
+			Healthy:        w.Healthy,
+			Busy:           w.Busy,
+			Running:        w.Running,
+			ActiveRequests: uint32(w.ActiveRequests),
+			Capacity:       uint32(w.Capacity),
+			Quarantined:    w.Quarantined,
+			Runs:           w.Stats.Runs,
+			Failures:       w.Stats.Failures,
+			Errors:         w.Stats.Errors,
+			BusyTimeNs:     uint64(w.Stats.BusyTime),
+		}
+	}
+
+	return resp, nil
+}
+
+// FollowOutput streams the archived output of a request, following it until the
+// request completes, then sends its result if the server's history holds it.
+func (s *pwTargetRunnerService) FollowOutput(
+	req *pb.FollowOutputRequest,
+	stream pb.TargetRunner_FollowOutputServer,
+) error {
+	archive := s.server.outputArchive
+	if archive == nil {
+		return status.Error(codes.FailedPrecondition, "Server does not archive output")
+	}
+
+	err := archive.Follow(stream.Context(), req.RequestId, func(data []byte) error {
+		return stream.Send(outputUpdate(data))
+	})
+	if err == errArchiveNotFound {
+		return status.Errorf(
+			codes.NotFound, "No archived output of a request with ID %s", req.RequestId)
+	}
+	if err != nil {
+		return err
+	}
+
+	if s.server.history == nil {
+		return nil
+	}
+	entry, ok := s.server.history.Find(req.RequestId)
+	if !ok || entry.Response.Err != nil {
+		return nil
+	}
+
+	desc := &pb.RunBinaryRequest{
+		FilePath:   entry.Path,
+		CaseFilter: entry.CaseFilter,
+		Labels:     entry.Labels,
+	}
+	result := runResponseToProto(desc, entry.Response)
+	result.Output = nil
+	return stream.Send(&pb.RunBinaryUpdate{
+		Update: &pb.RunBinaryUpdate_Result{Result: result},
+	})
+}
+
+// History returns the most recent results recorded by the server.
+func (s *pwTargetRunnerService) History(
+	ctx context.Context,
+	req *pb.HistoryRequest,
+) (*pb.HistoryList, error) {
+	if s.server.history == nil {
+		return nil, status.Error(
+			codes.FailedPrecondition, "Server does not keep a history of results")
+	}
+
+	entries := s.server.history.Recent(int(req.MaxResults))
+
+	resp := &pb.HistoryList{
+		Entries: make([]*pb.HistoryEntry, len(entries)),
+	}
+	for i, e := range entries {
+		desc := &pb.RunBinaryRequest{
+			FilePath:   e.Path,
+			CaseFilter: e.CaseFilter,
+			Labels:     e.Labels,
+		}
+		entry := &pb.HistoryEntry{
+			CompletionTimeNs: e.Time.UnixNano(),
+			Args:             e.Args,
+			Result:           runResponseToProto(desc, e.Response),
+		}
+		if e.Response.Err != nil {
+			entry.Error = e.Response.Err.Error()
+		}
+		resp.Entries[i] = entry
 	}
 
 	return resp, nil
@@ -0,0 +1,491 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "pigweed.dev/proto/pw_target_runner/target_runner_pb"
+	"pigweed.dev/pw_target_runner"
+	"pigweed.dev/pw_target_runner/testutil"
+)
+
+// startServer starts a server with a single worker using a runner, without
+// serving gRPC.
+func startServer(t *testing.T, runner pw_target_runner.DeviceRunner) *pw_target_runner.Server {
+	t.Helper()
+	s := pw_target_runner.NewServer()
+	s.RegisterWorker(runner)
+	if err := s.StartWithoutServing(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	return s
+}
+
+func TestRunBinaryServerNotRunning(t *testing.T) {
+	s := pw_target_runner.NewServer()
+	s.RegisterWorker(testutil.NewFakeDeviceRunner())
+
+	if _, err := s.RunBinary("/test/pass"); err == nil {
+		t.Error("Expected running a binary on a stopped server to fail")
+	}
+}
+
+func TestRunBinary(t *testing.T) {
+	runner := testutil.NewFakeDeviceRunner()
+	runner.SetResult("/test/fail", testutil.FakeResult{Status: pb.RunStatus_FAILURE})
+	s := startServer(t, runner)
+
+	res, err := s.RunBinary("/test/pass")
+	if err != nil {
+		t.Fatalf("Failed to run binary: %v", err)
+	}
+	if res.Status != pb.RunStatus_SUCCESS {
+		t.Errorf("Got status %v; want SUCCESS", res.Status)
+	}
+
+	res, err = s.RunBinary("/test/fail")
+	if err != nil {
+		t.Fatalf("Failed to run binary: %v", err)
+	}
+	if res.Status != pb.RunStatus_FAILURE {
+		t.Errorf("Got status %v; want FAILURE", res.Status)
+	}
+}
+
+func TestRunBinaryRunnerError(t *testing.T) {
+	injected := errors.New("device disconnected")
+	runner := testutil.NewFakeDeviceRunner()
+	runner.SetDefaultResult(testutil.FakeResult{Err: injected})
+	s := startServer(t, runner)
+
+	if _, err := s.RunBinary("/test/pass"); err != injected {
+		t.Errorf("Got error %v; want %v", err, injected)
+	}
+}
+
+func TestRunBinaryContextDeadline(t *testing.T) {
+	runner := testutil.NewFakeDeviceRunner()
+	runner.SetDefaultResult(testutil.FakeResult{
+		Status: pb.RunStatus_SUCCESS,
+		Delay:  time.Minute,
+	})
+	s := startServer(t, runner)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := s.RunBinaryContext(ctx, "/test/slow"); err != context.DeadlineExceeded {
+		t.Errorf("Got error %v; want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Request took %v to be abandoned", elapsed)
+	}
+}
+
+// Run with -race to check that the server's state is synchronized between its
+// startup, RPCs, and direct runs.
+func TestConcurrentServeStatusAndRun(t *testing.T) {
+	s := pw_target_runner.NewServer()
+	s.RegisterWorker(testutil.NewFakeDeviceRunner())
+	if err := s.Bind(0); err != nil {
+		t.Fatalf("Failed to bind: %v", err)
+	}
+	addr, err := s.Addr()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := grpc.Dial(addr.String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewTargetRunnerClient(conn)
+
+	served := make(chan error, 1)
+	go func() { served <- s.Serve() }()
+
+	// Runs may be made before the server has started, and fail; only that
+	// they do not race with it matters.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				s.RunBinary("/test/pass")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				client.Status(ctx, &pb.Empty{}, grpc.WaitForReady(true))
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := client.Status(context.Background(), &pb.Empty{}); err != nil {
+		t.Errorf("Status failed: %v", err)
+	}
+	if _, err := s.RunBinary("/test/pass"); err != nil {
+		t.Errorf("Run failed: %v", err)
+	}
+
+	if err := s.Shutdown(5 * time.Second); err != nil {
+		t.Fatalf("Failed to shut down: %v", err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Serve failed: %v", err)
+	}
+}
+
+func TestRunBinariesReportsItemErrors(t *testing.T) {
+	runner := testutil.NewFakeDeviceRunner()
+	runner.SetResult("/test/broken", testutil.FakeResult{
+		Err: errors.New("device disconnected"),
+	})
+	s := pw_target_runner.NewServer()
+	s.RegisterWorker(runner)
+	if err := s.Bind(0); err != nil {
+		t.Fatalf("Failed to bind: %v", err)
+	}
+	addr, err := s.Addr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	defer s.Shutdown(5 * time.Second)
+
+	conn, err := grpc.Dial(addr.String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewTargetRunnerClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.RunBinaries(ctx, &pb.RunBinariesRequest{
+		Binaries: []*pb.RunBinaryRequest{
+			{FilePath: "/test/broken"},
+			{FilePath: "/test/pass"},
+		},
+	}, grpc.WaitForReady(true))
+	if err != nil {
+		t.Fatalf("Failed to start batch: %v", err)
+	}
+
+	// The failure of one executable must not end the stream before the
+	// result of the other.
+	results := make(map[uint32]*pb.RunBinaryResponse)
+	for i := 0; i < 2; i++ {
+		res, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Failed to receive result %d: %v", i, err)
+		}
+		results[res.BatchIndex] = res
+	}
+
+	if res := results[0]; res == nil || res.Error == "" {
+		t.Errorf("Got result %v for /test/broken; want an error", res)
+	}
+	if res := results[1]; res == nil || res.Error != "" || res.Result != pb.RunStatus_SUCCESS {
+		t.Errorf("Got result %v for /test/pass; want SUCCESS", res)
+	}
+}
+
+func TestContinueOnDisconnectFollowOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pw_target_runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive, err := pw_target_runner.NewOutputArchive(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runner := testutil.NewFakeDeviceRunner()
+	runner.SetDefaultResult(testutil.FakeResult{
+		Status: pb.RunStatus_SUCCESS,
+		Output: []byte("still running\n"),
+		Delay:  500 * time.Millisecond,
+	})
+	s := pw_target_runner.NewServer()
+	s.RegisterWorker(runner)
+	if err := s.SetOutputArchive(archive); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.EnableHistory(10); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Bind(0); err != nil {
+		t.Fatalf("Failed to bind: %v", err)
+	}
+	addr, err := s.Addr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	defer s.Shutdown(5 * time.Second)
+
+	conn, err := grpc.Dial(addr.String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewTargetRunnerClient(conn)
+
+	// The client disconnects as soon as it knows the request's ID.
+	runCtx, disconnect := context.WithTimeout(context.Background(), 5*time.Second)
+	defer disconnect()
+	stream, err := client.RunBinaryStream(runCtx, &pb.RunBinaryRequest{
+		FilePath:             "/test/long",
+		ContinueOnDisconnect: true,
+	}, grpc.WaitForReady(true))
+	if err != nil {
+		t.Fatalf("Failed to start run: %v", err)
+	}
+	update, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Failed to receive update: %v", err)
+	}
+	queued := update.GetQueued()
+	if queued == nil || queued.RequestId == "" {
+		t.Fatalf("Got update %v; want a queued update with a request ID", update)
+	}
+	disconnect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	follow, err := client.FollowOutput(ctx, &pb.FollowOutputRequest{
+		RequestId: queued.RequestId,
+	})
+	if err != nil {
+		t.Fatalf("Failed to follow output: %v", err)
+	}
+
+	var output []byte
+	var result *pb.RunBinaryResponse
+	for {
+		update, err := follow.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to receive followed output: %v", err)
+		}
+		if out := update.GetOutput(); out != nil {
+			output = append(output, out.Data...)
+		}
+		if res := update.GetResult(); res != nil {
+			result = res
+		}
+	}
+
+	if string(output) != "still running\n" {
+		t.Errorf("Got output %q; want %q", output, "still running\n")
+	}
+	if result == nil || result.Result != pb.RunStatus_SUCCESS {
+		t.Errorf("Got result %v; want SUCCESS", result)
+	}
+}
+
+func TestCancelOnlyByRequestingClient(t *testing.T) {
+	runner := testutil.NewFakeDeviceRunner()
+	runner.SetDefaultResult(testutil.FakeResult{
+		Status: pb.RunStatus_SUCCESS,
+		Delay:  time.Minute,
+	})
+	s := startServer(t, runner)
+	defer s.Shutdown(5 * time.Second)
+
+	alice := pw_target_runner.WithClientIdentity(context.Background(), "alice")
+	mallory := pw_target_runner.WithClientIdentity(context.Background(), "mallory")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Run(alice, &pw_target_runner.RunRequest{ID: "owned", Path: "/test/long"})
+		done <- err
+	}()
+
+	// Another client cannot cancel the request once it is tracked.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := s.CancelRPC(mallory, "owned")
+		if code := status.Code(err); code == codes.PermissionDenied {
+			break
+		} else if code != codes.NotFound {
+			t.Fatalf("Got %v cancelling another client's request; want PermissionDenied", err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Request was never tracked")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := s.CancelRPC(alice, "owned"); err != nil {
+		t.Fatalf("Failed to cancel own request: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Cancelled request did not complete")
+	}
+}
+
+func TestShutdownWaitsForRunningRequests(t *testing.T) {
+	runner := testutil.NewFakeDeviceRunner()
+	runner.SetDefaultResult(testutil.FakeResult{
+		Status: pb.RunStatus_SUCCESS,
+		Delay:  50 * time.Millisecond,
+	})
+	s := startServer(t, runner)
+
+	started := make(chan struct{})
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := s.Run(context.Background(), &pw_target_runner.RunRequest{
+			Path:    "/test/slow",
+			OnStart: func() { close(started) },
+		})
+		errChan <- err
+	}()
+	<-started
+
+	if err := s.Shutdown(5 * time.Second); err != nil {
+		t.Fatalf("Failed to shut down: %v", err)
+	}
+	if err := <-errChan; err != nil {
+		t.Errorf("Running request failed: %v", err)
+	}
+
+	if _, err := s.RunBinary("/test/pass"); err == nil {
+		t.Error("Expected running a binary after shutdown to fail")
+	}
+}
+
+// stuckRunner is a runner whose runs ignore cancellation and block until it is
+// released.
+type stuckRunner struct {
+	release chan struct{}
+}
+
+func (r *stuckRunner) WorkerStart() error { return nil }
+func (r *stuckRunner) WorkerExit()        {}
+
+func (r *stuckRunner) HandleRunRequest(
+	req *pw_target_runner.RunRequest,
+) *pw_target_runner.RunResponse {
+	<-r.release
+	return &pw_target_runner.RunResponse{Status: pb.RunStatus_SUCCESS}
+}
+
+func TestShutdownTimesOut(t *testing.T) {
+	runner := &stuckRunner{release: make(chan struct{})}
+	defer close(runner.release)
+	s := startServer(t, runner)
+
+	started := make(chan struct{})
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := s.Run(context.Background(), &pw_target_runner.RunRequest{
+			Path:    "/test/stuck",
+			OnStart: func() { close(started) },
+		})
+		errChan <- err
+	}()
+	<-started
+
+	start := time.Now()
+	if err := s.Shutdown(50 * time.Millisecond); err == nil {
+		t.Error("Expected shutting down with a stuck worker to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Shutdown took %v", elapsed)
+	}
+
+	// The stuck request is abandoned rather than left waiting.
+	select {
+	case err := <-errChan:
+		if err != context.Canceled {
+			t.Errorf("Got error %v; want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stuck request was not abandoned")
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	runner := testutil.NewFakeDeviceRunner()
+	s := pw_target_runner.NewServer()
+	s.RegisterWorker(runner)
+	if err := s.EnableIdempotencyKeys(time.Minute); err != nil {
+		t.Fatalf("Failed to enable idempotency keys: %v", err)
+	}
+	if err := s.StartWithoutServing(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+
+	run := func(key string) *pw_target_runner.RunResponse {
+		t.Helper()
+		res, err := s.Run(context.Background(), &pw_target_runner.RunRequest{
+			Path:           "/test/pass",
+			IdempotencyKey: key,
+		})
+		if err != nil {
+			t.Fatalf("Failed to run binary: %v", err)
+		}
+		return res
+	}
+
+	first := run("batch-1")
+	if first.Replayed {
+		t.Error("First request with a key was replayed")
+	}
+
+	retried := run("batch-1")
+	if !retried.Replayed {
+		t.Error("Retried request was not replayed")
+	}
+	if retried.RequestID != first.RequestID {
+		t.Errorf("Got result of request %s; want %s", retried.RequestID, first.RequestID)
+	}
+
+	if res := run("batch-2"); res.Replayed {
+		t.Error("Request with a new key was replayed")
+	}
+
+	if got := len(runner.Requests()); got != 2 {
+		t.Errorf("Runner got %d requests; want 2", got)
+	}
+}
@@ -0,0 +1,492 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/creack/pty"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "pigweed.dev/proto/pw_target_runner/target_runner_pb"
+)
+
+var (
+	errSessionsUnsupported = errors.New("Worker does not support interactive sessions")
+	errNoSession           = errors.New("Session request has no session")
+)
+
+// The character which signals the end of input on a terminal.
+const ctrlD = 0x04
+
+// Session connects an executable run interactively to its requester.
+type Session struct {
+	// Read for the executable's standard input until it returns an error,
+	// such as io.EOF, at which point the input is closed. If nil, the
+	// executable's input is empty. Reads may still be in progress when the
+	// executable exits, so the reader should return once the requester is
+	// done with the session.
+	Stdin io.Reader
+
+	// Written with the executable's standard output and error as they are
+	// produced. Either may be nil to discard the output. Runners which run
+	// executables on terminals write all of their output to Stdout.
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// InteractiveRunner is an optional interface which a DeviceRunner may implement
+// to run executables interactively, exchanging input and output with their
+// requesters as they run.
+type InteractiveRunner interface {
+	// AcceptsSessions returns whether the runner runs session requests.
+	// Worker pools only give session requests to runners which do.
+	AcceptsSessions() bool
+
+	// RunSession runs the requested executable connected to the request's
+	// Session until the executable exits or the request is abandoned. The
+	// response's output is empty, as it has been written to the session.
+	RunSession(*RunRequest) *RunResponse
+}
+
+// acceptsSessions returns whether a worker's runner runs session requests.
+func acceptsSessions(runner DeviceRunner) bool {
+	interactive, ok := runner.(InteractiveRunner)
+	return ok && interactive.AcceptsSessions()
+}
+
+// runSession runs a session request using a worker's runner.
+func runSession(runner DeviceRunner, req *RunRequest) *RunResponse {
+	interactive, ok := runner.(InteractiveRunner)
+	if !ok {
+		return &RunResponse{Err: errSessionsUnsupported}
+	}
+	return interactive.RunSession(req)
+}
+
+// RunSession queues a request to run an executable interactively through a
+// worker in the server, connected to the request's Session. It blocks until the
+// executable exits or the context is done, in which case the executable is
+// killed. Sessions are never de-duplicated, and only run by workers whose
+// runners implement InteractiveRunner and accept sessions.
+func (s *Server) RunSession(ctx context.Context, req *RunRequest) (*RunResponse, error) {
+	if req.Session == nil {
+		return nil, errNoSession
+	}
+	return s.queue(ctx, req)
+}
+
+// SetInteractive configures whether the runner runs executables interactively
+// for session requests. Runners do not by default, so that sessions, which may
+// last as long as a person is debugging, only occupy the workers intended for
+// them.
+func (r *ExecDeviceRunner) SetInteractive(interactive bool) {
+	r.interactive = interactive
+}
+
+// AcceptsSessions returns whether SetInteractive has enabled sessions. Part of
+// InteractiveRunner interface.
+func (r *ExecDeviceRunner) AcceptsSessions() bool {
+	return r.interactive
+}
+
+// RunSession runs a requested executable through the runner's command, like
+// HandleRunRequest, with its standard input and output connected to the
+// request's session. The runner's hooks run before and after it, and it is
+// confined by the runner's sandbox, cgroup, and memory guard, but its output is
+// neither captured nor matched against output patterns, and core dumps are not
+// collected. Part of InteractiveRunner interface.
+func (r *ExecDeviceRunner) RunSession(req *RunRequest) *RunResponse {
+	if !r.interactive {
+		return &RunResponse{Err: errSessionsUnsupported}
+	}
+	return r.withHooks(req, r.runSession)
+}
+
+// runSession runs a session's executable, as described in RunSession.
+func (r *ExecDeviceRunner) runSession(req *RunRequest) *RunResponse {
+	res := &RunResponse{Status: pb.RunStatus_SUCCESS}
+
+	r.logger.Printf("[%s] Starting interactive session with %s\n", req.ID, req.Path)
+
+	ctx := req.Context()
+	runCtx := ctx
+	timeout := r.timeout(req)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// The session is confined as a run of the executable would be.
+	var guard *memoryGuard
+	if r.memoryGuard.MaxBytes > 0 {
+		guard = newMemoryGuard(r.memoryGuard)
+	}
+
+	cmd := r.buildCommand(context.Background(), req.Path, req.Args)
+	if guard != nil {
+		setProcessGroup(cmd, r.usePty)
+	}
+
+	if r.sandbox != nil {
+		sandbox, err := createSandbox(r.sandbox.Base)
+		if err != nil {
+			r.logger.Printf("[%s] Failed to create sandbox: %v\n", req.ID, err)
+			res.Err = err
+			return res
+		}
+		defer r.removeSandbox(req, sandbox)
+		cmd.Dir = sandbox.dir
+	}
+
+	var cgroup *runCgroup
+	if r.cgroupLimits.Parent != "" {
+		var err error
+		if cgroup, err = createCgroup(r.cgroupLimits.Parent, r.cgroupLimits); err != nil {
+			r.logger.Printf("[%s] Failed to create cgroup: %v\n", req.ID, err)
+			res.Err = err
+			return res
+		}
+		cgroup.apply(cmd)
+	}
+
+	started := func() {
+		if guard != nil {
+			guard.watch(cmd)
+		}
+	}
+	err := runSessionCommand(
+		runCtx, cmd, req.Session, r.usePty, r.killGracePeriod, started)
+
+	guardKilled := false
+	if guard != nil {
+		used, guardErr := guard.stop()
+		if guardErr != nil {
+			r.logger.Printf("[%s] Failed to poll memory usage: %v\n", req.ID, guardErr)
+		}
+		guardKilled = used > 0
+	}
+	oomKilled := false
+	if cgroup != nil {
+		oomKilled = r.removeCgroup(req, cgroup)
+	}
+
+	if ctx.Err() != nil {
+		r.logger.Printf("[%s] Session ended by requester; command terminated\n", req.ID)
+		res.Err = ctx.Err()
+		return res
+	}
+
+	if oomKilled || guardKilled {
+		r.logger.Printf("[%s] Session exceeded memory limit; command killed\n", req.ID)
+		res.Status = pb.RunStatus_OUT_OF_MEMORY
+	} else if runCtx.Err() == context.DeadlineExceeded {
+		r.logger.Printf(
+			"[%s] Session timed out after %v; command terminated\n", req.ID, timeout)
+		res.Status = pb.RunStatus_TIMEOUT
+	} else if err != nil {
+		if e, ok := err.(*exec.ExitError); ok {
+			r.logger.Printf("[%s] Command exited with status %d\n", req.ID, e.ExitCode())
+			res.Status = pb.RunStatus_FAILURE
+		} else {
+			r.logger.Printf("[%s] Command failed: %v\n", req.ID, err)
+			res.Err = err
+			return res
+		}
+	}
+
+	r.logger.Printf("[%s] Session ended\n", req.ID)
+	return res
+}
+
+// runSessionCommand runs a command connected to a session until it exits, or
+// until ctx is done, in which case it is terminated as by waitCommand. If usePty
+// is set, the command runs on a pseudo-terminal, which carries its input and
+// all of its output. If started is not nil, it is called once the command has
+// started.
+func runSessionCommand(
+	ctx context.Context,
+	cmd *exec.Cmd,
+	session *Session,
+	usePty bool,
+	gracePeriod time.Duration,
+	started func(),
+) error {
+	stdout, stderr := session.Stdout, session.Stderr
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+
+	// Each of the command's outputs is read from its own file, which is
+	// closed once the command has exited and it has been drained.
+	var outputs []*os.File
+	var copies []io.Writer
+	var stdin io.WriteCloser
+
+	if usePty {
+		terminal, err := pty.Start(cmd)
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, terminal)
+		copies = append(copies, stdout)
+		stdin = terminal
+	} else {
+		if session.Stdin != nil {
+			pipe, err := cmd.StdinPipe()
+			if err != nil {
+				return err
+			}
+			stdin = pipe
+		}
+
+		var err error
+		if outputs, err = startWithPipes(cmd); err != nil {
+			return err
+		}
+		copies = append(copies, stdout, stderr)
+	}
+	defer closeFiles(outputs)
+
+	if started != nil {
+		started()
+	}
+
+	// Input is copied until the session's reader fails or the command's
+	// input is closed after it exits. A pseudo-terminal cannot be closed
+	// without hanging up the command, so the end of input is signalled by
+	// writing the terminal's end-of-file character instead.
+	if session.Stdin != nil {
+		go func() {
+			io.Copy(stdin, session.Stdin)
+			if usePty {
+				stdin.Write([]byte{ctrlD})
+			} else {
+				stdin.Close()
+			}
+		}()
+	}
+
+	var waitGroup sync.WaitGroup
+	for i := range outputs {
+		waitGroup.Add(1)
+		go func(w io.Writer, f *os.File) {
+			defer waitGroup.Done()
+			io.Copy(w, f)
+		}(copies[i], outputs[i])
+	}
+
+	err := waitCommand(ctx, cmd, gracePeriod)
+
+	// As in runCommandGraceful, remaining output is drained for a short
+	// time, then reads stop even if processes spawned by the command still
+	// hold the outputs open.
+	for _, f := range outputs {
+		if f.SetReadDeadline(time.Now().Add(outputDrainTimeout)) != nil {
+			f.Close()
+		}
+	}
+	waitGroup.Wait()
+
+	return err
+}
+
+// startWithPipes starts a command with its stdout and stderr redirected to
+// separate pipes, returning their read ends in that order.
+func startWithPipes(cmd *exec.Cmd) ([]*os.File, error) {
+	var readers, writers []*os.File
+	for i := 0; i < 2; i++ {
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			closeFiles(readers)
+			closeFiles(writers)
+			return nil, err
+		}
+		readers = append(readers, pr)
+		writers = append(writers, pw)
+	}
+
+	cmd.Stdout = writers[0]
+	cmd.Stderr = writers[1]
+	err := cmd.Start()
+
+	// The command has its own copies of the write ends of the pipes.
+	// Closing these ensures reads reach EOF once the command exits.
+	closeFiles(writers)
+	if err != nil {
+		closeFiles(readers)
+		return nil, err
+	}
+	return readers, nil
+}
+
+// closeFiles closes each of a list of files.
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// sessionWriter is an io.Writer which sends a session's output to its client,
+// as either stdout or stderr.
+type sessionWriter struct {
+	send   func(*pb.SessionOutput) error
+	stderr bool
+}
+
+func (w *sessionWriter) Write(p []byte) (int, error) {
+	// The message is serialized before Send returns, so p need not be
+	// copied.
+	out := &pb.SessionOutput{Output: &pb.SessionOutput_Stdout{Stdout: p}}
+	if w.stderr {
+		out = &pb.SessionOutput{Output: &pb.SessionOutput_Stderr{Stderr: p}}
+	}
+	if err := w.send(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// InteractiveSession runs an executable interactively, forwarding the client's
+// input to it and its output to the client.
+func (s *pwTargetRunnerService) InteractiveSession(
+	stream pb.TargetRunner_InteractiveSessionServer,
+) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	start := first.GetStart()
+	if start == nil {
+		return status.Error(
+			codes.InvalidArgument, "First message of a session must start it")
+	}
+	path, err := s.server.checkAllowedPath(start.FilePath)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	// The session's output is sent from the runner's goroutines and the
+	// worker's, which gRPC does not allow to send at the same time. If the
+	// session is abandoned, the worker may still be running it after this
+	// handler returns, when the stream can no longer be used, so sends are
+	// refused from then on.
+	var sendMutex sync.Mutex
+	ended := false
+	send := func(out *pb.SessionOutput) error {
+		sendMutex.Lock()
+		defer sendMutex.Unlock()
+		if ended {
+			return io.ErrClosedPipe
+		}
+		return stream.Send(out)
+	}
+	defer func() {
+		sendMutex.Lock()
+		ended = true
+		sendMutex.Unlock()
+	}()
+
+	// Closing the reader once the session ends unblocks any write of input
+	// which the command will no longer read.
+	stdinReader, stdinWriter := io.Pipe()
+	defer stdinReader.Close()
+
+	// Closed if the client sends a message which does not belong in a
+	// running session, which ends it.
+	invalid := make(chan struct{})
+
+	go func() {
+		for {
+			in, err := stream.Recv()
+			if err == io.EOF {
+				stdinWriter.Close()
+				return
+			}
+			if err != nil {
+				stdinWriter.CloseWithError(err)
+				cancel()
+				return
+			}
+
+			switch input := in.Input.(type) {
+			case *pb.SessionInput_Stdin:
+				if _, err := stdinWriter.Write(input.Stdin); err != nil {
+					return
+				}
+			case *pb.SessionInput_CloseStdin:
+				stdinWriter.Close()
+			default:
+				close(invalid)
+				stdinWriter.Close()
+				cancel()
+				return
+			}
+		}
+	}()
+
+	req := &RunRequest{
+		Path:    path,
+		Args:    start.Args,
+		Timeout: time.Duration(start.TimeoutNs),
+		Session: &Session{
+			Stdin:  stdinReader,
+			Stdout: &sessionWriter{send: send},
+			Stderr: &sessionWriter{send: send, stderr: true},
+		},
+	}
+	req.OnStart = func() {
+		send(&pb.SessionOutput{
+			Output: &pb.SessionOutput_Started{
+				Started: &pb.SessionStarted{RequestId: req.ID},
+			},
+		})
+	}
+
+	res, err := s.server.RunSession(ctx, req)
+	select {
+	case <-invalid:
+		return status.Error(
+			codes.InvalidArgument, "Session received a message other than input")
+	default:
+	}
+	if err != nil {
+		return rpcError(err)
+	}
+
+	return send(&pb.SessionOutput{
+		Output: &pb.SessionOutput_Exit{
+			Exit: &pb.SessionExit{
+				Result:    res.Status,
+				RunTimeNs: uint64(res.RunTime),
+			},
+		},
+	})
+}
@@ -0,0 +1,139 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"errors"
+	"log"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+var errShutdownTimedOut = errors.New("Server shutdown timed out")
+
+// Shutdown stops a running server. The gRPC server stops accepting RPCs, and
+// the workers exit once the requests they are running complete. Requests still
+// queued then are cancelled. If this takes longer than timeout, such as when a
+// worker is stuck running an executable which ignores signals, the server is
+// stopped forcibly: remaining requests are abandoned and cancelled, the
+// processes of running commands are killed, and an error is returned without
+// waiting for the stuck workers. A timeout of zero waits indefinitely.
+func (s *Server) Shutdown(timeout time.Duration) error {
+	if !s.state.isActive() {
+		return errServerNotRunning
+	}
+	s.state.stop()
+
+	log.Println("Shutting down server")
+
+	// The gRPC server waits for RPCs in progress, which complete as the
+	// requests they are waiting on do or are cancelled.
+	grpcDone := make(chan struct{})
+	go func() {
+		if s.grpcServer != nil {
+			s.grpcServer.GracefulStop()
+		}
+		close(grpcDone)
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		s.workerPool.Stop()
+
+		// With the workers stopped, requests remaining in the queue
+		// would never run.
+		s.cancelRequests(false)
+		<-grpcDone
+		close(done)
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-done:
+		log.Println("Server shut down")
+		return nil
+	case <-expired:
+	}
+
+	log.Printf("Server did not shut down within %v; stopping forcibly\n", timeout)
+	s.cancelRequests(true)
+	if s.grpcServer != nil {
+		s.grpcServer.Stop()
+	}
+	if killed := runningCommands.killAll(); killed > 0 {
+		log.Printf("Killed %d running command(s)\n", killed)
+	}
+
+	return errShutdownTimedOut
+}
+
+// cancelRequests cancels all of the server's queued and running requests. If
+// abandoned is set, each is logged as having been abandoned by a forced
+// shutdown.
+func (s *Server) cancelRequests(abandoned bool) {
+	s.requestsMutex.Lock()
+	defer s.requestsMutex.Unlock()
+
+	for id, tracked := range s.requests {
+		if abandoned {
+			log.Printf("[%s] Abandoning request for %s\n", id, tracked.path)
+		}
+		tracked.cancel()
+	}
+}
+
+// commandSet tracks the commands started by the package's runners which have
+// not yet exited, so that they can be killed if the server is stopped
+// forcibly.
+type commandSet struct {
+	mutex    sync.Mutex
+	commands map[*exec.Cmd]bool
+}
+
+// Commands started by runners which are still running.
+var runningCommands = commandSet{commands: make(map[*exec.Cmd]bool)}
+
+// add tracks a started command until the returned function is called once it
+// has exited.
+func (c *commandSet) add(cmd *exec.Cmd) func() {
+	c.mutex.Lock()
+	c.commands[cmd] = true
+	c.mutex.Unlock()
+
+	return func() {
+		c.mutex.Lock()
+		delete(c.commands, cmd)
+		c.mutex.Unlock()
+	}
+}
+
+// killAll kills every running command with SIGKILL, along with the processes
+// in its process group if it leads one, returning how many there were.
+func (c *commandSet) killAll() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for cmd := range c.commands {
+		killProcessTree(cmd)
+	}
+	return len(c.commands)
+}
@@ -0,0 +1,211 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+// Package testutil provides helpers for testing code which uses the target
+// runner library without running real executables.
+package testutil
+
+import (
+	"sync"
+	"time"
+
+	pb "pigweed.dev/proto/pw_target_runner/target_runner_pb"
+	"pigweed.dev/pw_target_runner"
+)
+
+// FakeResult is the canned result of a run by a FakeDeviceRunner.
+type FakeResult struct {
+	// Status with which the run completes.
+	Status pb.RunStatus
+
+	// Output returned by the run. It is also passed to the request's
+	// OnOutput function, if it has one.
+	Output []byte
+
+	// How long the run takes. If the request's context is done first, the
+	// run is abandoned and fails with the context's error.
+	Delay time.Duration
+
+	// If set, the run fails with this error instead of completing.
+	Err error
+}
+
+// FakeDeviceRunner is a DeviceRunner which returns canned results without
+// running anything, for fast and deterministic tests of worker pools and
+// servers. Results are configured per path, with a default for other paths.
+// Its methods are safe to call while it is registered with a running pool.
+type FakeDeviceRunner struct {
+	mutex         sync.Mutex
+	results       map[string]FakeResult
+	sequences     map[string][]FakeResult
+	defaultResult FakeResult
+	startErr      error
+	startDelay    time.Duration
+	healthErr     error
+
+	// Paths of the requests handled, in the order in which they started.
+	requests []string
+
+	starts int
+	exits  int
+}
+
+// NewFakeDeviceRunner creates a fake runner whose runs all succeed immediately
+// with no output.
+func NewFakeDeviceRunner() *FakeDeviceRunner {
+	return &FakeDeviceRunner{
+		results:       make(map[string]FakeResult),
+		sequences:     make(map[string][]FakeResult),
+		defaultResult: FakeResult{Status: pb.RunStatus_SUCCESS},
+	}
+}
+
+// SetResult sets the result of runs of an executable path.
+func (r *FakeDeviceRunner) SetResult(path string, result FakeResult) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.results[path] = result
+}
+
+// SetResultSequence sets the results of the next runs of an executable path,
+// such as to fake a flaky executable. Each run takes the next result in order;
+// once they are used up, runs of the path get its result from SetResult or the
+// default.
+func (r *FakeDeviceRunner) SetResultSequence(path string, results ...FakeResult) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.sequences[path] = append([]FakeResult(nil), results...)
+}
+
+// SetDefaultResult sets the result of runs of paths with no result of their own.
+func (r *FakeDeviceRunner) SetDefaultResult(result FakeResult) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.defaultResult = result
+}
+
+// SetStartError makes subsequent calls to WorkerStart fail with err, or succeed
+// if it is nil.
+func (r *FakeDeviceRunner) SetStartError(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.startErr = err
+}
+
+// SetStartDelay makes subsequent calls to WorkerStart take d before returning,
+// such as to fake a board which is slow to enumerate.
+func (r *FakeDeviceRunner) SetStartDelay(d time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.startDelay = d
+}
+
+// SetHealthError makes subsequent health checks fail with err, or pass if it is
+// nil.
+func (r *FakeDeviceRunner) SetHealthError(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.healthErr = err
+}
+
+// Requests returns the paths of the requests the runner has handled, in the
+// order in which they started.
+func (r *FakeDeviceRunner) Requests() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string(nil), r.requests...)
+}
+
+// Starts returns the number of times WorkerStart has been called.
+func (r *FakeDeviceRunner) Starts() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.starts
+}
+
+// Exits returns the number of times WorkerExit has been called.
+func (r *FakeDeviceRunner) Exits() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.exits
+}
+
+// WorkerStart counts the start of the worker, failing if a start error is set
+// once any start delay has passed.
+func (r *FakeDeviceRunner) WorkerStart() error {
+	r.mutex.Lock()
+	r.starts++
+	delay, err := r.startDelay, r.startErr
+	r.mutex.Unlock()
+
+	time.Sleep(delay)
+	return err
+}
+
+// WorkerExit counts the exit of the worker.
+func (r *FakeDeviceRunner) WorkerExit() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.exits++
+}
+
+// HealthCheck fails with the health error, if one is set.
+func (r *FakeDeviceRunner) HealthCheck() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.healthErr
+}
+
+// HandleRunRequest returns the next canned result for the request's path after
+// its delay.
+func (r *FakeDeviceRunner) HandleRunRequest(
+	req *pw_target_runner.RunRequest,
+) *pw_target_runner.RunResponse {
+	r.mutex.Lock()
+	r.requests = append(r.requests, req.Path)
+	result, ok := r.results[req.Path]
+	if !ok {
+		result = r.defaultResult
+	}
+	if sequence := r.sequences[req.Path]; len(sequence) > 0 {
+		result = sequence[0]
+		r.sequences[req.Path] = sequence[1:]
+	}
+	r.mutex.Unlock()
+
+	if result.Delay > 0 {
+		timer := time.NewTimer(result.Delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			return &pw_target_runner.RunResponse{Err: req.Context().Err()}
+		}
+	}
+
+	if result.Err != nil {
+		return &pw_target_runner.RunResponse{Err: result.Err}
+	}
+
+	output := append([]byte(nil), result.Output...)
+	if req.OnOutput != nil && len(output) > 0 {
+		req.OnOutput(output)
+	}
+
+	return &pw_target_runner.RunResponse{
+		Output: output,
+		Status: result.Status,
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "pigweed.dev/proto/pw_target_runner/target_runner_pb"
+)
+
+// Number of bytes of an upload received between the progress updates sent by
+// UploadAndRunBinaryStream.
+const uploadProgressInterval = 1 << 20
+
+// UploadAndRunBinary receives an executable from the client, writes it to a
+// temporary file, and runs it. The file is deleted once the run completes.
+func (s *pwTargetRunnerService) UploadAndRunBinary(
+	stream pb.TargetRunner_UploadAndRunBinaryServer,
+) error {
+	desc, path, err := s.receiveBinary(stream, nil)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	req := runRequestFromProto(desc)
+	req.Path = path
+
+	runRes, err := s.server.Run(stream.Context(), req)
+	if err != nil {
+		return rpcError(err)
+	}
+
+	return stream.SendAndClose(runResponseToProto(desc, runRes))
+}
+
+// UploadAndRunBinaryStream receives an executable from the client as
+// UploadAndRunBinary does, sending updates on how much of it has been received,
+// then runs it, streaming updates on the run as RunBinaryStream does.
+func (s *pwTargetRunnerService) UploadAndRunBinaryStream(
+	stream pb.TargetRunner_UploadAndRunBinaryStreamServer,
+) error {
+	var total uint64
+	var reported int64
+	progress := func(received int64, first *pb.BinaryChunk, done bool) error {
+		if first != nil {
+			total = first.Size
+		}
+		if !done && received-reported < uploadProgressInterval {
+			return nil
+		}
+		reported = received
+
+		return stream.Send(&pb.RunBinaryUpdate{
+			Update: &pb.RunBinaryUpdate_UploadProgress{
+				UploadProgress: &pb.UploadProgress{
+					BytesReceived: uint64(received),
+					TotalBytes:    total,
+				},
+			},
+		})
+	}
+
+	desc, path, err := s.receiveBinary(stream, progress)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	// The uploaded binary is removed once the RPC returns, so its run
+	// cannot outlive the client.
+	desc.ContinueOnDisconnect = false
+
+	req := runRequestFromProto(desc)
+	req.Path = path
+	return s.streamRun(desc, req, stream)
+}
+
+// chunkReceiver is the receiving side of an RPC which uploads a binary.
+type chunkReceiver interface {
+	Recv() (*pb.BinaryChunk, error)
+}
+
+// receiveBinary receives an uploaded executable into a temporary file,
+// returning the description of the request to run it and the file's path. The
+// caller must remove the file. The upload must be within the server's maximum
+// size, and match its declared size and digest, if given. If progress is not
+// nil, it is called with the number of bytes received after each chunk, along
+// with the first chunk when it is received, and once more with done set when
+// the upload is complete.
+func (s *pwTargetRunnerService) receiveBinary(
+	stream chunkReceiver,
+	progress func(received int64, first *pb.BinaryChunk, done bool) error,
+) (*pb.RunBinaryRequest, string, error) {
+	maxSize := s.server.maxUploadSize
+	if maxSize <= 0 {
+		return nil, "", status.Error(
+			codes.PermissionDenied, "Binary uploads are not enabled on this server")
+	}
+
+	first, err := stream.Recv()
+	if err != nil {
+		return nil, "", err
+	}
+
+	desc := first.GetRequest()
+	if desc == nil {
+		return nil, "", status.Error(
+			codes.InvalidArgument, "First upload chunk must contain the request")
+	}
+
+	// Uploads declared to be too large are rejected before they are sent.
+	if first.Size > uint64(maxSize) {
+		return nil, "", uploadTooLargeError(maxSize)
+	}
+
+	file, err := ioutil.TempFile("", "pw_target_runner_upload_*")
+	if err != nil {
+		log.Printf("Failed to create file for uploaded binary: %v\n", err)
+		return nil, "", status.Error(codes.Internal, "Internal server error")
+	}
+	defer file.Close()
+
+	received, err := receiveUpload(stream, first, file, maxSize, progress)
+	if err == nil {
+		err = received.verify(first.Size)
+	}
+	if err == nil && progress != nil {
+		err = progress(received.size, nil, true)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return nil, "", err
+	}
+
+	// The file must be closed before it is run, as executing a file which
+	// is open for writing fails on some systems.
+	if err := file.Chmod(0700); err != nil {
+		log.Printf("Failed to make uploaded binary executable: %v\n", err)
+		os.Remove(file.Name())
+		return nil, "", status.Error(codes.Internal, "Internal server error")
+	}
+	if err := file.Close(); err != nil {
+		log.Printf("Failed to write uploaded binary: %v\n", err)
+		os.Remove(file.Name())
+		return nil, "", status.Error(codes.Internal, "Internal server error")
+	}
+
+	log.Printf("Received %d byte upload of %s\n", received.size, desc.FilePath)
+	return desc, file.Name(), nil
+}
+
+// receivedUpload describes the contents of an upload as they were received.
+type receivedUpload struct {
+	size int64
+
+	// Digest of the received contents, and that which the client declared,
+	// if any.
+	digest   []byte
+	declared []byte
+}
+
+// verify checks that an upload was received intact: that its size matches the
+// size declared by the client, if nonzero, and its digest that declared.
+func (u *receivedUpload) verify(size uint64) error {
+	if size != 0 && uint64(u.size) != size {
+		return status.Errorf(
+			codes.DataLoss,
+			"Received %d bytes of a %d byte upload",
+			u.size,
+			size)
+	}
+	if u.declared != nil && !bytes.Equal(u.digest, u.declared) {
+		return status.Error(
+			codes.DataLoss, "Uploaded binary does not match its SHA-256 digest")
+	}
+	return nil
+}
+
+// receiveUpload writes the data from each chunk of an upload to a file, starting
+// with the already received first chunk, and hashes it. If the upload exceeds
+// maxSize bytes, an error is returned. progress is called as described in
+// receiveBinary, except for the final call.
+func receiveUpload(
+	stream chunkReceiver,
+	chunk *pb.BinaryChunk,
+	file *os.File,
+	maxSize int64,
+	progress func(received int64, first *pb.BinaryChunk, done bool) error,
+) (*receivedUpload, error) {
+	upload := &receivedUpload{}
+	hash := sha256.New()
+	first := chunk
+
+	for {
+		upload.size += int64(len(chunk.Data))
+		if upload.size > maxSize {
+			return nil, uploadTooLargeError(maxSize)
+		}
+
+		if _, err := file.Write(chunk.Data); err != nil {
+			log.Printf("Failed to write uploaded binary: %v\n", err)
+			return nil, status.Error(codes.Internal, "Internal server error")
+		}
+		hash.Write(chunk.Data)
+
+		if chunk.Sha256 != nil {
+			upload.declared = chunk.Sha256
+		}
+
+		if progress != nil {
+			if err := progress(upload.size, first, false); err != nil {
+				return nil, err
+			}
+			first = nil
+		}
+
+		var err error
+		chunk, err = stream.Recv()
+		if err == io.EOF {
+			upload.digest = hash.Sum(nil)
+			return upload, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// uploadTooLargeError returns the error with which uploads larger than maxSize
+// bytes are rejected.
+func uploadTooLargeError(maxSize int64) error {
+	return status.Errorf(
+		codes.ResourceExhausted,
+		"Uploaded binary exceeds maximum size of %d bytes",
+		maxSize)
+}
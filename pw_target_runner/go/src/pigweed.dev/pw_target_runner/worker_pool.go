@@ -15,10 +15,14 @@
 package pw_target_runner
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
-	"os"
+	"math"
+	"runtime/debug"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -28,18 +32,145 @@ import (
 
 // RunRequest represents a client request to run a single executable on-device.
 type RunRequest struct {
+	// Short identifier for the request, used to correlate it across logs.
+	// Assigned by the worker pool when the request is queued, if unset.
+	ID string
+
 	// Filesystem path to the executable.
 	Path string
 
-	// Channel to which the response is sent back.
+	// Arguments to pass to the executable. How these are passed is up to
+	// the worker.
+	Args []string
+
+	// If set, only the test case with this name is run. How the case is
+	// selected is up to the worker.
+	CaseFilter string
+
+	// If set, the executable stops at its first failing test case. How it
+	// is told to is up to the worker.
+	FailFast bool
+
+	// If set, the executable's output is discarded rather than returned.
+	DiscardOutput bool
+
+	// Maximum time the executable may run before it is terminated and
+	// fails, for runners which support timeouts. If zero, the runner's
+	// default timeout applies. Runners may cap the timeout at a maximum.
+	Timeout time.Duration
+
+	// If set, the time by which the request's result is needed. The pool
+	// rejects the request when it is queued if it estimates, from the
+	// depth of its queue and the average run times it has seen, that the
+	// request cannot complete by then.
+	Deadline time.Time
+
+	// If set, the executable is known to be flaky, and a run which fails is
+	// retried on the same worker up to RetriesOnFailure times. The request
+	// passes if any attempt passes. Runs which are not marked flaky are
+	// never retried.
+	Flaky            bool
+	RetriesOnFailure int
+
+	// If either is nonzero, the executable is soaked: run repeatedly on the
+	// same worker until a run does not succeed, SoakIterations runs have
+	// passed, SoakDuration has elapsed, or the request is abandoned. The
+	// response is that of the first run which did not succeed, or of the
+	// last run if all of them did. Soaked requests are not retried.
+	SoakIterations int
+	SoakDuration   time.Duration
+
+	// If not PENDING, the status the executable is expected to have, such
+	// as FAILURE for a negative test. Runners which support this report
+	// SUCCESS if the executable's actual status matches, and FAILURE
+	// otherwise; others fail the request with an error.
+	ExpectedStatus pb.RunStatus
+
+	// Arbitrary labels attached to the request by its requester, such as
+	// the build it tests. They are not interpreted, but are passed along
+	// with the request to result sinks.
+	Labels map[string]string
+
+	// If set, the request is always run, even if the server de-duplicates
+	// identical requests.
+	NoDeduplicate bool
+
+	// If set, an opaque key chosen by the requester which identifies the
+	// request across retries. A server which honors idempotency keys
+	// returns the result of an earlier request with the same key rather
+	// than running the request again.
+	IdempotencyKey string
+
+	// If set, the executable's test cases are listed rather than run. This
+	// requires the worker's runner to implement CaseLister.
+	ListCases bool
+
+	// If set, the executable is run interactively, connected to the
+	// session, rather than with its output captured. This requires the
+	// worker's runner to implement InteractiveRunner.
+	Session *Session
+
+	// Channel to which the response is sent back. This should be buffered
+	// or read promptly; a worker gives up on sending the response if it is
+	// not received within the pool's response timeout.
 	ResponseChannel chan<- *RunResponse
 
+	// Optional channel to which an error is sent if the response was
+	// dropped because it was not received in time. The send never blocks,
+	// so the channel should be buffered.
+	ErrorChannel chan<- error
+
+	// Optional function called as the request is added to the queue, with
+	// its position in the queue starting from 1.
+	OnQueued func(position int)
+
+	// Optional function called when a worker starts running the request.
+	// This is called from the worker's goroutine, for the first attempt
+	// only if the request is retried after a backoff.
+	OnStart func()
+
+	// Optional function called with the executable's output as it is
+	// produced, for runners which support streaming output. The output is
+	// still returned in full in the response. Calls are made in order,
+	// from the runner's goroutines; the runner waits for each to return,
+	// so the function should not block indefinitely.
+	OnOutput func(data []byte)
+
+	// Controls how streamed output is grouped into calls to OnOutput.
+	OutputFlush OutputFlushPolicy
+
+	// Context of the request. Once it is done, the request is abandoned.
+	ctx context.Context
+
+	// Share of the worker pool's output budget, if it has one, against
+	// which runners count captured output. Internal to the package.
+	outputBudget *outputReservation
+
 	// Time when the request was queued. Internal to the worker pool.
 	queueStart time.Time
+
+	// Status of each attempt at running a flaky request which is retried
+	// through the queue, and when its first attempt ended. Internal to the
+	// worker pool.
+	attempts   []pb.RunStatus
+	retryStart time.Time
+}
+
+// Context returns the request's context. Workers should stop processing the
+// request when the context is done.
+func (r *RunRequest) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
 }
 
 // RunResponse is the response sent after a run request is processed.
 type RunResponse struct {
+	// Identifier of the request to which this is a response. Set by the
+	// worker pool.
+	RequestID string
+
 	// Length of time that the run request was queued before being handled
 	// by a worker. Set by the worker pool.
 	QueueTime time.Duration
@@ -51,9 +182,64 @@ type RunResponse struct {
 	// Raw output of the execution.
 	Output []byte
 
+	// Whether invalid UTF-8 sequences in Output were replaced.
+	OutputReplaced bool
+
+	// Number of bytes dropped from the start of Output, if only the end of
+	// the output was kept.
+	OutputDroppedBytes int64
+
+	// Output of any commands run before or after the executable by the
+	// runner, kept separately from the executable's own output.
+	HookOutput []byte
+
+	// Number of processes spawned by the executable which were still
+	// running after it exited and had to be killed, for runners which
+	// detect them.
+	LeakedProcesses int
+
+	// Resource usage of the executable's run, for runners which measure it:
+	// its peak resident set size, and the CPU time it spent in user and
+	// system mode. Zero if not measured.
+	MaxRSSBytes   int64
+	UserCPUTime   time.Duration
+	SystemCPUTime time.Duration
+
+	// Paths on the server of core dumps left by the executable, for runners
+	// which collect them.
+	CoreDumps []string
+
+	// Names of the executable's test cases, for requests which list cases.
+	Cases []string
+
 	// Result of the run.
 	Status pb.RunStatus
 
+	// For requests with an expected status, the status the executable
+	// actually had, before it was compared with the expected status.
+	ActualStatus pb.RunStatus
+
+	// Status of each attempt at running a flaky executable, in order. The
+	// response's other fields are those of the last attempt. Set by the
+	// worker pool for flaky requests only.
+	Attempts []pb.RunStatus
+
+	// For soaked requests, the number of times the executable was run, and
+	// the iteration, counting from 1, on which it did not succeed, or zero
+	// if every iteration succeeded. Set by the worker pool.
+	SoakIterations      int
+	SoakFailedIteration int
+
+	// Moving average of the run times of earlier successful runs of the
+	// executable, if the pool tracks them, for comparison with this run's.
+	// Zero if there is no average.
+	BaselineRunTime time.Duration
+
+	// Whether the response is that of an earlier request with the same
+	// idempotency key, rather than of a run for this request. Set by the
+	// server.
+	Replayed bool
+
 	// Error that occurred during the run, if any. If this is not nil, none
 	// of the other fields in this struct are guaranteed to be valid.
 	Err error
@@ -76,31 +262,258 @@ type DeviceRunner interface {
 	WorkerExit()
 }
 
+// HealthChecker is an optional interface which a DeviceRunner may implement to
+// report whether it is able to run executables. The worker pool calls
+// HealthCheck periodically and before handing a request to the worker. While
+// the check fails, the worker is considered unhealthy and is not given any
+// requests.
+type HealthChecker interface {
+	// HealthCheck returns an error if the worker is not currently able to
+	// run executables.
+	HealthCheck() error
+}
+
+// CaseLister is an optional interface which a DeviceRunner may implement to
+// list the test cases in an executable without running them.
+type CaseLister interface {
+	// ListCases returns the names of the test cases in the requested
+	// executable.
+	ListCases(*RunRequest) ([]string, error)
+}
+
+// ConcurrentRunner is an optional interface which a DeviceRunner may implement
+// to handle multiple requests at once, for example if it runs executables on
+// hardware which supports running several of them in parallel. The runner's
+// HandleRunRequest, and HealthCheck if it is implemented, must then be safe to
+// call concurrently.
+type ConcurrentRunner interface {
+	// Capacity returns the maximum number of requests the worker can
+	// handle at once.
+	Capacity() int
+}
+
+// SettlingRunner is an optional interface which a DeviceRunner may implement to
+// have the pool wait between the requests it runs, for example to let the power
+// rails of a board settle after it is flashed.
+type SettlingRunner interface {
+	// SettleDelay returns how long the worker waits after running an
+	// executable before it takes another request. The wait is cut short if
+	// the pool is stopped.
+	SettleDelay() time.Duration
+}
+
+// WorkerInfo describes the current state of a worker in a pool.
+type WorkerInfo struct {
+	// Index of the worker within its pool.
+	ID int
+
+	// Whether the worker's most recent health check passed.
+	Healthy bool
+
+	// Whether the worker has been quarantined after repeated errors, and is
+	// not given requests until it is released.
+	Quarantined bool
+
+	// Whether the worker is currently running an executable.
+	Busy bool
+
+	// Whether the worker's routine is running.
+	Running bool
+
+	// Number of requests the worker is currently handling, and the maximum
+	// number it can handle at once.
+	ActiveRequests int
+	Capacity       int
+
+	// Counts of the requests the worker has run over its lifetime.
+	Stats WorkerStats
+}
+
+// PoolStats describes the state of a worker pool and the requests it has
+// handled since it was created.
+type PoolStats struct {
+	// Number of requests waiting to be taken by a worker.
+	QueueDepth int
+
+	// Number of registered workers, those running at least one request, and
+	// those whose most recent health check failed.
+	WorkersTotal     int
+	WorkersBusy      int
+	WorkersUnhealthy int
+
+	// Number of workers quarantined after repeated errors.
+	WorkersQuarantined int
+
+	// Number of requests added to the queue, of requests which a worker
+	// finished with, and of requests refused because no worker was able
+	// to run them.
+	RequestsQueued    uint64
+	RequestsCompleted uint64
+	RequestsRejected  uint64
+
+	// Whether the pool is paused.
+	Paused bool
+}
+
+// workerState tracks a registered worker and its status within the pool.
+type workerState struct {
+	id      int
+	runner  DeviceRunner
+	healthy bool
+
+	// Number of requests the worker is handling, and the maximum number it
+	// can handle at once.
+	active   int
+	capacity int
+
+	// How long the worker waits after running an executable before it
+	// takes another request in its place.
+	settleDelay time.Duration
+
+	// Whether the worker's routine is running. Workers are stopped when the
+	// pool is stopped, or when they shut down after being idle.
+	running bool
+
+	// Whether the worker's routine exited because the worker failed to
+	// start.
+	startFailed bool
+
+	// Whether a WorkerStart hook which timed out has yet to return. The
+	// worker is not started again until it has.
+	startPending bool
+
+	// Requests assigned to the worker by the pool's dispatch strategy, and
+	// the number assigned which have not completed. Unused if the pool has
+	// no dispatch strategy.
+	assignedChannel chan *RunRequest
+	assigned        int
+
+	// Moving average of the time the worker has taken to run requests.
+	averageRunTime time.Duration
+
+	// Number of consecutive requests for which the worker's runner returned
+	// an error, and whether the worker is quarantined because of them.
+	consecutiveErrors int
+	quarantined       bool
+
+	// Counts of the requests the worker has run over its lifetime.
+	stats WorkerStats
+}
+
+// available returns whether a worker is able to be given requests: that it is
+// healthy and not quarantined. The state mutex must be held.
+func (w *workerState) available() bool {
+	return w.healthy && !w.quarantined
+}
+
 // WorkerPool represents a collection of device runners which run on-device
 // binaries. The worker pool distributes requests to run binaries among its
 // available workers.
 type WorkerPool struct {
-	activeWorkers uint32
-	logger        *log.Logger
-	workers       []DeviceRunner
-	waitGroup     sync.WaitGroup
-	reqChannel    chan *RunRequest
-	quitChannel   chan bool
+	// Lifetime request counters, accessed atomically. These are kept at
+	// the start of the struct to be 64-bit aligned on 32-bit platforms.
+	requestsQueued    uint64
+	requestsCompleted uint64
+	requestsRejected  uint64
+
+	// Number of queued requests not yet taken by a worker, accessed
+	// atomically.
+	queueDepth int64
+
+	activeWorkers       uint32
+	logger              *log.Logger
+	workers             []*workerState
+	stateMutex          sync.Mutex
+	waitGroup           sync.WaitGroup
+	reqChannel          chan *RunRequest
+	quitChannel         chan bool
+	resultSinks         []ResultSink
+	eventListeners      []EventListener
+	healthCheckInterval time.Duration
+	responseTimeout     time.Duration
+	startTimeout        time.Duration
+	idleTimeout         time.Duration
+	minWarmWorkers      int
+	retryBackoff        RetryBackoff
+	started             bool
+
+	// Queue of session requests, which are taken directly by the workers
+	// which accept sessions, bypassing any dispatch strategy.
+	sessionChannel chan *RunRequest
+
+	// Channel which is closed when the pool is stopped, cutting short the
+	// settle delays of its workers.
+	stopping chan struct{}
+
+	// Whether workers are held from taking requests, and a channel which
+	// is closed and replaced whenever that changes, to wake them.
+	paused       bool
+	pauseChanged chan struct{}
+
+	// If set, limits the output held in memory by all running requests.
+	outputBudget *outputBudget
+
+	// If set, tracks the average run time of each executable.
+	runTimes *runTimeTracker
+
+	// If nonzero, the number of consecutive errors after which a worker is
+	// quarantined, and how often quarantined workers are probed.
+	quarantineThreshold     int
+	quarantineProbeInterval time.Duration
+
+	// If set, the file to which the workers' statistics are saved, the
+	// statistics loaded from it which have yet to be restored, and when
+	// they were last saved.
+	statsPath      string
+	savedStats     []savedWorkerStats
+	statsSaveMutex sync.Mutex
+	statsSaved     time.Time
+
+	// If set, a dispatch routine assigns requests to workers using this
+	// strategy. Otherwise, workers take requests from the queue as they
+	// become free.
+	strategy     DispatchStrategy
+	dispatchWake chan struct{}
+	dispatchQuit chan struct{}
+	dispatchDone chan struct{}
 }
 
+// Default interval between health checks of workers which support them.
+const defaultHealthCheckInterval = time.Minute
+
+// Default time a worker waits for a response to be received from its request's
+// response channel before dropping it.
+const defaultResponseTimeout = 30 * time.Second
+
 var (
 	errWorkerPoolActive    = errors.New("Worker pool is running")
 	errNoRegisteredWorkers = errors.New("No workers registered in pool")
+	errNoAvailableWorkers  = errors.New("No healthy workers available in pool")
+
+	errCaseListingUnsupported = errors.New("Worker does not support listing cases")
+	errCaseFilterUnsupported  = errors.New("Worker does not support case filters")
+	errFailFastUnsupported    = errors.New("Worker does not support fail-fast runs")
+
+	errExpectedStatusUnsupported = errors.New("Worker does not support expected statuses")
+
+	errResponseTimeout    = errors.New("Response was not received in time and was dropped")
+	errWorkerStartTimeout = errors.New("Worker did not start in time")
+
+	errResponseChannelClosed = errors.New("Response channel was closed")
 )
 
 // newWorkerPool creates an empty worker pool.
 func newWorkerPool(name string) *WorkerPool {
-	logPrefix := fmt.Sprintf("[%s] ", name)
 	return &WorkerPool{
-		logger:      log.New(os.Stdout, logPrefix, log.LstdFlags),
-		workers:     make([]DeviceRunner, 0),
-		reqChannel:  make(chan *RunRequest, 1024),
-		quitChannel: make(chan bool, 64),
+		logger:              newLogger(name),
+		workers:             make([]*workerState, 0),
+		reqChannel:          make(chan *RunRequest, 1024),
+		quitChannel:         make(chan bool, 64),
+		sessionChannel:      make(chan *RunRequest, 1024),
+		healthCheckInterval: defaultHealthCheckInterval,
+		responseTimeout:     defaultResponseTimeout,
+		dispatchWake:        make(chan struct{}, 1),
+		pauseChanged:        make(chan struct{}),
 	}
 }
 
@@ -110,7 +523,189 @@ func (p *WorkerPool) RegisterWorker(worker DeviceRunner) error {
 	if p.Active() {
 		return errWorkerPoolActive
 	}
-	p.workers = append(p.workers, worker)
+	capacity := 1
+	if c, ok := worker.(ConcurrentRunner); ok && c.Capacity() > 1 {
+		capacity = c.Capacity()
+	}
+	var settleDelay time.Duration
+	if s, ok := worker.(SettlingRunner); ok {
+		settleDelay = s.SettleDelay()
+	}
+
+	p.workers = append(p.workers, &workerState{
+		id:              len(p.workers),
+		runner:          worker,
+		healthy:         true,
+		capacity:        capacity,
+		settleDelay:     settleDelay,
+		assignedChannel: make(chan *RunRequest, capacity),
+	})
+	return nil
+}
+
+// SetHealthCheckInterval sets how often workers implementing HealthChecker
+// have their health checked while idle. This cannot be done while the pool is
+// processing requests.
+func (p *WorkerPool) SetHealthCheckInterval(interval time.Duration) error {
+	if p.Active() {
+		return errWorkerPoolActive
+	}
+	p.healthCheckInterval = interval
+	return nil
+}
+
+// SetDispatchStrategy sets the strategy with which the pool assigns requests to
+// workers. By default, the strategy is nil, and each request is taken by
+// whichever worker is free first, which suits pools of identical workers. With
+// a strategy, such as LeastLoaded, the pool chooses a worker for each request
+// based on the load of the workers. This cannot be done while the pool is
+// processing requests.
+func (p *WorkerPool) SetDispatchStrategy(strategy DispatchStrategy) error {
+	if p.Active() {
+		return errWorkerPoolActive
+	}
+	p.strategy = strategy
+	return nil
+}
+
+// SetResponseTimeout sets how long a worker waits for a response to be received
+// from a request's response channel. If the requester does not read the
+// response in time, it is dropped so that the worker is not stalled. This
+// cannot be done while the pool is processing requests.
+func (p *WorkerPool) SetResponseTimeout(timeout time.Duration) error {
+	if p.Active() {
+		return errWorkerPoolActive
+	}
+	p.responseTimeout = timeout
+	return nil
+}
+
+// SetWorkerStartTimeout sets how long a worker's WorkerStart hook may take, such
+// as to enumerate its board. A worker which does not start in time is treated
+// as having failed to start, so that one unresponsive worker cannot hold up the
+// others; its hook is left to finish in the background, and the worker is not
+// started again until it has. If the hook eventually succeeds, the worker's
+// WorkerExit hook is called. A timeout of zero, the default, waits
+// indefinitely. This cannot be done while the pool is
+// processing requests.
+func (p *WorkerPool) SetWorkerStartTimeout(timeout time.Duration) error {
+	if p.Active() {
+		return errWorkerPoolActive
+	}
+	p.startTimeout = timeout
+	return nil
+}
+
+// SetOutputBudget limits the total number of bytes of output which the pool's
+// running requests hold in memory, on top of any per-run limit of the runners.
+// Each request holds its share of the budget until its response has been sent.
+// The mode determines whether output beyond the budget is dropped or waits for
+// budget to be released. Only output captured by the package's runners in
+// memory is counted. A limit of zero, the default, disables the budget. This
+// cannot be done while the pool is processing requests.
+func (p *WorkerPool) SetOutputBudget(limit int64, mode OutputBudgetMode) error {
+	if p.Active() {
+		return errWorkerPoolActive
+	}
+
+	if limit > 0 {
+		p.outputBudget = newOutputBudget(limit, mode)
+	} else {
+		p.outputBudget = nil
+	}
+	return nil
+}
+
+// SetIdleShutdown configures workers to exit after going idleTimeout without
+// receiving a request, as long as at least minWarmWorkers would remain running.
+// Workers which have exited are started again when requests arrive and no
+// running worker is free to take them. An idleTimeout of zero, the default,
+// keeps workers running until the pool is stopped. This cannot be done while
+// the pool is processing requests.
+func (p *WorkerPool) SetIdleShutdown(idleTimeout time.Duration, minWarmWorkers int) error {
+	if p.Active() {
+		return errWorkerPoolActive
+	}
+	p.idleTimeout = idleTimeout
+	p.minWarmWorkers = minWarmWorkers
+	return nil
+}
+
+// RetryBackoff configures how long a worker pool waits before retrying a flaky
+// request whose run failed.
+type RetryBackoff struct {
+	// Delay before the first retry of a request.
+	Delay time.Duration
+
+	// Factor by which the delay grows with each further retry of the same
+	// request. Values of 1 or less keep the delay constant.
+	Multiplier float64
+
+	// If nonzero, the longest a request may spend being retried, counted
+	// from the end of its first attempt. A retry which would start later
+	// is not made, and the result of the last attempt is returned.
+	MaxWindow time.Duration
+}
+
+// delay returns how long to wait before the retry following an attempt.
+func (b RetryBackoff) delay(attempt int) time.Duration {
+	if b.Multiplier <= 1 {
+		return b.Delay
+	}
+	return time.Duration(float64(b.Delay) * math.Pow(b.Multiplier, float64(attempt-1)))
+}
+
+// SetRetryBackoff configures the pool to wait before retrying flaky requests
+// which fail, rather than retrying them immediately, so that a worker with
+// broken hardware is not hammered with retries. A request waiting to be retried
+// does not occupy a worker; once its delay has passed, it is queued again and
+// may be retried by any worker. With a zero delay, the default, flaky requests
+// are retried immediately on the worker which ran them. This cannot be done
+// while the pool is processing requests.
+func (p *WorkerPool) SetRetryBackoff(backoff RetryBackoff) error {
+	if p.Active() {
+		return errWorkerPoolActive
+	}
+	p.retryBackoff = backoff
+	return nil
+}
+
+// AddResultSink adds a sink to which the result of every processed request is
+// sent. This cannot be done while the pool is processing requests.
+func (p *WorkerPool) AddResultSink(sink ResultSink) error {
+	if p.Active() {
+		return errWorkerPoolActive
+	}
+	p.resultSinks = append(p.resultSinks, sink)
+	return nil
+}
+
+// EnableRunTimeTracking has the pool keep an exponential moving average of the
+// run time of each executable and test case it runs, which is returned in each
+// response as its BaselineRunTime. Only successful runs are added to the
+// averages, each weighted by smoothing, which must be in (0, 1]; higher values
+// follow recent runs more closely. Averages are kept for up to size of the most
+// recently run executables. Soaked requests are not tracked. This cannot be done
+// while the pool is processing requests.
+func (p *WorkerPool) EnableRunTimeTracking(size int, smoothing float64) error {
+	if p.Active() {
+		return errWorkerPoolActive
+	}
+	if size <= 0 || smoothing <= 0 || smoothing > 1 {
+		return errInvalidRunTimeTracking
+	}
+	p.runTimes = newRunTimeTracker(size, smoothing)
+	return nil
+}
+
+// AddEventListener adds a listener which is notified as each request is
+// queued, started, and completed. This cannot be done while the pool is
+// processing requests.
+func (p *WorkerPool) AddEventListener(listener EventListener) error {
+	if p.Active() {
+		return errWorkerPoolActive
+	}
+	p.eventListeners = append(p.eventListeners, listener)
 	return nil
 }
 
@@ -121,15 +716,41 @@ func (p *WorkerPool) Start() error {
 	}
 
 	p.logger.Printf("Starting %d workers\n", len(p.workers))
+
+	p.stateMutex.Lock()
+	p.started = true
+	p.stopping = make(chan struct{})
+	p.restoreWorkerStats()
 	for _, worker := range p.workers {
-		p.waitGroup.Add(1)
-		atomic.AddUint32(&p.activeWorkers, 1)
-		go p.runWorker(worker)
+		worker.quarantined = false
+		worker.consecutiveErrors = 0
+		if worker.startPending {
+			p.logger.Printf(
+				"Worker %d is still starting from before; not starting it again\n",
+				worker.id)
+			continue
+		}
+		p.startWorker(worker)
+	}
+	p.stateMutex.Unlock()
+
+	if p.strategy != nil {
+		p.dispatchQuit = make(chan struct{})
+		p.dispatchDone = make(chan struct{})
+		go p.dispatch(p.dispatchQuit, p.dispatchDone)
 	}
 
 	return nil
 }
 
+// startWorker launches the routine for a worker. The state mutex must be held.
+func (p *WorkerPool) startWorker(w *workerState) {
+	w.running = true
+	p.waitGroup.Add(1)
+	atomic.AddUint32(&p.activeWorkers, 1)
+	go p.runWorker(w, p.stopping)
+}
+
 // Stop terminates all running workers in the pool. The work queue is not
 // cleared; queued requests persist and can be processed by calling Start()
 // again.
@@ -138,53 +759,466 @@ func (p *WorkerPool) Stop() {
 		return
 	}
 
+	// Mark the pool as stopped so that no idle workers are restarted.
+	p.stateMutex.Lock()
+	p.started = false
+	if p.stopping != nil {
+		close(p.stopping)
+		p.stopping = nil
+	}
+	p.stateMutex.Unlock()
+
+	// Stop assigning requests before stopping the workers, which return
+	// any requests assigned to them to the queue as they exit.
+	if p.dispatchQuit != nil {
+		close(p.dispatchQuit)
+		<-p.dispatchDone
+		p.dispatchQuit = nil
+	}
+
 	// Send N quit commands to the workers and wait for them to exit.
-	for i := uint32(0); i < p.activeWorkers; i++ {
+	running := atomic.LoadUint32(&p.activeWorkers)
+	for i := uint32(0); i < running; i++ {
 		p.quitChannel <- true
 	}
 	p.waitGroup.Wait()
 
+	// Workers which shut down after being idle while the pool was stopping
+	// leave their quit commands unread. Discard them so that they do not
+	// stop workers the next time the pool is started.
+	for len(p.quitChannel) > 0 {
+		<-p.quitChannel
+	}
+
+	if p.statsPath != "" {
+		p.saveWorkerStats(true)
+	}
+
 	p.logger.Println("All workers in pool stopped")
 }
 
-// Active returns true if any worker routines are currently running.
+// Pause stops the pool's workers from taking further requests, without stopping
+// them. Requests which are running complete, and those queued, including any
+// queued while the pool is paused, wait until Resume is called. This is lighter
+// than Stop for briefly holding requests, e.g. during hardware maintenance, as
+// workers do not need to be started again.
+func (p *WorkerPool) Pause() {
+	p.setPaused(true)
+}
+
+// Resume allows the pool's workers to take requests again after Pause.
+func (p *WorkerPool) Resume() {
+	p.setPaused(false)
+	p.wakeDispatcher()
+}
+
+// Paused returns whether the pool is paused.
+func (p *WorkerPool) Paused() bool {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	return p.paused
+}
+
+// setPaused pauses or resumes the pool, waking its workers if that changes.
+func (p *WorkerPool) setPaused(paused bool) {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+
+	if p.paused == paused {
+		return
+	}
+
+	p.paused = paused
+	close(p.pauseChanged)
+	p.pauseChanged = make(chan struct{})
+
+	if paused {
+		p.logger.Printf(
+			"Pausing workers; %d queued requests are held\n",
+			atomic.LoadInt64(&p.queueDepth))
+	} else {
+		p.logger.Println("Resuming workers")
+	}
+}
+
+// pauseState returns whether the pool is paused and a channel which is closed
+// when that changes.
+func (p *WorkerPool) pauseState() (bool, <-chan struct{}) {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	return p.paused, p.pauseChanged
+}
+
+// Active returns true if the pool has been started, or if any worker routines
+// are currently running.
 func (p *WorkerPool) Active() bool {
-	return p.activeWorkers > 0
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	return p.started || atomic.LoadUint32(&p.activeWorkers) > 0
+}
+
+// Workers returns a snapshot of the state of each worker in the pool.
+func (p *WorkerPool) Workers() []WorkerInfo {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+
+	info := make([]WorkerInfo, len(p.workers))
+	for i, w := range p.workers {
+		info[i] = WorkerInfo{
+			ID:             w.id,
+			Healthy:        w.healthy,
+			Quarantined:    w.quarantined,
+			Busy:           w.active > 0,
+			Running:        w.running,
+			ActiveRequests: w.active,
+			Capacity:       w.capacity,
+			Stats:          w.stats,
+		}
+	}
+	return info
+}
+
+// Snapshot returns the current state of the pool and its request counters.
+func (p *WorkerPool) Snapshot() PoolStats {
+	stats := PoolStats{
+		QueueDepth:        int(atomic.LoadInt64(&p.queueDepth)),
+		RequestsQueued:    atomic.LoadUint64(&p.requestsQueued),
+		RequestsCompleted: atomic.LoadUint64(&p.requestsCompleted),
+		RequestsRejected:  atomic.LoadUint64(&p.requestsRejected),
+	}
+
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+
+	stats.Paused = p.paused
+
+	stats.WorkersTotal = len(p.workers)
+	for _, w := range p.workers {
+		if w.active > 0 {
+			stats.WorkersBusy++
+		}
+		if !w.healthy {
+			stats.WorkersUnhealthy++
+		}
+		if w.quarantined {
+			stats.WorkersQuarantined++
+		}
+	}
+	return stats
 }
 
 // QueueExecutable adds an executable to the worker pool's queue. If no workers
-// are registered in the pool, this operation fails and an immediate response is
-// sent back to the requester indicating the error.
+// are registered in the pool, none of them are able to process requests, or the
+// request cannot complete before its deadline, this operation fails and an
+// immediate response is sent back to the requester indicating the error.
 func (p *WorkerPool) QueueExecutable(req *RunRequest) {
+	if req.ID == "" {
+		req.ID = newRequestID()
+	}
+
 	if len(p.workers) == 0 {
-		p.logger.Printf("Attempt to queue executable %s with no active workers", req.Path)
-		req.ResponseChannel <- &RunResponse{
+		p.logger.Printf(
+			"[%s] Attempt to queue executable %s with no active workers\n",
+			req.ID,
+			req.Path)
+		atomic.AddUint64(&p.requestsRejected, 1)
+		p.sendResponse(req, &RunResponse{
 			Err: errNoRegisteredWorkers,
-		}
+		})
+		return
+	}
+
+	if req.Session != nil && !p.acceptsSessions() {
+		p.logger.Printf(
+			"[%s] Attempt to start session with %s with no interactive workers\n",
+			req.ID,
+			req.Path)
+		atomic.AddUint64(&p.requestsRejected, 1)
+		p.sendResponse(req, &RunResponse{
+			Err: errSessionsUnsupported,
+		})
+		return
+	}
+
+	if !p.hasAvailableWorker(req.Session != nil) {
+		p.logger.Printf(
+			"[%s] Attempt to queue executable %s with no healthy workers\n",
+			req.ID,
+			req.Path)
+		atomic.AddUint64(&p.requestsRejected, 1)
+		p.sendResponse(req, &RunResponse{
+			Err: errNoAvailableWorkers,
+		})
 		return
 	}
 
-	p.logger.Printf("Queueing executable %s\n", req.Path)
+	if err := p.checkDeadline(req); err != nil {
+		atomic.AddUint64(&p.requestsRejected, 1)
+		p.sendResponse(req, &RunResponse{Err: err})
+		return
+	}
+
+	p.logger.Printf("[%s] Queueing executable %s\n", req.ID, req.Path)
 
 	// Start tracking how long the request is queued.
 	req.queueStart = time.Now()
-	p.reqChannel <- req
+	atomic.AddUint64(&p.requestsQueued, 1)
+	atomic.AddInt64(&p.queueDepth, 1)
+	queue := p.reqChannel
+	if req.Session != nil {
+		queue = p.sessionChannel
+	}
+	if req.OnQueued != nil {
+		req.OnQueued(len(queue) + 1)
+	}
+	for _, listener := range p.eventListeners {
+		listener.OnQueued(req)
+	}
+	queue <- req
+
+	p.wakeIdleWorker(req.Session != nil)
+}
+
+// acceptsSessions returns whether any worker in the pool accepts session
+// requests.
+func (p *WorkerPool) acceptsSessions() bool {
+	for _, w := range p.workers {
+		if acceptsSessions(w.runner) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAvailableWorker returns whether any worker in the pool is able to process
+// requests, or session requests if sessions is set. A worker must be healthy,
+// not quarantined, and either running or, if the pool shuts down idle workers,
+// able to be restarted. Workers which failed to start are not available.
+// Requests queued before the pool is started wait for it to start, so all
+// workers are considered available until then.
+func (p *WorkerPool) hasAvailableWorker(sessions bool) bool {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+
+	if !p.started {
+		return true
+	}
+
+	for _, w := range p.workers {
+		if sessions && !acceptsSessions(w.runner) {
+			continue
+		}
+		if w.available() && !w.startFailed && (w.running || p.idleTimeout > 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// wakeIdleWorker restarts a worker which shut down after being idle if none of
+// the running workers are free to process requests, or session requests if
+// sessions is set.
+func (p *WorkerPool) wakeIdleWorker(sessions bool) {
+	if p.idleTimeout == 0 {
+		return
+	}
+
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+
+	if !p.started {
+		return
+	}
+
+	var stopped *workerState
+	for _, w := range p.workers {
+		if sessions && !acceptsSessions(w.runner) {
+			continue
+		}
+		if w.running && w.active < w.capacity && w.available() {
+			return
+		}
+		if !w.running && !w.quarantined && !w.startPending && stopped == nil {
+			stopped = w
+		}
+	}
+
+	if stopped != nil {
+		p.logger.Printf("Restarting idle worker %d to process requests\n", stopped.id)
+		p.startWorker(stopped)
+	}
+}
+
+// shouldExitIdle determines whether a worker which has been idle should shut
+// down, marking it as stopped if so.
+func (p *WorkerPool) shouldExitIdle(w *workerState) bool {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+
+	// A request may have been queued just as the worker became idle. As
+	// the queuing routine saw this worker as free, it will not have
+	// restarted another, so this worker must stay to process it.
+	if len(p.reqChannel) > 0 || acceptsSessions(w.runner) && len(p.sessionChannel) > 0 {
+		return false
+	}
+
+	// A quarantined worker which is probed stays running for its probes.
+	if w.quarantined && p.quarantineProbeInterval > 0 {
+		return false
+	}
+
+	running := 0
+	for _, other := range p.workers {
+		if other.running {
+			running++
+		}
+	}
+
+	if running <= p.minWarmWorkers {
+		return false
+	}
+
+	w.running = false
+	return true
+}
+
+// startRunner calls a worker's WorkerStart hook, returning
+// errWorkerStartTimeout if the pool has a start timeout and the hook does not
+// return within it.
+func (p *WorkerPool) startRunner(w *workerState) error {
+	if p.startTimeout <= 0 {
+		return w.runner.WorkerStart()
+	}
+
+	// The hook cannot be interrupted, so if it times out, the worker is
+	// marked as still starting until it returns. If it then succeeds, the
+	// worker is exited again, as the pool has given up on it. The result is
+	// passed back with the state mutex held so that it cannot be missed by
+	// a timeout at the same moment.
+	result := make(chan error, 1)
+	go func() {
+		err := w.runner.WorkerStart()
+
+		p.stateMutex.Lock()
+		abandoned := w.startPending
+		w.startPending = false
+		if !abandoned {
+			result <- err
+		}
+		p.stateMutex.Unlock()
+
+		if !abandoned {
+			return
+		}
+		if err != nil {
+			p.logger.Printf("Worker %d failed to start after timing out: %v\n", w.id, err)
+			return
+		}
+		p.logger.Printf("Worker %d started after timing out; exiting it\n", w.id)
+		w.runner.WorkerExit()
+	}()
+
+	timer := time.NewTimer(p.startTimeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+	}
+
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	select {
+	case err := <-result:
+		return err
+	default:
+		w.startPending = true
+		return errWorkerStartTimeout
+	}
 }
 
 // runWorker is a function run by the worker pool in a separate goroutine for
 // each of its registered workers. The function is responsible for calling the
 // appropriate worker lifecycle hooks and processing requests as they come in
 // through the worker pool's queue.
-func (p *WorkerPool) runWorker(worker DeviceRunner) {
+//
+// Each request is processed in its own goroutine, with up to the worker's
+// capacity of them running at once. Health checks and the idle timeout are
+// suspended while any requests are in progress. Settle delays end early once
+// stopping is closed.
+func (p *WorkerPool) runWorker(w *workerState, stopping <-chan struct{}) {
 	defer func() {
+		p.stateMutex.Lock()
+		w.running = false
+		p.stateMutex.Unlock()
+
+		// Once the worker is no longer running, no more requests are
+		// assigned to it.
+		if p.strategy != nil {
+			p.unassign(w)
+		}
+
 		atomic.AddUint32(&p.activeWorkers, ^uint32(0))
 		p.waitGroup.Done()
 	}()
 
-	if err := worker.WorkerStart(); err != nil {
+	worker := w.runner
+	if err := p.startRunner(w); err != nil {
+		p.logger.Printf("Worker %d failed to start: %v\n", w.id, err)
+		p.stateMutex.Lock()
+		w.startFailed = true
+		p.stateMutex.Unlock()
 		return
 	}
 
+	p.stateMutex.Lock()
+	w.startFailed = false
+	p.stateMutex.Unlock()
+	p.wakeDispatcher()
+
+	// With a dispatch strategy, the worker only takes requests assigned to
+	// it. Otherwise, it takes them directly from the pool's queue.
+	queue := p.reqChannel
+	if p.strategy != nil {
+		queue = w.assignedChannel
+	}
+
+	// Workers which support health checks are checked on startup and then
+	// periodically. Others are assumed to always be healthy, and receive
+	// no health check ticks.
+	healthChecker, checksHealth := worker.(HealthChecker)
+	var healthTicks <-chan time.Time
+	if checksHealth {
+		ticker := time.NewTicker(p.healthCheckInterval)
+		defer ticker.Stop()
+		healthTicks = ticker.C
+		p.checkHealth(w, healthChecker)
+	}
+
+	// Quarantined workers are probed periodically, if the pool is so
+	// configured, to see whether they have recovered. The timer runs only
+	// while the worker is quarantined.
+	var probeTimer *time.Timer
+	defer func() {
+		if probeTimer != nil {
+			probeTimer.Stop()
+		}
+	}()
+
+	// Workers configured to shut down when idle track how long it has been
+	// since they last processed a request.
+	var idleTimer *time.Timer
+	var idleTimeouts <-chan time.Time
+	if p.idleTimeout > 0 {
+		idleTimer = time.NewTimer(p.idleTimeout)
+		defer idleTimer.Stop()
+		idleTimeouts = idleTimer.C
+	}
+
+	inFlight := 0
+	requestDone := make(chan struct{}, w.capacity)
+
 processLoop:
 	for {
 		// Force the quit channel to be processed before the request
@@ -199,26 +1233,545 @@ processLoop:
 		default:
 		}
 
+		// An unhealthy worker does not take requests off the queue
+		// until a subsequent health check passes, a quarantined one
+		// until it is released, a worker at capacity until one of its
+		// requests completes, and no worker takes them while the pool
+		// is paused. Receiving from a nil channel blocks forever,
+		// removing the case from the select. Only workers which accept
+		// sessions take session requests.
+		paused, pauseChanged := p.pauseState()
+		reqChannel := queue
+		var sessions chan *RunRequest
+		if acceptsSessions(worker) {
+			sessions = p.sessionChannel
+		}
+		if !p.isAvailable(w) || inFlight >= w.capacity || paused {
+			reqChannel, sessions = nil, nil
+		}
+
+		var probes <-chan time.Time
+		if p.quarantineProbeInterval > 0 && p.isQuarantined(w) {
+			if probeTimer == nil {
+				probeTimer = time.NewTimer(p.quarantineProbeInterval)
+			}
+			probes = probeTimer.C
+		} else if probeTimer != nil {
+			probeTimer.Stop()
+			probeTimer = nil
+		}
+
+		ticks, timeouts := healthTicks, idleTimeouts
+		if inFlight > 0 {
+			ticks, timeouts = nil, nil
+		}
+
+		var req *RunRequest
 		select {
 		case q, ok := <-p.quitChannel:
 			if q || !ok {
 				break processLoop
 			}
-		case req, ok := <-p.reqChannel:
-			if !ok {
-				continue
+		case <-pauseChanged:
+		case <-ticks:
+			if !p.checkHealth(w, healthChecker) && p.strategy != nil {
+				p.unassign(w)
 			}
+		case <-probes:
+			probeTimer = nil
+			p.probeQuarantined(w, healthChecker)
+		case <-timeouts:
+			if p.shouldExitIdle(w) {
+				p.logger.Printf(
+					"Worker %d idle for %v; shutting down\n",
+					w.id,
+					p.idleTimeout)
+				break processLoop
+			}
+			idleTimer.Reset(p.idleTimeout)
+		case req = <-reqChannel:
+		case req = <-sessions:
+		case <-requestDone:
+			inFlight--
 
-			queueTime := time.Since(req.queueStart)
+			if inFlight == 0 && idleTimer != nil {
+				// The timer may have fired while requests were in
+				// progress, leaving a stale value in its channel.
+				if !idleTimer.Stop() {
+					select {
+					case <-idleTimer.C:
+					default:
+					}
+				}
+				idleTimer.Reset(p.idleTimeout)
+			}
+		}
+		if req == nil {
+			continue
+		}
 
-			runStart := time.Now()
-			res := worker.HandleRunRequest(req)
-			res.RunTime = time.Since(runStart)
+		// Session requests are not assigned by the dispatch strategy,
+		// so the worker has no assignment to release for them.
+		assigned := p.strategy != nil && req.Session == nil
 
-			res.QueueTime = queueTime
-			req.ResponseChannel <- res
+		// The pool may have been paused as the request was taken, and
+		// an unhealthy or quarantined worker cannot run it. Either way,
+		// the request is returned to the queue so that it can be picked
+		// up later or by another worker.
+		if p.Paused() || p.isQuarantined(w) ||
+			checksHealth && !p.checkHealth(w, healthChecker) {
+			if assigned {
+				p.requestFinished(w)
+			}
+			if p.strategy != nil {
+				p.unassign(w)
+			}
+			p.requeue(req)
+			continue
 		}
+
+		inFlight++
+		go func() {
+			ran := p.processRequest(w, req)
+
+			// The request's response has been sent, but if it ran
+			// an executable, the worker does not take another in
+			// its place until its runner has settled or the pool
+			// is stopped.
+			if ran && w.settleDelay > 0 {
+				settle := time.NewTimer(w.settleDelay)
+				select {
+				case <-settle.C:
+				case <-stopping:
+					settle.Stop()
+				}
+			}
+			if assigned {
+				p.requestFinished(w)
+			}
+			requestDone <- struct{}{}
+		}()
+	}
+
+	// Requests which are in progress are allowed to complete before the
+	// worker exits.
+	for ; inFlight > 0; inFlight-- {
+		<-requestDone
 	}
 
 	worker.WorkerExit()
 }
+
+// processRequest runs a single request on a worker and sends back its response.
+// It returns whether an executable was run for the request, as opposed to it
+// being dropped, listing cases, or running a session.
+func (p *WorkerPool) processRequest(w *workerState, req *RunRequest) bool {
+	queueTime := time.Since(req.queueStart)
+	atomic.AddInt64(&p.queueDepth, -1)
+
+	// Requests which are queued again to be retried are not yet complete.
+	retry := false
+	defer func() {
+		if !retry {
+			atomic.AddUint64(&p.requestsCompleted, 1)
+		}
+	}()
+
+	// Requests which were cancelled while waiting in the queue are dropped
+	// without being run.
+	if err := req.Context().Err(); err != nil {
+		p.logger.Printf("[%s] Request for %s cancelled while queued\n", req.ID, req.Path)
+		p.sendResponse(req, &RunResponse{QueueTime: queueTime, Err: err})
+		return false
+	}
+
+	if req.OnStart != nil && len(req.attempts) == 0 {
+		req.OnStart()
+	}
+	for _, listener := range p.eventListeners {
+		listener.OnStarted(req, w.id)
+	}
+
+	// The request's output is held until its response has been sent.
+	if p.outputBudget != nil {
+		req.outputBudget = p.outputBudget.reserve(req.Context())
+		defer req.outputBudget.release()
+	}
+
+	p.addActive(w, 1)
+	runStart := time.Now()
+	var res *RunResponse
+	if req.ListCases {
+		res = listCases(w.runner, req)
+	} else if req.Session != nil {
+		res = runSession(w.runner, req)
+	} else if req.SoakIterations > 0 || req.SoakDuration > 0 {
+		res = p.runSoak(w, req)
+	} else if p.retryBackoff.Delay > 0 {
+		res, retry = p.runAttempt(w, req)
+	} else {
+		res = p.runWithRetries(w, req)
+	}
+	res.RunTime = time.Since(runStart)
+	p.addActive(w, -1)
+
+	// Listing cases does not run the executable, and the run times of
+	// sessions depend on their requesters, so neither is used to estimate
+	// the run times of other requests.
+	timed := !req.ListCases && req.Session == nil
+	if timed {
+		p.recordRunTime(w, res.RunTime)
+		p.recordWorkerStats(w, req, res)
+	}
+
+	// Once a worker is quarantined, requests assigned to it are returned
+	// to the queue for other workers.
+	if p.recordOutcome(w, req, res) && p.strategy != nil {
+		p.unassign(w)
+	}
+
+	soaked := req.SoakIterations > 0 || req.SoakDuration > 0
+	if p.runTimes != nil && timed && !soaked && res.Err == nil {
+		res.BaselineRunTime = p.runTimes.observe(
+			runTimeKey(req), res.RunTime, res.Status == pb.RunStatus_SUCCESS)
+	}
+
+	res.QueueTime = queueTime
+
+	if retry {
+		p.scheduleRetry(req, res)
+		return true
+	}
+	p.sendResponse(req, res)
+	return timed
+}
+
+// runWithRetries runs a request on a worker. A flaky request whose run fails
+// is run again until an attempt does not fail, it runs out of retries, or it
+// is abandoned. Runs which end in an error or another status are not retried.
+func (p *WorkerPool) runWithRetries(w *workerState, req *RunRequest) *RunResponse {
+	if !req.Flaky || req.RetriesOnFailure <= 0 {
+		return w.runner.HandleRunRequest(req)
+	}
+
+	var attempts []pb.RunStatus
+	for attempt := 1; ; attempt++ {
+		res := w.runner.HandleRunRequest(req)
+		if res.Err != nil {
+			return res
+		}
+
+		attempts = append(attempts, res.Status)
+		res.Attempts = attempts
+
+		if !p.shouldRetry(req, res, attempt) {
+			return res
+		}
+
+		p.logger.Printf(
+			"[%s] Flaky executable %s failed on attempt %d of %d; retrying\n",
+			req.ID,
+			req.Path,
+			attempt,
+			req.RetriesOnFailure+1)
+
+		// The failed attempt's output is dropped, so its share of the
+		// output budget is returned.
+		req.outputBudget.release()
+	}
+}
+
+// runSoak runs a soaked request on a worker repeatedly until a run does not
+// succeed, the request's iteration or time limit is reached, or it is abandoned.
+// Each run's timeout applies to it alone. The output of a run which succeeded is
+// dropped when the next run starts.
+func (p *WorkerPool) runSoak(w *workerState, req *RunRequest) *RunResponse {
+	start := time.Now()
+	for iteration := 1; ; iteration++ {
+		res := w.runner.HandleRunRequest(req)
+		if res.Err != nil {
+			return res
+		}
+		res.SoakIterations = iteration
+
+		if res.Status != pb.RunStatus_SUCCESS {
+			res.SoakFailedIteration = iteration
+			p.logger.Printf(
+				"[%s] Soaked executable %s had status %v on iteration %d\n",
+				req.ID,
+				req.Path,
+				res.Status,
+				iteration)
+			return res
+		}
+
+		if (req.SoakIterations > 0 && iteration >= req.SoakIterations) ||
+			(req.SoakDuration > 0 && time.Since(start) >= req.SoakDuration) ||
+			req.Context().Err() != nil {
+			p.logger.Printf(
+				"[%s] Soaked executable %s passed %d iteration(s) in %v\n",
+				req.ID,
+				req.Path,
+				iteration,
+				time.Since(start))
+			return res
+		}
+
+		req.outputBudget.release()
+	}
+}
+
+// runAttempt runs a single attempt at a request on a worker, for pools which
+// back off before retrying flaky requests. It returns whether the request should
+// be queued again to be retried.
+func (p *WorkerPool) runAttempt(w *workerState, req *RunRequest) (*RunResponse, bool) {
+	res := w.runner.HandleRunRequest(req)
+	if res.Err != nil || !req.Flaky || req.RetriesOnFailure <= 0 {
+		return res, false
+	}
+
+	req.attempts = append(req.attempts, res.Status)
+	res.Attempts = req.attempts
+
+	attempt := len(req.attempts)
+	if !p.shouldRetry(req, res, attempt) {
+		return res, false
+	}
+
+	if attempt == 1 {
+		req.retryStart = time.Now()
+	}
+
+	delay := p.retryBackoff.delay(attempt)
+	window := p.retryBackoff.MaxWindow
+	if window > 0 && time.Since(req.retryStart)+delay > window {
+		p.logger.Printf(
+			"[%s] Flaky executable %s failed on attempt %d; retry window of %v "+
+				"exhausted\n",
+			req.ID,
+			req.Path,
+			attempt,
+			window)
+		return res, false
+	}
+
+	p.logger.Printf(
+		"[%s] Flaky executable %s failed on attempt %d of %d; retrying in %v\n",
+		req.ID,
+		req.Path,
+		attempt,
+		req.RetriesOnFailure+1,
+		delay)
+	return res, true
+}
+
+// shouldRetry returns whether a flaky request should be retried after the given
+// attempt: if the attempt failed, the request has retries left, and it has not
+// been abandoned.
+func (p *WorkerPool) shouldRetry(req *RunRequest, res *RunResponse, attempt int) bool {
+	if res.Status == pb.RunStatus_FAILURE &&
+		attempt <= req.RetriesOnFailure &&
+		req.Context().Err() == nil {
+		return true
+	}
+
+	if res.Status == pb.RunStatus_SUCCESS && attempt > 1 {
+		p.logger.Printf(
+			"[%s] Flaky executable %s passed on attempt %d\n",
+			req.ID,
+			req.Path,
+			attempt)
+	}
+	return false
+}
+
+// scheduleRetry queues a request again once the backoff delay following its
+// last attempt has passed. If the request is abandoned while it waits, the
+// response to its last attempt is sent instead.
+func (p *WorkerPool) scheduleRetry(req *RunRequest, res *RunResponse) {
+	delay := p.retryBackoff.delay(len(req.attempts))
+
+	go func() {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			p.sendResponse(req, res)
+			return
+		}
+
+		req.queueStart = time.Now()
+		atomic.AddInt64(&p.queueDepth, 1)
+		for _, listener := range p.eventListeners {
+			listener.OnQueued(req)
+		}
+		p.reqChannel <- req
+		p.wakeIdleWorker(false)
+	}()
+}
+
+// listCases lists the test cases in a requested executable using a worker's
+// runner.
+func listCases(runner DeviceRunner, req *RunRequest) *RunResponse {
+	lister, ok := runner.(CaseLister)
+	if !ok {
+		return &RunResponse{Err: errCaseListingUnsupported}
+	}
+
+	cases, err := lister.ListCases(req)
+	return &RunResponse{Cases: cases, Err: err}
+}
+
+// checkHealth runs a worker's health check and records the result, returning
+// whether the worker is healthy.
+func (p *WorkerPool) checkHealth(w *workerState, checker HealthChecker) bool {
+	err := checker.HealthCheck()
+	healthy := err == nil
+
+	p.stateMutex.Lock()
+	wasHealthy := w.healthy
+	w.healthy = healthy
+	p.stateMutex.Unlock()
+
+	if healthy && !wasHealthy {
+		p.wakeDispatcher()
+	}
+
+	if wasHealthy && !healthy {
+		p.logger.Printf("Worker %d failed health check: %v\n", w.id, err)
+	} else if !wasHealthy && healthy {
+		p.logger.Printf("Worker %d is healthy again\n", w.id)
+	}
+
+	return healthy
+}
+
+// isAvailable returns whether a worker is able to be given requests.
+func (p *WorkerPool) isAvailable(w *workerState) bool {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	return w.available()
+}
+
+// addActive adjusts the number of requests a worker is currently handling.
+func (p *WorkerPool) addActive(w *workerState, delta int) {
+	p.stateMutex.Lock()
+	w.active += delta
+	p.stateMutex.Unlock()
+}
+
+// recordRunTime updates a worker's moving average run time with the run time of
+// a request. Each request is weighted so that the average reflects roughly the
+// last few requests.
+func (p *WorkerPool) recordRunTime(w *workerState, runTime time.Duration) {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+
+	if w.averageRunTime == 0 {
+		w.averageRunTime = runTime
+	} else {
+		w.averageRunTime += (runTime - w.averageRunTime) / 4
+	}
+}
+
+// sendResponse sends a response back to a request's originator, tagging it with
+// the request's ID and passing it to the pool's result sinks and event
+// listeners. A sink or listener which panics is logged and skipped, without
+// affecting the others or the delivery of the response. If the requester does
+// not receive the response within the pool's response timeout, or has already
+// gone away and closed its response channel, the response is dropped rather
+// than stalling or taking down the sending goroutine.
+func (p *WorkerPool) sendResponse(req *RunRequest, res *RunResponse) {
+	res.RequestID = req.ID
+
+	// Listing an executable's cases does not run it, so there is no result
+	// to record.
+	if !req.ListCases {
+		for _, sink := range p.resultSinks {
+			p.guardCallback(req, "Result sink", func() {
+				if err := sink.OnResult(req, res); err != nil {
+					p.logger.Printf("[%s] Result sink failed: %v\n", req.ID, err)
+				}
+			})
+		}
+	}
+
+	for _, listener := range p.eventListeners {
+		p.guardCallback(req, "Event listener", func() {
+			listener.OnCompleted(req, res)
+		})
+	}
+
+	switch p.deliverResponse(req, res) {
+	case errResponseChannelClosed:
+		p.logger.Printf(
+			"[%s] Dropping response for %s: response channel closed\n",
+			req.ID,
+			req.Path)
+	case errResponseTimeout:
+		p.logger.Printf(
+			"[%s] Dropping response for %s: not received within %v\n",
+			req.ID,
+			req.Path,
+			p.responseTimeout)
+
+		if req.ErrorChannel != nil {
+			select {
+			case req.ErrorChannel <- errResponseTimeout:
+			default:
+			}
+		}
+	}
+}
+
+// guardCallback calls a result sink or event listener through callback for a
+// request, logging any panic in it rather than letting it propagate.
+func (p *WorkerPool) guardCallback(req *RunRequest, name string, callback func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.logger.Printf("[%s] %s panicked: %v\n%s", req.ID, name, r, debug.Stack())
+		}
+	}()
+	callback()
+}
+
+// deliverResponse sends a response on its request's response channel, waiting
+// up to the pool's response timeout for it to be received. It fails with
+// errResponseTimeout if it is not, or with errResponseChannelClosed if the
+// requester has closed the channel.
+func (p *WorkerPool) deliverResponse(req *RunRequest, res *RunResponse) (err error) {
+	defer func() {
+		if recover() != nil {
+			err = errResponseChannelClosed
+		}
+	}()
+
+	select {
+	case req.ResponseChannel <- res:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(p.responseTimeout)
+	defer timer.Stop()
+
+	select {
+	case req.ResponseChannel <- res:
+		return nil
+	case <-timer.C:
+		return errResponseTimeout
+	}
+}
+
+// newRequestID generates a short random identifier for a request.
+func newRequestID() string {
+	var id [6]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		// Fall back to a timestamp-based ID if no randomness is
+		// available, which is still sufficient to correlate logs.
+		return fmt.Sprintf("%012x", time.Now().UnixNano()&0xffffffffffff)
+	}
+	return hex.EncodeToString(id[:])
+}
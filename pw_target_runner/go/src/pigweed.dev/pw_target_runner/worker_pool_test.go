@@ -0,0 +1,1198 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "pigweed.dev/proto/pw_target_runner/target_runner_pb"
+	"pigweed.dev/pw_target_runner"
+	"pigweed.dev/pw_target_runner/testutil"
+)
+
+// receive waits for a response from a worker pool, failing the test if none is
+// sent in time.
+func receive(t *testing.T, resChan <-chan *pw_target_runner.RunResponse) *pw_target_runner.RunResponse {
+	t.Helper()
+	select {
+	case res := <-resChan:
+		return res
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for response")
+		return nil
+	}
+}
+
+func TestQueueExecutableWithoutWorkers(t *testing.T) {
+	pool := pw_target_runner.NewWorkerPool()
+	resChan := make(chan *pw_target_runner.RunResponse, 1)
+	pool.QueueExecutable(&pw_target_runner.RunRequest{
+		Path:            "/test/pass",
+		ResponseChannel: resChan,
+	})
+
+	if res := receive(t, resChan); res.Err == nil {
+		t.Error("Expected request to fail with no workers registered")
+	}
+}
+
+func TestQueueExecutableReturnsResults(t *testing.T) {
+	runner := testutil.NewFakeDeviceRunner()
+	runner.SetResult("/test/fail", testutil.FakeResult{
+		Status: pb.RunStatus_FAILURE,
+		Output: []byte("expected 1, got 2"),
+	})
+
+	pool := pw_target_runner.NewWorkerPool()
+	pool.RegisterWorker(runner)
+	if err := pool.Start(); err != nil {
+		t.Fatalf("Failed to start worker pool: %v", err)
+	}
+	defer pool.Stop()
+
+	resChan := make(chan *pw_target_runner.RunResponse, 1)
+	pool.QueueExecutable(&pw_target_runner.RunRequest{
+		ID:              "pass",
+		Path:            "/test/pass",
+		ResponseChannel: resChan,
+	})
+	res := receive(t, resChan)
+	if res.Err != nil || res.Status != pb.RunStatus_SUCCESS {
+		t.Errorf("Got status %v, error %v; want SUCCESS", res.Status, res.Err)
+	}
+	if res.RequestID != "pass" {
+		t.Errorf("Got request ID %q; want %q", res.RequestID, "pass")
+	}
+
+	pool.QueueExecutable(&pw_target_runner.RunRequest{
+		Path:            "/test/fail",
+		ResponseChannel: resChan,
+	})
+	res = receive(t, resChan)
+	if res.Err != nil || res.Status != pb.RunStatus_FAILURE {
+		t.Errorf("Got status %v, error %v; want FAILURE", res.Status, res.Err)
+	}
+	if string(res.Output) != "expected 1, got 2" {
+		t.Errorf("Got output %q", res.Output)
+	}
+
+	got := runner.Requests()
+	if len(got) != 2 || got[0] != "/test/pass" || got[1] != "/test/fail" {
+		t.Errorf("Runner handled %v; want [/test/pass /test/fail]", got)
+	}
+}
+
+func TestQueueExecutableClosedResponseChannel(t *testing.T) {
+	runner := testutil.NewFakeDeviceRunner()
+	runner.SetResult("/test/slow", testutil.FakeResult{
+		Status: pb.RunStatus_SUCCESS,
+		Delay:  50 * time.Millisecond,
+	})
+
+	pool := pw_target_runner.NewWorkerPool()
+	pool.RegisterWorker(runner)
+	pool.Start()
+	defer pool.Stop()
+
+	// The requester goes away, closing its channel, before the response is
+	// sent.
+	closed := make(chan *pw_target_runner.RunResponse)
+	pool.QueueExecutable(&pw_target_runner.RunRequest{
+		Path:            "/test/slow",
+		ResponseChannel: closed,
+	})
+	close(closed)
+
+	// The worker survives to run the next request.
+	resChan := make(chan *pw_target_runner.RunResponse, 1)
+	pool.QueueExecutable(&pw_target_runner.RunRequest{
+		Path:            "/test/pass",
+		ResponseChannel: resChan,
+	})
+	if res := receive(t, resChan); res.Err != nil || res.Status != pb.RunStatus_SUCCESS {
+		t.Errorf("Got status %v, error %v; want SUCCESS", res.Status, res.Err)
+	}
+}
+
+func TestQueueExecutableRunnerError(t *testing.T) {
+	injected := errors.New("device disconnected")
+	runner := testutil.NewFakeDeviceRunner()
+	runner.SetDefaultResult(testutil.FakeResult{Err: injected})
+
+	pool := pw_target_runner.NewWorkerPool()
+	pool.RegisterWorker(runner)
+	pool.Start()
+	defer pool.Stop()
+
+	resChan := make(chan *pw_target_runner.RunResponse, 1)
+	pool.QueueExecutable(&pw_target_runner.RunRequest{
+		Path:            "/test/pass",
+		ResponseChannel: resChan,
+	})
+
+	if res := receive(t, resChan); res.Err != injected {
+		t.Errorf("Got error %v; want %v", res.Err, injected)
+	}
+}
+
+// recordingListener records the events it receives as strings.
+type recordingListener struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func (l *recordingListener) record(format string, args ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.events = append(l.events, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingListener) OnQueued(req *pw_target_runner.RunRequest) {
+	l.record("queued %s", req.ID)
+}
+
+func (l *recordingListener) OnStarted(req *pw_target_runner.RunRequest, worker int) {
+	l.record("started %s on %d", req.ID, worker)
+}
+
+func (l *recordingListener) OnCompleted(
+	req *pw_target_runner.RunRequest,
+	res *pw_target_runner.RunResponse,
+) {
+	l.record("completed %s %v", req.ID, res.Status)
+}
+
+func TestEventListeners(t *testing.T) {
+	runner := testutil.NewFakeDeviceRunner()
+	runner.SetResult("/test/fail", testutil.FakeResult{Status: pb.RunStatus_FAILURE})
+
+	listener := &recordingListener{}
+
+	pool := pw_target_runner.NewWorkerPool()
+	pool.RegisterWorker(runner)
+	pool.AddEventListener(pw_target_runner.NopEventListener{})
+	pool.AddEventListener(pw_target_runner.NewLoggingEventListener())
+	pool.AddEventListener(listener)
+	pool.Start()
+	defer pool.Stop()
+
+	if err := pool.AddEventListener(listener); err == nil {
+		t.Error("Added a listener while the pool was active")
+	}
+
+	resChan := make(chan *pw_target_runner.RunResponse, 1)
+	for _, path := range []string{"/test/pass", "/test/fail"} {
+		pool.QueueExecutable(&pw_target_runner.RunRequest{
+			ID:              path[len("/test/"):],
+			Path:            path,
+			ResponseChannel: resChan,
+		})
+		receive(t, resChan)
+	}
+
+	want := []string{
+		"queued pass",
+		"started pass on 0",
+		"completed pass SUCCESS",
+		"queued fail",
+		"started fail on 0",
+		"completed fail FAILURE",
+	}
+	if !reflect.DeepEqual(listener.events, want) {
+		t.Errorf("Got events %v; want %v", listener.events, want)
+	}
+}
+
+// panickingListener is an event listener which panics once a request completes.
+type panickingListener struct {
+	pw_target_runner.NopEventListener
+}
+
+func (panickingListener) OnCompleted(*pw_target_runner.RunRequest, *pw_target_runner.RunResponse) {
+	panic("listener failed unexpectedly")
+}
+
+func TestPanickingListenerDoesNotDropResponse(t *testing.T) {
+	listener := &recordingListener{}
+
+	pool := pw_target_runner.NewWorkerPool()
+	pool.RegisterWorker(testutil.NewFakeDeviceRunner())
+	pool.AddEventListener(panickingListener{})
+	pool.AddEventListener(listener)
+	pool.Start()
+	defer pool.Stop()
+
+	// The response is delivered, and later listeners are still notified.
+	resChan := make(chan *pw_target_runner.RunResponse, 1)
+	pool.QueueExecutable(&pw_target_runner.RunRequest{
+		ID:              "pass",
+		Path:            "/test/pass",
+		ResponseChannel: resChan,
+	})
+	if res := receive(t, resChan); res.Status != pb.RunStatus_SUCCESS {
+		t.Errorf("Got status %v; want SUCCESS", res.Status)
+	}
+
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+	if n := len(listener.events); n == 0 || listener.events[n-1] != "completed pass SUCCESS" {
+		t.Errorf("Got events %v; want the request completed", listener.events)
+	}
+}
+
+func TestQueueExecutableRetriesFlakyFailures(t *testing.T) {
+	pass := testutil.FakeResult{Status: pb.RunStatus_SUCCESS}
+	fail := testutil.FakeResult{Status: pb.RunStatus_FAILURE}
+	timeout := testutil.FakeResult{Status: pb.RunStatus_TIMEOUT}
+
+	tests := []struct {
+		name     string
+		flaky    bool
+		retries  int
+		sequence []testutil.FakeResult
+		want     pb.RunStatus
+		attempts []pb.RunStatus
+	}{
+		{
+			name:     "strict runs are not retried",
+			retries:  2,
+			sequence: []testutil.FakeResult{fail, pass},
+			want:     pb.RunStatus_FAILURE,
+		},
+		{
+			name:     "passes on retry",
+			flaky:    true,
+			retries:  2,
+			sequence: []testutil.FakeResult{fail, fail, pass},
+			want:     pb.RunStatus_SUCCESS,
+			attempts: []pb.RunStatus{
+				pb.RunStatus_FAILURE,
+				pb.RunStatus_FAILURE,
+				pb.RunStatus_SUCCESS,
+			},
+		},
+		{
+			name:     "runs out of retries",
+			flaky:    true,
+			retries:  1,
+			sequence: []testutil.FakeResult{fail, fail, pass},
+			want:     pb.RunStatus_FAILURE,
+			attempts: []pb.RunStatus{
+				pb.RunStatus_FAILURE,
+				pb.RunStatus_FAILURE,
+			},
+		},
+		{
+			name:     "only failures are retried",
+			flaky:    true,
+			retries:  2,
+			sequence: []testutil.FakeResult{timeout, pass},
+			want:     pb.RunStatus_TIMEOUT,
+			attempts: []pb.RunStatus{pb.RunStatus_TIMEOUT},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := testutil.NewFakeDeviceRunner()
+			runner.SetResultSequence("/test/flaky", tt.sequence...)
+
+			pool := pw_target_runner.NewWorkerPool()
+			pool.RegisterWorker(runner)
+			pool.Start()
+			defer pool.Stop()
+
+			resChan := make(chan *pw_target_runner.RunResponse, 1)
+			pool.QueueExecutable(&pw_target_runner.RunRequest{
+				Path:             "/test/flaky",
+				Flaky:            tt.flaky,
+				RetriesOnFailure: tt.retries,
+				ResponseChannel:  resChan,
+			})
+
+			res := receive(t, resChan)
+			if res.Status != tt.want {
+				t.Errorf("Got status %v; want %v", res.Status, tt.want)
+			}
+			if !reflect.DeepEqual(res.Attempts, tt.attempts) {
+				t.Errorf("Got attempts %v; want %v", res.Attempts, tt.attempts)
+			}
+
+			wantRuns := len(tt.attempts)
+			if wantRuns == 0 {
+				wantRuns = 1
+			}
+			if runs := len(runner.Requests()); runs != wantRuns {
+				t.Errorf("Executable ran %d times; want %d", runs, wantRuns)
+			}
+		})
+	}
+}
+
+func TestRetryBackoffFreesWorker(t *testing.T) {
+	runner := testutil.NewFakeDeviceRunner()
+	runner.SetResultSequence(
+		"/test/flaky",
+		testutil.FakeResult{Status: pb.RunStatus_FAILURE},
+		testutil.FakeResult{Status: pb.RunStatus_SUCCESS})
+
+	pool := pw_target_runner.NewWorkerPool()
+	pool.RegisterWorker(runner)
+	pool.SetRetryBackoff(pw_target_runner.RetryBackoff{Delay: 200 * time.Millisecond})
+	pool.Start()
+	defer pool.Stop()
+
+	start := time.Now()
+	flakyChan := make(chan *pw_target_runner.RunResponse, 1)
+	pool.QueueExecutable(&pw_target_runner.RunRequest{
+		Path:             "/test/flaky",
+		Flaky:            true,
+		RetriesOnFailure: 2,
+		ResponseChannel:  flakyChan,
+	})
+
+	// The pool's only worker runs other requests while the flaky one waits
+	// to be retried.
+	passChan := make(chan *pw_target_runner.RunResponse, 1)
+	pool.QueueExecutable(&pw_target_runner.RunRequest{
+		Path:            "/test/pass",
+		ResponseChannel: passChan,
+	})
+	receive(t, passChan)
+	select {
+	case <-flakyChan:
+		t.Fatal("Flaky request was retried before other requests ran")
+	default:
+	}
+
+	res := receive(t, flakyChan)
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Flaky request was retried after %v; want at least 200ms", elapsed)
+	}
+	want := []pb.RunStatus{pb.RunStatus_FAILURE, pb.RunStatus_SUCCESS}
+	if res.Status != pb.RunStatus_SUCCESS || !reflect.DeepEqual(res.Attempts, want) {
+		t.Errorf(
+			"Got status %v with attempts %v; want SUCCESS with %v",
+			res.Status,
+			res.Attempts,
+			want)
+	}
+}
+
+func TestRetryBackoffStartsOnce(t *testing.T) {
+	runner := testutil.NewFakeDeviceRunner()
+	runner.SetResultSequence(
+		"/test/flaky",
+		testutil.FakeResult{Status: pb.RunStatus_FAILURE},
+		testutil.FakeResult{Status: pb.RunStatus_FAILURE},
+		testutil.FakeResult{Status: pb.RunStatus_SUCCESS})
+
+	pool := pw_target_runner.NewWorkerPool()
+	pool.RegisterWorker(runner)
+	pool.SetRetryBackoff(pw_target_runner.RetryBackoff{Delay: 10 * time.Millisecond})
+	pool.Start()
+	defer pool.Stop()
+
+	// Nothing reads the start notifications, as if the request's client
+	// had gone away, so a second one would block the worker.
+	started := make(chan struct{}, 1)
+	resChan := make(chan *pw_target_runner.RunResponse, 1)
+	pool.QueueExecutable(&pw_target_runner.RunRequest{
+		Path:             "/test/flaky",
+		Flaky:            true,
+		RetriesOnFailure: 2,
+		ResponseChannel:  resChan,
+		OnStart:          func() { started <- struct{}{} },
+	})
+
+	res := receive(t, resChan)
+	if res.Status != pb.RunStatus_SUCCESS || len(res.Attempts) != 3 {
+		t.Errorf(
+			"Got status %v with attempts %v; want SUCCESS after 3 attempts",
+			res.Status,
+			res.Attempts)
+	}
+}
+
+func TestRetryBackoffWindow(t *testing.T) {
+	fail := testutil.FakeResult{Status: pb.RunStatus_FAILURE}
+	runner := testutil.NewFakeDeviceRunner()
+	runner.SetResultSequence("/test/flaky", fail, fail, fail, fail)
+
+	// The second retry would wait 100ms, by which time the request would
+	// have been retried for longer than the window allows.
+	pool := pw_target_runner.NewWorkerPool()
+	pool.RegisterWorker(runner)
+	pool.SetRetryBackoff(pw_target_runner.RetryBackoff{
+		Delay:      50 * time.Millisecond,
+		Multiplier: 2,
+		MaxWindow:  120 * time.Millisecond,
+	})
+	pool.Start()
+	defer pool.Stop()
+
+	resChan := make(chan *pw_target_runner.RunResponse, 1)
+	pool.QueueExecutable(&pw_target_runner.RunRequest{
+		Path:             "/test/flaky",
+		Flaky:            true,
+		RetriesOnFailure: 3,
+		ResponseChannel:  resChan,
+	})
+
+	res := receive(t, resChan)
+	want := []pb.RunStatus{pb.RunStatus_FAILURE, pb.RunStatus_FAILURE}
+	if res.Status != pb.RunStatus_FAILURE || !reflect.DeepEqual(res.Attempts, want) {
+		t.Errorf(
+			"Got status %v with attempts %v; want FAILURE with %v",
+			res.Status,
+			res.Attempts,
+			want)
+	}
+}
+
+func TestSoak(t *testing.T) {
+	pass := testutil.FakeResult{Status: pb.RunStatus_SUCCESS, Output: []byte("pass")}
+	fail := testutil.FakeResult{Status: pb.RunStatus_FAILURE, Output: []byte("fail")}
+
+	tests := []struct {
+		name       string
+		iterations int
+		duration   time.Duration
+		sequence   []testutil.FakeResult
+		want       pb.RunStatus
+		ran        int
+		failedAt   int
+	}{
+		{
+			name:       "fails intermittently",
+			iterations: 10,
+			sequence:   []testutil.FakeResult{pass, pass, fail, pass},
+			want:       pb.RunStatus_FAILURE,
+			ran:        3,
+			failedAt:   3,
+		},
+		{
+			name:       "passes every iteration",
+			iterations: 4,
+			sequence:   []testutil.FakeResult{pass, pass, pass, pass, fail},
+			want:       pb.RunStatus_SUCCESS,
+			ran:        4,
+		},
+		{
+			name:     "stops after duration",
+			duration: 50 * time.Millisecond,
+			sequence: []testutil.FakeResult{
+				{Status: pb.RunStatus_SUCCESS, Delay: 30 * time.Millisecond},
+				{Status: pb.RunStatus_SUCCESS, Delay: 30 * time.Millisecond},
+				fail,
+			},
+			want: pb.RunStatus_SUCCESS,
+			ran:  2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := testutil.NewFakeDeviceRunner()
+			runner.SetResultSequence("/test/soak", tt.sequence...)
+
+			pool := pw_target_runner.NewWorkerPool()
+			pool.RegisterWorker(runner)
+			pool.Start()
+			defer pool.Stop()
+
+			resChan := make(chan *pw_target_runner.RunResponse, 1)
+			pool.QueueExecutable(&pw_target_runner.RunRequest{
+				Path:            "/test/soak",
+				SoakIterations:  tt.iterations,
+				SoakDuration:    tt.duration,
+				ResponseChannel: resChan,
+			})
+
+			res := receive(t, resChan)
+			if res.Err != nil || res.Status != tt.want {
+				t.Errorf("Got status %v, error %v; want %v", res.Status, res.Err, tt.want)
+			}
+			if res.SoakIterations != tt.ran || res.SoakFailedIteration != tt.failedAt {
+				t.Errorf(
+					"Got %d iteration(s), failed on %d; want %d, failed on %d",
+					res.SoakIterations,
+					res.SoakFailedIteration,
+					tt.ran,
+					tt.failedAt)
+			}
+			if tt.failedAt > 0 && string(res.Output) != "fail" {
+				t.Errorf("Got output %q; want that of the failing run", res.Output)
+			}
+			if got := len(runner.Requests()); got != tt.ran {
+				t.Errorf("Runner ran %d time(s); want %d", got, tt.ran)
+			}
+		})
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	runner := testutil.NewFakeDeviceRunner()
+	runner.SetResult("/test/broken", testutil.FakeResult{Err: errors.New("device disconnected")})
+
+	pool := pw_target_runner.NewWorkerPool()
+	pool.RegisterWorker(runner)
+	if err := pool.EnableQuarantine(2, 20*time.Millisecond); err != nil {
+		t.Fatalf("Failed to enable quarantine: %v", err)
+	}
+	pool.Start()
+	defer pool.Stop()
+
+	run := func(path string) *pw_target_runner.RunResponse {
+		resChan := make(chan *pw_target_runner.RunResponse, 1)
+		pool.QueueExecutable(&pw_target_runner.RunRequest{
+			Path:            path,
+			ResponseChannel: resChan,
+		})
+		return receive(t, resChan)
+	}
+
+	// A success between errors resets the worker's count.
+	run("/test/broken")
+	run("/test/pass")
+	run("/test/broken")
+	if pool.Workers()[0].Quarantined {
+		t.Fatal("Worker quarantined after non-consecutive errors")
+	}
+
+	run("/test/broken")
+	if !pool.Workers()[0].Quarantined {
+		t.Fatal("Worker not quarantined after consecutive errors")
+	}
+
+	// The worker fails its probes while it is still broken.
+	runner.SetHealthError(errors.New("device disconnected"))
+	if n := pool.Snapshot().WorkersQuarantined; n != 1 {
+		t.Errorf("Pool reports %d quarantined workers; want 1", n)
+	}
+	if res := run("/test/pass"); res.Err == nil {
+		t.Error("Request ran with the only worker quarantined")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if !pool.Workers()[0].Quarantined {
+		t.Fatal("Worker released despite failing its probes")
+	}
+
+	runner.SetHealthError(nil)
+	for deadline := time.Now().Add(5 * time.Second); pool.Workers()[0].Quarantined; {
+		if time.Now().After(deadline) {
+			t.Fatal("Worker not released after passing a probe")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if res := run("/test/pass"); res.Err != nil || res.Status != pb.RunStatus_SUCCESS {
+		t.Errorf("Got status %v, error %v after release; want SUCCESS", res.Status, res.Err)
+	}
+}
+
+func TestQuarantineIgnoresUnsupportedRequests(t *testing.T) {
+	runner := testutil.NewFakeDeviceRunner()
+	runner.SetResult("/test/filtered", testutil.FakeResult{
+		Err: pw_target_runner.ErrCaseFilterUnsupported,
+	})
+
+	pool := pw_target_runner.NewWorkerPool()
+	pool.RegisterWorker(runner)
+	if err := pool.EnableQuarantine(2, 0); err != nil {
+		t.Fatalf("Failed to enable quarantine: %v", err)
+	}
+	pool.Start()
+	defer pool.Stop()
+
+	for i := 0; i < 3; i++ {
+		resChan := make(chan *pw_target_runner.RunResponse, 1)
+		pool.QueueExecutable(&pw_target_runner.RunRequest{
+			Path:            "/test/filtered",
+			ResponseChannel: resChan,
+		})
+		receive(t, resChan)
+	}
+	if pool.Workers()[0].Quarantined {
+		t.Error("Worker quarantined for requests it does not support")
+	}
+}
+
+func TestSessionsRunOnInteractiveWorkers(t *testing.T) {
+	pool := pw_target_runner.NewWorkerPool()
+	pool.RegisterWorker(testutil.NewFakeDeviceRunner())
+
+	// Without a worker which accepts sessions, they are rejected upfront.
+	resChan := make(chan *pw_target_runner.RunResponse, 4)
+	pool.QueueExecutable(&pw_target_runner.RunRequest{
+		Path:            "/test/shell",
+		Session:         &pw_target_runner.Session{},
+		ResponseChannel: resChan,
+	})
+	if res := receive(t, resChan); res.Err == nil {
+		t.Error("Session was accepted with no interactive workers")
+	}
+
+	interactive := &sessionRunner{}
+	pool.RegisterWorker(interactive)
+	pool.Start()
+	defer pool.Stop()
+
+	// The non-interactive worker is free, but never takes the sessions.
+	for i := 0; i < 4; i++ {
+		pool.QueueExecutable(&pw_target_runner.RunRequest{
+			Path:            "/test/shell",
+			Session:         &pw_target_runner.Session{},
+			ResponseChannel: resChan,
+		})
+	}
+	for i := 0; i < 4; i++ {
+		if res := receive(t, resChan); res.Err != nil {
+			t.Errorf("Session failed: %v", res.Err)
+		}
+	}
+	if n := atomic.LoadInt32(&interactive.sessions); n != 4 {
+		t.Errorf("Interactive worker ran %d sessions; want 4", n)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	runner := testutil.NewFakeDeviceRunner()
+	runner.SetDefaultResult(testutil.FakeResult{
+		Status: pb.RunStatus_SUCCESS,
+		Delay:  50 * time.Millisecond,
+	})
+
+	pool := pw_target_runner.NewWorkerPool()
+	pool.RegisterWorker(runner)
+	pool.Start()
+	defer pool.Stop()
+
+	run := func(deadline time.Time) *pw_target_runner.RunResponse {
+		resChan := make(chan *pw_target_runner.RunResponse, 1)
+		pool.QueueExecutable(&pw_target_runner.RunRequest{
+			Path:            "/test/slow",
+			Deadline:        deadline,
+			ResponseChannel: resChan,
+		})
+		return receive(t, resChan)
+	}
+
+	// With nothing run yet, only a deadline which has passed is rejected.
+	if res := run(time.Now().Add(-time.Second)); res.Err == nil {
+		t.Error("Request with a past deadline was run")
+	}
+	if res := run(time.Now().Add(10 * time.Millisecond)); res.Err != nil {
+		t.Errorf("Request with no run time history failed: %v", res.Err)
+	}
+
+	// Having seen how long runs take, the pool rejects requests which could
+	// not finish in time.
+	if res := run(time.Now().Add(10 * time.Millisecond)); res.Err == nil {
+		t.Error("Request which cannot finish by its deadline was run")
+	}
+	if res := run(time.Now().Add(5 * time.Second)); res.Err != nil {
+		t.Errorf("Request with a reachable deadline failed: %v", res.Err)
+	}
+	if n := len(runner.Requests()); n != 2 {
+		t.Errorf("Runner ran %d request(s); want 2", n)
+	}
+}
+
+func TestWorkerStartTimeout(t *testing.T) {
+	hung := testutil.NewFakeDeviceRunner()
+	hung.SetStartDelay(2 * time.Second)
+	runner := testutil.NewFakeDeviceRunner()
+
+	pool := pw_target_runner.NewWorkerPool()
+	pool.RegisterWorker(hung)
+	pool.RegisterWorker(runner)
+	if err := pool.SetWorkerStartTimeout(20 * time.Millisecond); err != nil {
+		t.Fatalf("Failed to set start timeout: %v", err)
+	}
+	pool.Start()
+
+	for deadline := time.Now().Add(time.Second); pool.Workers()[0].Running; {
+		if time.Now().After(deadline) {
+			t.Fatal("Worker still starting after its start timeout")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	resChan := make(chan *pw_target_runner.RunResponse, 1)
+	pool.QueueExecutable(&pw_target_runner.RunRequest{
+		Path:            "/test/pass",
+		ResponseChannel: resChan,
+	})
+	if res := receive(t, resChan); res.Err != nil || res.Status != pb.RunStatus_SUCCESS {
+		t.Errorf("Got status %v, error %v; want SUCCESS", res.Status, res.Err)
+	}
+
+	// Stopping the pool does not wait for the hung worker.
+	start := time.Now()
+	pool.Stop()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Stopping the pool took %v", elapsed)
+	}
+}
+
+func TestWorkerStartTimeoutLateStart(t *testing.T) {
+	slow := testutil.NewFakeDeviceRunner()
+	slow.SetStartDelay(200 * time.Millisecond)
+
+	pool := pw_target_runner.NewWorkerPool()
+	pool.RegisterWorker(slow)
+	if err := pool.SetWorkerStartTimeout(20 * time.Millisecond); err != nil {
+		t.Fatalf("Failed to set start timeout: %v", err)
+	}
+	pool.Start()
+
+	for deadline := time.Now().Add(time.Second); pool.Workers()[0].Running; {
+		if time.Now().After(deadline) {
+			t.Fatal("Worker still starting after its start timeout")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Restarting the pool does not start the worker again while its
+	// abandoned start is still running.
+	pool.Stop()
+	pool.Start()
+	defer pool.Stop()
+	if starts := slow.Starts(); starts != 1 {
+		t.Errorf("Worker started %d times; want 1", starts)
+	}
+
+	// Once the abandoned start succeeds, the worker is exited again.
+	for deadline := time.Now().Add(5 * time.Second); slow.Exits() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("Worker not exited after its abandoned start succeeded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// settlingRunner is a fake runner which waits between requests.
+type settlingRunner struct {
+	*testutil.FakeDeviceRunner
+	delay time.Duration
+}
+
+func (r *settlingRunner) SettleDelay() time.Duration { return r.delay }
+
+func TestSettleDelay(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	runner := &settlingRunner{testutil.NewFakeDeviceRunner(), delay}
+
+	pool := pw_target_runner.NewWorkerPool()
+	pool.RegisterWorker(runner)
+	pool.Start()
+	defer pool.Stop()
+
+	start := time.Now()
+	resChan := make(chan *pw_target_runner.RunResponse, 2)
+	for _, path := range []string{"/test/first", "/test/second"} {
+		pool.QueueExecutable(&pw_target_runner.RunRequest{
+			Path:            path,
+			ResponseChannel: resChan,
+		})
+	}
+
+	// The first result is not held up by the delay which follows it, but
+	// the second request waits for it.
+	receive(t, resChan)
+	if elapsed := time.Since(start); elapsed >= delay {
+		t.Errorf("First result took %v; want it before the settle delay", elapsed)
+	}
+	receive(t, resChan)
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("Second result took %v; want it after the settle delay of %v", elapsed, delay)
+	}
+}
+
+func TestSettleDelayOnlyAfterRuns(t *testing.T) {
+	const delay = 500 * time.Millisecond
+	runner := &settlingRunner{testutil.NewFakeDeviceRunner(), delay}
+
+	pool := pw_target_runner.NewWorkerPool()
+	pool.RegisterWorker(runner)
+	pool.Start()
+	defer pool.Stop()
+
+	// Listing cases does not run the executable, so the request which
+	// follows it does not wait.
+	start := time.Now()
+	resChan := make(chan *pw_target_runner.RunResponse, 2)
+	pool.QueueExecutable(&pw_target_runner.RunRequest{
+		Path:            "/test/first",
+		ListCases:       true,
+		ResponseChannel: resChan,
+	})
+	pool.QueueExecutable(&pw_target_runner.RunRequest{
+		Path:            "/test/second",
+		ResponseChannel: resChan,
+	})
+	receive(t, resChan)
+	receive(t, resChan)
+	if elapsed := time.Since(start); elapsed >= delay {
+		t.Errorf("Results took %v; want them before the settle delay", elapsed)
+	}
+}
+
+func TestStopEndsSettleDelay(t *testing.T) {
+	runner := &settlingRunner{testutil.NewFakeDeviceRunner(), time.Minute}
+
+	pool := pw_target_runner.NewWorkerPool()
+	pool.RegisterWorker(runner)
+	pool.Start()
+
+	resChan := make(chan *pw_target_runner.RunResponse, 1)
+	pool.QueueExecutable(&pw_target_runner.RunRequest{
+		Path:            "/test/first",
+		ResponseChannel: resChan,
+	})
+	receive(t, resChan)
+
+	start := time.Now()
+	pool.Stop()
+	if elapsed := time.Since(start); elapsed >= 5*time.Second {
+		t.Errorf("Stop took %v; want it to end the settle delay", elapsed)
+	}
+}
+
+func TestWorkerStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pw_target_runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	statsFile := filepath.Join(dir, "stats.json")
+
+	runner := testutil.NewFakeDeviceRunner()
+	runner.SetResult("/test/fail", testutil.FakeResult{Status: pb.RunStatus_FAILURE})
+	runner.SetResult("/test/broken", testutil.FakeResult{Err: errors.New("device disconnected")})
+
+	newPool := func() *pw_target_runner.WorkerPool {
+		pool := pw_target_runner.NewWorkerPool()
+		pool.RegisterWorker(runner)
+		if err := pool.SetWorkerStatsFile(statsFile); err != nil {
+			t.Fatalf("Failed to set stats file: %v", err)
+		}
+		pool.Start()
+		return pool
+	}
+
+	run := func(pool *pw_target_runner.WorkerPool, path string) {
+		resChan := make(chan *pw_target_runner.RunResponse, 1)
+		pool.QueueExecutable(&pw_target_runner.RunRequest{
+			Path:            path,
+			ResponseChannel: resChan,
+		})
+		receive(t, resChan)
+	}
+
+	pool := newPool()
+	run(pool, "/test/pass")
+	run(pool, "/test/fail")
+	run(pool, "/test/broken")
+	pool.Stop()
+
+	want := pw_target_runner.WorkerStats{Runs: 2, Failures: 1, Errors: 1}
+	if got := pool.Workers()[0].Stats; got.Runs != want.Runs ||
+		got.Failures != want.Failures ||
+		got.Errors != want.Errors {
+		t.Errorf("Got stats %+v; want %+v", got, want)
+	}
+
+	// A new pool picks up the counts where the old one left off.
+	pool = newPool()
+	defer pool.Stop()
+	run(pool, "/test/pass")
+
+	want.Runs++
+	if got := pool.Workers()[0].Stats; got.Runs != want.Runs ||
+		got.Failures != want.Failures ||
+		got.Errors != want.Errors {
+		t.Errorf("Got stats %+v after restart; want %+v", got, want)
+	}
+}
+
+func TestStopAndStart(t *testing.T) {
+	runner := testutil.NewFakeDeviceRunner()
+	pool := pw_target_runner.NewWorkerPool()
+	pool.RegisterWorker(runner)
+
+	// Requests queued before the pool is started wait for it to start.
+	resChan := make(chan *pw_target_runner.RunResponse, 1)
+	pool.QueueExecutable(&pw_target_runner.RunRequest{
+		Path:            "/test/first",
+		ResponseChannel: resChan,
+	})
+
+	pool.Start()
+	if !pool.Active() {
+		t.Error("Pool is not active after starting")
+	}
+	if err := pool.Start(); err == nil {
+		t.Error("Expected starting an active pool to fail")
+	}
+	if err := pool.RegisterWorker(testutil.NewFakeDeviceRunner()); err == nil {
+		t.Error("Expected registering a worker in an active pool to fail")
+	}
+	receive(t, resChan)
+
+	pool.Stop()
+	if pool.Active() {
+		t.Error("Pool is active after stopping")
+	}
+	if runner.Starts() != 1 || runner.Exits() != 1 {
+		t.Errorf(
+			"Worker started %d times and exited %d times; want 1 each",
+			runner.Starts(),
+			runner.Exits())
+	}
+
+	// Requests queued while the pool is stopped persist until it is started
+	// again.
+	pool.QueueExecutable(&pw_target_runner.RunRequest{
+		Path:            "/test/second",
+		ResponseChannel: resChan,
+	})
+	select {
+	case <-resChan:
+		t.Fatal("Request was processed while the pool was stopped")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	pool.Start()
+	defer pool.Stop()
+	if res := receive(t, resChan); res.Err != nil {
+		t.Errorf("Request failed after restarting pool: %v", res.Err)
+	}
+	if runner.Starts() != 2 {
+		t.Errorf("Worker started %d times; want 2", runner.Starts())
+	}
+}
+
+// Workers check the quit channel before taking each request, so stopping a pool
+// with a long queue must not wait for the queue to drain.
+func TestStopPrioritizesQuitOverQueue(t *testing.T) {
+	const queued = 100
+
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+			runner := testutil.NewFakeDeviceRunner()
+			runner.SetDefaultResult(testutil.FakeResult{
+				Status: pb.RunStatus_SUCCESS,
+				Delay:  5 * time.Millisecond,
+			})
+
+			pool := pw_target_runner.NewWorkerPool()
+			for i := 0; i < workers; i++ {
+				pool.RegisterWorker(runner)
+			}
+
+			resChan := make(chan *pw_target_runner.RunResponse, queued)
+			for i := 0; i < queued; i++ {
+				pool.QueueExecutable(&pw_target_runner.RunRequest{
+					Path:            fmt.Sprintf("/test/%d", i),
+					ResponseChannel: resChan,
+				})
+			}
+
+			pool.Start()
+			receive(t, resChan)
+
+			runsBeforeStop := len(runner.Requests())
+			start := time.Now()
+			pool.Stop()
+			elapsed := time.Since(start)
+
+			// Each worker finishes the request it is running, and may
+			// have taken one more before the quit command was sent.
+			runs := len(runner.Requests())
+			if max := runsBeforeStop + 2*workers; runs > max {
+				t.Errorf(
+					"%d of %d requests ran; want at most %d",
+					runs,
+					queued,
+					max)
+			}
+			if elapsed > time.Second {
+				t.Errorf("Stopping the pool took %v", elapsed)
+			}
+
+			// The requests which did not run are still queued.
+			pool.Start()
+			defer pool.Stop()
+			for received := 1; received < queued; received++ {
+				if res := receive(t, resChan); res.Err != nil {
+					t.Fatalf("Request failed after restarting pool: %v", res.Err)
+				}
+			}
+			if runs := len(runner.Requests()); runs != queued {
+				t.Errorf("%d requests ran; want %d", runs, queued)
+			}
+		})
+	}
+}
+
+func TestPauseAndResume(t *testing.T) {
+	strategies := map[string]pw_target_runner.DispatchStrategy{
+		"queue":       nil,
+		"LeastLoaded": pw_target_runner.LeastLoaded{},
+	}
+
+	for name, strategy := range strategies {
+		t.Run(name, func(t *testing.T) {
+			runner := testutil.NewFakeDeviceRunner()
+			pool := pw_target_runner.NewWorkerPool()
+			pool.RegisterWorker(runner)
+			if strategy != nil {
+				pool.SetDispatchStrategy(strategy)
+			}
+			pool.Start()
+			defer pool.Stop()
+
+			pool.Pause()
+			if !pool.Paused() || !pool.Snapshot().Paused {
+				t.Error("Pool is not paused after pausing")
+			}
+
+			// Requests can still be queued while the pool is paused,
+			// but are not run until it is resumed.
+			resChan := make(chan *pw_target_runner.RunResponse, 2)
+			for _, path := range []string{"/test/first", "/test/second"} {
+				pool.QueueExecutable(&pw_target_runner.RunRequest{
+					Path:            path,
+					ResponseChannel: resChan,
+				})
+			}
+			select {
+			case <-resChan:
+				t.Fatal("Request was processed while the pool was paused")
+			case <-time.After(50 * time.Millisecond):
+			}
+			if depth := pool.Snapshot().QueueDepth; depth != 2 {
+				t.Errorf("Queue depth is %d while paused; want 2", depth)
+			}
+
+			pool.Resume()
+			for i := 0; i < 2; i++ {
+				if res := receive(t, resChan); res.Err != nil {
+					t.Errorf("Request failed after resuming: %v", res.Err)
+				}
+			}
+			if runner.Starts() != 1 {
+				t.Errorf("Worker started %d times; want 1", runner.Starts())
+			}
+		})
+	}
+}
+
+// instantRunner is a DeviceRunner which passes every request immediately, so
+// that benchmarks measure only the overhead of the worker pool.
+type instantRunner struct{}
+
+func (instantRunner) WorkerStart() error { return nil }
+
+func (instantRunner) HandleRunRequest(*pw_target_runner.RunRequest) *pw_target_runner.RunResponse {
+	return &pw_target_runner.RunResponse{Status: pb.RunStatus_SUCCESS}
+}
+
+func (instantRunner) WorkerExit() {}
+
+// sessionRunner is an instantRunner which also accepts sessions, ending each
+// immediately.
+type sessionRunner struct {
+	instantRunner
+	sessions int32
+}
+
+func (*sessionRunner) AcceptsSessions() bool { return true }
+
+func (r *sessionRunner) RunSession(*pw_target_runner.RunRequest) *pw_target_runner.RunResponse {
+	atomic.AddInt32(&r.sessions, 1)
+	return &pw_target_runner.RunResponse{Status: pb.RunStatus_SUCCESS}
+}
+
+// BenchmarkWorkerPoolThroughput floods a pool of instant workers with batches
+// of requests, reporting the rate at which requests complete and the average
+// time each spends in the queue.
+func BenchmarkWorkerPoolThroughput(b *testing.B) {
+	for _, workers := range []int{1, 4, 16} {
+		for _, batch := range []int{16, 256, 1024} {
+			name := fmt.Sprintf("workers=%d/batch=%d", workers, batch)
+			b.Run(name, func(b *testing.B) {
+				benchmarkWorkerPoolThroughput(b, workers, batch)
+			})
+		}
+	}
+}
+
+func benchmarkWorkerPoolThroughput(b *testing.B, workers, batch int) {
+	// The pool's logs are discarded, as logging every request would
+	// dominate the time measured.
+	pool := pw_target_runner.NewWorkerPool()
+
+	for i := 0; i < workers; i++ {
+		if err := pool.RegisterWorker(instantRunner{}); err != nil {
+			b.Fatalf("Failed to register worker: %v", err)
+		}
+	}
+	if err := pool.Start(); err != nil {
+		b.Fatalf("Failed to start worker pool: %v", err)
+	}
+	defer pool.Stop()
+
+	resChan := make(chan *pw_target_runner.RunResponse, batch)
+	var queueTime time.Duration
+
+	b.ResetTimer()
+	start := time.Now()
+
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < batch; j++ {
+			pool.QueueExecutable(&pw_target_runner.RunRequest{
+				Path:            "/bin/true",
+				ResponseChannel: resChan,
+			})
+		}
+
+		for j := 0; j < batch; j++ {
+			res := <-resChan
+			if res.Err != nil {
+				b.Fatalf("Request failed: %v", res.Err)
+			}
+			queueTime += res.QueueTime
+		}
+	}
+
+	elapsed := time.Since(start)
+	b.StopTimer()
+
+	requests := float64(b.N * batch)
+	b.ReportMetric(requests/elapsed.Seconds(), "req/s")
+	b.ReportMetric(float64(queueTime.Nanoseconds())/requests, "ns/queue")
+}
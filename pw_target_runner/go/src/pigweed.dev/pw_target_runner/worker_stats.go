@@ -0,0 +1,177 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pw_target_runner
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	pb "pigweed.dev/proto/pw_target_runner/target_runner_pb"
+)
+
+// Least time between saves of a pool's worker statistics while it runs.
+const workerStatsSaveInterval = 10 * time.Second
+
+// WorkerStats counts the requests a worker has run over its lifetime.
+type WorkerStats struct {
+	// Number of requests the worker has run to completion, and how many of
+	// them did not succeed.
+	Runs     uint64
+	Failures uint64
+
+	// Number of requests for which the worker's runner returned an error
+	// rather than a result, excluding those abandoned by their requesters.
+	Errors uint64
+
+	// Total time the worker has spent running requests.
+	BusyTime time.Duration
+}
+
+// savedWorkerStats is the form in which a worker's statistics are saved.
+type savedWorkerStats struct {
+	ID         int    `json:"id"`
+	Runs       uint64 `json:"runs"`
+	Failures   uint64 `json:"failures"`
+	Errors     uint64 `json:"errors"`
+	BusyTimeNs int64  `json:"busy_time_ns"`
+}
+
+// SetWorkerStatsFile has the pool persist the lifetime statistics of its
+// workers to a JSON file, so that they accumulate across restarts, e.g. to
+// rotate boards which have run the most tests. Statistics in an existing file
+// are loaded now and restored to the workers with the same IDs when the pool is
+// next started, so workers should be registered in the same order each time.
+// The file is rewritten periodically while the pool runs and when it is
+// stopped. This cannot be done while the pool is processing requests.
+func (p *WorkerPool) SetWorkerStatsFile(path string) error {
+	if p.Active() {
+		return errWorkerPoolActive
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var saved []savedWorkerStats
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, &saved); err != nil {
+			return err
+		}
+	}
+
+	p.statsPath = path
+	p.savedStats = saved
+	return nil
+}
+
+// restoreWorkerStats restores the statistics of the pool's workers from those
+// loaded from its stats file. The state mutex must be held.
+func (p *WorkerPool) restoreWorkerStats() {
+	for _, saved := range p.savedStats {
+		if saved.ID < 0 || saved.ID >= len(p.workers) {
+			p.logger.Printf("Ignoring saved statistics of unknown worker %d\n", saved.ID)
+			continue
+		}
+
+		p.workers[saved.ID].stats = WorkerStats{
+			Runs:     saved.Runs,
+			Failures: saved.Failures,
+			Errors:   saved.Errors,
+			BusyTime: time.Duration(saved.BusyTimeNs),
+		}
+	}
+	p.savedStats = nil
+}
+
+// recordWorkerStats counts a request run by a worker in its statistics, saving
+// them if the pool persists them and they have not been saved recently.
+func (p *WorkerPool) recordWorkerStats(w *workerState, req *RunRequest, res *RunResponse) {
+	p.stateMutex.Lock()
+	if res.Err == nil {
+		w.stats.Runs++
+		if res.Status != pb.RunStatus_SUCCESS {
+			w.stats.Failures++
+		}
+	} else if req.Context().Err() == nil {
+		w.stats.Errors++
+	}
+	w.stats.BusyTime += res.RunTime
+	p.stateMutex.Unlock()
+
+	if p.statsPath != "" {
+		p.saveWorkerStats(false)
+	}
+}
+
+// saveWorkerStats writes the statistics of the pool's workers to its stats file,
+// replacing it atomically. Unless force is set, nothing is written if they were
+// saved within workerStatsSaveInterval.
+func (p *WorkerPool) saveWorkerStats(force bool) {
+	p.statsSaveMutex.Lock()
+	defer p.statsSaveMutex.Unlock()
+
+	if !force && time.Since(p.statsSaved) < workerStatsSaveInterval {
+		return
+	}
+
+	p.stateMutex.Lock()
+	saved := make([]savedWorkerStats, len(p.workers))
+	for i, w := range p.workers {
+		saved[i] = savedWorkerStats{
+			ID:         w.id,
+			Runs:       w.stats.Runs,
+			Failures:   w.stats.Failures,
+			Errors:     w.stats.Errors,
+			BusyTimeNs: int64(w.stats.BusyTime),
+		}
+	}
+	p.stateMutex.Unlock()
+
+	if err := writeJSONFile(p.statsPath, saved); err != nil {
+		p.logger.Printf("Failed to save worker statistics: %v\n", err)
+		return
+	}
+	p.statsSaved = time.Now()
+}
+
+// writeJSONFile writes a value to a file as indented JSON. The value is written
+// to a temporary file which then replaces the file, so that the file is never
+// left partially written.
+func writeJSONFile(path string, v interface{}) error {
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(append(content, '\n'))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,167 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	pb "pigweed.dev/proto/pw_target_runner/target_runner_pb"
+)
+
+// resultCache saves the results of successful runs to a directory, allowing
+// them to be reused instead of running an unchanged executable again. Results
+// are keyed by the contents of the executable and the arguments, test case, and
+// output options it was run with.
+type resultCache struct {
+	dir string
+
+	// How long a result remains usable after it was saved.
+	ttl time.Duration
+
+	// If set, saved results are ignored, but new results are still saved.
+	refresh bool
+
+	// Label of the target server whose results are cached, if not the
+	// default server. Results from different targets are kept apart.
+	target string
+}
+
+// newResultCache creates a resultCache in the specified directory, creating it
+// if necessary.
+func newResultCache(dir string, ttl time.Duration, refresh bool) (*resultCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &resultCache{dir: dir, ttl: ttl, refresh: refresh}, nil
+}
+
+// forTarget returns a view of the cache holding the results of the target server
+// with the given label.
+func (c *resultCache) forTarget(label string) *resultCache {
+	scoped := *c
+	scoped.target = label
+	return &scoped
+}
+
+// lookup computes the cache key of a request and returns it along with the
+// request's saved result, if a fresh one exists.
+func (c *resultCache) lookup(req *pb.RunBinaryRequest) (string, *pb.RunBinaryResponse, error) {
+	key, err := c.key(req)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if c.refresh {
+		return key, nil, nil
+	}
+
+	return key, c.get(key), nil
+}
+
+// key hashes the contents of a request's executable along with its arguments
+// and test case.
+func (c *resultCache) key(req *pb.RunBinaryRequest) (string, error) {
+	file, err := os.Open(req.FilePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	// Each field is prefixed with its length so that different arguments
+	// cannot produce the same key.
+	for _, arg := range req.Args {
+		fmt.Fprintf(hash, "%d:%s", len(arg), arg)
+	}
+	fmt.Fprintf(hash, "case=%d:%s", len(req.CaseFilter), req.CaseFilter)
+	fmt.Fprintf(hash, "discard_output=%t", req.DiscardOutput)
+	if req.FailFast {
+		fmt.Fprintf(hash, "fail_fast")
+	}
+	if req.ExpectedStatus != pb.RunStatus_PENDING {
+		fmt.Fprintf(hash, "expected=%d", req.ExpectedStatus)
+	}
+	if c.target != "" {
+		fmt.Fprintf(hash, "target=%d:%s", len(c.target), c.target)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// get returns the result saved under a key, or nil if there is no result or it
+// has expired.
+func (c *resultCache) get(key string) *pb.RunBinaryResponse {
+	path := filepath.Join(c.dir, key)
+
+	info, err := os.Stat(path)
+	if err != nil || time.Since(info.ModTime()) > c.ttl {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	var res pb.RunBinaryResponse
+	if err := proto.Unmarshal(data, &res); err != nil {
+		return nil
+	}
+	return &res
+}
+
+// put saves a result under a key. Only successful results are saved, so that
+// failures are always rerun.
+func (c *resultCache) put(key string, res *pb.RunBinaryResponse) error {
+	if res.Result != pb.RunStatus_SUCCESS {
+		return nil
+	}
+
+	data, err := proto.Marshal(res)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that concurrent runs of the same
+	// executable never read a partially written result.
+	file, err := ioutil.TempFile(c.dir, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return os.Rename(file.Name(), filepath.Join(c.dir, key))
+}
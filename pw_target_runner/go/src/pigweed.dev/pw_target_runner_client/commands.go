@@ -0,0 +1,478 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/grpc"
+
+	pb "pigweed.dev/proto/pw_target_runner/target_runner_pb"
+)
+
+// command is a subcommand of the client, selected by the first argument.
+type command struct {
+	name    string
+	summary string
+
+	// Runs the command with the arguments following its name.
+	run func(args []string)
+}
+
+// connectionFlags holds the options shared by all commands for connecting to
+// the server.
+type connectionFlags struct {
+	host      *string
+	port      *int
+	tls       *bool
+	tlsCA     *string
+	tlsCert   *string
+	tlsKey    *string
+	authority *string
+	retry     *string
+
+	// If set, the RPCs of the clients created from the flags are traced.
+	tracing *tracing
+}
+
+// addConnectionFlags defines the options for connecting to the server in a
+// command's flag set.
+func addConnectionFlags(fs *flag.FlagSet) *connectionFlags {
+	return &connectionFlags{
+		host: fs.String("host", "localhost", "Server host"),
+		port: fs.Int("port", 8080, "Server port"),
+		tls:  fs.Bool("tls", false, "Connect to the server over TLS"),
+		tlsCA: fs.String(
+			"tls-ca",
+			"",
+			"CA certificate file with which to verify the server; implies -tls"),
+		tlsCert: fs.String(
+			"tls-cert",
+			"",
+			"Certificate file to present to the server; implies -tls"),
+		tlsKey: fs.String("tls-key", "", "Private key file for -tls-cert"),
+		authority: fs.String(
+			"authority",
+			"",
+			"Value of the :authority header sent to the server, in place of "+
+				"host:port; over TLS, also the name the server's certificate "+
+				"is verified against"),
+		retry: fs.String(
+			"retry-policy",
+			"none",
+			"How failed calls are retried: \"none\", \"default\" (retry runs "+
+				"while the server is unavailable), or a gRPC service config "+
+				"JSON file"),
+	}
+}
+
+// connect creates a client for the server specified by the flags, exiting if
+// its TLS configuration cannot be loaded.
+func (f *connectionFlags) connect() *Client {
+	return f.connectTo(*f.host, *f.port)
+}
+
+// connectTo creates a client for the server at the given address, using the
+// TLS options of the flags.
+func (f *connectionFlags) connectTo(host string, port int) *Client {
+	var tlsConfig *tls.Config
+	if *f.tls || *f.tlsCA != "" || *f.tlsCert != "" {
+		var err error
+		tlsConfig, err = clientTLSConfig(*f.tlsCA, *f.tlsCert, *f.tlsKey)
+		if err != nil {
+			log.Fatalf("Failed to load TLS configuration: %v", err)
+		}
+	}
+
+	serviceConfig, err := retryServiceConfig(*f.retry)
+	if err != nil {
+		log.Fatalf("Failed to load retry policy: %v", err)
+	}
+
+	var opts []grpc.DialOption
+	if *f.authority != "" {
+		opts = append(opts, grpc.WithAuthority(*f.authority))
+	}
+	if f.tracing != nil {
+		opts = append(opts, f.tracing.dialOption())
+	}
+
+	cli, err := NewClient(host, port, tlsConfig, serviceConfig, opts...)
+	if err != nil {
+		log.Fatalf("Failed to create gRPC client: %v", err)
+	}
+	cli.tracing = f.tracing
+	return cli
+}
+
+// retryServiceConfig returns the gRPC service config for a -retry-policy option:
+// none for "none", DefaultServiceConfig for "default", or otherwise the contents
+// of the named file.
+func retryServiceConfig(policy string) (string, error) {
+	switch policy {
+	case "none":
+		return "", nil
+	case "default":
+		return DefaultServiceConfig, nil
+	}
+
+	config, err := ioutil.ReadFile(policy)
+	if err != nil {
+		return "", err
+	}
+	return string(config), nil
+}
+
+// clientTLSConfig creates a TLS configuration for connecting to the server. If
+// caFile is set, the server's certificate is verified against the CAs in it
+// instead of the system roots. If certFile and keyFile are set, the client
+// presents that certificate to the server.
+func clientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// pingMain implements the ping command, which checks that the server is
+// reachable and reports the round-trip time of an RPC.
+func pingMain(args []string) {
+	fs := flag.NewFlagSet("ping", flag.ExitOnError)
+	conn := addConnectionFlags(fs)
+	fs.Parse(args)
+
+	latency, err := conn.connect().Ping()
+	if err != nil {
+		log.Fatalf("Failed to ping server: %v", err)
+	}
+	fmt.Printf("Server %s:%d responded in %v\n", *conn.host, *conn.port, latency)
+}
+
+// statusMain implements the status command, which prints information about the
+// server.
+func statusMain(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	conn := addConnectionFlags(fs)
+	fs.Parse(args)
+
+	status, err := conn.connect().Status()
+	if err != nil {
+		log.Fatalf("Failed to get server status: %v", err)
+	}
+
+	fmt.Printf("Uptime:             %v\n", time.Duration(status.UptimeNs))
+	fmt.Printf("Executables passed: %d\n", status.TasksPassed)
+	fmt.Printf("Executables failed: %d\n", status.TasksFailed)
+	fmt.Printf("Unhealthy workers:  %d\n", status.WorkersUnhealthy)
+
+	// Servers predating pool statistics do not report them.
+	if pool := status.Pool; pool != nil {
+		fmt.Printf("Paused:             %t\n", pool.Paused)
+		fmt.Printf("Queue depth:        %d\n", pool.QueueDepth)
+		fmt.Printf(
+			"Workers:            %d total, %d busy, %d unhealthy, %d quarantined\n",
+			pool.WorkersTotal,
+			pool.WorkersBusy,
+			pool.WorkersUnhealthy,
+			pool.WorkersQuarantined)
+		fmt.Printf(
+			"Requests:           %d queued, %d completed, %d rejected\n",
+			pool.RequestsQueued,
+			pool.RequestsCompleted,
+			pool.RequestsRejected)
+	}
+}
+
+// listWorkersMain implements the list-workers command, which prints the state of
+// each of the server's workers.
+func listWorkersMain(args []string) {
+	fs := flag.NewFlagSet("list-workers", flag.ExitOnError)
+	conn := addConnectionFlags(fs)
+	fs.Parse(args)
+
+	workers, err := conn.connect().ListWorkers()
+	if err != nil {
+		log.Fatalf("Failed to list workers: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tRUNNING\tHEALTHY\tQUARANTINED\tACTIVE\tCAPACITY\tRUNS\tFAILED\tERRORS\tBUSY")
+	for _, worker := range workers {
+		fmt.Fprintf(
+			w,
+			"%d\t%t\t%t\t%t\t%d\t%d\t%d\t%d\t%d\t%v\n",
+			worker.Id,
+			worker.Running,
+			worker.Healthy,
+			worker.Quarantined,
+			worker.ActiveRequests,
+			worker.Capacity,
+			worker.Runs,
+			worker.Failures,
+			worker.Errors,
+			time.Duration(worker.BusyTimeNs).Round(time.Second))
+	}
+	w.Flush()
+}
+
+// cancelMain implements the cancel command, which cancels queued or running
+// requests by their IDs.
+func cancelMain(args []string) {
+	fs := flag.NewFlagSet("cancel", flag.ExitOnError)
+	conn := addConnectionFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		log.Fatalf("Must provide the IDs of requests to cancel")
+	}
+
+	cli := conn.connect()
+	failed := 0
+	for _, id := range fs.Args() {
+		if err := cli.Cancel(id); err != nil {
+			log.Printf("Failed to cancel request %s: %v\n", id, err)
+			failed++
+		} else {
+			fmt.Printf("Cancelled request %s\n", id)
+		}
+	}
+
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// followOutputMain implements the follow-output command, which prints the
+// server's archived output of a request by its ID, following it until the
+// request completes, such as after the client which ran it disconnected.
+func followOutputMain(args []string) {
+	fs := flag.NewFlagSet("follow-output", flag.ExitOnError)
+	conn := addConnectionFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		log.Fatalf("Must provide the ID of a single request")
+	}
+	id := fs.Arg(0)
+
+	res, err := conn.connect().FollowOutput(id, os.Stdout)
+	if err != nil {
+		log.Fatalf("Failed to follow output of request %s: %v", id, err)
+	}
+	if res == nil {
+		return
+	}
+
+	log.Printf("%s: %s\n", res.FilePath, res.Result)
+	if res.Result != pb.RunStatus_SUCCESS {
+		os.Exit(1)
+	}
+}
+
+// pauseMain implements the pause command, which holds the requests queued on
+// the server, e.g. while its devices are being maintained.
+func pauseMain(args []string) {
+	fs := flag.NewFlagSet("pause", flag.ExitOnError)
+	conn := addConnectionFlags(fs)
+	fs.Parse(args)
+
+	if err := conn.connect().Pause(); err != nil {
+		log.Fatalf("Failed to pause server: %v", err)
+	}
+	fmt.Printf("Paused server %s:%d\n", *conn.host, *conn.port)
+}
+
+// resumeMain implements the resume command, which allows a paused server to run
+// its queued requests again.
+func resumeMain(args []string) {
+	fs := flag.NewFlagSet("resume", flag.ExitOnError)
+	conn := addConnectionFlags(fs)
+	fs.Parse(args)
+
+	if err := conn.connect().Resume(); err != nil {
+		log.Fatalf("Failed to resume server: %v", err)
+	}
+	fmt.Printf("Resumed server %s:%d\n", *conn.host, *conn.port)
+}
+
+// historyMain implements the history command, which prints the results of the
+// executables most recently run by the server.
+func historyMain(args []string) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	conn := addConnectionFlags(fs)
+	countPtr := fs.Int("n", 20, "Number of results to print; 0 prints all")
+	outputPtr := fs.Bool("output", false, "Print the output of each executable")
+	fs.Parse(args)
+
+	entries, err := conn.connect().History(*countPtr)
+	if err != nil {
+		log.Fatalf("Failed to get server history: %v", err)
+	}
+
+	// Print the oldest result first, so that the most recent is nearest the
+	// prompt.
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "COMPLETED\tREQUEST\tRESULT\tQUEUED\tRAN\tPATH")
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		res := entry.Result
+
+		result := res.Result.String()
+		if entry.Error != "" {
+			result = "ERROR"
+		}
+
+		path := res.FilePath
+		if res.CaseFilter != "" {
+			path += " (" + res.CaseFilter + ")"
+		}
+
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\t%v\t%v\t%s\n",
+			time.Unix(0, entry.CompletionTimeNs).Format("15:04:05"),
+			res.RequestId,
+			result,
+			time.Duration(res.QueueTimeNs),
+			time.Duration(res.RunTimeNs),
+			path)
+
+		if *outputPtr {
+			// Output is printed between rows, so the table is
+			// flushed to keep its columns from spanning it.
+			w.Flush()
+			if entry.Error != "" {
+				fmt.Printf("\n  Error: %s\n\n", entry.Error)
+			} else if len(res.Output) > 0 {
+				fmt.Printf("\n%s\n", res.Output)
+			}
+		}
+	}
+	w.Flush()
+}
+
+// reflectMain implements the reflect command, which lists the services the
+// server exposes through gRPC reflection and the methods of one of them. This
+// helps to diagnose calls failing with "unknown method" when the client and
+// server were built from different versions of the protos.
+func reflectMain(args []string) {
+	fs := flag.NewFlagSet("reflect", flag.ExitOnError)
+	conn := addConnectionFlags(fs)
+	servicePtr := fs.String(
+		"service", targetRunnerService, "Full name of the service whose methods to print")
+	fs.Parse(args)
+
+	refl, err := conn.connect().newReflectionClient()
+	if err != nil {
+		log.Fatalf("Failed to connect to reflection service: %v", err)
+	}
+	defer refl.Close()
+
+	services, err := refl.ListServices()
+	if err != nil {
+		log.Fatalf("Failed to list services: %v", err)
+	}
+
+	fmt.Println("Services:")
+	for _, name := range services {
+		fmt.Printf("  %s\n", name)
+	}
+
+	service, err := refl.Service(*servicePtr)
+	if err != nil {
+		log.Fatalf("Failed to describe service %s: %v", *servicePtr, err)
+	}
+
+	fmt.Printf("\nMethods of %s:\n", *servicePtr)
+	for _, method := range service.Method {
+		fmt.Printf("  %s\n", methodSignature(method))
+	}
+}
+
+// printUsage prints the client's usage and its commands.
+func printUsage(commands []*command) {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [command] [options] [args]\n\n", os.Args[0])
+	fmt.Fprintf(out, "Commands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-14s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(out, "\nIf no command is given, run is assumed.\n")
+	fmt.Fprintf(out, "Run \"%s <command> -help\" for a command's options.\n", os.Args[0])
+}
+
+func main() {
+	commands := []*command{
+		{"run", "Run executables on the server (default)", runMain},
+		{"ping", "Check that the server is reachable", pingMain},
+		{"status", "Print information about the server", statusMain},
+		{"watch", "Show a live view of the server's status", watchMain},
+		{"list-workers", "Print the state of the server's workers", listWorkersMain},
+		{"cancel", "Cancel queued or running requests by ID", cancelMain},
+		{"pause", "Hold the server's queued requests", pauseMain},
+		{"resume", "Run the server's queued requests again", resumeMain},
+		{"history", "Print the results of recent executables", historyMain},
+		{"follow-output", "Print the archived output of a request by ID", followOutputMain},
+		{"session", "Run an executable interactively on the server", sessionMain},
+		{"reflect", "Print the services and methods the server exposes", reflectMain},
+		{"diff", "Compare the results in two JSON reports", diffMain},
+	}
+
+	args := os.Args[1:]
+	if len(args) > 0 {
+		if args[0] == "help" || args[0] == "-help" || args[0] == "--help" {
+			printUsage(commands)
+			return
+		}
+
+		for _, cmd := range commands {
+			if args[0] == cmd.name {
+				cmd.run(args[1:])
+				return
+			}
+		}
+	}
+
+	// Without a command, the arguments are those of the run command, as
+	// they were before the client had commands.
+	runMain(args)
+}
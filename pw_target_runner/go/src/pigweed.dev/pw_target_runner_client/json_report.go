@@ -0,0 +1,185 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	pb "pigweed.dev/proto/pw_target_runner/target_runner_pb"
+)
+
+// Longest line read from a JSON report. Lines hold a run's output, which the
+// server caps at 16 MiB by default.
+const maxReportLineSize = 64 << 20
+
+// reportEntry is the structure of each line of a JSON report. Its fields match
+// those of the server's results file, so either can be read back as a report.
+type reportEntry struct {
+	Time        time.Time         `json:"time"`
+	RequestID   string            `json:"request_id,omitempty"`
+	Target      string            `json:"target,omitempty"`
+	Path        string            `json:"path"`
+	Args        []string          `json:"args,omitempty"`
+	Case        string            `json:"case,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Status      string            `json:"status,omitempty"`
+	QueueTimeNs int64             `json:"queue_time_ns"`
+	RunTimeNs   int64             `json:"run_time_ns"`
+	Output      string            `json:"output,omitempty"`
+	Cached      bool              `json:"cached,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// failed returns whether the entry's run failed or could not be run.
+func (e *reportEntry) failed() bool {
+	return e.Error != "" || e.Status != pb.RunStatus_SUCCESS.String()
+}
+
+// name identifies the entry's executable as a job's name does.
+func (e *reportEntry) name() string {
+	if e.Target != "" {
+		return e.Target + "=" + e.Path
+	}
+	return e.Path
+}
+
+// jsonReport writes the result of each run in a batch to a file as a line of
+// JSON.
+type jsonReport struct {
+	file *os.File
+}
+
+// newJSONReport creates a report which writes to the file at path, replacing
+// any existing file.
+func newJSONReport(path string) (*jsonReport, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonReport{file: file}, nil
+}
+
+// write appends the result of a run to the report.
+func (r *jsonReport) write(result *runResult) error {
+	job := result.job
+	entry := reportEntry{
+		Time:   time.Now(),
+		Target: job.target,
+		Path:   job.path,
+		Args:   job.args,
+		Case:   job.caseFilter,
+		Labels: job.labels,
+		Cached: result.cached,
+	}
+
+	if result.err != nil {
+		entry.Error = result.err.Error()
+	} else {
+		entry.RequestID = result.res.RequestId
+		entry.Status = result.res.Result.String()
+		entry.QueueTimeNs = int64(result.res.QueueTimeNs)
+		entry.RunTimeNs = int64(result.res.RunTimeNs)
+		entry.Output = string(result.res.Output)
+	}
+
+	line, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+	_, err = r.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the report's file.
+func (r *jsonReport) Close() error {
+	return r.file.Close()
+}
+
+// loadReport reads the entries of a JSON report.
+func loadReport(path string) ([]*reportEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []*reportEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, maxReportLineSize)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		var entry reportEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		entries = append(entries, &entry)
+	}
+	return entries, scanner.Err()
+}
+
+// runKey identifies the run of an entry by its executable, arguments, and test
+// case.
+func (e *reportEntry) runKey() string {
+	return strings.Join(append([]string{e.name(), e.Case}, e.Args...), "\x00")
+}
+
+// latestRuns returns the last entry of each run in a report, which may hold
+// several results of the same run, such as a results file appended to by many
+// batches. The runs' keys are returned in the order in which they first appear
+// in the report.
+func latestRuns(entries []*reportEntry) ([]string, map[string]*reportEntry) {
+	latest := make(map[string]*reportEntry)
+	var keys []string
+	for _, entry := range entries {
+		key := entry.runKey()
+		if _, ok := latest[key]; !ok {
+			keys = append(keys, key)
+		}
+		latest[key] = entry
+	}
+	return keys, latest
+}
+
+// failedRuns returns the entries of a report whose runs failed, grouped by the
+// name of their executable. Only the last result of each run is considered.
+// Executables' names are returned in the order in which they first appear in
+// the report.
+func failedRuns(entries []*reportEntry) ([]string, map[string][]*reportEntry) {
+	keys, latest := latestRuns(entries)
+
+	var names []string
+	failed := make(map[string][]*reportEntry)
+	for _, key := range keys {
+		entry := latest[key]
+		if !entry.failed() {
+			continue
+		}
+
+		name := entry.name()
+		if _, ok := failed[name]; !ok {
+			names = append(names, name)
+		}
+		failed[name] = append(failed[name], entry)
+	}
+	return names, failed
+}
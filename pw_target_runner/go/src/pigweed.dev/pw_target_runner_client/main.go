@@ -15,16 +15,27 @@ package main
 
 import (
 	"context"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
 	"log"
+	"math/rand"
+	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/credentials"
 
 	pb "pigweed.dev/proto/pw_target_runner/target_runner_pb"
 )
@@ -32,82 +43,1492 @@ import (
 // Client is a gRPC client that communicates with a TargetRunner service.
 type Client struct {
 	conn *grpc.ClientConn
+
+	// Whether to upload executables to the server rather than sending their
+	// paths.
+	upload bool
+
+	// Cache of previous results to reuse, if any.
+	cache *resultCache
+
+	// Tracer of the client's runs, if they are traced.
+	tracing *tracing
 }
 
+// Size of each chunk of an uploaded executable.
+const uploadChunkSize = 64 << 10
+
+// DefaultServiceConfig is a gRPC service config which retries the RPCs that run
+// executables, with exponential backoff, when the server is unavailable or out
+// of resources. Streaming RPCs are only retried until the server responds.
+const DefaultServiceConfig = `{
+  "methodConfig": [{
+    "name": [
+      {"service": "pw.target_runner.TargetRunner", "method": "RunBinary"},
+      {"service": "pw.target_runner.TargetRunner", "method": "RunBinaryStream"},
+      {"service": "pw.target_runner.TargetRunner", "method": "RunBinaries"}
+    ],
+    "retryPolicy": {
+      "maxAttempts": 4,
+      "initialBackoff": "0.5s",
+      "maxBackoff": "10s",
+      "backoffMultiplier": 2,
+      "retryableStatusCodes": ["UNAVAILABLE", "RESOURCE_EXHAUSTED"]
+    }
+  }]
+}`
+
 // NewClient creates a gRPC client which connects to a gRPC server hosted at the
-// specified address.
-func NewClient(host string, port int) (*Client, error) {
-	// The server currently only supports running locally over an insecure
-	// connection.
-	// TODO(frolv): Investigate adding TLS support to the server and client.
+// specified address. If serviceConfig is set, it is used as the connection's
+// gRPC service config in JSON form, such as DefaultServiceConfig, configuring
+// how calls are retried. Any extra options are added to those of the
+// connection, such as grpc.WithAuthority to send a :authority header other than
+// the dialed address, e.g. to reach a backend through an SNI-based gateway.
+// Over TLS, the authority is also the name against which the server's
+// certificate is verified.
+func NewClient(
+	host string,
+	port int,
+	tlsConfig *tls.Config,
+	serviceConfig string,
+	extra ...grpc.DialOption,
+) (*Client, error) {
+	// Connections are insecure unless a TLS configuration is provided.
 	opts := []grpc.DialOption{grpc.WithInsecure()}
+	if tlsConfig != nil {
+		opts = []grpc.DialOption{
+			grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+		}
+	}
+
+	if serviceConfig != "" {
+		opts = append(opts, grpc.WithDefaultServiceConfig(serviceConfig))
+	}
+	opts = append(opts, extra...)
 
 	conn, err := grpc.Dial(fmt.Sprintf("%s:%d", host, port), opts...)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Client{conn}, nil
+	return &Client{conn: conn}, nil
+}
+
+// RunBinary sends a RunBinaryStream RPC to the target runner service and waits
+// for its result. If progress is not nil, it is called with each of the
+// intermediate updates sent by the server before the result. Output which the
+// server sends in chunks ahead of the result is reassembled into it.
+func (c *Client) RunBinary(
+	ctx context.Context,
+	req *pb.RunBinaryRequest,
+	progress func(*pb.RunBinaryUpdate),
+) (*pb.RunBinaryResponse, error) {
+	client := pb.NewTargetRunnerClient(c.conn)
+	stream, err := client.RunBinaryStream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return receiveResult(stream, progress)
+}
+
+// updateReceiver is the receiving side of an RPC which streams updates on a
+// run.
+type updateReceiver interface {
+	Recv() (*pb.RunBinaryUpdate, error)
+}
+
+// receiveResult receives the updates on a run from a stream until its result,
+// as described in RunBinary.
+func receiveResult(
+	stream updateReceiver,
+	progress func(*pb.RunBinaryUpdate),
+) (*pb.RunBinaryResponse, error) {
+	var output []byte
+	var chunks uint32
+	for {
+		update, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+
+		if chunk := update.GetResultOutput(); chunk != nil {
+			if chunk.Sequence != chunks {
+				return nil, fmt.Errorf(
+					"received output chunk %d out of order; expected %d",
+					chunk.Sequence,
+					chunks)
+			}
+			output = append(output, chunk.Data...)
+			chunks++
+			continue
+		}
+
+		if res := update.GetResult(); res != nil {
+			if res.OutputChunked {
+				if uint64(len(output)) != res.OutputSize {
+					return nil, fmt.Errorf(
+						"received %d bytes of output; expected %d",
+						len(output),
+						res.OutputSize)
+				}
+				res.Output = output
+			}
+			if err := checkOutput(res); err != nil {
+				return nil, err
+			}
+
+			// The server ends the stream after the result. Reading
+			// to its end finishes the RPC, rather than leaving it
+			// open until the connection is closed.
+			stream.Recv()
+			return res, nil
+		}
+
+		if progress != nil {
+			progress(update)
+		}
+	}
+}
+
+// checkOutput checks the output of a result against the CRC-32 computed by the
+// server, returning an error if it was truncated or corrupted in transit.
+// Results from servers which do not compute the checksum are not checked.
+func checkOutput(res *pb.RunBinaryResponse) error {
+	if res.OutputCrc32 == 0 {
+		return nil
+	}
+	if sum := crc32.ChecksumIEEE(res.Output); sum != res.OutputCrc32 {
+		return fmt.Errorf(
+			"output of %s failed checksum: received %d bytes with CRC-32 %08x; expected %08x",
+			res.FilePath,
+			len(res.Output),
+			sum,
+			res.OutputCrc32)
+	}
+	return nil
+}
+
+// UploadBinary sends the executable at the request's path to the target runner
+// service through an UploadAndRunBinaryStream RPC and waits for its result. The
+// server checks the executable against its size and SHA-256 digest before
+// running it. progress is called with updates as in RunBinary, including those
+// on how much of the executable the server has received.
+func (c *Client) UploadBinary(
+	ctx context.Context,
+	req *pb.RunBinaryRequest,
+	progress func(*pb.RunBinaryUpdate),
+) (*pb.RunBinaryResponse, error) {
+	file, err := os.Open(req.FilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	client := pb.NewTargetRunnerClient(c.conn)
+	stream, err := client.UploadAndRunBinaryStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The executable is sent while the server's progress updates are
+	// received. If it cannot be read, the RPC is cancelled.
+	readErr := make(chan error, 1)
+	go func() {
+		if err := sendBinary(stream, req, file, uint64(info.Size())); err != nil {
+			readErr <- err
+			cancel()
+		}
+	}()
+
+	res, err := receiveResult(stream, progress)
+	if err != nil {
+		select {
+		case err := <-readErr:
+			return nil, err
+		default:
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// sendBinary sends an executable of the given size in chunks, the first of which
+// holds the request to run it and the last its SHA-256 digest, then closes the
+// sending side of the stream.
+func sendBinary(
+	stream pb.TargetRunner_UploadAndRunBinaryStreamClient,
+	req *pb.RunBinaryRequest,
+	file io.Reader,
+	size uint64,
+) error {
+	hash := sha256.New()
+	chunk := &pb.BinaryChunk{Request: req, Size: size}
+	buf := make([]byte, uploadChunkSize)
+
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			hash.Write(buf[:n])
+			chunk.Data = buf[:n]
+			if err := stream.Send(chunk); err != nil {
+				// The cause of a failed send is reported by the
+				// receiving side of the stream.
+				return nil
+			}
+			chunk = &pb.BinaryChunk{}
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// The digest is sent in a final chunk, along with the request if the
+	// executable is empty.
+	chunk.Sha256 = hash.Sum(nil)
+	if err := stream.Send(chunk); err != nil {
+		return nil
+	}
+	return stream.CloseSend()
+}
+
+// ListCases lists the test cases in an executable through a ListCases RPC. As
+// for runs, a relative path is resolved from the client's working directory.
+func (c *Client) ListCases(path string) ([]string, error) {
+	req, err := (&runJob{path: path}).request()
+	if err != nil {
+		return nil, err
+	}
+
+	client := pb.NewTargetRunnerClient(c.conn)
+	res, err := client.ListCases(context.Background(), req)
+	if err != nil {
+		return nil, err
+	}
+	return res.Cases, nil
+}
+
+// Ping sends a Ping RPC to the server, returning the RPC's round-trip time.
+func (c *Client) Ping() (time.Duration, error) {
+	client := pb.NewTargetRunnerClient(c.conn)
+
+	start := time.Now()
+	if _, err := client.Ping(context.Background(), &pb.Empty{}); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// Status fetches information about the server through a Status RPC.
+func (c *Client) Status() (*pb.ServerStatus, error) {
+	client := pb.NewTargetRunnerClient(c.conn)
+	return client.Status(context.Background(), &pb.Empty{})
+}
+
+// ListWorkers fetches the state of each of the server's workers through a
+// ListWorkers RPC.
+func (c *Client) ListWorkers() ([]*pb.WorkerStatus, error) {
+	client := pb.NewTargetRunnerClient(c.conn)
+	res, err := client.ListWorkers(context.Background(), &pb.Empty{})
+	if err != nil {
+		return nil, err
+	}
+	return res.Workers, nil
+}
+
+// Cancel cancels a queued or running request on the server by its ID.
+func (c *Client) Cancel(id string) error {
+	client := pb.NewTargetRunnerClient(c.conn)
+	_, err := client.Cancel(context.Background(), &pb.CancelRequest{RequestId: id})
+	return err
+}
+
+// Pause holds the requests queued on the server until Resume is called.
+func (c *Client) Pause() error {
+	client := pb.NewTargetRunnerClient(c.conn)
+	_, err := client.Pause(context.Background(), &pb.Empty{})
+	return err
+}
+
+// Resume allows the server to run queued requests again after Pause.
+func (c *Client) Resume() error {
+	client := pb.NewTargetRunnerClient(c.conn)
+	_, err := client.Resume(context.Background(), &pb.Empty{})
+	return err
 }
 
-// RunBinary sends a RunBinary RPC to the target runner service.
-func (c *Client) RunBinary(path string) error {
-	abspath, err := filepath.Abs(path)
+// FollowLogs streams the server's log lines about a request through a LogStream
+// RPC, writing each to out, until the request completes.
+func (c *Client) FollowLogs(requestID string, out io.Writer) error {
+	client := pb.NewTargetRunnerClient(c.conn)
+	stream, err := client.LogStream(
+		context.Background(), &pb.LogStreamRequest{RequestId: requestID})
 	if err != nil {
 		return err
 	}
 
+	for {
+		line, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "[server] %s\n", line.Line)
+	}
+}
+
+// FollowOutput streams the server's archived output of a request through a
+// FollowOutput RPC, writing it to out, until the request completes. It returns
+// the request's result, without its output, if the server's history holds it,
+// or otherwise nil.
+func (c *Client) FollowOutput(requestID string, out io.Writer) (*pb.RunBinaryResponse, error) {
 	client := pb.NewTargetRunnerClient(c.conn)
-	req := &pb.RunBinaryRequest{FilePath: abspath}
+	stream, err := client.FollowOutput(
+		context.Background(), &pb.FollowOutputRequest{RequestId: requestID})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		update, err := stream.Recv()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if output := update.GetOutput(); output != nil {
+			out.Write(output.Data)
+		} else if result := update.GetResult(); result != nil {
+			return result, nil
+		}
+	}
+}
+
+// History fetches up to n of the most recent results recorded by the server,
+// newest first, through a History RPC. If n is zero, all are fetched.
+func (c *Client) History(n int) ([]*pb.HistoryEntry, error) {
+	client := pb.NewTargetRunnerClient(c.conn)
+	res, err := client.History(
+		context.Background(), &pb.HistoryRequest{MaxResults: uint32(n)})
+	if err != nil {
+		return nil, err
+	}
+	return res.Entries, nil
+}
+
+// run runs a single job, either by path or by uploading its executable. If the
+// client has a result cache holding a result for the job, it is returned instead
+// of running the job. If the client's runs are traced, the job's run is a span.
+func (c *Client) run(
+	job *runJob,
+	progress func(*pb.RunBinaryUpdate),
+) (result *runResult) {
+	ctx, endTrace := c.tracing.traceRun(context.Background(), job)
+	defer func() { endTrace(result) }()
+
+	req, err := job.request()
+	if err != nil {
+		return &runResult{job: job, err: err}
+	}
+
+	// Bazel targets are not files, so their results are not cached.
+	var key string
+	if c.cache != nil && !isBazelLabel(job.path) {
+		var cached *pb.RunBinaryResponse
+		key, cached, err = c.cache.lookup(req)
+		if err != nil {
+			return &runResult{job: job, err: err}
+		}
+		if cached != nil {
+			return &runResult{job: job, res: cached, cached: true}
+		}
+	}
+
+	var res *pb.RunBinaryResponse
+	if c.upload {
+		res, err = c.UploadBinary(ctx, req, progress)
+	} else {
+		res, err = c.RunBinary(ctx, req, progress)
+	}
+
+	if err == nil && key != "" {
+		if err := c.cache.put(key, res); err != nil {
+			log.Printf("Failed to cache result of %s: %v\n", job, err)
+		}
+	}
+
+	return &runResult{job: job, res: res, err: err}
+}
+
+// forJob returns the client which runs a job: the client of its target server,
+// if it has one, or otherwise c.
+func (c *Client) forJob(job *runJob) *Client {
+	if job.client != nil {
+		return job.client
+	}
+	return c
+}
+
+// runServerBatches submits jobs as server batches through RunServerBatch, with
+// one batch for each target server the jobs are routed to. The batches run
+// concurrently, and their results are passed to report one at a time.
+func runServerBatches(c *Client, jobs []*runJob, report func(*runResult)) {
+	batches := make(map[*Client][]*runJob)
+	for _, job := range jobs {
+		cli := c.forJob(job)
+		batches[cli] = append(batches[cli], job)
+	}
+
+	var mutex sync.Mutex
+	var waitGroup sync.WaitGroup
+	for cli, batch := range batches {
+		waitGroup.Add(1)
+		go func(cli *Client, batch []*runJob) {
+			defer waitGroup.Done()
+
+			err := cli.RunServerBatch(batch, func(result *runResult) {
+				mutex.Lock()
+				report(result)
+				mutex.Unlock()
+			})
+			if err != nil {
+				name := "batch"
+				if batch[0].target != "" {
+					name = batch[0].target + " batch"
+				}
+				mutex.Lock()
+				printError(&runJob{path: name}, err)
+				mutex.Unlock()
+			}
+		}(cli, batch)
+	}
+	waitGroup.Wait()
+}
+
+// runJob is a single run of an executable within a batch.
+type runJob struct {
+	path string
+	args []string
+
+	// Label of the target server the job is routed to, and the client for
+	// it. Jobs without a target run on the default server.
+	target string
+	client *Client
+
+	// Name of the single test case to run, if any.
+	caseFilter string
+
+	// Whether the executable stops at its first failing test case.
+	failFast bool
+
+	// Whether to have the server discard the executable's output.
+	discardOutput bool
+
+	// If nonzero, the longest the server lets the executable run.
+	timeout time.Duration
+
+	// If set, the time by which the job's result is needed. The server
+	// rejects the job if it does not expect to finish it by then.
+	deadline time.Time
+
+	// Labels the server records with the executable's result.
+	labels map[string]string
+
+	// Whether the executable is flaky, and how many times the server
+	// retries it if it fails.
+	flaky   bool
+	retries int
+
+	// If either is nonzero, the server runs the executable repeatedly until
+	// it fails or this many runs or this long have passed.
+	soakIterations int
+	soakDuration   time.Duration
+
+	// If not PENDING, the status the executable is expected to have.
+	expectedStatus pb.RunStatus
+
+	// If set, the executable's output is streamed as it runs, grouped
+	// according to this policy.
+	followOutput *pb.OutputFlush
+
+	// Whether the server keeps running the executable if the client
+	// disconnects.
+	continueOnDisconnect bool
+
+	// Index of the job's argument set among those the executable is run
+	// with.
+	variant int
+
+	// Percentage of the job's executable the server had received when its
+	// upload progress was last reported.
+	uploadReported int
+}
+
+// request builds the RunBinaryRequest for a job. Paths are made absolute, as the
+// server does not share the client's working directory, except for Bazel
+// labels.
+func (j *runJob) request() (*pb.RunBinaryRequest, error) {
+	abspath := j.path
+	if !isBazelLabel(j.path) {
+		var err error
+		if abspath, err = filepath.Abs(j.path); err != nil {
+			return nil, err
+		}
+	}
+
+	var deadline uint64
+	if !j.deadline.IsZero() {
+		deadline = uint64(j.deadline.UnixNano())
+	}
+
+	return &pb.RunBinaryRequest{
+		FilePath:             abspath,
+		Args:                 j.args,
+		CaseFilter:           j.caseFilter,
+		FailFast:             j.failFast,
+		DiscardOutput:        j.discardOutput,
+		TimeoutNs:            uint64(j.timeout),
+		Flaky:                j.flaky,
+		RetriesOnFailure:     uint32(j.retries),
+		ExpectedStatus:       j.expectedStatus,
+		SoakIterations:       uint32(j.soakIterations),
+		SoakDurationNs:       uint64(j.soakDuration),
+		DeadlineUnixNs:       deadline,
+		Labels:               j.labels,
+		StreamOutput:         j.followOutput != nil,
+		OutputFlush:          j.followOutput,
+		ContinueOnDisconnect: j.continueOnDisconnect,
+	}, nil
+}
+
+// isBazelLabel returns whether a path is a Bazel target label, such as
+// "//pkg:test", for servers which run Bazel tests.
+func isBazelLabel(path string) bool {
+	return strings.HasPrefix(path, "//") || strings.HasPrefix(path, "@")
+}
+
+// runResult is the outcome of a single job within a batch.
+type runResult struct {
+	job *runJob
+	res *pb.RunBinaryResponse
+	err error
+
+	// Whether the result was reused from a previous run.
+	cached bool
+}
+
+// RunBatch runs a list of jobs through the target runner service, keeping up
+// to concurrency of them in flight at once. Each result is passed to report as
+// soon as it is available. Intermediate progress updates are passed to
+// progress, if it is not nil.
+//
+// If deadline is nonzero, no new jobs are submitted once that much time has
+// elapsed since the start of the batch. Any jobs which were not run are
+// returned.
+func (c *Client) RunBatch(
+	jobs []*runJob,
+	concurrency int,
+	deadline time.Duration,
+	report func(*runResult),
+	progress func(*runJob, *pb.RunBinaryUpdate),
+) []*runJob {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	start := time.Now()
+	slots := make(chan struct{}, concurrency)
+	var skipped []*runJob
+	var mutex sync.Mutex
+	var waitGroup sync.WaitGroup
+
+	for i, job := range jobs {
+		// Wait for a free job slot before checking the deadline, so
+		// that time spent waiting on earlier runs is accounted for.
+		slots <- struct{}{}
+
+		if deadline > 0 && time.Since(start) >= deadline {
+			skipped = jobs[i:]
+			break
+		}
+
+		waitGroup.Add(1)
+		go func(job *runJob) {
+			defer func() {
+				<-slots
+				waitGroup.Done()
+			}()
+
+			var onUpdate func(*pb.RunBinaryUpdate)
+			if progress != nil {
+				onUpdate = func(update *pb.RunBinaryUpdate) {
+					mutex.Lock()
+					progress(job, update)
+					mutex.Unlock()
+				}
+			}
 
-	res, err := client.RunBinary(context.Background(), req)
+			result := c.forJob(job).run(job, onUpdate)
+
+			mutex.Lock()
+			report(result)
+			mutex.Unlock()
+		}(job)
+	}
+
+	waitGroup.Wait()
+
+	return skipped
+}
+
+// RunServerBatch sends all of the jobs to the target runner service in a single
+// RunBinaries RPC, leaving it to the server to schedule them. Each result is
+// passed to report as soon as the server sends it. Jobs with a cached result are
+// reported immediately and not sent to the server. Each job is given a random
+// idempotency key, so that a server which honors them does not run the batch
+// again if the RPC is retried. If the client's runs are traced, the batch is a
+// span, with a span for each of its runs.
+func (c *Client) RunServerBatch(jobs []*runJob, report func(*runResult)) (err error) {
+	ctx, endBatch := c.tracing.traceBatch(context.Background(), len(jobs))
+	defer endBatch()
+
+	batch := &pb.RunBinariesRequest{}
+	var cacheKeys []string
+
+	// Functions which end the trace of each pending job's run. The runs of
+	// any jobs which have not completed when the batch fails end with its
+	// error.
+	var pending []*runJob
+	var endTraces []func(*runResult)
+	defer func() {
+		for i, end := range endTraces {
+			if end != nil {
+				end(&runResult{job: pending[i], err: err})
+			}
+		}
+	}()
+
+	for _, job := range jobs {
+		req, err := job.request()
+		if err != nil {
+			return err
+		}
+
+		// Bazel targets are not files, so their results are not
+		// cached.
+		var key string
+		if c.cache != nil && !isBazelLabel(job.path) {
+			var cached *pb.RunBinaryResponse
+			key, cached, err = c.cache.lookup(req)
+			if err != nil {
+				return err
+			}
+			if cached != nil {
+				result := &runResult{job: job, res: cached, cached: true}
+				_, endTrace := c.tracing.traceRun(ctx, job)
+				endTrace(result)
+				report(result)
+				continue
+			}
+		}
+		cacheKeys = append(cacheKeys, key)
+
+		// The key is set after the cache lookup so that it does not
+		// affect the job's cache key.
+		if req.IdempotencyKey, err = newIdempotencyKey(); err != nil {
+			return err
+		}
+
+		_, endTrace := c.tracing.traceRun(ctx, job)
+		endTraces = append(endTraces, endTrace)
+
+		pending = append(pending, job)
+		batch.Binaries = append(batch.Binaries, req)
+	}
+
+	if len(pending) == 0 {
+		return nil
+	}
+	jobs = pending
+
+	client := pb.NewTargetRunnerClient(c.conn)
+	stream, err := client.RunBinaries(ctx, batch)
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("%s\n", path)
-	fmt.Printf(
-		"Queued for %v, ran in %v\n\n",
-		time.Duration(res.QueueTimeNs),
-		time.Duration(res.RunTimeNs),
-	)
-	fmt.Println(string(res.Output))
+	for range jobs {
+		res, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		if int(res.BatchIndex) >= len(jobs) {
+			return fmt.Errorf("server returned invalid batch index %d", res.BatchIndex)
+		}
+
+		var result *runResult
+		if res.Error != "" {
+			// The server could not run this executable, but continues
+			// with the rest of the batch.
+			result = &runResult{
+				job: jobs[res.BatchIndex],
+				err: errors.New(res.Error),
+			}
+		} else {
+			if err := checkOutput(res); err != nil {
+				return err
+			}
+			if key := cacheKeys[res.BatchIndex]; key != "" {
+				if err := c.cache.put(key, res); err != nil {
+					log.Printf(
+						"Failed to cache result of %s: %v\n",
+						jobs[res.BatchIndex],
+						err)
+				}
+			}
+			result = &runResult{job: jobs[res.BatchIndex], res: res}
+		}
+		if end := endTraces[res.BatchIndex]; end != nil {
+			end(result)
+			endTraces[res.BatchIndex] = nil
+		}
+		report(result)
+	}
+
+	// Finish the RPC by reading to the end of the stream, as for a single
+	// run's result.
+	stream.Recv()
+	return nil
+}
+
+// newIdempotencyKey returns a random key which identifies a job to the server
+// across retries of its batch.
+func newIdempotencyKey() (string, error) {
+	var key [16]byte
+	if _, err := cryptorand.Read(key[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key[:]), nil
+}
+
+// expandPaths expands glob patterns and directories in a list of paths into the
+// executables they contain. Other paths are returned unchanged.
+//
+// Directories are expanded to the files within them, descending into
+// subdirectories if recursive is set. These files are filtered by matching
+// their names against pattern if it is provided, or by their executable bit
+// otherwise. The second return value reports whether any expansion occurred.
+func expandPaths(paths []string, recursive bool, pattern string) ([]string, bool, error) {
+	var expanded []string
+	didExpand := false
+
+	// Checks whether a file found within a directory should be run.
+	include := func(path string, info os.FileInfo) (bool, error) {
+		if !info.Mode().IsRegular() {
+			return false, nil
+		}
+		if pattern != "" {
+			return filepath.Match(pattern, filepath.Base(path))
+		}
+		return info.Mode()&0111 != 0, nil
+	}
+
+	for _, path := range paths {
+		matches := []string{path}
+		if strings.ContainsAny(path, "*?[") {
+			var err error
+			if matches, err = filepath.Glob(path); err != nil {
+				return nil, false, err
+			}
+			didExpand = true
+		}
+
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil || !info.IsDir() {
+				// Individual files are passed through as-is;
+				// any errors are reported when they are run.
+				expanded = append(expanded, match)
+				continue
+			}
+
+			didExpand = true
+			err = filepath.Walk(match, func(p string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if info.IsDir() && p != match && !recursive {
+					return filepath.SkipDir
+				}
+				ok, err := include(p, info)
+				if ok {
+					expanded = append(expanded, p)
+				}
+				return err
+			})
+			if err != nil {
+				return nil, false, err
+			}
+		}
+	}
+
+	return expanded, didExpand, nil
+}
+
+// listCases prints the test cases in each of the executables, returning the
+// number of executables whose cases could not be listed. The cases of a single
+// executable are printed one per line; for multiple executables, they are
+// grouped under each executable's path. Paths prefixed with the label of one
+// of targets are listed by that target's server.
+func listCases(c *Client, paths []string, targets map[string]*Client) int {
+	failed := 0
+
+	for _, path := range paths {
+		cli := c
+		label, targetPath := splitTarget(path, targets)
+		if label != "" {
+			cli = targets[label]
+		}
+
+		cases, err := cli.ListCases(targetPath)
+		if err != nil {
+			printError(&runJob{path: path}, err)
+			failed++
+			continue
+		}
+
+		if len(paths) == 1 {
+			for _, name := range cases {
+				fmt.Println(name)
+			}
+			continue
+		}
 
-	if res.Result != pb.RunStatus_SUCCESS {
-		return errors.New("Binary run was unsuccessful")
+		fmt.Printf("%s:\n", path)
+		for _, name := range cases {
+			fmt.Printf("  %s\n", name)
+		}
 	}
 
+	return failed
+}
+
+// argSets is a flag.Value collecting each occurrence of a flag as a separate
+// set of whitespace-separated arguments.
+type argSets [][]string
+
+func (a *argSets) String() string {
+	return fmt.Sprint(*a)
+}
+
+func (a *argSets) Set(value string) error {
+	*a = append(*a, strings.Fields(value))
 	return nil
 }
 
-func main() {
-	hostPtr := flag.String("host", "localhost", "Server host")
-	portPtr := flag.Int("port", 8080, "Server port")
-	pathPtr := flag.String("binary", "", "Path to executable file")
+// labelSet is a flag.Value collecting labels given as "key=value". A key given
+// more than once takes its last value.
+type labelSet map[string]string
+
+func (l labelSet) String() string {
+	return fmt.Sprint(map[string]string(l))
+}
+
+func (l labelSet) Set(value string) error {
+	eq := strings.Index(value, "=")
+	if eq <= 0 {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	l[value[:eq]] = value[eq+1:]
+	return nil
+}
+
+// shardPaths returns the subset of paths belonging to the specified shard.
+// Paths are assigned to shards by their hash, so every path belongs to exactly
+// one of the shards regardless of the order in which the paths are listed.
+func shardPaths(paths []string, index int, count int) []string {
+	var shard []string
+	for _, path := range paths {
+		h := fnv.New32a()
+		h.Write([]byte(filepath.ToSlash(filepath.Clean(path))))
+		if int(h.Sum32()%uint32(count)) == index {
+			shard = append(shard, path)
+		}
+	}
+	return shard
+}
+
+// orderPaths reorders paths according to an -order option: "listed" keeps the
+// order in which they were given, "alpha" sorts them, and "shuffle" shuffles
+// them using seed, so that a shuffled order can be repeated.
+func orderPaths(paths []string, order string, seed int64) error {
+	switch order {
+	case "listed":
+	case "alpha":
+		sort.Strings(paths)
+	case "shuffle":
+		rng := rand.New(rand.NewSource(seed))
+		rng.Shuffle(len(paths), func(i, j int) {
+			paths[i], paths[j] = paths[j], paths[i]
+		})
+	default:
+		return fmt.Errorf("unknown order %q", order)
+	}
+	return nil
+}
+
+// runMain implements the run command, which runs executables on the server and
+// reports their results.
+func runMain(args []string) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	conn := addConnectionFlags(fs)
+	pathPtr := fs.String("binary", "", "Path to executable file")
+	jobsPtr := fs.Int("jobs", 1, "Number of executables to run concurrently")
+	deadlinePtr := fs.Duration(
+		"deadline",
+		0,
+		"Stop submitting executables after this much time has elapsed")
+	finishWithinPtr := fs.Duration(
+		"finish-within",
+		0,
+		"Have the server reject or abandon executables which it cannot "+
+			"finish within this much time of the client starting")
+	recursivePtr := fs.Bool(
+		"recursive", false, "Search subdirectories of directory arguments")
+	patternPtr := fs.String(
+		"pattern",
+		"",
+		"Only run files in directory arguments whose names match this glob "+
+			"(default: files with the executable bit set)")
+	shardIndexPtr := fs.Int(
+		"shard-index", 0, "Index of the shard of executables to run")
+	shardCountPtr := fs.Int(
+		"shard-count", 1, "Total number of shards to split executables into")
+	serverBatchPtr := fs.Bool(
+		"server-batch",
+		false,
+		"Submit all executables in a single request, letting the server "+
+			"schedule them; -jobs and -deadline do not apply")
+	uploadPtr := fs.Bool(
+		"upload",
+		false,
+		"Upload executables to the server rather than sending their paths")
+	casePtr := fs.String(
+		"case", "", "Run only the named test case (e.g. Suite.Case) of executables")
+	listCasesPtr := fs.Bool(
+		"list-cases", false, "List the test cases in executables without running them")
+	failFastPtr := fs.Bool(
+		"fail-fast",
+		false,
+		"Have executables stop at their first failing test case; the server's "+
+			"runners must support it")
+	cacheDirPtr := fs.String(
+		"cache-dir",
+		"",
+		"Directory in which to cache successful results, which are reused "+
+			"for unchanged executables")
+	cacheTTLPtr := fs.Duration(
+		"cache-ttl", 24*time.Hour, "How long cached results remain usable")
+	noCachePtr := fs.Bool(
+		"no-cache", false, "Run executables even if they have a cached result")
+	noOutputPtr := fs.Bool(
+		"no-output",
+		false,
+		"Have the server discard the output of executables, reporting only "+
+			"their results")
+	timeoutPtr := fs.Duration(
+		"timeout",
+		0,
+		"Longest each executable may run before the server terminates it "+
+			"(default: server's)")
+	flakyPtr := fs.Bool(
+		"flaky",
+		false,
+		"Mark the executables as flaky, so that the server retries them if "+
+			"they fail")
+	retriesPtr := fs.Int(
+		"retries-on-failure",
+		2,
+		"Number of times the server retries a flaky executable which fails")
+	soakIterationsPtr := fs.Int(
+		"soak-iterations",
+		0,
+		"Run each executable repeatedly until it fails or has passed this "+
+			"many times")
+	soakDurationPtr := fs.Duration(
+		"soak-duration",
+		0,
+		"Run each executable repeatedly until it fails or this long has passed")
+	expectStatusPtr := fs.String(
+		"expect-status",
+		"",
+		"Status the executables are expected to have, such as \"failure\" for "+
+			"negative tests; they pass if their status matches")
+	outputDirPtr := fs.String(
+		"output-dir", "", "Directory in which to save the output of each run")
+	quietPtr := fs.Bool(
+		"quiet", false, "Only print the output of unsuccessful executables")
+	followPtr := fs.Bool(
+		"follow",
+		false,
+		"Print the output of a single executable as it runs, rather than once "+
+			"it has finished")
+	flushPtr := fs.String(
+		"flush",
+		"hybrid",
+		"How -follow groups output: \"hybrid\" (by -flush-size or "+
+			"-flush-interval, whichever is reached first), \"lines\", "+
+			"\"chunks\" (of -flush-size), or \"interval\" (every -flush-interval)")
+	flushSizePtr := fs.Int(
+		"flush-size", 0, "Bytes of output grouped by -follow (default: server's)")
+	flushIntervalPtr := fs.Duration(
+		"flush-interval",
+		0,
+		"Longest time -follow holds output (default: server's)")
+	orderPtr := fs.String(
+		"order",
+		"listed",
+		"Order in which executables are submitted: \"listed\", \"alpha\", "+
+			"or \"shuffle\"")
+	seedPtr := fs.Int64(
+		"seed",
+		0,
+		"Seed with which -order shuffle shuffles executables (default: random)")
+	followLogsPtr := fs.Bool(
+		"follow-logs",
+		false,
+		"Print the server's log lines about a single executable as it runs")
+	continueOnDisconnectPtr := fs.Bool(
+		"continue-on-disconnect",
+		false,
+		"Have the server keep running the executables if the client "+
+			"disconnects, so that their output can be fetched with the "+
+			"follow-output command; the server must archive output")
+	jsonReportPtr := fs.String(
+		"json-report",
+		"",
+		"File to which to write the result of each run as a line of JSON")
+	onlyFailedPtr := fs.String(
+		"only-failed",
+		"",
+		"Rerun only the runs which failed in this JSON report, written by "+
+			"-json-report or the server's -results-file")
+	otlpEndpointPtr := fs.String(
+		"otlp-endpoint",
+		"",
+		"URL of an OTLP gRPC collector to which to export a trace of each "+
+			"run, e.g. http://localhost:4317")
+	slowFactorPtr := fs.Float64(
+		"slow-factor",
+		2,
+		"Warn about runs which take this many times longer than their "+
+			"executable's average on the server; 0 disables the warning")
+	timingSummaryPtr := fs.Bool(
+		"timing-summary",
+		false,
+		"After running, print percentiles of the queue and run times of the batch")
+	targetsFilePtr := fs.String(
+		"targets-file",
+		"",
+		"File listing a label and host:port on each line of servers to which "+
+			"executables given as label=path are routed")
+	var targetFlags targetList
+	fs.Var(
+		&targetFlags,
+		"target",
+		"Server, as label=host:port, to which executables given as "+
+			"label=path are routed; may be repeated")
+	labels := make(labelSet)
+	fs.Var(
+		labels,
+		"label",
+		"Label, as key=value, to attach to each run, such as a build ID; the "+
+			"server records it with the result; may be repeated")
+	var variants argSets
+	fs.Var(
+		&variants,
+		"args",
+		"Arguments to pass to each executable; may be repeated to run "+
+			"each executable once per argument set")
+
+	fs.Parse(args)
+
+	// Runs must finish within -finish-within of the client starting.
+	var finishBy time.Time
+	if *finishWithinPtr > 0 {
+		finishBy = time.Now().Add(*finishWithinPtr)
+	}
+
+	if *serverBatchPtr && *deadlinePtr != 0 {
+		log.Fatalf("-deadline cannot be used with -server-batch")
+	}
+
+	if *serverBatchPtr && *uploadPtr {
+		log.Fatalf("-upload cannot be used with -server-batch")
+	}
+
+	if *followPtr && (*serverBatchPtr || *uploadPtr || *listCasesPtr) {
+		log.Fatalf("-follow cannot be used with -server-batch, -upload, or -list-cases")
+	}
+
+	if *followLogsPtr && (*serverBatchPtr || *uploadPtr || *listCasesPtr) {
+		log.Fatalf(
+			"-follow-logs cannot be used with -server-batch, -upload, or -list-cases")
+	}
+
+	if *continueOnDisconnectPtr && (*serverBatchPtr || *uploadPtr) {
+		log.Fatalf("-continue-on-disconnect cannot be used with -server-batch or -upload")
+	}
+
+	expectedStatus := pb.RunStatus_PENDING
+	if *expectStatusPtr != "" {
+		status, ok := pb.RunStatus_value[strings.ToUpper(*expectStatusPtr)]
+		if !ok || status == int32(pb.RunStatus_PENDING) {
+			log.Fatalf("Unknown -expect-status %q", *expectStatusPtr)
+		}
+		expectedStatus = pb.RunStatus(status)
+	}
+
+	var followOutput *pb.OutputFlush
+	if *followPtr {
+		mode, ok := pb.OutputFlush_Mode_value[strings.ToUpper(*flushPtr)]
+		if !ok {
+			log.Fatalf("Unknown -flush mode %q", *flushPtr)
+		}
+		followOutput = &pb.OutputFlush{
+			Mode:       pb.OutputFlush_Mode(mode),
+			ChunkSize:  uint32(*flushSizePtr),
+			IntervalNs: uint64(*flushIntervalPtr),
+		}
+	}
 
-	flag.Parse()
+	if *shardCountPtr < 1 || *shardIndexPtr < 0 || *shardIndexPtr >= *shardCountPtr {
+		log.Fatalf(
+			"Invalid shard %d of %d; -shard-index must be in [0, -shard-count)",
+			*shardIndexPtr,
+			*shardCountPtr)
+	}
 
-	if *pathPtr == "" {
-		log.Fatalf("Must provide -binary option")
+	if *otlpEndpointPtr != "" {
+		var err error
+		conn.tracing, err = newTracing(*otlpEndpointPtr)
+		if err != nil {
+			log.Fatalf("Failed to set up tracing: %v", err)
+		}
 	}
 
-	cli, err := NewClient(*hostPtr, *portPtr)
+	cli := conn.connect()
+
+	// Targets listed through -target take precedence over those with the
+	// same label in the targets file.
+	targets := []target(targetFlags)
+	if *targetsFilePtr != "" {
+		loaded, err := loadTargetsFile(*targetsFilePtr)
+		if err != nil {
+			log.Fatalf("Failed to load targets file: %v", err)
+		}
+		targets = append(loaded, targets...)
+	}
+
+	targetClients := make(map[string]*Client)
+	for _, t := range targets {
+		targetClients[t.label] = conn.connectTo(t.host, t.port)
+	}
+
+	// Executables may be specified through the -binary option, as
+	// positional arguments, or both. Positional arguments may be glob
+	// patterns or directories, and may be routed to a target server by
+	// prefixing them with its label.
+	paths := fs.Args()
+	if *pathPtr != "" {
+		paths = append([]string{*pathPtr}, paths...)
+	}
+
+	// Reruns of failed runs are made with the arguments and test case they
+	// were originally run with.
+	var reruns map[string][]*reportEntry
+	if *onlyFailedPtr != "" {
+		if len(paths) > 0 || len(variants) > 0 || *casePtr != "" {
+			log.Fatalf("-only-failed cannot be combined with executables, -args, or -case")
+		}
+
+		entries, err := loadReport(*onlyFailedPtr)
+		if err != nil {
+			log.Fatalf("Failed to read report: %v", err)
+		}
+
+		paths, reruns = failedRuns(entries)
+		if len(paths) == 0 {
+			log.Printf("No runs failed in %s\n", *onlyFailedPtr)
+			return
+		}
+		for _, name := range paths {
+			if target := reruns[name][0].Target; target != "" && targetClients[target] == nil {
+				log.Fatalf("%s was run on target %q, which is not configured", name, target)
+			}
+		}
+		log.Printf("Rerunning %d failed executable(s) from %s\n", len(paths), *onlyFailedPtr)
+	}
+
+	paths, expanded, err := expandTargetPaths(
+		paths, targetClients, *recursivePtr, *patternPtr)
 	if err != nil {
-		log.Fatalf("Failed to create gRPC client: %v", err)
+		log.Fatalf("Failed to expand executable paths: %v", err)
 	}
 
-	if err := cli.RunBinary(*pathPtr); err != nil {
-		log.Println("Failed to run executable on target:")
-		log.Println("")
+	if expanded {
+		log.Printf("Matched %d executable(s)\n", len(paths))
+	}
 
-		s, _ := status.FromError(err)
-		if s.Code() == codes.Unavailable {
-			log.Println("  No pw_target_runner_server is running.")
-			log.Println("  Check that a server has been started for your target.")
-		} else {
-			log.Printf("  %v\n", err)
+	if len(paths) == 0 {
+		log.Fatalf("Must provide -binary option or executable paths")
+	}
+
+	if *shardCountPtr > 1 {
+		total := len(paths)
+		paths = shardPaths(paths, *shardIndexPtr, *shardCountPtr)
+		log.Printf(
+			"Running shard %d of %d: %d of %d executable(s)\n",
+			*shardIndexPtr,
+			*shardCountPtr,
+			len(paths),
+			total)
+	}
+
+	// The seed of a random shuffle is logged so that the same order can be
+	// used again.
+	if *orderPtr == "shuffle" {
+		if *seedPtr == 0 {
+			*seedPtr = time.Now().UnixNano()
+		}
+		log.Printf("Shuffling executables with -seed %d\n", *seedPtr)
+	}
+
+	// With multiple concurrent jobs, this orders only their submission;
+	// they may complete in any order.
+	if err := orderPaths(paths, *orderPtr, *seedPtr); err != nil {
+		log.Fatalf("Invalid -order: %v", err)
+	}
+
+	cli.upload = *uploadPtr
+
+	if *cacheDirPtr != "" {
+		// Soaking is meant to reproduce failures, so it always runs.
+		soak := *soakIterationsPtr > 0 || *soakDurationPtr > 0
+		cli.cache, err = newResultCache(*cacheDirPtr, *cacheTTLPtr, *noCachePtr || soak)
+		if err != nil {
+			log.Fatalf("Failed to create result cache: %v", err)
+		}
+	}
+
+	for label, targetCli := range targetClients {
+		targetCli.upload = cli.upload
+		if cli.cache != nil {
+			targetCli.cache = cli.cache.forTarget(label)
+		}
+	}
+
+	if *listCasesPtr {
+		if failed := listCases(cli, paths, targetClients); failed > 0 {
+			log.Fatalf("Failed to list cases in %d executable(s)", failed)
+		}
+		return
+	}
+
+	// Build a job for each variant of each executable. All of an
+	// executable's variants are listed together so that they are likely to
+	// complete close together and can be reported as a group.
+	if len(variants) == 0 {
+		variants = argSets{nil}
+	}
+
+	var jobs []*runJob
+	for _, arg := range paths {
+		label, path := splitTarget(arg, targetClients)
+		newJob := func(args []string, caseFilter string, variant int) *runJob {
+			return &runJob{
+				path:           path,
+				target:         label,
+				client:         targetClients[label],
+				args:           args,
+				caseFilter:     caseFilter,
+				failFast:       *failFastPtr,
+				discardOutput:  *noOutputPtr,
+				timeout:        *timeoutPtr,
+				deadline:       finishBy,
+				labels:         labels,
+				flaky:          *flakyPtr,
+				retries:        *retriesPtr,
+				soakIterations: *soakIterationsPtr,
+				soakDuration:   *soakDurationPtr,
+				expectedStatus: expectedStatus,
+				followOutput:   followOutput,
+				variant:        variant,
+
+				continueOnDisconnect: *continueOnDisconnectPtr,
+			}
+		}
+
+		// Failed runs are reported individually rather than grouped
+		// as variants of their executable.
+		if reruns != nil {
+			for _, run := range reruns[arg] {
+				jobs = append(jobs, newJob(run.Args, run.Case, 0))
+			}
+			continue
+		}
+
+		for i, args := range variants {
+			jobs = append(jobs, newJob(args, *casePtr, i))
 		}
+	}
+
+	// Output from several executables would be interleaved.
+	if *followPtr && len(jobs) != 1 {
+		log.Fatalf("-follow requires a single executable")
+	}
+	if *followLogsPtr && len(jobs) != 1 {
+		log.Fatalf("-follow-logs requires a single executable")
+	}
+
+	// Progress updates are only useful when interactively running a single
+	// executable; in a batch they would clutter the output.
+	var progress func(*runJob, *pb.RunBinaryUpdate)
+	printsQueued := len(jobs) == 1 && (!*quietPtr || *followPtr)
+	if printsQueued {
+		progress = printProgress
+	}
+
+	// The server's logs about the executable are followed once it has
+	// been queued, as that is when its request ID is known.
+	var logsDone chan struct{}
+	if *followLogsPtr {
+		printUpdate := progress
+		progress = func(job *runJob, update *pb.RunBinaryUpdate) {
+			if queued := update.GetQueued(); queued != nil && logsDone == nil {
+				logsDone = make(chan struct{})
+				go func() {
+					defer close(logsDone)
+					err := cli.forJob(job).FollowLogs(queued.RequestId, os.Stderr)
+					if err != nil {
+						log.Printf("Failed to follow server logs: %v\n", err)
+					}
+				}()
+			}
+			if printUpdate != nil {
+				printUpdate(job, update)
+			}
+		}
+	}
+
+	// Request IDs of executables which keep running after a disconnect are
+	// always logged, even in batches and with -quiet, as they are needed to
+	// fetch the output afterwards.
+	if *continueOnDisconnectPtr && !printsQueued {
+		printUpdate := progress
+		progress = func(job *runJob, update *pb.RunBinaryUpdate) {
+			if queued := update.GetQueued(); queued != nil {
+				log.Printf("%s is request %s\n", job, queued.RequestId)
+			}
+			if printUpdate != nil {
+				printUpdate(job, update)
+			}
+		}
+	}
+
+	// Each rerun is counted on its own, as it may be one of several of an
+	// executable's runs which failed.
+	total := len(paths)
+	reporterVariants := len(variants)
+	if reruns != nil {
+		total = len(jobs)
+		reporterVariants = 1
+	}
+
+	reporter := newReporter(reporterVariants, *quietPtr)
+	reporter.slowFactor = *slowFactorPtr
+
+	if *outputDirPtr != "" {
+		if err := os.MkdirAll(*outputDirPtr, 0755); err != nil {
+			log.Fatalf("Failed to create output directory: %v", err)
+		}
+		reporter.outputDir = *outputDirPtr
+	}
+
+	if *jsonReportPtr != "" {
+		report, err := newJSONReport(*jsonReportPtr)
+		if err != nil {
+			log.Fatalf("Failed to create JSON report: %v", err)
+		}
+		reporter.jsonReport = report
+	}
+
+	var skipped []*runJob
+	if *serverBatchPtr {
+		runServerBatches(cli, jobs, reporter.report)
+	} else {
+		skipped = cli.RunBatch(jobs, *jobsPtr, *deadlinePtr, reporter.report, progress)
+	}
+	reporter.flush()
+	if conn.tracing != nil {
+		conn.tracing.shutdown()
+	}
+	if reporter.jsonReport != nil {
+		if err := reporter.jsonReport.Close(); err != nil {
+			log.Printf("Failed to write JSON report: %v\n", err)
+		}
+	}
+
+	// The server ends the log stream once the executable has completed,
+	// after sending the last of its lines.
+	if logsDone != nil {
+		<-logsDone
+	}
+
+	if len(skipped) > 0 {
+		log.Printf(
+			"Deadline of %v exceeded; %d run(s) were not started:\n",
+			*deadlinePtr,
+			len(skipped))
+		for _, job := range skipped {
+			log.Printf("  %s\n", job)
+		}
+	}
+
+	if *timingSummaryPtr {
+		reporter.printTimingSummary()
+	}
+
+	notRun := total - reporter.passed - reporter.failed
+
+	if *quietPtr {
+		fmt.Printf(
+			"%d passed, %d failed, %d not run\n",
+			reporter.passed,
+			reporter.failed,
+			notRun)
+	}
 
-		log.Fatal("")
+	if reporter.failed > 0 || notRun > 0 {
+		log.Fatalf(
+			"%d of %d executable(s) did not succeed",
+			reporter.failed+notRun,
+			total)
 	}
 }
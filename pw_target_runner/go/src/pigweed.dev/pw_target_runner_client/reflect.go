@@ -0,0 +1,139 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+)
+
+// Full name of the target runner service, as registered with the server.
+const targetRunnerService = "pw.target_runner.TargetRunner"
+
+// reflectionClient queries a server's gRPC reflection service over a single
+// stream.
+type reflectionClient struct {
+	stream rpb.ServerReflection_ServerReflectionInfoClient
+	cancel context.CancelFunc
+}
+
+// newReflectionClient opens a stream to the server's reflection service. It
+// must be closed once done.
+func (c *Client) newReflectionClient() (*reflectionClient, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := rpb.NewServerReflectionClient(c.conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &reflectionClient{stream: stream, cancel: cancel}, nil
+}
+
+// Close closes the reflection stream.
+func (r *reflectionClient) Close() {
+	r.stream.CloseSend()
+	r.cancel()
+}
+
+// query sends a request to the reflection service and returns its response,
+// converting error responses to errors.
+func (r *reflectionClient) query(
+	req *rpb.ServerReflectionRequest,
+) (*rpb.ServerReflectionResponse, error) {
+	if err := r.stream.Send(req); err != nil {
+		return nil, err
+	}
+
+	res, err := r.stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+
+	if e := res.GetErrorResponse(); e != nil {
+		return nil, fmt.Errorf("reflection error %d: %s", e.ErrorCode, e.ErrorMessage)
+	}
+	return res, nil
+}
+
+// ListServices returns the full names of the services registered with the
+// server.
+func (r *reflectionClient) ListServices() ([]string, error) {
+	res, err := r.query(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_ListServices{ListServices: "*"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, service := range res.GetListServicesResponse().GetService() {
+		names = append(names, service.Name)
+	}
+	return names, nil
+}
+
+// Service returns the descriptor of a service registered with the server, by
+// its full name.
+func (r *reflectionClient) Service(name string) (*descpb.ServiceDescriptorProto, error) {
+	res, err := r.query(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{
+			FileContainingSymbol: name,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The response holds the file defining the service, followed by the
+	// files it depends on.
+	for _, encoded := range res.GetFileDescriptorResponse().GetFileDescriptorProto() {
+		var file descpb.FileDescriptorProto
+		if err := proto.Unmarshal(encoded, &file); err != nil {
+			return nil, err
+		}
+
+		for _, service := range file.Service {
+			fullName := service.GetName()
+			if file.GetPackage() != "" {
+				fullName = file.GetPackage() + "." + fullName
+			}
+			if fullName == name {
+				return service, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("server did not describe service %s", name)
+}
+
+// methodSignature formats a method as it would be declared in a .proto file.
+func methodSignature(method *descpb.MethodDescriptorProto) string {
+	input := strings.TrimPrefix(method.GetInputType(), ".")
+	if method.GetClientStreaming() {
+		input = "stream " + input
+	}
+
+	output := strings.TrimPrefix(method.GetOutputType(), ".")
+	if method.GetServerStreaming() {
+		output = "stream " + output
+	}
+
+	return fmt.Sprintf("rpc %s(%s) returns (%s)", method.GetName(), input, output)
+}
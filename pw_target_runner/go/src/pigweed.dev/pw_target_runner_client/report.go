@@ -0,0 +1,397 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "pigweed.dev/proto/pw_target_runner/target_runner_pb"
+)
+
+// reporter prints the results of a batch as they arrive and tracks the
+// batch's overall outcome.
+//
+// Each executable in a batch may be run as several variants with different
+// arguments. The results of an executable's variants are grouped together and
+// reported once all of them have completed. An executable fails if any of its
+// variants fail.
+type reporter struct {
+	// Whether to suppress the output of successful executables.
+	quiet bool
+
+	// Number of variants each executable is run as.
+	variants int
+
+	// Directory in which to save the output of each run, if set.
+	outputDir string
+
+	// Report to which the result of each run is written, if set.
+	jsonReport *jsonReport
+
+	// If nonzero, runs which take this many times longer than their
+	// executable's baseline run time on the server are warned about.
+	slowFactor float64
+
+	// Completed results of executables with outstanding variants.
+	pending map[string][]*runResult
+
+	// Queue and run times of each completed run, excluding cached results.
+	queueTimes []time.Duration
+	runTimes   []time.Duration
+
+	passed int
+	failed int
+}
+
+func newReporter(variants int, quiet bool) *reporter {
+	if variants < 1 {
+		variants = 1
+	}
+	return &reporter{
+		quiet:    quiet,
+		variants: variants,
+		pending:  make(map[string][]*runResult),
+	}
+}
+
+// report records the result of a single run within the batch.
+func (r *reporter) report(result *runResult) {
+	if r.outputDir != "" && result.err == nil {
+		if err := r.saveOutput(result); err != nil {
+			log.Printf("Failed to save output of %s: %v\n", result.job, err)
+		}
+	}
+
+	if r.jsonReport != nil {
+		if err := r.jsonReport.write(result); err != nil {
+			log.Printf("Failed to write result of %s to report: %v\n", result.job, err)
+		}
+	}
+
+	if result.err == nil && !result.cached {
+		r.checkRunTime(result)
+		r.queueTimes = append(r.queueTimes, time.Duration(result.res.QueueTimeNs))
+		r.runTimes = append(r.runTimes, time.Duration(result.res.RunTimeNs))
+	}
+
+	path := result.job.name()
+	results := append(r.pending[path], result)
+
+	if len(results) < r.variants {
+		r.pending[path] = results
+		return
+	}
+
+	delete(r.pending, path)
+	r.finish(path, results, true)
+}
+
+// checkRunTime warns if a run was much slower than its executable's baseline.
+func (r *reporter) checkRunTime(result *runResult) {
+	baseline := time.Duration(result.res.BaselineRunTimeNs)
+	runTime := time.Duration(result.res.RunTimeNs)
+	if r.slowFactor <= 0 || baseline <= 0 {
+		return
+	}
+
+	if ratio := float64(runTime) / float64(baseline); ratio >= r.slowFactor {
+		log.Printf(
+			"%s ran in %v, %.1f times longer than its usual %v\n",
+			result.job,
+			runTime,
+			ratio,
+			baseline)
+	}
+}
+
+// flush reports all executables with variants that did not run.
+func (r *reporter) flush() {
+	for path, results := range r.pending {
+		r.finish(path, results, false)
+	}
+	r.pending = make(map[string][]*runResult)
+}
+
+// saveOutput writes the output of a run to its own file in the output
+// directory. The file is named after the executable's path, followed by the
+// run's test case and variant, if any, and its request ID.
+func (r *reporter) saveOutput(result *runResult) error {
+	job := result.job
+	replacer := strings.NewReplacer("/", "_", ":", "_")
+
+	// Flatten the executable's path into a single file name component so
+	// that identically named executables in different directories do not
+	// collide.
+	name := strings.Trim(filepath.ToSlash(filepath.Clean(job.path)), "/")
+	name = replacer.Replace(name)
+	if job.target != "" {
+		name = job.target + "." + name
+	}
+
+	if job.caseFilter != "" {
+		name += "." + replacer.Replace(job.caseFilter)
+	}
+	if r.variants > 1 {
+		name += fmt.Sprintf(".variant%d", job.variant)
+	}
+	name += fmt.Sprintf(".%s.log", result.res.RequestId)
+
+	return ioutil.WriteFile(filepath.Join(r.outputDir, name), result.res.Output, 0644)
+}
+
+// printTimingSummary prints the distribution of the queue and run times of the
+// runs in the batch.
+func (r *reporter) printTimingSummary() {
+	if len(r.runTimes) == 0 {
+		fmt.Println("No timing information; no runs completed")
+		return
+	}
+
+	fmt.Printf("Timing summary of %d run(s):\n", len(r.runTimes))
+	printPercentiles("Queue time", r.queueTimes)
+	printPercentiles("Run time", r.runTimes)
+}
+
+// printPercentiles prints the median, 90th and 99th percentiles, and maximum of
+// a set of durations.
+func printPercentiles(name string, durations []time.Duration) {
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	fmt.Printf(
+		"  %-11s p50 %v, p90 %v, p99 %v, max %v\n",
+		name+":",
+		percentile(sorted, 50),
+		percentile(sorted, 90),
+		percentile(sorted, 99),
+		sorted[len(sorted)-1])
+}
+
+// percentile returns the pth percentile of a sorted, non-empty set of durations
+// using the nearest-rank method.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// finish prints the results of an executable's variants and records its
+// overall outcome. If complete is false, some of its variants did not run; the
+// executable is only counted if it failed.
+func (r *reporter) finish(path string, results []*runResult, complete bool) {
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].job.variant < results[j].job.variant
+	})
+
+	passed := 0
+	for _, result := range results {
+		if err := printResult(result, r.quiet); err != nil {
+			printError(result.job, err)
+		} else {
+			passed++
+		}
+	}
+
+	ok := passed == len(results)
+	if r.variants > 1 && (!r.quiet || !ok) {
+		fmt.Printf("%s: %d of %d variant(s) passed\n\n", path, passed, r.variants)
+	}
+
+	if !ok {
+		r.failed++
+	} else if complete {
+		r.passed++
+	}
+}
+
+// printResult prints the outcome of a run, returning an error if the run was
+// unsuccessful. If quiet is set, nothing is printed for successful runs.
+func printResult(r *runResult, quiet bool) error {
+	if r.err != nil {
+		return r.err
+	}
+
+	// Leaked processes are reported even for successful runs, as they may
+	// cause later runs to fail.
+	if r.res.LeakedProcesses > 0 && !r.cached {
+		log.Printf(
+			"%s left %d process(es) running, which the server killed\n",
+			r.job,
+			r.res.LeakedProcesses)
+	}
+
+	// Flaky executables which needed retries are reported even when they
+	// passed, so that they are not forgotten about.
+	if len(r.res.AttemptResults) > 1 && !r.cached {
+		attempts := make([]string, len(r.res.AttemptResults))
+		for i, result := range r.res.AttemptResults {
+			attempts[i] = result.String()
+		}
+		log.Printf(
+			"%s ran %d time(s): %s\n",
+			r.job,
+			len(attempts),
+			strings.Join(attempts, ", "))
+	}
+
+	if r.res.SoakIterations > 0 && !r.cached {
+		if failed := r.res.SoakFailedIteration; failed > 0 {
+			log.Printf("%s failed on iteration %d of its soak\n", r.job, failed)
+		} else {
+			log.Printf("%s passed %d soak iteration(s)\n", r.job, r.res.SoakIterations)
+		}
+	}
+
+	// Servers which do not support expected statuses leave the actual
+	// status unset.
+	if expected := r.job.expectedStatus; expected != pb.RunStatus_PENDING {
+		actual := r.res.ActualStatus
+		if actual == pb.RunStatus_PENDING {
+			log.Printf("%s: server did not check the expected status\n", r.job)
+		} else if actual != expected {
+			log.Printf("%s had status %v; expected %v\n", r.job, actual, expected)
+		}
+	}
+
+	if quiet && r.res.Result == pb.RunStatus_SUCCESS {
+		return nil
+	}
+
+	if r.cached {
+		fmt.Printf("%s (cached result of request %s)\n", r.job, r.res.RequestId)
+	} else {
+		fmt.Printf("%s (request %s)\n", r.job, r.res.RequestId)
+	}
+	fmt.Printf(
+		"Queued for %v, ran in %v\n",
+		time.Duration(r.res.QueueTimeNs),
+		time.Duration(r.res.RunTimeNs),
+	)
+	if r.res.MaxRssBytes > 0 || r.res.UserCpuNs > 0 || r.res.SysCpuNs > 0 {
+		fmt.Printf(
+			"Used %v user and %v system CPU time, peak memory %.1f MiB\n",
+			time.Duration(r.res.UserCpuNs),
+			time.Duration(r.res.SysCpuNs),
+			float64(r.res.MaxRssBytes)/(1<<20))
+	}
+	for _, core := range r.res.CoreDumps {
+		fmt.Printf("Core dump saved on server at %s\n", core)
+	}
+	fmt.Println()
+
+	// Followed output has already been printed as it arrived.
+	if r.job.followOutput == nil || r.cached {
+		if r.res.OutputTailed {
+			fmt.Printf("[%d bytes of output omitted]\n", r.res.OutputDroppedBytes)
+		}
+		fmt.Println(string(r.res.Output))
+	}
+	if len(r.res.HookOutput) > 0 {
+		fmt.Printf("Hook output:\n%s\n", r.res.HookOutput)
+	}
+
+	if r.res.Result == pb.RunStatus_TIMEOUT {
+		return errors.New("Binary run timed out")
+	}
+	if r.res.Result == pb.RunStatus_OUT_OF_MEMORY {
+		return errors.New("Binary run exceeded its memory limit")
+	}
+	if r.res.Result != pb.RunStatus_SUCCESS {
+		return errors.New("Binary run was unsuccessful")
+	}
+
+	return nil
+}
+
+// printProgress logs an intermediate update on the progress of a run.
+func printProgress(job *runJob, update *pb.RunBinaryUpdate) {
+	if queued := update.GetQueued(); queued != nil {
+		log.Printf(
+			"%s queued at position %d (request %s)\n",
+			job,
+			queued.Position,
+			queued.RequestId)
+	} else if upload := update.GetUploadProgress(); upload != nil {
+		// Uploads are reported in steps of 10%, and when complete.
+		if upload.TotalBytes == 0 {
+			return
+		}
+		percent := int(upload.BytesReceived * 100 / upload.TotalBytes)
+		if percent/10 > job.uploadReported/10 || percent == 100 {
+			job.uploadReported = percent
+			log.Printf(
+				"Uploaded %d of %d bytes of %s (%d%%)\n",
+				upload.BytesReceived,
+				upload.TotalBytes,
+				job,
+				percent)
+		}
+	} else if update.GetStarted() != nil {
+		log.Printf("%s is running\n", job)
+	} else if output := update.GetOutput(); output != nil {
+		os.Stdout.Write(output.Data)
+	}
+}
+
+// printError logs an error which occurred while running an executable.
+func printError(job *runJob, err error) {
+	log.Printf("Failed to run executable %s on target:\n", job)
+	log.Println("")
+
+	s, _ := status.FromError(err)
+	if s.Code() == codes.Unavailable {
+		log.Println("  No pw_target_runner_server is running.")
+		log.Println("  Check that a server has been started for your target.")
+	} else {
+		log.Printf("  %v\n", err)
+	}
+
+	log.Println("")
+}
+
+// name identifies a job's executable: its path, prefixed with its target's
+// label if it has one.
+func (j *runJob) name() string {
+	if j.target != "" {
+		return j.target + "=" + j.path
+	}
+	return j.path
+}
+
+// String formats a job as its executable name followed by its test case and
+// arguments.
+func (j *runJob) String() string {
+	s := j.name()
+	if j.caseFilter != "" {
+		s = fmt.Sprintf("%s (case %s)", s, j.caseFilter)
+	}
+	if len(j.args) != 0 {
+		s = fmt.Sprintf("%s [%s]", s, strings.Join(j.args, " "))
+	}
+	return s
+}
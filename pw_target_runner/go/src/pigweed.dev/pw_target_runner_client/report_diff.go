@@ -0,0 +1,209 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Kinds of difference between the results of a run in two reports.
+const (
+	runRegressed = "REGRESSED"
+	runFixed     = "FIXED"
+	runChanged   = "CHANGED"
+	runAdded     = "ADDED"
+	runRemoved   = "REMOVED"
+	runSlower    = "SLOWER"
+	runFaster    = "FASTER"
+)
+
+// The order in which kinds of difference are listed.
+var runDiffOrder = []string{
+	runRegressed, runFixed, runChanged, runAdded, runRemoved, runSlower, runFaster,
+}
+
+// runDiff is the difference between the results of a run in two reports. Either
+// entry is nil if the run is missing from that report.
+type runDiff struct {
+	kind   string
+	before *reportEntry
+	after  *reportEntry
+}
+
+// diffReports compares the last result of each run in two reports. Runs whose
+// status is unchanged are included only if their run time changed, by at least
+// threshold as a fraction of the earlier run time. Differences are grouped by
+// kind, in the order of runDiffOrder, and within each kind are in the order in
+// which their runs appear in the reports.
+func diffReports(before, after []*reportEntry, threshold float64) []*runDiff {
+	beforeKeys, beforeRuns := latestRuns(before)
+	afterKeys, afterRuns := latestRuns(after)
+
+	var diffs []*runDiff
+	for _, key := range afterKeys {
+		a := afterRuns[key]
+		b, ok := beforeRuns[key]
+		if !ok {
+			diffs = append(diffs, &runDiff{kind: runAdded, after: a})
+			continue
+		}
+
+		kind := ""
+		switch {
+		case !b.failed() && a.failed():
+			kind = runRegressed
+		case b.failed() && !a.failed():
+			kind = runFixed
+		case entryStatus(b) != entryStatus(a):
+			kind = runChanged
+		case a.failed() || b.RunTimeNs == 0:
+			// Failed runs' times say little about the executable.
+		case a.RunTimeNs == b.RunTimeNs:
+			// Unchanged times are not listed, even with a threshold of
+			// zero.
+		case float64(a.RunTimeNs-b.RunTimeNs) >= threshold*float64(b.RunTimeNs):
+			kind = runSlower
+		case float64(b.RunTimeNs-a.RunTimeNs) >= threshold*float64(b.RunTimeNs):
+			kind = runFaster
+		}
+		if kind != "" {
+			diffs = append(diffs, &runDiff{kind: kind, before: b, after: a})
+		}
+	}
+
+	for _, key := range beforeKeys {
+		if _, ok := afterRuns[key]; !ok {
+			diffs = append(diffs, &runDiff{kind: runRemoved, before: beforeRuns[key]})
+		}
+	}
+
+	order := make(map[string]int)
+	for i, kind := range runDiffOrder {
+		order[kind] = i
+	}
+	sort.SliceStable(diffs, func(i, j int) bool {
+		return order[diffs[i].kind] < order[diffs[j].kind]
+	})
+	return diffs
+}
+
+// entryStatus describes the result of an entry's run, or "ERROR" if it could
+// not be made.
+func entryStatus(e *reportEntry) string {
+	if e == nil {
+		return "-"
+	}
+	if e.Error != "" {
+		return "ERROR"
+	}
+	return e.Status
+}
+
+// describeRun identifies an entry's run by its executable, test case, and
+// arguments.
+func describeRun(e *reportEntry) string {
+	desc := e.name()
+	if e.Case != "" {
+		desc += " (" + e.Case + ")"
+	}
+	if len(e.Args) > 0 {
+		desc += " " + strings.Join(e.Args, " ")
+	}
+	return desc
+}
+
+// describeRunTimes formats the run times of a run in two reports and their
+// difference.
+func describeRunTimes(before, after *reportEntry) string {
+	format := func(e *reportEntry) string {
+		if e == nil || e.Error != "" {
+			return "-"
+		}
+		return time.Duration(e.RunTimeNs).Round(time.Millisecond).String()
+	}
+
+	desc := format(before) + " -> " + format(after)
+	if before != nil && after != nil && before.RunTimeNs > 0 && after.Error == "" {
+		delta := float64(after.RunTimeNs-before.RunTimeNs) / float64(before.RunTimeNs)
+		desc += fmt.Sprintf(" (%+.0f%%)", delta*100)
+	}
+	return desc
+}
+
+// diffMain implements the diff command, which compares the results of the runs
+// in two JSON reports, such as those of two commits, and exits with a nonzero
+// status if any run which passed in the first failed in the second.
+func diffMain(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	thresholdPtr := fs.Float64(
+		"time-threshold",
+		10,
+		"Percentage by which the run time of a run whose status is unchanged "+
+			"must change for it to be listed")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		log.Fatalf("Must provide two JSON reports")
+	}
+
+	before, err := loadReport(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("Failed to read report: %v", err)
+	}
+	after, err := loadReport(fs.Arg(1))
+	if err != nil {
+		log.Fatalf("Failed to read report: %v", err)
+	}
+
+	diffs := diffReports(before, after, *thresholdPtr/100)
+	counts := make(map[string]int)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CHANGE\tBEFORE\tAFTER\tRUN TIME\tRUN")
+	for _, diff := range diffs {
+		counts[diff.kind]++
+
+		entry := diff.after
+		if entry == nil {
+			entry = diff.before
+		}
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\t%s\t%s\n",
+			diff.kind,
+			entryStatus(diff.before),
+			entryStatus(diff.after),
+			describeRunTimes(diff.before, diff.after),
+			describeRun(entry))
+	}
+	w.Flush()
+
+	var summary []string
+	for _, kind := range runDiffOrder {
+		summary = append(summary, fmt.Sprintf("%d %s", counts[kind], strings.ToLower(kind)))
+	}
+	fmt.Printf("\n%s\n", strings.Join(summary, ", "))
+
+	if counts[runRegressed] > 0 {
+		os.Exit(1)
+	}
+}
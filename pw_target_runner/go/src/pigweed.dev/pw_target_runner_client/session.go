@@ -0,0 +1,146 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	pb "pigweed.dev/proto/pw_target_runner/target_runner_pb"
+)
+
+// Size of each read of a session's input.
+const sessionInputChunkSize = 32 << 10
+
+var errSessionNoExit = errors.New("server ended the session before the executable exited")
+
+// Session runs an executable interactively through an InteractiveSession RPC.
+// Input read from stdin is sent to the executable until it reaches EOF, and its
+// output is written to stdout and stderr as it arrives. onStart, if set, is
+// called with the request's ID once the executable starts. The executable's
+// exit is returned once it has exited.
+func (c *Client) Session(
+	start *pb.SessionStart,
+	stdin io.Reader,
+	stdout io.Writer,
+	stderr io.Writer,
+	onStart func(requestID string),
+) (*pb.SessionExit, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := pb.NewTargetRunnerClient(c.conn)
+	stream, err := client.InteractiveSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stream.Send(&pb.SessionInput{Input: &pb.SessionInput_Start{Start: start}})
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		buf := make([]byte, sessionInputChunkSize)
+		for {
+			n, err := stdin.Read(buf)
+			if n > 0 {
+				in := &pb.SessionInput{
+					Input: &pb.SessionInput_Stdin{Stdin: buf[:n]},
+				}
+				if stream.Send(in) != nil {
+					return
+				}
+			}
+			if err != nil {
+				stream.CloseSend()
+				return
+			}
+		}
+	}()
+
+	for {
+		out, err := stream.Recv()
+		if err == io.EOF {
+			return nil, errSessionNoExit
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch output := out.Output.(type) {
+		case *pb.SessionOutput_Started:
+			if onStart != nil {
+				onStart(output.Started.RequestId)
+			}
+		case *pb.SessionOutput_Stdout:
+			stdout.Write(output.Stdout)
+		case *pb.SessionOutput_Stderr:
+			stderr.Write(output.Stderr)
+		case *pb.SessionOutput_Exit:
+			// Finish the RPC by reading to the end of the stream.
+			stream.Recv()
+			return output.Exit, nil
+		}
+	}
+}
+
+// sessionMain implements the session command, which runs an executable on the
+// server interactively, connected to the client's stdin, stdout, and stderr.
+// The client exits with a nonzero status unless the executable succeeds.
+func sessionMain(args []string) {
+	fs := flag.NewFlagSet("session", flag.ExitOnError)
+	conn := addConnectionFlags(fs)
+	timeoutPtr := fs.Duration(
+		"timeout",
+		0,
+		"If nonzero, how long the session may last before the executable is "+
+			"killed; overrides the server's default timeout")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		log.Fatalf("Must provide an executable to run")
+	}
+
+	path, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	start := &pb.SessionStart{
+		FilePath:  path,
+		Args:      fs.Args()[1:],
+		TimeoutNs: uint64(*timeoutPtr),
+	}
+	exit, err := conn.connect().Session(
+		start,
+		os.Stdin,
+		os.Stdout,
+		os.Stderr,
+		func(requestID string) { log.Printf("Session started as request %s\n", requestID) })
+	if err != nil {
+		log.Fatalf("Session failed: %v", err)
+	}
+
+	if exit.Result != pb.RunStatus_SUCCESS {
+		log.Printf("Executable ended with %v\n", exit.Result)
+		os.Exit(1)
+	}
+}
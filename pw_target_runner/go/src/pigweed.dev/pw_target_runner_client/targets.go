@@ -0,0 +1,152 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// target is a labeled server to which executables can be routed, such as one
+// serving a particular type of board.
+type target struct {
+	label string
+	host  string
+	port  int
+}
+
+// parseTarget parses a target's label and "host:port" address.
+func parseTarget(label string, address string) (target, error) {
+	if label == "" || strings.ContainsAny(label, "=/") {
+		return target{}, fmt.Errorf("invalid target label %q", label)
+	}
+
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return target{}, err
+	}
+
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return target{}, fmt.Errorf("invalid port in address %q", address)
+	}
+
+	return target{label: label, host: host, port: port}, nil
+}
+
+// targetList is a flag.Value collecting targets given as "label=host:port".
+type targetList []target
+
+func (t *targetList) String() string {
+	return fmt.Sprint(*t)
+}
+
+func (t *targetList) Set(value string) error {
+	eq := strings.Index(value, "=")
+	if eq < 0 {
+		return fmt.Errorf("expected label=host:port, got %q", value)
+	}
+
+	parsed, err := parseTarget(value[:eq], value[eq+1:])
+	if err != nil {
+		return err
+	}
+	*t = append(*t, parsed)
+	return nil
+}
+
+// loadTargetsFile reads targets from a file listing a label and a "host:port"
+// address on each line, separated by whitespace. Blank lines and lines starting
+// with "#" are ignored.
+func loadTargetsFile(path string) ([]target, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var targets []target
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a label and host:port", path, lineNumber)
+		}
+
+		parsed, err := parseTarget(fields[0], fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNumber, err)
+		}
+		targets = append(targets, parsed)
+	}
+
+	return targets, scanner.Err()
+}
+
+// splitTarget splits an executable argument of the form "label=path" into the
+// label of the target it is routed to and its path. Arguments which are not
+// prefixed by the label of a known target are returned as-is, with no label,
+// to run on the default server.
+func splitTarget(arg string, clients map[string]*Client) (string, string) {
+	eq := strings.Index(arg, "=")
+	if eq < 0 {
+		return "", arg
+	}
+
+	if _, ok := clients[arg[:eq]]; !ok {
+		return "", arg
+	}
+	return arg[:eq], arg[eq+1:]
+}
+
+// expandTargetPaths expands executable arguments as expandPaths does, keeping
+// the target label of each argument on each of the paths it expands to.
+func expandTargetPaths(
+	args []string,
+	clients map[string]*Client,
+	recursive bool,
+	pattern string,
+) ([]string, bool, error) {
+	var paths []string
+	expanded := false
+
+	for _, arg := range args {
+		label, path := splitTarget(arg, clients)
+
+		matches, didExpand, err := expandPaths([]string{path}, recursive, pattern)
+		if err != nil {
+			return nil, false, err
+		}
+		expanded = expanded || didExpand
+
+		for _, match := range matches {
+			if label != "" {
+				match = label + "=" + match
+			}
+			paths = append(paths, match)
+		}
+	}
+
+	return paths, expanded, nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+
+	pb "pigweed.dev/proto/pw_target_runner/target_runner_pb"
+)
+
+// Longest the client waits to export its remaining spans before it exits.
+const traceShutdownTimeout = 5 * time.Second
+
+// tracing exports OpenTelemetry traces of the client's runs to an OTLP
+// collector. Each run is a span, with the RPCs made for it as its children.
+type tracing struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+// newTracing creates a tracer which exports spans to the OTLP gRPC endpoint at
+// a URL, such as "http://localhost:4317". Endpoints with an "http" scheme are
+// connected to without TLS.
+func newTracing(endpoint string) (*tracing, error) {
+	exporter, err := otlptracegrpc.New(
+		context.Background(), otlptracegrpc.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "pw_target_runner_client"))))
+
+	return &tracing{
+		provider: provider,
+		tracer:   provider.Tracer("pigweed.dev/pw_target_runner_client"),
+	}, nil
+}
+
+// dialOption returns the option which traces the RPCs of a connection,
+// propagating their trace context to the server in their metadata.
+func (t *tracing) dialOption() grpc.DialOption {
+	return grpc.WithStatsHandler(otelgrpc.NewClientHandler(
+		otelgrpc.WithTracerProvider(t.provider),
+		otelgrpc.WithPropagators(propagation.TraceContext{})))
+}
+
+// traceRun starts the span of a job's run as a child of any span in ctx. It
+// returns a context carrying the span for the run's RPCs, and a function which
+// records the run's result on the span and ends it. If t is nil, nothing is
+// traced.
+func (t *tracing) traceRun(
+	ctx context.Context,
+	job *runJob,
+) (context.Context, func(*runResult)) {
+	if t == nil {
+		return ctx, func(*runResult) {}
+	}
+
+	ctx, span := t.startRun(ctx, job)
+	return ctx, func(result *runResult) { endRun(span, result) }
+}
+
+// traceBatch starts the span of a server batch of jobs, under which the span of
+// each of its runs is started. It returns a context carrying the span and a
+// function which ends it. If t is nil, nothing is traced.
+func (t *tracing) traceBatch(ctx context.Context, size int) (context.Context, func()) {
+	if t == nil {
+		return ctx, func() {}
+	}
+
+	ctx, span := t.tracer.Start(
+		ctx,
+		"pw_target_runner.batch",
+		trace.WithAttributes(attribute.Int("pw_target_runner.batch_size", size)))
+	return ctx, func() { span.End() }
+}
+
+// startRun starts the span of a job's run, returning a context carrying it for
+// the run's RPCs.
+func (t *tracing) startRun(ctx context.Context, job *runJob) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{
+		attribute.String("pw_target_runner.path", job.path),
+	}
+	if job.target != "" {
+		attrs = append(attrs, attribute.String("pw_target_runner.target", job.target))
+	}
+	if job.caseFilter != "" {
+		attrs = append(attrs, attribute.String("pw_target_runner.case", job.caseFilter))
+	}
+	if len(job.args) > 0 {
+		attrs = append(attrs, attribute.StringSlice("pw_target_runner.args", job.args))
+	}
+
+	return t.tracer.Start(ctx, "pw_target_runner.run", trace.WithAttributes(attrs...))
+}
+
+// endRun records the result of a run on its span and ends it.
+func endRun(span trace.Span, result *runResult) {
+	defer span.End()
+
+	if result.err != nil {
+		span.RecordError(result.err)
+		span.SetStatus(otelcodes.Error, result.err.Error())
+		return
+	}
+	if result.res == nil {
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("pw_target_runner.request_id", result.res.RequestId),
+		attribute.String("pw_target_runner.result", result.res.Result.String()),
+		attribute.Bool("pw_target_runner.cached", result.cached))
+	if result.res.Result != pb.RunStatus_SUCCESS {
+		span.SetStatus(otelcodes.Error, result.res.Result.String())
+	}
+}
+
+// shutdown exports any spans which have not yet been sent.
+func (t *tracing) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), traceShutdownTimeout)
+	defer cancel()
+
+	if err := t.provider.Shutdown(ctx); err != nil {
+		log.Printf("Failed to export traces: %v\n", err)
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	pb "pigweed.dev/proto/pw_target_runner/target_runner_pb"
+)
+
+// Terminal escape sequence which clears the screen and moves the cursor to its
+// top left corner.
+const clearScreen = "\033[H\033[2J"
+
+// watchMain implements the watch command, which polls the server's status and
+// redraws it as a live view until interrupted.
+func watchMain(args []string) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	conn := addConnectionFlags(fs)
+	intervalPtr := fs.Duration("interval", 2*time.Second, "Time between status updates")
+	fs.Parse(args)
+
+	if *intervalPtr <= 0 {
+		log.Fatalf("-interval must be positive")
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	// When not writing to a terminal, such as when piped to a file, each
+	// update is appended rather than redrawn.
+	redraw := isTerminal(os.Stdout)
+
+	client := conn.connect()
+	server := fmt.Sprintf("%s:%d", *conn.host, *conn.port)
+	ticker := time.NewTicker(*intervalPtr)
+	defer ticker.Stop()
+
+	var last *pb.ServerStatus
+	for first := true; ; first = false {
+		status, err := client.Status()
+
+		// The view is drawn in full before it is written so that the
+		// terminal does not flicker as it is redrawn.
+		var view bytes.Buffer
+		if redraw {
+			view.WriteString(clearScreen)
+		} else if !first {
+			view.WriteString("\n")
+		}
+		writeStatusView(&view, server, status, last, *intervalPtr, err)
+		os.Stdout.Write(view.Bytes())
+		if err == nil {
+			last = status
+		}
+
+		select {
+		case <-signals:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// writeStatusView writes a compact view of the server's status. If last is not
+// nil, it is the status from the previous update, which was interval earlier,
+// and is used to show the server's recent throughput. If the status could not
+// be fetched, err is shown instead.
+func writeStatusView(
+	w io.Writer,
+	server string,
+	status *pb.ServerStatus,
+	last *pb.ServerStatus,
+	interval time.Duration,
+	err error,
+) {
+	fmt.Fprintf(w, "%s at %s\n\n", server, time.Now().Format("15:04:05"))
+	if err != nil {
+		fmt.Fprintf(w, "Failed to get server status: %v\n", err)
+		return
+	}
+
+	fmt.Fprintf(w, "Uptime:   %v\n", time.Duration(status.UptimeNs).Round(time.Second))
+	fmt.Fprintf(w, "Results:  %d passed, %d failed\n", status.TasksPassed, status.TasksFailed)
+
+	// Servers predating pool statistics do not report them.
+	pool := status.Pool
+	if pool == nil {
+		fmt.Fprintf(w, "Queued:   %d\n", status.TasksQueued)
+		return
+	}
+
+	queue := fmt.Sprintf("%d", pool.QueueDepth)
+	if pool.Paused {
+		queue += " (paused)"
+	}
+	fmt.Fprintf(w, "Queued:   %s\n", queue)
+	fmt.Fprintf(
+		w,
+		"Workers:  %d of %d busy, %d unhealthy, %d quarantined\n",
+		pool.WorkersBusy,
+		pool.WorkersTotal,
+		pool.WorkersUnhealthy,
+		pool.WorkersQuarantined)
+
+	if last != nil && last.Pool != nil && pool.RequestsCompleted >= last.Pool.RequestsCompleted {
+		completed := pool.RequestsCompleted - last.Pool.RequestsCompleted
+		fmt.Fprintf(
+			w,
+			"Rate:     %.1f completed/min\n",
+			float64(completed)/interval.Minutes())
+	}
+}
+
+// isTerminal returns whether a file is a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
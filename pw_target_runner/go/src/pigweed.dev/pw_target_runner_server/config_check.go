@@ -0,0 +1,66 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"pigweed.dev/pw_target_runner"
+)
+
+// configCheckMain implements the config-check command, which validates a
+// config file as the server would load it with -strict-config, and prints the
+// workers it defines. Nothing is started. The program exits with a nonzero
+// status if the config is invalid, so that config changes can be checked
+// before they are deployed.
+func configCheckMain(args []string) {
+	fs := flag.NewFlagSet("config-check", flag.ExitOnError)
+	var configs configFiles
+	fs.Var(
+		&configs,
+		"config",
+		"Path to server configuration file; several comma-separated or "+
+			"repeated files are merged in order")
+	fs.Parse(args)
+
+	if len(configs) == 0 {
+		fmt.Fprintln(os.Stderr, "config-check requires -config")
+		os.Exit(2)
+	}
+
+	// The server logs each worker as it is registered, which would repeat
+	// the summary.
+	log.SetOutput(ioutil.Discard)
+
+	server := pw_target_runner.NewServer()
+	workers, err := configureServerFromFiles(server, configs, "", true, 0, 0)
+	if err == nil && len(workers) == 0 {
+		err = fmt.Errorf("config defines no runners")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf(
+		"%s is valid and defines %d worker(s):\n", configs.String(), len(workers))
+	for i, worker := range workers {
+		fmt.Printf("  %d: %s\n", i, worker)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+
+	pb "pigweed.dev/proto/pw_target_runner/exec_server_config_pb"
+)
+
+// Defaults which the server applies to runners that leave these fields unset.
+// See applyRunnerDefaults.
+const (
+	defaultRunnerCapacity    = 1
+	defaultKillGracePeriodMs = 5000
+	defaultBazelProgram      = "bazel"
+)
+
+// resolveServerConfig applies the server's flags and defaults to a merged
+// config in place, so that it describes the workers the server would register.
+// Nonzero defaultTimeout and maxTimeout override the config's timeouts, rounded
+// up to whole seconds.
+func resolveServerConfig(
+	config *pb.ServerConfig,
+	defaultTimeout time.Duration,
+	maxTimeout time.Duration,
+) {
+	if defaultTimeout > 0 {
+		config.DefaultTimeoutSeconds = durationSeconds(defaultTimeout)
+	}
+	if maxTimeout > 0 {
+		config.MaxTimeoutSeconds = durationSeconds(maxTimeout)
+	}
+	applyRunnerDefaults(config)
+}
+
+// applyRunnerDefaults fills in the fields of a config's runners which the server
+// defaults when they are unset. The server creates its workers from the config
+// after this, so these are the only definitions of the defaults.
+func applyRunnerDefaults(config *pb.ServerConfig) {
+	for _, runner := range config.GetRunner() {
+		if runner.GetCapacity() == 0 {
+			runner.Capacity = defaultRunnerCapacity
+		}
+		if runner.GetKillGracePeriodMs() == 0 {
+			runner.KillGracePeriodMs = defaultKillGracePeriodMs
+		}
+	}
+
+	for _, runner := range config.GetBazelRunner() {
+		if runner.GetBazel() == "" {
+			runner.Bazel = defaultBazelProgram
+		}
+	}
+}
+
+// durationSeconds converts a positive duration to whole seconds, rounding up.
+func durationSeconds(d time.Duration) uint32 {
+	return uint32((d + time.Second - 1) / time.Second)
+}
+
+// dumpServerConfig prints the config the server would run with, after merging
+// the config files in paths and applying its flags and defaults, as JSON. Fields
+// which are unset are printed with their zero values.
+func dumpServerConfig(paths []string, defaultTimeout, maxTimeout time.Duration) error {
+	config, err := loadServerConfig(paths)
+	if err != nil {
+		return err
+	}
+	resolveServerConfig(config, defaultTimeout, maxTimeout)
+
+	options := protojson.MarshalOptions{
+		Multiline:       true,
+		Indent:          "  ",
+		EmitUnpopulated: true,
+	}
+	content, err := options.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(content))
+	return nil
+}
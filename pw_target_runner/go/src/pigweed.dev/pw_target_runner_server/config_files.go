@@ -0,0 +1,205 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+
+	pb "pigweed.dev/proto/pw_target_runner/exec_server_config_pb"
+)
+
+// configFiles is a flag listing server config files, given either as a
+// comma-separated list or by repeating the flag.
+type configFiles []string
+
+func (f *configFiles) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *configFiles) Set(value string) error {
+	for _, path := range strings.Split(value, ",") {
+		if path != "" {
+			*f = append(*f, path)
+		}
+	}
+	return nil
+}
+
+// runnerSource records where a runner with an ID was defined, to report which
+// runners later config files override and conflicts between them.
+type runnerSource struct {
+	path string
+	kind string
+}
+
+// loadServerConfig loads a series of server config files and merges them in
+// order. Runners are appended to those of earlier files, except that a runner
+// with the same ID as one from an earlier file replaces it. Nonzero top-level
+// fields override those of earlier files. Runner IDs must be unique within a
+// file, and a runner cannot replace one of a different kind.
+func loadServerConfig(paths []string) (*pb.ServerConfig, error) {
+	merged := &pb.ServerConfig{}
+	sources := make(map[string]runnerSource)
+
+	for _, path := range paths {
+		config, err := loadConfigFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+
+		if err := mergeServerConfig(merged, config, path, sources); err != nil {
+			return nil, err
+		}
+
+		log.Printf("Parsed server configuration from %s\n", path)
+	}
+
+	return merged, nil
+}
+
+// loadConfigFile parses a single server config file. Relative env_file and
+// core_dump_dir paths in the file are resolved from its directory, so that they
+// remain valid once the file is merged with others.
+func loadConfigFile(path string) (*pb.ServerConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config pb.ServerConfig
+	if err := proto.UnmarshalText(string(content), &config); err != nil {
+		return nil, err
+	}
+
+	for _, runner := range config.GetRunner() {
+		if envFile := runner.GetEnvFile(); envFile != "" && !filepath.IsAbs(envFile) {
+			runner.EnvFile = filepath.Join(filepath.Dir(path), envFile)
+		}
+		if dir := runner.GetCoreDumpDir(); dir != "" && !filepath.IsAbs(dir) {
+			runner.CoreDumpDir = filepath.Join(filepath.Dir(path), dir)
+		}
+	}
+
+	return &config, nil
+}
+
+// mergeServerConfig merges a config loaded from path into merged. sources holds
+// the kind and file of each runner ID in merged, and is updated with those of
+// the added config.
+func mergeServerConfig(
+	merged *pb.ServerConfig,
+	config *pb.ServerConfig,
+	path string,
+	sources map[string]runnerSource,
+) error {
+	seen := make(map[string]bool)
+
+	// claim records a runner's ID, returning whether the runner replaces
+	// one from an earlier file. Runners without an ID are always added.
+	claim := func(id string, kind string) (bool, error) {
+		if id == "" {
+			return false, nil
+		}
+		if seen[id] {
+			return false, fmt.Errorf("%s: runner ID %q is used more than once", path, id)
+		}
+		seen[id] = true
+
+		prev, ok := sources[id]
+		sources[id] = runnerSource{path: path, kind: kind}
+		if !ok {
+			return false, nil
+		}
+		if prev.kind != kind {
+			return false, fmt.Errorf(
+				"%s: %s %q conflicts with %s %q from %s",
+				path,
+				kind,
+				id,
+				prev.kind,
+				id,
+				prev.path)
+		}
+
+		log.Printf("%s %q from %s is overridden by %s\n", kind, id, prev.path, path)
+		return true, nil
+	}
+
+	for _, runner := range config.GetRunner() {
+		replace, err := claim(runner.GetId(), "runner")
+		if err != nil {
+			return err
+		}
+		if replace {
+			for i, r := range merged.Runner {
+				if r.GetId() == runner.GetId() {
+					merged.Runner[i] = runner
+				}
+			}
+		} else {
+			merged.Runner = append(merged.Runner, runner)
+		}
+	}
+
+	for _, runner := range config.GetQemuRunner() {
+		replace, err := claim(runner.GetId(), "qemu_runner")
+		if err != nil {
+			return err
+		}
+		if replace {
+			for i, r := range merged.QemuRunner {
+				if r.GetId() == runner.GetId() {
+					merged.QemuRunner[i] = runner
+				}
+			}
+		} else {
+			merged.QemuRunner = append(merged.QemuRunner, runner)
+		}
+	}
+
+	for _, runner := range config.GetBazelRunner() {
+		replace, err := claim(runner.GetId(), "bazel_runner")
+		if err != nil {
+			return err
+		}
+		if replace {
+			for i, r := range merged.BazelRunner {
+				if r.GetId() == runner.GetId() {
+					merged.BazelRunner[i] = runner
+				}
+			}
+		} else {
+			merged.BazelRunner = append(merged.BazelRunner, runner)
+		}
+	}
+
+	if timeout := config.GetDefaultTimeoutSeconds(); timeout != 0 {
+		merged.DefaultTimeoutSeconds = timeout
+	}
+	if timeout := config.GetMaxTimeoutSeconds(); timeout != 0 {
+		merged.MaxTimeoutSeconds = timeout
+	}
+	if timeout := config.GetWorkerStartTimeoutSeconds(); timeout != 0 {
+		merged.WorkerStartTimeoutSeconds = timeout
+	}
+
+	return nil
+}
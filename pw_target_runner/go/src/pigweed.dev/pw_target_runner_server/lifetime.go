@@ -0,0 +1,53 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Longest in advance the server warns that it is about to reach its maximum
+// lifetime.
+const maxLifetimeWarning = 5 * time.Minute
+
+// scheduleShutdown returns a channel which receives once the server has run for
+// maxLifetime, logging when that will be now and again shortly beforehand. If
+// maxLifetime is zero, the channel never receives.
+func scheduleShutdown(maxLifetime time.Duration) <-chan time.Time {
+	if maxLifetime <= 0 {
+		return nil
+	}
+
+	at := time.Now().Add(maxLifetime)
+	log.Printf(
+		"Server will shut down at %s, after its maximum lifetime of %v\n",
+		at.Format(time.RFC3339),
+		maxLifetime)
+
+	// Short lifetimes are warned about a tenth of the way before they end.
+	warning := maxLifetime / 10
+	if warning > maxLifetimeWarning {
+		warning = maxLifetimeWarning
+	}
+	time.AfterFunc(maxLifetime-warning, func() {
+		log.Printf(
+			"Server will shut down in %v, at %s, on reaching its maximum lifetime\n",
+			warning,
+			at.Format(time.RFC3339))
+	})
+
+	return time.After(maxLifetime)
+}
@@ -14,13 +14,21 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/golang/protobuf/proto"
 	"pigweed.dev/pw_target_runner"
 
 	pb "pigweed.dev/proto/pw_target_runner/exec_server_config_pb"
@@ -35,27 +43,52 @@ type ServerOptions struct {
 	port int
 }
 
-// configureServerFromFile sets up the server with workers specifyed in a
-// config file. The file contains a pw.target_runner.ServerConfig protobuf
-// message in canonical protobuf text format.
-func configureServerFromFile(s *pw_target_runner.Server, filepath string) error {
-	content, err := ioutil.ReadFile(filepath)
+// configureServerFromFiles sets up the server with workers specifyed in one or
+// more config files, merged as described in loadServerConfig. Each file
+// contains a pw.target_runner.ServerConfig protobuf message in canonical
+// protobuf text format. If warmupPath is set, each worker
+// runs that executable when it starts. If strict is set, every command in the
+// config must resolve to an executable, or no workers are registered. Nonzero
+// defaultTimeout and maxTimeout override the timeouts set in the config.
+// Descriptions of the registered workers are returned in the order of their
+// IDs.
+func configureServerFromFiles(
+	s *pw_target_runner.Server,
+	paths []string,
+	warmupPath string,
+	strict bool,
+	defaultTimeout time.Duration,
+	maxTimeout time.Duration,
+) ([]string, error) {
+	config, err := loadServerConfig(paths)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	applyRunnerDefaults(config)
 
-	var config pb.ServerConfig
-	if err := proto.UnmarshalText(string(content), &config); err != nil {
-		return err
+	if strict {
+		if err := checkCommands(config); err != nil {
+			return nil, err
+		}
 	}
 
-	log.Printf("Parsed server configuration from %s\n", filepath)
+	if defaultTimeout == 0 {
+		defaultTimeout = time.Duration(config.GetDefaultTimeoutSeconds()) * time.Second
+	}
+	if maxTimeout == 0 {
+		maxTimeout = time.Duration(config.GetMaxTimeoutSeconds()) * time.Second
+	}
 
-	runners := config.GetRunner()
-	if runners == nil {
-		return nil
+	if timeout := config.GetWorkerStartTimeoutSeconds(); timeout != 0 {
+		err := s.SetWorkerStartTimeout(time.Duration(timeout) * time.Second)
+		if err != nil {
+			return nil, err
+		}
 	}
 
+	runners := config.GetRunner()
+	var workers []string
+
 	// Create an exec worker for each of the runner messages listed in the
 	// config and register them with the server.
 	for i, runner := range runners {
@@ -66,44 +99,674 @@ func configureServerFromFile(s *pw_target_runner.Server, filepath string) error
 		if cmd[0] == "" {
 			msg := fmt.Sprintf(
 				"ServerConfig.runner[%d] does not specify a command; skipping\n", i)
-			return errors.New(msg)
+			return nil, errors.New(msg)
 		}
 
 		if args := runner.GetArgs(); args != nil {
 			cmd = append(cmd, args...)
 		}
 
+		env, err := runnerEnv(runner)
+		if err != nil {
+			return nil, fmt.Errorf("ServerConfig.runner[%d]: %v", i, err)
+		}
+
 		worker := pw_target_runner.NewExecDeviceRunner(i, cmd)
+		worker.SetEnv(env)
+		worker.SetReplaceInvalidUTF8(runner.GetReplaceInvalidUtf8())
+		worker.SetListCasesArgs(runner.GetListCasesArgs())
+		worker.SetCaseFilterArg(runner.GetCaseFilterArg())
+		worker.SetFailFastArgs(runner.GetFailFastArgs())
+		worker.SetSettleDelay(time.Duration(runner.GetSettleDelayMs()) * time.Millisecond)
+		worker.SetUsePty(runner.GetUsePty())
+		worker.SetWarmupPath(warmupPath)
+		worker.SetOutputTailSize(int(runner.GetOutputTailBytes()))
+		worker.SetPreRunHook(runner.GetPreRunHook())
+		worker.SetPostRunHook(runner.GetPostRunHook())
+		worker.SetDetectLeakedProcesses(runner.GetDetectLeakedProcesses())
+		if cgroup := runner.GetCgroup(); cgroup != nil {
+			if cgroup.GetParent() == "" {
+				return nil, fmt.Errorf(
+					"ServerConfig.runner[%d]: cgroup must have a parent", i)
+			}
+			worker.SetCgroupLimits(pw_target_runner.CgroupLimits{
+				Parent:         cgroup.GetParent(),
+				MemoryMaxBytes: int64(cgroup.GetMemoryMaxBytes()),
+				CPUPercent:     int(cgroup.GetCpuPercent()),
+			})
+		}
+		if guard := runner.GetMemoryGuard(); guard != nil {
+			if guard.GetMemoryMaxBytes() == 0 {
+				return nil, fmt.Errorf(
+					"ServerConfig.runner[%d]: memory_guard must have a limit", i)
+			}
+			worker.SetMemoryGuard(pw_target_runner.MemoryGuard{
+				MaxBytes:     int64(guard.GetMemoryMaxBytes()),
+				PollInterval: time.Duration(guard.GetPollIntervalMs()) * time.Millisecond,
+			})
+		}
+		if sandbox := runner.GetSandbox(); sandbox != nil {
+			worker.SetSandbox(&pw_target_runner.SandboxConfig{Base: sandbox.GetBase()})
+		}
+		worker.SetCoreDumpDir(runner.GetCoreDumpDir())
+		success, failure, err := outputPatterns(runner)
+		if err != nil {
+			return nil, fmt.Errorf("ServerConfig.runner[%d]: %v", i, err)
+		}
+		worker.SetOutputPatterns(success, failure)
+		worker.SetInteractive(runner.GetInteractive())
+		worker.SetDefaultTimeout(defaultTimeout)
+		worker.SetMaxTimeout(maxTimeout)
+		if capacity := runner.GetCapacity(); capacity > 1 {
+			worker.SetCapacity(int(capacity))
+		}
+		grace := runner.GetKillGracePeriodMs()
+		if grace < 0 {
+			grace = 0
+		}
+		worker.SetKillGracePeriod(time.Duration(grace) * time.Millisecond)
+		s.RegisterWorker(worker)
+
+		desc := fmt.Sprintf("ExecDeviceRunner %s with args %v", cmd[0], cmd[1:])
+		if capacity := runner.GetCapacity(); capacity > 1 {
+			desc += fmt.Sprintf(" and capacity %d", capacity)
+		}
+		if cgroup := runner.GetCgroup(); cgroup != nil {
+			desc += fmt.Sprintf(" in cgroups under %s", cgroup.GetParent())
+		}
+		if guard := runner.GetMemoryGuard(); guard != nil {
+			desc += fmt.Sprintf(
+				" limited to %d bytes of memory", guard.GetMemoryMaxBytes())
+		}
+		if sandbox := runner.GetSandbox(); sandbox != nil {
+			desc += " in sandboxes"
+			if base := sandbox.GetBase(); base != "" {
+				desc += " over " + base
+			}
+		}
+		if runner.GetInteractive() {
+			desc += " allowing interactive sessions"
+		}
+		workers = append(workers, desc)
+		log.Printf("Registered %s\n", desc)
+	}
+
+	// QEMU workers are numbered after the exec workers.
+	for i, runner := range config.GetQemuRunner() {
+		if runner.GetQemu() == "" || runner.GetMachine() == "" {
+			return nil, fmt.Errorf(
+				"ServerConfig.qemu_runner[%d] must specify qemu and machine", i)
+		}
+
+		worker := pw_target_runner.NewQemuDeviceRunner(
+			len(runners)+i, runner.GetQemu(), runner.GetMachine())
+		worker.SetCPU(runner.GetCpu())
+		worker.SetArgs(runner.GetArgs())
+		worker.SetTimeout(time.Duration(runner.GetTimeoutSeconds()) * time.Second)
+		s.RegisterWorker(worker)
+
+		desc := fmt.Sprintf(
+			"QemuDeviceRunner %s for machine %s", runner.GetQemu(), runner.GetMachine())
+		workers = append(workers, desc)
+		log.Printf("Registered %s\n", desc)
+	}
+
+	// Bazel workers are numbered after the QEMU workers.
+	firstBazelID := len(runners) + len(config.GetQemuRunner())
+	for i, runner := range config.GetBazelRunner() {
+		if runner.GetWorkspace() == "" {
+			return nil, fmt.Errorf(
+				"ServerConfig.bazel_runner[%d] does not specify a workspace", i)
+		}
+
+		worker := pw_target_runner.NewBazelTestRunner(
+			firstBazelID+i, runner.GetWorkspace())
+		worker.SetBazel(runner.GetBazel())
+		worker.SetFlags(runner.GetFlags())
 		s.RegisterWorker(worker)
 
-		log.Printf(
-			"Registered ExecDeviceRunner %s with args %v\n",
-			cmd[0],
-			cmd[1:])
+		desc := fmt.Sprintf(
+			"BazelTestRunner for workspace %s with flags %v",
+			runner.GetWorkspace(),
+			runner.GetFlags())
+		workers = append(workers, desc)
+		log.Printf("Registered %s\n", desc)
+	}
+
+	return workers, nil
+}
+
+// runnerEnv builds the environment variables of a runner from its env_file,
+// which has been resolved relative to the directory of its config file, and its
+// inline env entries, which are added last so that they take precedence.
+func runnerEnv(runner *pb.TestRunner) ([]string, error) {
+	var env []string
+
+	if envFile := runner.GetEnvFile(); envFile != "" {
+		var err error
+		env, err = loadEnvFile(envFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, entry := range runner.GetEnv() {
+		if !strings.Contains(entry, "=") {
+			return nil, fmt.Errorf("env entry %q is not KEY=VALUE", entry)
+		}
+		env = append(env, entry)
+	}
+
+	return env, nil
+}
+
+// outputPatterns compiles the success and failure patterns of a runner, either
+// of which is nil if the runner does not set it.
+func outputPatterns(runner *pb.TestRunner) (*regexp.Regexp, *regexp.Regexp, error) {
+	var success, failure *regexp.Regexp
+	var err error
+
+	if pattern := runner.GetSuccessPattern(); pattern != "" {
+		if success, err = regexp.Compile(pattern); err != nil {
+			return nil, nil, fmt.Errorf("invalid success_pattern: %v", err)
+		}
+	}
+	if pattern := runner.GetFailurePattern(); pattern != "" {
+		if failure, err = regexp.Compile(pattern); err != nil {
+			return nil, nil, fmt.Errorf("invalid failure_pattern: %v", err)
+		}
+	}
+
+	return success, failure, nil
+}
+
+// checkCommands verifies that every command in a server config, including those
+// of runners and their hooks, resolves to an executable through exec.LookPath.
+// The returned error lists all commands which do not.
+func checkCommands(config *pb.ServerConfig) error {
+	var commands []string
+	for _, runner := range config.GetRunner() {
+		commands = append(commands, runner.GetCommand())
+		if hook := runner.GetPreRunHook(); len(hook) > 0 {
+			commands = append(commands, hook[0])
+		}
+		if hook := runner.GetPostRunHook(); len(hook) > 0 {
+			commands = append(commands, hook[0])
+		}
+	}
+	for _, runner := range config.GetQemuRunner() {
+		commands = append(commands, runner.GetQemu())
+	}
+	for _, runner := range config.GetBazelRunner() {
+		commands = append(commands, runner.GetBazel())
 	}
 
+	var unresolved []string
+	for _, command := range commands {
+		// Missing commands are reported when the runners are created.
+		if command == "" {
+			continue
+		}
+		if _, err := exec.LookPath(command); err != nil {
+			unresolved = append(unresolved, command)
+		}
+	}
+
+	if len(unresolved) > 0 {
+		return fmt.Errorf(
+			"config references commands which are not executable: %s",
+			strings.Join(unresolved, ", "))
+	}
 	return nil
 }
 
+// serverTLSConfig creates a TLS configuration for the server from its
+// certificate and key files. If clientCAFile is set, clients must present a
+// certificate signed by one of the CAs in that file.
+func serverTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
 func main() {
-	configPtr := flag.String("config", "", "Path to server configuration file")
+	// Subcommands are checked for before the server's own flags are parsed.
+	if len(os.Args) > 1 && os.Args[1] == "config-check" {
+		configCheckMain(os.Args[2:])
+		return
+	}
+
+	var configs configFiles
+	flag.Var(
+		&configs,
+		"config",
+		"Path to server configuration file; several comma-separated or "+
+			"repeated files are merged in order")
 	portPtr := flag.Int("port", 8080, "Server port")
+	listenBacklogPtr := flag.Int(
+		"listen-backlog",
+		0,
+		"Maximum number of connections waiting to be accepted (default: "+
+			"system maximum)")
+	outputLogDirPtr := flag.String(
+		"output-log-dir", "", "Directory in which to save the output of each run")
+	outputLogMaxFilesPtr := flag.Int(
+		"output-log-max-files", 0, "Maximum number of output logs to keep")
+	outputLogMaxBytesPtr := flag.Int64(
+		"output-log-max-bytes", 0, "Maximum total size of output logs to keep")
+	outputArchiveDirPtr := flag.String(
+		"output-archive-dir",
+		"",
+		"Directory in which to archive the output of streamed runs as it is "+
+			"produced, for clients to follow again by request ID")
+	outputArchiveMaxFilesPtr := flag.Int(
+		"output-archive-max-files", 0, "Maximum number of output archives to keep")
+	outputArchiveMaxBytesPtr := flag.Int64(
+		"output-archive-max-bytes", 0, "Maximum total size of output archives to keep")
+	idleTimeoutPtr := flag.Duration(
+		"idle-timeout", 0, "Shut down workers after they are idle for this long")
+	minWarmWorkersPtr := flag.Int(
+		"min-warm-workers", 0, "Number of workers to keep running when idle")
+	retryDelayPtr := flag.Duration(
+		"retry-delay",
+		0,
+		"Time to wait before retrying a flaky executable which failed, during "+
+			"which it does not occupy a worker (default: retry immediately)")
+	retryBackoffPtr := flag.Float64(
+		"retry-backoff",
+		1,
+		"Factor by which -retry-delay grows with each retry of an executable")
+	retryWindowPtr := flag.Duration(
+		"retry-window",
+		0,
+		"Longest a flaky executable may spend being retried (default: no limit)")
+	quarantineAfterPtr := flag.Int(
+		"quarantine-after",
+		0,
+		"Stop giving executables to a worker after its runner returns errors "+
+			"for this many consecutive executables; 0 disables quarantine")
+	quarantineProbePtr := flag.Duration(
+		"quarantine-probe-interval",
+		0,
+		"How often to probe quarantined workers for recovery (default: never)")
+	workerStatsFilePtr := flag.String(
+		"worker-stats-file",
+		"",
+		"JSON file in which to keep each worker's run counts across restarts")
+	allowUploadsPtr := flag.Bool(
+		"allow-uploads", false, "Allow clients to upload binaries to run")
+	maxUploadSizePtr := flag.Int64(
+		"max-upload-size", 64<<20, "Maximum size of an uploaded binary, in bytes")
+	strictConfigPtr := flag.Bool(
+		"strict-config",
+		false,
+		"Refuse to start if any command in the config file is not executable")
+	jsonConfigDumpPtr := flag.Bool(
+		"json-config-dump",
+		false,
+		"Print the config the server would run with, after merging config "+
+			"files and applying flags and defaults, as JSON and exit")
+	warmupBinaryPtr := flag.String(
+		"warmup-binary",
+		"",
+		"Executable each worker runs when it starts, before handling requests")
+	tlsCertPtr := flag.String(
+		"tls-cert", "", "Certificate file with which to serve TLS connections")
+	tlsKeyPtr := flag.String("tls-key", "", "Private key file for -tls-cert")
+	tlsClientCAPtr := flag.String(
+		"tls-client-ca",
+		"",
+		"CA certificate file with which to verify client certificates, "+
+			"which clients are then required to present")
+	allowedClientsPtr := flag.String(
+		"allowed-clients",
+		"",
+		"Comma-separated common names of the client certificates allowed "+
+			"to use the server; requires -tls-client-ca")
+	allowedRootsPtr := flag.String(
+		"allowed-roots",
+		"",
+		"Comma-separated directories outside of which clients may not "+
+			"request executables")
+	resultsFilePtr := flag.String(
+		"results-file", "", "File to which to append each result as a line of JSON")
+	outputBudgetPtr := flag.Int64(
+		"output-budget",
+		0,
+		"Maximum total bytes of output held in memory across all running "+
+			"executables; 0 disables the limit")
+	outputBudgetModePtr := flag.String(
+		"output-budget-mode",
+		"truncate",
+		"What happens to output beyond -output-budget: \"truncate\" drops "+
+			"it, \"block\" waits for other executables to finish")
+	outputChunkSizePtr := flag.Int(
+		"output-chunk-size",
+		0,
+		"Bytes of output above which a streamed result's output is sent in "+
+			"chunks of this size ahead of it; 0 uses the default of 1 MiB")
+	defaultTimeoutPtr := flag.Duration(
+		"default-timeout",
+		0,
+		"How long executables may run when their requests set no timeout; "+
+			"overrides the config's default_timeout_seconds")
+	maxTimeoutPtr := flag.Duration(
+		"max-timeout",
+		0,
+		"Longest any executable may run, regardless of its request's "+
+			"timeout; overrides the config's max_timeout_seconds")
+	historySizePtr := flag.Int(
+		"history-size",
+		100,
+		"Number of recent results to keep for the History RPC; 0 disables it")
+	runTimeBaselinesPtr := flag.Int(
+		"run-time-baselines",
+		1000,
+		"Number of executables whose average run time is tracked and returned "+
+			"as a baseline in results; 0 disables tracking")
+	runTimeSmoothingPtr := flag.Float64(
+		"run-time-smoothing",
+		0.2,
+		"Weight of each run in the average run time of its executable, "+
+			"between 0 and 1")
+	dispatchPtr := flag.String(
+		"dispatch",
+		"first-available",
+		"How requests are assigned to workers: \"first-available\", where "+
+			"the first free worker takes each request, or \"least-loaded\"")
+	maxQueuedPerClientPtr := flag.Int(
+		"max-queued-per-client",
+		0,
+		"Maximum number of requests each client may have queued or running; "+
+			"0 disables the limit")
+	dedupPtr := flag.Bool(
+		"dedup",
+		false,
+		"Run identical executables requested at the same time only once, "+
+			"sharing the result; only for idempotent executables")
+	idempotencyTTLPtr := flag.Duration(
+		"idempotency-ttl",
+		0,
+		"If nonzero, how long the results of requests with idempotency keys "+
+			"are kept and returned to retries with the same key")
+	shutdownTimeoutPtr := flag.Duration(
+		"shutdown-timeout",
+		time.Minute,
+		"How long running executables are given to finish when the server "+
+			"is shut down, after which they are killed and the server exits "+
+			"with an error; 0 waits indefinitely")
+	maxLifetimePtr := flag.Duration(
+		"max-lifetime",
+		0,
+		"Shut the server down gracefully after it has run for this long, for "+
+			"a supervisor to restart it (default: no limit)")
+	channelzPtr := flag.Bool(
+		"channelz",
+		false,
+		"Serve gRPC's channelz service for debugging connections")
+	logEventsPtr := flag.Bool(
+		"log-events",
+		false,
+		"Log each executable as it is queued, started, and completed")
+	otlpEndpointPtr := flag.String(
+		"otlp-endpoint",
+		"",
+		"URL of an OTLP gRPC collector to which to export a trace of each "+
+			"RPC and executable run, e.g. http://localhost:4317")
+	logFormatPtr := flag.String(
+		"log-format", "text", "Format of log lines: \"text\" or \"json\"")
 
 	flag.Parse()
 
+	if *jsonConfigDumpPtr {
+		if len(configs) == 0 {
+			log.Fatalf("-json-config-dump requires -config")
+		}
+		if err := dumpServerConfig(configs, *defaultTimeoutPtr, *maxTimeoutPtr); err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+		return
+	}
+
+	switch *logFormatPtr {
+	case "text":
+		pw_target_runner.SetLogFormat(pw_target_runner.LogFormatText)
+	case "json":
+		pw_target_runner.SetLogFormat(pw_target_runner.LogFormatJSON)
+	default:
+		log.Fatalf("Unknown log format %q", *logFormatPtr)
+	}
+
 	server := pw_target_runner.NewServer()
 
-	if *configPtr != "" {
-		if err := configureServerFromFile(server, *configPtr); err != nil {
-			log.Fatalf("Failed to parse config file %s: %v", *configPtr, err)
+	if len(configs) > 0 {
+		_, err := configureServerFromFiles(
+			server,
+			configs,
+			*warmupBinaryPtr,
+			*strictConfigPtr,
+			*defaultTimeoutPtr,
+			*maxTimeoutPtr)
+		if err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+	}
+
+	if *tlsCertPtr != "" {
+		config, err := serverTLSConfig(*tlsCertPtr, *tlsKeyPtr, *tlsClientCAPtr)
+		if err != nil {
+			log.Fatalf("Failed to load TLS configuration: %v", err)
+		}
+		if err := server.SetTLSConfig(config); err != nil {
+			log.Fatal(err)
+		}
+	} else if *tlsClientCAPtr != "" {
+		log.Fatalf("-tls-client-ca requires -tls-cert")
+	}
+
+	if *allowedClientsPtr != "" {
+		clients := strings.Split(*allowedClientsPtr, ",")
+		log.Printf("Allowing clients %v\n", clients)
+		if err := server.SetAllowedClients(clients); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *allowedRootsPtr != "" {
+		roots := strings.Split(*allowedRootsPtr, ",")
+		log.Printf("Allowing executables within %v\n", roots)
+		if err := server.SetAllowedRoots(roots); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		log.Println(
+			"Warning: clients may run executables at any path; " +
+				"restrict them with -allowed-roots")
+	}
+
+	if *outputBudgetPtr > 0 {
+		var mode pw_target_runner.OutputBudgetMode
+		switch *outputBudgetModePtr {
+		case "truncate":
+			mode = pw_target_runner.OutputBudgetTruncate
+		case "block":
+			mode = pw_target_runner.OutputBudgetBlock
+		default:
+			log.Fatalf("Unknown output budget mode %q", *outputBudgetModePtr)
+		}
+		if err := server.SetOutputBudget(*outputBudgetPtr, mode); err != nil {
+			log.Fatalf("Failed to set output budget: %v", err)
+		}
+	}
+
+	if *outputChunkSizePtr > 0 {
+		server.SetOutputChunkSize(*outputChunkSizePtr)
+	}
+
+	switch *dispatchPtr {
+	case "first-available":
+	case "least-loaded":
+		server.SetDispatchStrategy(pw_target_runner.LeastLoaded{})
+	default:
+		log.Fatalf("Unknown dispatch strategy %q", *dispatchPtr)
+	}
+
+	if *allowUploadsPtr {
+		log.Printf("Allowing uploads of binaries up to %d bytes\n", *maxUploadSizePtr)
+		server.EnableUploads(*maxUploadSizePtr)
+	}
+
+	if *idleTimeoutPtr > 0 {
+		server.SetIdleShutdown(*idleTimeoutPtr, *minWarmWorkersPtr)
+	}
+
+	if *retryDelayPtr > 0 {
+		server.SetRetryBackoff(pw_target_runner.RetryBackoff{
+			Delay:      *retryDelayPtr,
+			Multiplier: *retryBackoffPtr,
+			MaxWindow:  *retryWindowPtr,
+		})
+	}
+
+	if *quarantineAfterPtr > 0 {
+		server.EnableQuarantine(*quarantineAfterPtr, *quarantineProbePtr)
+	}
+
+	if *workerStatsFilePtr != "" {
+		if err := server.SetWorkerStatsFile(*workerStatsFilePtr); err != nil {
+			log.Fatalf("Failed to load worker statistics: %v", err)
+		}
+	}
+
+	if *outputLogDirPtr != "" {
+		outputLog, err := pw_target_runner.NewOutputLog(
+			*outputLogDirPtr,
+			*outputLogMaxFilesPtr,
+			*outputLogMaxBytesPtr)
+		if err != nil {
+			log.Fatalf("Failed to create output log directory: %v", err)
+		}
+		server.AddResultSink(outputLog)
+	}
+
+	if *outputArchiveDirPtr != "" {
+		archive, err := pw_target_runner.NewOutputArchive(
+			*outputArchiveDirPtr,
+			*outputArchiveMaxFilesPtr,
+			*outputArchiveMaxBytesPtr)
+		if err != nil {
+			log.Fatalf("Failed to create output archive directory: %v", err)
+		}
+		server.SetOutputArchive(archive)
+	}
+
+	if *resultsFilePtr != "" {
+		sink, err := pw_target_runner.NewJSONLinesSink(*resultsFilePtr)
+		if err != nil {
+			log.Fatalf("Failed to open results file: %v", err)
+		}
+		defer sink.Close()
+		server.AddResultSink(sink)
+	}
+
+	if *channelzPtr {
+		server.EnableChannelz()
+	}
+
+	if *logEventsPtr {
+		server.AddEventListener(pw_target_runner.NewLoggingEventListener())
+	}
+
+	var tracer *tracing
+	if *otlpEndpointPtr != "" {
+		var err error
+		tracer, err = newTracing(*otlpEndpointPtr)
+		if err != nil {
+			log.Fatalf("Failed to set up tracing: %v", err)
 		}
+		server.SetStatsHandler(tracer.statsHandler())
+		server.AddEventListener(tracer)
+	}
+
+	if *historySizePtr > 0 {
+		server.EnableHistory(*historySizePtr)
+	}
+
+	if *runTimeBaselinesPtr > 0 {
+		err := server.EnableRunTimeTracking(*runTimeBaselinesPtr, *runTimeSmoothingPtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *dedupPtr {
+		server.EnableDeduplication()
+	}
+
+	if *idempotencyTTLPtr > 0 {
+		server.EnableIdempotencyKeys(*idempotencyTTLPtr)
+	}
+
+	if *maxQueuedPerClientPtr > 0 {
+		server.SetMaxQueuedPerClient(*maxQueuedPerClientPtr)
+	}
+
+	if *listenBacklogPtr > 0 {
+		server.SetListenBacklog(*listenBacklogPtr)
 	}
 
 	if err := server.Bind(*portPtr); err != nil {
 		log.Fatal(err)
 	}
 
+	// The server shuts down on SIGINT or SIGTERM, or once it reaches its
+	// maximum lifetime, exiting with an error if it had to be stopped
+	// forcibly.
+	exitCode := make(chan int, 1)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	expired := scheduleShutdown(*maxLifetimePtr)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("Received %v\n", sig)
+		case <-expired:
+			log.Printf("Reached maximum lifetime of %v\n", *maxLifetimePtr)
+		}
+		if err := server.Shutdown(*shutdownTimeoutPtr); err != nil {
+			log.Printf("Failed to shut down cleanly: %v", err)
+			exitCode <- 1
+		} else {
+			exitCode <- 0
+		}
+	}()
+
 	if err := server.Serve(); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
+
+	// Serve returns as soon as the shutdown starts.
+	code := <-exitCode
+	if tracer != nil {
+		tracer.shutdown()
+	}
+	os.Exit(code)
 }
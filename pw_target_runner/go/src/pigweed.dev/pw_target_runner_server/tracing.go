@@ -0,0 +1,129 @@
+// Copyright 2019 The Pigweed Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/stats"
+
+	"pigweed.dev/pw_target_runner"
+
+	runnerpb "pigweed.dev/proto/pw_target_runner/target_runner_pb"
+)
+
+// Longest the server waits to export its remaining spans before it exits.
+const traceShutdownTimeout = 5 * time.Second
+
+// tracing exports OpenTelemetry traces of the server's RPCs to an OTLP
+// collector. Each RPC is a span, continuing the trace of the client which made
+// it. Under it, each executable run is a span, split into the time it spent
+// queued and the time it spent running.
+type tracing struct {
+	pw_target_runner.NopEventListener
+
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+// newTracing creates a tracer which exports spans to the OTLP gRPC endpoint at
+// a URL, such as "http://localhost:4317". Endpoints with an "http" scheme are
+// connected to without TLS.
+func newTracing(endpoint string) (*tracing, error) {
+	exporter, err := otlptracegrpc.New(
+		context.Background(), otlptracegrpc.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "pw_target_runner_server"))))
+
+	return &tracing{
+		provider: provider,
+		tracer:   provider.Tracer("pigweed.dev/pw_target_runner_server"),
+	}, nil
+}
+
+// statsHandler returns the gRPC stats handler which starts the span of each
+// RPC, continuing any trace context in the RPC's metadata.
+func (t *tracing) statsHandler() stats.Handler {
+	return otelgrpc.NewServerHandler(
+		otelgrpc.WithTracerProvider(t.provider),
+		otelgrpc.WithPropagators(propagation.TraceContext{}))
+}
+
+// OnCompleted records the span of a completed run under that of the RPC which
+// requested it. The run's queue and run times, as measured by the worker pool,
+// become the spans of its time in the queue and in execution. Part of
+// EventListener interface.
+func (t *tracing) OnCompleted(
+	req *pw_target_runner.RunRequest,
+	res *pw_target_runner.RunResponse,
+) {
+	end := time.Now()
+	runStart := end.Add(-res.RunTime)
+	queueStart := runStart.Add(-res.QueueTime)
+
+	ctx, span := t.tracer.Start(
+		req.Context(),
+		"pw_target_runner.run",
+		trace.WithTimestamp(queueStart),
+		trace.WithAttributes(
+			attribute.String("pw_target_runner.request_id", req.ID),
+			attribute.String("pw_target_runner.path", req.Path)))
+	defer span.End(trace.WithTimestamp(end))
+
+	_, queued := t.tracer.Start(
+		ctx, "pw_target_runner.queue", trace.WithTimestamp(queueStart))
+	queued.End(trace.WithTimestamp(runStart))
+
+	if res.Err != nil {
+		span.RecordError(res.Err)
+		span.SetStatus(otelcodes.Error, res.Err.Error())
+		return
+	}
+
+	_, execution := t.tracer.Start(
+		ctx, "pw_target_runner.execution", trace.WithTimestamp(runStart))
+	execution.End(trace.WithTimestamp(end))
+
+	span.SetAttributes(attribute.String("pw_target_runner.result", res.Status.String()))
+	if res.Status != runnerpb.RunStatus_SUCCESS {
+		span.SetStatus(otelcodes.Error, res.Status.String())
+	}
+}
+
+// shutdown exports any spans which have not yet been sent.
+func (t *tracing) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), traceShutdownTimeout)
+	defer cancel()
+
+	if err := t.provider.Shutdown(ctx); err != nil {
+		log.Printf("Failed to export traces: %v\n", err)
+	}
+}